@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/mknyszek/goat"
+	"github.com/mknyszek/goat/simulation"
+	"github.com/mknyszek/goat/simulation/toolbox"
+)
+
+// checkpointConfig describes everything about a run which affects
+// its results and its output. A checkpoint may only be resumed by a
+// run with the same configuration.
+type checkpointConfig struct {
+	Sims        []string
+	Specs       []*toolbox.Spec
+	Pacer       bool
+	GCPercent   int
+	MemoryLimit uint64
+	Sample      string
+	Period      uint64
+	Every       uint64
+	Format      string
+	Long        bool
+	Out         string
+	Impl        string
+	PerP        string
+}
+
+// currentConfig returns the encoded configuration of this run.
+func currentConfig() ([]byte, error) {
+	cfg := checkpointConfig{
+		Sims:        sims,
+		Pacer:       pacer,
+		GCPercent:   gcPercent,
+		MemoryLimit: memoryLimit,
+		Sample:      samplePolicy,
+		Period:      period,
+		Every:       sampleEvery,
+		Format:      format,
+		Long:        longFormat,
+		Out:         outFile,
+		Impl:        implFile,
+		PerP:        perPFile,
+	}
+	for _, name := range sims {
+		cfg.Specs = append(cfg.Specs, simulations[name])
+	}
+	return json.Marshal(&cfg)
+}
+
+// checkpointHeader is the first part of a checkpoint. It's followed
+// by the state of the parser, and then by the statistics, the
+// runState, and the simulation state of each simulation in order.
+type checkpointHeader struct {
+	Config []byte
+
+	// Outputs is the size of each output file at the time of
+	// the checkpoint.
+	Outputs map[string]int64
+}
+
+// runState is the saved state of a simRun other than its
+// simulation and its statistics.
+type runState struct {
+	Sampler        uint64
+	Min, Max, Peak []uint64
+}
+
+// outputs are the output files opened by this run, by name, whose
+// sizes are recorded in each checkpoint.
+var outputs struct {
+	mu    sync.Mutex
+	files map[string]*os.File
+}
+
+// resumeOutputs is the size of each output file in the checkpoint
+// being resumed, if any.
+var resumeOutputs map[string]int64
+
+// resuming reports whether this run resumes from a checkpoint.
+func resuming() bool {
+	return resumeFile != ""
+}
+
+// createOutput creates the named output file. When resuming, it
+// instead opens the existing file, discards anything written after
+// the checkpoint, and positions it for appending.
+func createOutput(name string) (*os.File, error) {
+	var f *os.File
+	if resuming() {
+		size, ok := resumeOutputs[name]
+		if !ok {
+			return nil, fmt.Errorf("output file %s is not part of the checkpoint", name)
+		}
+		var err error
+		f, err = os.OpenFile(name, os.O_WRONLY, 0)
+		if err != nil {
+			return nil, err
+		}
+		if err := f.Truncate(size); err != nil {
+			f.Close()
+			return nil, err
+		}
+		if _, err := f.Seek(size, io.SeekStart); err != nil {
+			f.Close()
+			return nil, err
+		}
+	} else {
+		var err error
+		f, err = os.Create(name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	outputs.mu.Lock()
+	if outputs.files == nil {
+		outputs.files = make(map[string]*os.File)
+	}
+	outputs.files[name] = f
+	outputs.mu.Unlock()
+	return f, nil
+}
+
+// outputSizes flushes every output file to disk and returns
+// their sizes.
+func outputSizes() (map[string]int64, error) {
+	outputs.mu.Lock()
+	defer outputs.mu.Unlock()
+	sizes := make(map[string]int64)
+	for name, f := range outputs.files {
+		if err := f.Sync(); err != nil {
+			return nil, err
+		}
+		fi, err := f.Stat()
+		if err != nil {
+			return nil, err
+		}
+		sizes[name] = fi.Size()
+	}
+	return sizes, nil
+}
+
+// readCheckpointHeader opens the checkpoint being resumed, checks
+// that it was taken with the same configuration as this run, and
+// returns a decoder positioned just after the header.
+func readCheckpointHeader() (*gob.Decoder, io.Closer, error) {
+	f, err := os.Open(resumeFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("opening checkpoint: %v", err)
+	}
+	dec := gob.NewDecoder(bufio.NewReader(f))
+	var hdr checkpointHeader
+	if err := dec.Decode(&hdr); err != nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("reading checkpoint: %v", err)
+	}
+	cfg, err := currentConfig()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if !bytes.Equal(cfg, hdr.Config) {
+		f.Close()
+		return nil, nil, errors.New("checkpoint was taken with a different configuration")
+	}
+	resumeOutputs = hdr.Outputs
+	return dec, f, nil
+}
+
+// loadRun restores the state of sr from dec. sr's statistics must
+// already be registered.
+func loadRun(dec *gob.Decoder, sr *simRun) error {
+	if err := sr.stats.LoadState(dec); err != nil {
+		return err
+	}
+	var st runState
+	if err := dec.Decode(&st); err != nil {
+		return err
+	}
+	if sr.sampler != nil {
+		sr.sampler.setState(st.Sampler)
+	}
+	if sr.ext != nil {
+		if len(st.Min) != len(sr.ext.gauges) {
+			return fmt.Errorf("checkpoint has extrema for %d gauges, but %d are tracked", len(st.Min), len(sr.ext.gauges))
+		}
+		copy(sr.ext.min, st.Min)
+		copy(sr.ext.max, st.Max)
+		copy(sr.ext.peak, st.Peak)
+	}
+	return simulation.LoadState(dec, sr.sim)
+}
+
+// writeCheckpoint saves the state of p and each simulation in runs
+// to the checkpoint file. Every event decoded by p must have been
+// processed by each simulation.
+//
+// The checkpoint is written to a temporary file first and then
+// renamed, so that a crash part way through never leaves behind a
+// corrupt checkpoint.
+func writeCheckpoint(p *goat.Parser, runs []*simRun) error {
+	cfg, err := currentConfig()
+	if err != nil {
+		return err
+	}
+	sizes, err := outputSizes()
+	if err != nil {
+		return fmt.Errorf("syncing output: %v", err)
+	}
+	tmp := checkpointFile + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	if err := encodeCheckpoint(gob.NewEncoder(w), cfg, sizes, p, runs); err != nil {
+		f.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, checkpointFile)
+}
+
+func encodeCheckpoint(enc *gob.Encoder, cfg []byte, sizes map[string]int64, p *goat.Parser, runs []*simRun) error {
+	if err := enc.Encode(&checkpointHeader{Config: cfg, Outputs: sizes}); err != nil {
+		return err
+	}
+	if err := p.SaveState(enc); err != nil {
+		return err
+	}
+	for _, sr := range runs {
+		if err := sr.stats.SaveState(enc); err != nil {
+			return err
+		}
+		var st runState
+		if sr.sampler != nil {
+			st.Sampler = sr.sampler.state()
+		}
+		if sr.ext != nil {
+			st.Min, st.Max, st.Peak = sr.ext.min, sr.ext.max, sr.ext.peak
+		}
+		if err := enc.Encode(&st); err != nil {
+			return err
+		}
+		if err := simulation.SaveState(enc, sr.sim); err != nil {
+			return err
+		}
+	}
+	return nil
+}
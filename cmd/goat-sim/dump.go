@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/mknyszek/goat"
+	"github.com/mknyszek/goat/cmd/internal/heapmap"
+	"github.com/mknyszek/goat/simulation"
+	"github.com/mknyszek/goat/simulation/toolbox"
+)
+
+// heapMapFile returns the name of the file that the heap map of the
+// named simulation for the given GC cycle is written to.
+func heapMapFile(sim string, cycle uint64) string {
+	file := strings.TrimSuffix(outFile, filepath.Ext(outFile)) + ".json"
+	if len(sims) > 1 {
+		file = simOutputFile(file, sim)
+	}
+	return simOutputFile(file, fmt.Sprintf("heap%d", cycle))
+}
+
+// heapDumper writes heap maps of a simulation for the GC cycles
+// selected by -dump-at.
+//
+// The heap map for a cycle is written once the cycle's dead objects
+// are known, but before they're swept: just before the next GC cycle
+// recorded in the trace starts, or at the end of the trace. With a
+// simulated pacer, dead objects are known as soon as a cycle ends, so
+// it's written just after.
+type heapDumper struct {
+	sim  *toolbox.Simulator
+	name string
+
+	// cycles are the GC cycles left to write heap maps for, in
+	// ascending order.
+	cycles []uint64
+}
+
+// newHeapDumper returns a heapDumper for the named simulation. Cycles
+// before the current one are skipped, since their heap maps were
+// already written if the simulation was resumed from a checkpoint.
+func newHeapDumper(sim *toolbox.Simulator, name string, stats *simulation.Stats) *heapDumper {
+	d := &heapDumper{sim: sim, name: name, cycles: dumpCycles}
+	for len(d.cycles) != 0 && d.cycles[0] < stats.GCCycles {
+		d.cycles = d.cycles[1:]
+	}
+	return d
+}
+
+// due reports whether a heap map should be written before ev
+// is processed.
+func (d *heapDumper) due(ev goat.Event, stats *simulation.Stats) bool {
+	if len(d.cycles) == 0 || stats.GCCycles < d.cycles[0] {
+		return false
+	}
+	return pacer || ev.Kind == goat.EventGCStart
+}
+
+// dump writes out the heap map for each selected cycle that has
+// already ended.
+func (d *heapDumper) dump(stats *simulation.Stats) error {
+	if len(d.cycles) == 0 || stats.GCCycles < d.cycles[0] {
+		return nil
+	}
+	spans, pages := d.sim.Inspect()
+	b, err := json.Marshal(&heapmap.HeapMap{
+		Sim:       d.name,
+		GCCycles:  stats.GCCycles,
+		Timestamp: stats.Timestamp,
+		Spans:     heapmap.FromSpanInfo(spans),
+		Pages:     heapmap.FromSpanInfo(pages),
+	})
+	if err != nil {
+		return err
+	}
+	for len(d.cycles) != 0 && d.cycles[0] <= stats.GCCycles {
+		if err := ioutil.WriteFile(heapMapFile(d.name, d.cycles[0]), b, 0644); err != nil {
+			return err
+		}
+		d.cycles = d.cycles[1:]
+	}
+	return nil
+}
@@ -1,11 +1,16 @@
 package main
 
 import (
+	"context"
+	"encoding/gob"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 
@@ -13,67 +18,286 @@ import (
 	"github.com/mknyszek/goat/cmd/internal/spinner"
 	"github.com/mknyszek/goat/simulation"
 	"github.com/mknyszek/goat/simulation/toolbox"
-	"github.com/mknyszek/goat/simulation/toolbox/object"
-	"github.com/mknyszek/goat/simulation/toolbox/page"
-	"github.com/mknyszek/goat/simulation/toolbox/stack"
+	_ "github.com/mknyszek/goat/simulation/toolbox/object"
+	_ "github.com/mknyszek/goat/simulation/toolbox/page"
+	_ "github.com/mknyszek/goat/simulation/toolbox/stack"
 
 	"golang.org/x/exp/mmap"
+	"golang.org/x/sync/errgroup"
 )
 
-var simType string
+var simTypes string
+var configFiles string
 var period uint64
+var samplePolicy string
+var sampleEvery uint64
 var outFile string
 var implFile string
-var sim simulation.Simulator
-
-func go115Simulator() *toolbox.Simulator {
-	as := toolbox.NewAddressSpace48(4096)
-	pa := page.NewGo114(as)
-	sa := stack.NewGo114(pa)
-	oa := object.NewGo115(pa)
-	return toolbox.NewSimulator(oa, sa)
-}
-
-func go115ImmixSimulator() *toolbox.Simulator {
-	as := toolbox.NewAddressSpace48(4096)
-	pa := page.NewGo114(as)
-	sa := stack.NewGo114(pa)
-	oa := object.NewImmix(pa)
-	return toolbox.NewSimulator(oa, sa)
-}
+var perPFile string
+var longFormat bool
+var format string
+var sweepFile string
+var pacer bool
+var gcPercent int
+var memoryLimit uint64
+var checkpointFile string
+var checkpointEvery uint64
+var resumeFile string
+var dumpAt string
+var dumpCycles []uint64
+var sims []string
 
-var simulations = map[string]simulation.Simulator{
-	"go115":       go115Simulator(),
-	"go115+immix": go115ImmixSimulator(),
+var simulations = map[string]*toolbox.Spec{
+	"go115": {
+		AddressSpace:    toolbox.ComponentSpec{Name: "as48"},
+		PageAllocator:   toolbox.ComponentSpec{Name: "go114"},
+		StackAllocator:  toolbox.ComponentSpec{Name: "go114"},
+		ObjectAllocator: toolbox.ComponentSpec{Name: "go115"},
+	},
+	"go115+immix": {
+		AddressSpace:    toolbox.ComponentSpec{Name: "as48"},
+		PageAllocator:   toolbox.ComponentSpec{Name: "go114"},
+		StackAllocator:  toolbox.ComponentSpec{Name: "go114"},
+		ObjectAllocator: toolbox.ComponentSpec{Name: "immix"},
+	},
+	"go115-radix": {
+		AddressSpace:    toolbox.ComponentSpec{Name: "as48"},
+		PageAllocator:   toolbox.ComponentSpec{Name: "radix"},
+		StackAllocator:  toolbox.ComponentSpec{Name: "go114"},
+		ObjectAllocator: toolbox.ComponentSpec{Name: "go115"},
+	},
+	"go122": {
+		AddressSpace:    toolbox.ComponentSpec{Name: "as48"},
+		PageAllocator:   toolbox.ComponentSpec{Name: "radix"},
+		StackAllocator:  toolbox.ComponentSpec{Name: "go114"},
+		ObjectAllocator: toolbox.ComponentSpec{Name: "go122"},
+	},
 }
 
 func init() {
 	flag.Usage = func() {
 		fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s:\n", os.Args[0])
-		fmt.Fprintf(flag.CommandLine.Output(), "Utility that runs an allocation simulation\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "Utility that runs allocation simulations\n")
 		fmt.Fprintf(flag.CommandLine.Output(), "and generates a CSV of memory statistics.\n")
 		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] <allocation-trace-file>\n", os.Args[0])
 		flag.PrintDefaults()
 	}
-	flag.StringVar(&simType, "type", "", "the type of simulation")
+	flag.StringVar(&simTypes, "type", "", "comma-separated list of the types of simulation to run")
+	flag.StringVar(&configFiles, "config", "", "comma-separated list of JSON simulation spec files to run")
 	flag.StringVar(&outFile, "o", "./out.csv", "output file for the simulation data")
 	flag.StringVar(&implFile, "oimpl", "./out-impl.csv", "output file for implementation-specific simulation data")
-	flag.Uint64Var(&period, "period", 2000000000, "the period in CPU ticks to capture stats")
+	flag.StringVar(&perPFile, "perp", "", "output file for per-P simulation data, with columns for each P; off if empty")
+	flag.StringVar(&sweepFile, "sweep", "", "JSON parameter sweep file; runs every configuration and writes a summary table to -o")
+	flag.StringVar(&format, "format", "csv", "output format for -o: csv (with -oimpl and a metadata file), json, or prom (latest sample only)")
+	flag.BoolVar(&longFormat, "long", false, "write all simulation data to a single long-format CSV (-o) with a Sim column")
+	flag.BoolVar(&pacer, "pacer", false, "decide when GC cycles happen with a simulated GC pacer instead of following the trace")
+	flag.IntVar(&gcPercent, "gogc", 100, "GOGC value for the simulated GC pacer; a negative value means off (requires -pacer)")
+	flag.Uint64Var(&memoryLimit, "memlimit", 0, "memory limit in bytes for the simulated GC pacer; 0 means no limit (requires -pacer)")
+	flag.Uint64Var(&period, "period", 2000000000, "the period in CPU ticks to capture stats (with -sample period)")
+	flag.StringVar(&samplePolicy, "sample", "period", "when to capture stats: period (every -period ticks, with each gauge's min, max, and peak), gc (at each GC start and end), or events (every -every events)")
+	flag.Uint64Var(&sampleEvery, "every", 10000, "the number of events between captured stats (with -sample events)")
+	flag.StringVar(&checkpointFile, "checkpoint", "", "file to periodically save the state of the simulations to at GC boundaries; off if empty")
+	flag.Uint64Var(&checkpointEvery, "checkpoint-every", 10, "the number of GC cycles in the trace between checkpoints (with -checkpoint)")
+	flag.StringVar(&dumpAt, "dump-at", "", "comma-separated list of GC cycles to write a JSON map of the simulated heap for, to files named after -o; off if empty")
+	flag.StringVar(&resumeFile, "resume", "", "checkpoint file to resume simulating from; all other flags must match the checkpointed run")
+}
+
+// loadSpec reads a simulation spec from a file. The simulation is named
+// after the file unless the spec provides a name.
+func loadSpec(file string) (string, *toolbox.Spec, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", nil, err
+	}
+	defer f.Close()
+	spec, err := toolbox.ParseSpec(f)
+	if err != nil {
+		return "", nil, fmt.Errorf("%s: %v", file, err)
+	}
+	name := spec.Name
+	if name == "" {
+		name = strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+	}
+	return name, spec, nil
 }
 
 func checkFlags() error {
 	if flag.NArg() != 1 {
 		return errors.New("incorrect number of arguments")
 	}
-	var sims []string
-	for typ, s := range simulations {
-		if simType == typ {
-			sim = s
+	switch format {
+	case "csv", "json", "prom":
+	default:
+		return errors.New("-format must be one of csv, json, or prom")
+	}
+	if longFormat && format != "csv" {
+		return errors.New("-long requires -format csv")
+	}
+	switch samplePolicy {
+	case "period", "gc", "events":
+	default:
+		return errors.New("-sample must be one of period, gc, or events")
+	}
+	if samplePolicy == "events" && sampleEvery == 0 {
+		return errors.New("-every must be non-zero")
+	}
+	if checkpointFile != "" && checkpointEvery == 0 {
+		return errors.New("-checkpoint-every must be non-zero")
+	}
+	if dumpAt != "" {
+		for _, c := range strings.Split(dumpAt, ",") {
+			cycle, err := strconv.ParseUint(strings.TrimSpace(c), 10, 64)
+			if err != nil {
+				return errors.New("-dump-at must be a list of GC cycle numbers")
+			}
+			dumpCycles = append(dumpCycles, cycle)
+		}
+		sort.Slice(dumpCycles, func(i, j int) bool {
+			return dumpCycles[i] < dumpCycles[j]
+		})
+	}
+	if sweepFile != "" {
+		if checkpointFile != "" || resumeFile != "" || dumpAt != "" {
+			return errors.New("-sweep may not be combined with -checkpoint, -resume, or -dump-at")
+		}
+		if simTypes != "" || configFiles != "" || longFormat || perPFile != "" || format != "csv" {
+			return errors.New("-sweep may not be combined with -type, -config, -long, -perp, or -format")
+		}
+		specs, err := loadSweep(sweepFile)
+		if err != nil {
+			return err
+		}
+		for i := range specs {
+			if _, ok := simulations[specs[i].Name]; ok {
+				return fmt.Errorf("sweep configuration %s specified more than once", specs[i].Name)
+			}
+			simulations[specs[i].Name] = &specs[i]
+			sims = append(sims, specs[i].Name)
+		}
+	} else if simTypes == "" && configFiles == "" {
+		return errors.New("at least one of -type, -config, or -sweep is required")
+	}
+	var valid []string
+	for typ := range simulations {
+		valid = append(valid, typ)
+	}
+	sort.Strings(valid)
+	seen := make(map[string]bool)
+	if simTypes != "" {
+		for _, typ := range strings.Split(simTypes, ",") {
+			typ = strings.TrimSpace(typ)
+			if _, ok := simulations[typ]; !ok {
+				return fmt.Errorf("-type must be a list of valid simulation types: %s", strings.Join(valid, ", "))
+			}
+			if seen[typ] {
+				return fmt.Errorf("simulation type %s specified more than once", typ)
+			}
+			seen[typ] = true
+			sims = append(sims, typ)
+		}
+	}
+	if configFiles != "" {
+		for _, file := range strings.Split(configFiles, ",") {
+			name, spec, err := loadSpec(strings.TrimSpace(file))
+			if err != nil {
+				return err
+			}
+			if seen[name] {
+				return fmt.Errorf("simulation %s specified more than once", name)
+			}
+			seen[name] = true
+			simulations[name] = spec
+			sims = append(sims, name)
+		}
+	}
+	// Make sure every simulation can actually be constructed, so we
+	// can fail early.
+	for _, name := range sims {
+		if _, err := simulations[name].Build(); err != nil {
+			return fmt.Errorf("simulation %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// eventBatchSize is the number of events decoded from the trace
+// before they're handed off to each simulation.
+const eventBatchSize = 4096
+
+// simRun is a single simulation being driven by the trace.
+type simRun struct {
+	name    string
+	sim     simulation.Simulator
+	stats   *simulation.Stats
+	out     statsWriter
+	sampler sampler
+	ext     *extrema
+	summary *summary
+	dump    *heapDumper
+	events  chan eventBatch
+}
+
+// eventBatch is a batch of events handed off to each simulation.
+type eventBatch struct {
+	evs []goat.Event
+
+	// processed, if not nil, is marked done by each simulation
+	// once it has processed the batch, so that a checkpoint may
+	// be taken.
+	processed *sync.WaitGroup
+}
+
+// process feeds events from r.events into the simulation until
+// the channel is closed, sampling stats as decided by r.sampler.
+//
+// If the simulation stops part way through, for example because it
+// runs out of address space, the rest of the events are discarded,
+// leaving the other simulations to carry on.
+func (r *simRun) process() error {
+	stopped := simulation.Err(r.sim) != nil
+	for b := range r.events {
+		for _, ev := range b.evs {
+			if stopped {
+				break
+			}
+			if r.dump != nil && r.dump.due(ev, r.stats) {
+				if err := r.dump.dump(r.stats); err != nil {
+					return fmt.Errorf("writing heap map: %v", err)
+				}
+			}
+			r.sim.Process(ev, r.stats)
+			if err := simulation.Err(r.sim); err != nil {
+				fmt.Fprintf(os.Stderr, "warning: simulation %s stopped %v\n", r.name, err)
+				stopped = true
+				break
+			}
+			if r.summary != nil {
+				r.summary.observe(r.stats)
+			}
+			if r.out == nil {
+				continue
+			}
+			if r.ext != nil {
+				r.ext.observe(r.stats)
+			}
+			if r.sampler.sample(ev, r.stats) {
+				if err := r.out.writeSample(r.stats, r.ext); err != nil {
+					return fmt.Errorf("writing stats: %v", err)
+				}
+				if r.ext != nil {
+					r.ext.reset(r.stats)
+				}
+			}
+		}
+		if b.processed != nil {
+			b.processed.Done()
 		}
-		sims = append(sims, typ)
 	}
-	if sim == nil {
-		return fmt.Errorf("-type must be a valid simulation type: %s", strings.Join(sims, ", "))
+	if r.dump != nil {
+		// Write out any heap maps for the last cycles.
+		if err := r.dump.dump(r.stats); err != nil {
+			return fmt.Errorf("writing heap map: %v", err)
+		}
 	}
 	return nil
 }
@@ -89,28 +313,112 @@ func run() error {
 	if err != nil {
 		return fmt.Errorf("creating parser: %v", err)
 	}
-
-	out, err := os.Create(outFile)
-	if err != nil {
-		return fmt.Errorf("creating simulation data file: %v", err)
+	var resume *gob.Decoder
+	if resuming() {
+		fmt.Println("Resuming from checkpoint...")
+		dec, f, err := readCheckpointHeader()
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if err := p.LoadState(dec); err != nil {
+			return fmt.Errorf("restoring parser: %v", err)
+		}
+		resume = dec
 	}
-	defer out.Close()
 
-	outImpl, err := os.Create(implFile)
-	if err != nil {
-		return fmt.Errorf("creating impl-specific simulation data file: %v", err)
+	var long *longOutput
+	if longFormat {
+		long, err = newLongOutput(outFile)
+		if err != nil {
+			return err
+		}
+		defer long.Close()
 	}
-	defer outImpl.Close()
-
-	stats := simulation.NewStats()
-	sim.RegisterStats(stats)
+	runs := make([]*simRun, 0, len(sims))
+	for _, name := range sims {
+		var out statsWriter
+		if sweepFile != "" {
+			// Only produce a summary.
+		} else if long != nil {
+			out = long.writer(name)
+		} else if format != "csv" {
+			o := outFile
+			if len(sims) > 1 {
+				o = simOutputFile(o, name)
+			}
+			if format == "json" {
+				out, err = newJSONWriter(o, name)
+				if err != nil {
+					return err
+				}
+			} else {
+				out = newPromWriter(o, name)
+			}
+		} else {
+			o, oi := outFile, implFile
+			if len(sims) > 1 {
+				o, oi = simOutputFile(o, name), simOutputFile(oi, name)
+			}
+			out, err = newCSVWriter(o, oi)
+			if err != nil {
+				return err
+			}
+		}
+		if perPFile != "" {
+			f := perPFile
+			if len(sims) > 1 {
+				f = simOutputFile(f, name)
+			}
+			pw, err := newPerPWriter(f, p.NumP())
+			if err != nil {
+				return err
+			}
+			out = multiWriter{out, pw}
+		}
+		if out != nil {
+			defer out.Close()
+		}
 
-	fmt.Fprintln(out, "Timestamp,GCCycles,Allocs,Frees,ObjectBytes,StackBytes,UnusedBytes,FreeBytes")
-	fmt.Fprintf(outImpl, "Timestamp")
-	for _, name := range stats.OtherStats() {
-		fmt.Fprintf(outImpl, ",%s", name)
+		sim, err := simulations[name].Build()
+		if err != nil {
+			return fmt.Errorf("simulation %s: %v", name, err)
+		}
+		var s simulation.Simulator = sim
+		if pacer {
+			s = simulation.NewPacer(s, simulation.PacerGOGC(gcPercent), simulation.PacerMemoryLimit(memoryLimit))
+		}
+		sr := &simRun{
+			name:   name,
+			sim:    s,
+			stats:  simulation.NewStats(),
+			out:    out,
+			events: make(chan eventBatch, 16),
+		}
+		sr.sim.RegisterStats(sr.stats)
+		if out != nil {
+			sr.sampler = newSampler()
+			if samplePolicy == "period" {
+				sr.ext = newExtrema(sr.stats)
+			}
+		}
+		if resume != nil {
+			if err := loadRun(resume, sr); err != nil {
+				return fmt.Errorf("simulation %s: restoring checkpoint: %v", name, err)
+			}
+		} else if out != nil {
+			if err := out.writeHeader(sr.stats, sr.ext); err != nil {
+				return fmt.Errorf("writing header: %v", err)
+			}
+		}
+		if sweepFile != "" {
+			sr.summary = &summary{name: name}
+		}
+		if len(dumpCycles) != 0 {
+			sr.dump = newHeapDumper(sim, name, sr.stats)
+		}
+		runs = append(runs, sr)
 	}
-	fmt.Fprintln(outImpl)
 
 	var pMu sync.Mutex
 	spinner.Start(func() float64 {
@@ -119,38 +427,100 @@ func run() error {
 		pMu.Unlock()
 		return prog
 	}, spinner.Format("Processing... %.4f%%"))
+	defer spinner.Stop()
 
-	var ts uint64
-	for {
-		pMu.Lock()
-		ev, err := p.Next()
-		pMu.Unlock()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return fmt.Errorf("parsing events: %v", err)
-		}
-		sim.Process(ev, stats)
-		diff := stats.Timestamp - ts
-		if diff > period {
-			// Generate standard stats line.
-			fmt.Fprintf(out, "%d,%d,%d,%d,%d,%d,%d,%d\n", stats.Timestamp, stats.GCCycles, stats.Allocs, stats.Frees, stats.ObjectBytes, stats.StackBytes, stats.UnusedBytes, stats.FreeBytes)
-			out.Sync()
-
-			// Generate impl-specific stats line.
-			fmt.Fprintf(outImpl, "%d", stats.Timestamp)
-			for _, name := range stats.OtherStats() {
-				fmt.Fprintf(outImpl, ",%d", stats.GetOther(name))
+	// Decode the trace once, and fan the events out to each
+	// simulation, which each run concurrently.
+	eg, ctx := errgroup.WithContext(context.Background())
+	for _, sr := range runs {
+		eg.Go(sr.process)
+	}
+	eg.Go(func() error {
+		defer func() {
+			for _, sr := range runs {
+				close(sr.events)
 			}
-			fmt.Fprintln(outImpl)
-			outImpl.Sync()
+		}()
+		var gcs uint64
+		for {
+			b := eventBatch{evs: make([]goat.Event, 0, eventBatchSize)}
+			var perr error
+			pMu.Lock()
+			for len(b.evs) < eventBatchSize {
+				ev, err := p.Next()
+				if err != nil {
+					perr = err
+					break
+				}
+				b.evs = append(b.evs, ev)
 
-			ts = stats.Timestamp
+				// Cut the batch short at a GC boundary if it's
+				// time for a checkpoint.
+				if checkpointFile != "" && ev.Kind == goat.EventGCEnd {
+					gcs++
+					if gcs%checkpointEvery == 0 {
+						b.processed = new(sync.WaitGroup)
+						b.processed.Add(len(runs))
+						break
+					}
+				}
+			}
+			pMu.Unlock()
+			if perr != nil && perr != io.EOF {
+				return fmt.Errorf("parsing events: %v", perr)
+			}
+			for _, sr := range runs {
+				select {
+				case sr.events <- b:
+				case <-ctx.Done():
+					return nil
+				}
+			}
+			if b.processed != nil {
+				// Wait for every simulation to catch up
+				// before saving their state.
+				done := make(chan struct{})
+				go func() {
+					b.processed.Wait()
+					close(done)
+				}()
+				select {
+				case <-done:
+				case <-ctx.Done():
+					return nil
+				}
+				pMu.Lock()
+				err := writeCheckpoint(p, runs)
+				pMu.Unlock()
+				if err != nil {
+					return fmt.Errorf("writing checkpoint: %v", err)
+				}
+			}
+			if perr == io.EOF {
+				return nil
+			}
 		}
+	})
+	if err := eg.Wait(); err != nil {
+		return err
 	}
 	spinner.Stop()
 
+	if sweepFile != "" {
+		sums := make([]*summary, 0, len(runs))
+		for _, sr := range runs {
+			sums = append(sums, sr.summary)
+		}
+		out, err := os.Create(outFile)
+		if err != nil {
+			return fmt.Errorf("creating summary file: %v", err)
+		}
+		defer out.Close()
+		if err := writeSummaries(out, sums); err != nil {
+			return fmt.Errorf("writing summary: %v", err)
+		}
+		return printSummaries(os.Stdout, sums)
+	}
 	return nil
 }
 
@@ -0,0 +1,557 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/mknyszek/goat/simulation"
+)
+
+// statsWriter writes out samples of simulation statistics.
+type statsWriter interface {
+	// writeHeader writes out any header information for the output
+	// format. It is called once after stats are registered.
+	writeHeader(stats *simulation.Stats, ext *extrema) error
+
+	// writeSample writes out a sample of stats, along with the
+	// extrema of the interval since the last sample, if they're
+	// tracked. ext is nil otherwise.
+	writeSample(stats *simulation.Stats, ext *extrema) error
+
+	// Close closes any files owned by the writer.
+	Close() error
+}
+
+// simOutputFile derives an output file name for a simulation
+// when multiple simulations are being run at once.
+func simOutputFile(file, sim string) string {
+	ext := filepath.Ext(file)
+	return strings.TrimSuffix(file, ext) + "-" + sim + ext
+}
+
+// standardStat describes one of the standard statistics in a
+// simulation.Stats.
+type standardStat struct {
+	simulation.StatDesc
+	value func(*simulation.Stats) uint64
+}
+
+// standardStats are the standard statistics, in output order.
+var standardStats = []standardStat{
+	{simulation.StatDesc{Name: "GCCycles", Kind: simulation.Counter, Description: "complete GC cycles"},
+		func(s *simulation.Stats) uint64 { return s.GCCycles }},
+	{simulation.StatDesc{Name: "Allocs", Kind: simulation.Counter, Description: "object allocations"},
+		func(s *simulation.Stats) uint64 { return s.Allocs }},
+	{simulation.StatDesc{Name: "Frees", Kind: simulation.Counter, Description: "object frees"},
+		func(s *simulation.Stats) uint64 { return s.Frees }},
+	{simulation.StatDesc{Name: "ObjectBytes", Unit: simulation.UnitBytes, Description: "memory occupied by live objects"},
+		func(s *simulation.Stats) uint64 { return s.ObjectBytes }},
+	{simulation.StatDesc{Name: "StackBytes", Unit: simulation.UnitBytes, Description: "memory occupied by live stacks"},
+		func(s *simulation.Stats) uint64 { return s.StackBytes }},
+	{simulation.StatDesc{Name: "UnusedBytes", Unit: simulation.UnitBytes, Description: "memory neither live nor usable for allocation"},
+		func(s *simulation.Stats) uint64 { return s.UnusedBytes }},
+	{simulation.StatDesc{Name: "FreeBytes", Unit: simulation.UnitBytes, Description: "memory usable for allocation"},
+		func(s *simulation.Stats) uint64 { return s.FreeBytes }},
+	{simulation.StatDesc{Name: "ReleasedBytes", Unit: simulation.UnitBytes, Description: "free memory returned to the OS"},
+		func(s *simulation.Stats) uint64 { return s.ReleasedBytes }},
+	{simulation.StatDesc{Name: "RSSBytes", Unit: simulation.UnitBytes, Description: "resident memory"},
+		func(s *simulation.Stats) uint64 { return s.RSSBytes }},
+}
+
+// statColumns returns the names of the columns for an
+// implementation-specific statistic in tabular output. Histograms
+// have a column per bucket, followed by their sum and count.
+func statColumns(stat *simulation.Stat) []string {
+	desc := stat.Desc()
+	if desc.Kind != simulation.Histogram {
+		return []string{desc.Name}
+	}
+	cols := make([]string, 0, len(desc.Buckets)+3)
+	for _, b := range desc.Buckets {
+		cols = append(cols, fmt.Sprintf("%s[le=%d]", desc.Name, b))
+	}
+	return append(cols, desc.Name+"[le=inf]", desc.Name+"[sum]", desc.Name+"[count]")
+}
+
+// statValues returns the values of the columns returned by
+// statColumns for stat.
+func statValues(stat *simulation.Stat) []uint64 {
+	if stat.Desc().Kind != simulation.Histogram {
+		return []uint64{stat.Value()}
+	}
+	vals := append([]uint64(nil), stat.Counts()...)
+	return append(vals, stat.Sum(), stat.Value())
+}
+
+// writeMetadata writes a CSV table describing the standard and
+// implementation-specific statistics in stats, and the extrema.
+func writeMetadata(w io.Writer, stats *simulation.Stats, ext *extrema) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"Stat", "Kind", "Unit", "Description"})
+	row := func(desc simulation.StatDesc, _ uint64) {
+		cw.Write([]string{desc.Name, desc.Kind.String(), desc.Unit.String(), desc.Description})
+	}
+	for _, std := range standardStats {
+		row(std.StatDesc, 0)
+	}
+	ext.columns(false, row)
+	for _, stat := range stats.OtherStats() {
+		row(stat.Desc(), 0)
+	}
+	ext.columns(true, row)
+	cw.Flush()
+	return cw.Error()
+}
+
+// csvWriter writes standard statistics and implementation-specific
+// statistics to two separate wide-format CSV files, and describes
+// the statistics in a third.
+type csvWriter struct {
+	out, outImpl *os.File
+	metaFile     string
+}
+
+func newCSVWriter(outFile, implFile string) (*csvWriter, error) {
+	out, err := createOutput(outFile)
+	if err != nil {
+		return nil, fmt.Errorf("creating simulation data file: %v", err)
+	}
+	outImpl, err := createOutput(implFile)
+	if err != nil {
+		out.Close()
+		return nil, fmt.Errorf("creating impl-specific simulation data file: %v", err)
+	}
+	return &csvWriter{out: out, outImpl: outImpl, metaFile: simOutputFile(implFile, "meta")}, nil
+}
+
+func (w *csvWriter) writeHeader(stats *simulation.Stats, ext *extrema) error {
+	meta, err := os.Create(w.metaFile)
+	if err != nil {
+		return fmt.Errorf("creating simulation metadata file: %v", err)
+	}
+	if err := writeMetadata(meta, stats, ext); err != nil {
+		meta.Close()
+		return err
+	}
+	if err := meta.Close(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w.out, "Timestamp")
+	for _, std := range standardStats {
+		fmt.Fprintf(w.out, ",%s", std.Name)
+	}
+	ext.columns(false, func(desc simulation.StatDesc, _ uint64) {
+		fmt.Fprintf(w.out, ",%s", desc.Name)
+	})
+	fmt.Fprintln(w.out)
+	fmt.Fprintf(w.outImpl, "Timestamp")
+	for _, stat := range stats.OtherStats() {
+		for _, col := range statColumns(stat) {
+			fmt.Fprintf(w.outImpl, ",%s", col)
+		}
+	}
+	ext.columns(true, func(desc simulation.StatDesc, _ uint64) {
+		fmt.Fprintf(w.outImpl, ",%s", desc.Name)
+	})
+	_, err = fmt.Fprintln(w.outImpl)
+	return err
+}
+
+func (w *csvWriter) writeSample(stats *simulation.Stats, ext *extrema) error {
+	// Generate standard stats line.
+	fmt.Fprintf(w.out, "%d", stats.Timestamp)
+	for _, std := range standardStats {
+		fmt.Fprintf(w.out, ",%d", std.value(stats))
+	}
+	ext.columns(false, func(_ simulation.StatDesc, v uint64) {
+		fmt.Fprintf(w.out, ",%d", v)
+	})
+	fmt.Fprintln(w.out)
+	if err := w.out.Sync(); err != nil {
+		return err
+	}
+
+	// Generate impl-specific stats line.
+	fmt.Fprintf(w.outImpl, "%d", stats.Timestamp)
+	for _, stat := range stats.OtherStats() {
+		for _, v := range statValues(stat) {
+			fmt.Fprintf(w.outImpl, ",%d", v)
+		}
+	}
+	ext.columns(true, func(_ simulation.StatDesc, v uint64) {
+		fmt.Fprintf(w.outImpl, ",%d", v)
+	})
+	fmt.Fprintln(w.outImpl)
+	return w.outImpl.Sync()
+}
+
+func (w *csvWriter) Close() error {
+	err1 := w.out.Close()
+	err2 := w.outImpl.Close()
+	if err1 != nil {
+		return err1
+	}
+	return err2
+}
+
+// longOutput is a single long-format CSV file shared by
+// several simulations, with one row per statistic per sample.
+type longOutput struct {
+	mu  sync.Mutex
+	out *os.File
+}
+
+func newLongOutput(outFile string) (*longOutput, error) {
+	out, err := createOutput(outFile)
+	if err != nil {
+		return nil, fmt.Errorf("creating simulation data file: %v", err)
+	}
+	if !resuming() {
+		if _, err := fmt.Fprintln(out, "Sim,Timestamp,Stat,Value"); err != nil {
+			out.Close()
+			return nil, err
+		}
+	}
+	return &longOutput{out: out}, nil
+}
+
+// writer returns a statsWriter for the named simulation which
+// writes to the shared file.
+func (l *longOutput) writer(sim string) *longWriter {
+	return &longWriter{l, sim}
+}
+
+// longWriter is a statsWriter for a single simulation that
+// writes into a longOutput.
+type longWriter struct {
+	*longOutput
+	sim string
+}
+
+func (w *longWriter) writeHeader(_ *simulation.Stats, _ *extrema) error {
+	return nil
+}
+
+func (w *longWriter) writeSample(stats *simulation.Stats, ext *extrema) error {
+	var sb strings.Builder
+	cw := csv.NewWriter(&sb)
+	ts := strconv.FormatUint(stats.Timestamp, 10)
+	row := func(name string, value uint64) {
+		cw.Write([]string{w.sim, ts, name, strconv.FormatUint(value, 10)})
+	}
+	for _, std := range standardStats {
+		row(std.Name, std.value(stats))
+	}
+	for _, stat := range stats.OtherStats() {
+		vals := statValues(stat)
+		for i, col := range statColumns(stat) {
+			row(col, vals[i])
+		}
+	}
+	extRow := func(desc simulation.StatDesc, v uint64) {
+		row(desc.Name, v)
+	}
+	ext.columns(false, extRow)
+	ext.columns(true, extRow)
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, err := w.out.WriteString(sb.String()); err != nil {
+		return err
+	}
+	return w.out.Sync()
+}
+
+func (w *longWriter) Close() error {
+	// The shared file is closed by its owner.
+	return nil
+}
+
+func (l *longOutput) Close() error {
+	return l.out.Close()
+}
+
+// jsonWriter writes statistics as JSON lines. The first line
+// describes the statistics, and each following line is a sample.
+type jsonWriter struct {
+	out *os.File
+	enc *json.Encoder
+	sim string
+}
+
+// jsonStat is the JSON description of a statistic.
+type jsonStat struct {
+	Name        string
+	Kind        string
+	Unit        string
+	Description string
+	Buckets     []uint64 `json:",omitempty"`
+}
+
+// jsonHistogram is the JSON value of a histogram, with the count
+// of values in each bucket, the overflow bucket last.
+type jsonHistogram struct {
+	Counts []uint64
+	Sum    uint64
+}
+
+// jsonSample is the JSON form of a sample of statistics.
+type jsonSample struct {
+	Timestamp  uint64
+	Values     map[string]uint64
+	Histograms map[string]jsonHistogram `json:",omitempty"`
+}
+
+func newJSONWriter(outFile, sim string) (*jsonWriter, error) {
+	out, err := createOutput(outFile)
+	if err != nil {
+		return nil, fmt.Errorf("creating simulation data file: %v", err)
+	}
+	return &jsonWriter{out: out, enc: json.NewEncoder(out), sim: sim}, nil
+}
+
+func (w *jsonWriter) writeHeader(stats *simulation.Stats, ext *extrema) error {
+	var descs []jsonStat
+	add := func(d simulation.StatDesc) {
+		descs = append(descs, jsonStat{
+			Name:        d.Name,
+			Kind:        d.Kind.String(),
+			Unit:        d.Unit.String(),
+			Description: d.Description,
+			Buckets:     d.Buckets,
+		})
+	}
+	for _, std := range standardStats {
+		add(std.StatDesc)
+	}
+	for _, stat := range stats.OtherStats() {
+		add(stat.Desc())
+	}
+	extDesc := func(desc simulation.StatDesc, _ uint64) {
+		add(desc)
+	}
+	ext.columns(false, extDesc)
+	ext.columns(true, extDesc)
+	return w.enc.Encode(struct {
+		Sim   string
+		Stats []jsonStat
+	}{w.sim, descs})
+}
+
+func (w *jsonWriter) writeSample(stats *simulation.Stats, ext *extrema) error {
+	sample := jsonSample{
+		Timestamp: stats.Timestamp,
+		Values:    make(map[string]uint64),
+	}
+	for _, std := range standardStats {
+		sample.Values[std.Name] = std.value(stats)
+	}
+	for _, stat := range stats.OtherStats() {
+		desc := stat.Desc()
+		if desc.Kind != simulation.Histogram {
+			sample.Values[desc.Name] = stat.Value()
+			continue
+		}
+		if sample.Histograms == nil {
+			sample.Histograms = make(map[string]jsonHistogram)
+		}
+		sample.Histograms[desc.Name] = jsonHistogram{
+			Counts: append([]uint64(nil), stat.Counts()...),
+			Sum:    stat.Sum(),
+		}
+	}
+	extValue := func(desc simulation.StatDesc, v uint64) {
+		sample.Values[desc.Name] = v
+	}
+	ext.columns(false, extValue)
+	ext.columns(true, extValue)
+	if err := w.enc.Encode(&sample); err != nil {
+		return err
+	}
+	return w.out.Sync()
+}
+
+func (w *jsonWriter) Close() error {
+	return w.out.Close()
+}
+
+// promWriter writes the latest sample of statistics in the Prometheus
+// text exposition format, replacing the file on each sample, so that
+// it may be scraped by a textfile collector.
+type promWriter struct {
+	file string
+	sim  string
+}
+
+func newPromWriter(outFile, sim string) *promWriter {
+	return &promWriter{file: outFile, sim: sim}
+}
+
+// promName converts a CamelCase statistic name into a Prometheus
+// metric name.
+func promName(name string, kind simulation.StatKind) string {
+	var sb strings.Builder
+	sb.WriteString("goat_")
+	for i, r := range name {
+		if unicode.IsUpper(r) && i > 0 {
+			prev := rune(name[i-1])
+			nextLower := i+1 < len(name) && unicode.IsLower(rune(name[i+1]))
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextLower) {
+				sb.WriteByte('_')
+			}
+		}
+		sb.WriteRune(unicode.ToLower(r))
+	}
+	if kind == simulation.Counter {
+		sb.WriteString("_total")
+	}
+	return sb.String()
+}
+
+func (w *promWriter) writeHeader(_ *simulation.Stats, _ *extrema) error {
+	return nil
+}
+
+func (w *promWriter) writeSample(stats *simulation.Stats, ext *extrema) error {
+	var sb strings.Builder
+	labels := fmt.Sprintf("sim=%q", w.sim)
+	metric := func(d simulation.StatDesc) string {
+		name := promName(d.Name, d.Kind)
+		typ := d.Kind.String()
+		fmt.Fprintf(&sb, "# HELP %s %s (%s).\n", name, d.Description, d.Unit)
+		fmt.Fprintf(&sb, "# TYPE %s %s\n", name, typ)
+		return name
+	}
+	name := metric(simulation.StatDesc{Name: "Timestamp", Description: "time of the latest event in CPU ticks"})
+	fmt.Fprintf(&sb, "%s{%s} %d\n", name, labels, stats.Timestamp)
+	for _, std := range standardStats {
+		name := metric(std.StatDesc)
+		fmt.Fprintf(&sb, "%s{%s} %d\n", name, labels, std.value(stats))
+	}
+	for _, stat := range stats.OtherStats() {
+		desc := stat.Desc()
+		name := metric(desc)
+		if desc.Kind != simulation.Histogram {
+			fmt.Fprintf(&sb, "%s{%s} %d\n", name, labels, stat.Value())
+			continue
+		}
+		var cum uint64
+		for i, count := range stat.Counts() {
+			cum += count
+			le := "+Inf"
+			if i < len(desc.Buckets) {
+				le = fmt.Sprint(desc.Buckets[i])
+			}
+			fmt.Fprintf(&sb, "%s_bucket{%s,le=%q} %d\n", name, labels, le, cum)
+		}
+		fmt.Fprintf(&sb, "%s_sum{%s} %d\n", name, labels, stat.Sum())
+		fmt.Fprintf(&sb, "%s_count{%s} %d\n", name, labels, stat.Value())
+	}
+	extMetric := func(desc simulation.StatDesc, v uint64) {
+		name := metric(desc)
+		fmt.Fprintf(&sb, "%s{%s} %d\n", name, labels, v)
+	}
+	ext.columns(false, extMetric)
+	ext.columns(true, extMetric)
+
+	// Write to a temporary file and rename it, so that readers
+	// never see a partial sample.
+	tmp := w.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(sb.String()), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, w.file)
+}
+
+func (w *promWriter) Close() error {
+	return nil
+}
+
+// perPWriter writes per-P statistics to a wide-format CSV file,
+// with a column for each statistic of each P.
+type perPWriter struct {
+	out  *os.File
+	numP int
+}
+
+func newPerPWriter(file string, numP int) (*perPWriter, error) {
+	out, err := createOutput(file)
+	if err != nil {
+		return nil, fmt.Errorf("creating per-P simulation data file: %v", err)
+	}
+	return &perPWriter{out: out, numP: numP}, nil
+}
+
+func (w *perPWriter) writeHeader(_ *simulation.Stats, _ *extrema) error {
+	var sb strings.Builder
+	sb.WriteString("Timestamp")
+	for p := 0; p < w.numP; p++ {
+		fmt.Fprintf(&sb, ",P%[1]dAllocs,P%[1]dFrees,P%[1]dCachedBytes,P%[1]dRefills", p)
+	}
+	sb.WriteString("\n")
+	_, err := w.out.WriteString(sb.String())
+	return err
+}
+
+func (w *perPWriter) writeSample(stats *simulation.Stats, _ *extrema) error {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%d", stats.Timestamp)
+	for p := 0; p < w.numP; p++ {
+		ps := stats.PerP(int32(p))
+		fmt.Fprintf(&sb, ",%d,%d,%d,%d", ps.Allocs, ps.Frees, ps.CachedBytes, ps.Refills)
+	}
+	sb.WriteString("\n")
+	if _, err := w.out.WriteString(sb.String()); err != nil {
+		return err
+	}
+	return w.out.Sync()
+}
+
+func (w *perPWriter) Close() error {
+	return w.out.Close()
+}
+
+// multiWriter is a statsWriter which writes to several statsWriters.
+type multiWriter []statsWriter
+
+func (m multiWriter) writeHeader(stats *simulation.Stats, ext *extrema) error {
+	for _, w := range m {
+		if err := w.writeHeader(stats, ext); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m multiWriter) writeSample(stats *simulation.Stats, ext *extrema) error {
+	for _, w := range m {
+		if err := w.writeSample(stats, ext); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m multiWriter) Close() error {
+	var err error
+	for _, w := range m {
+		if cerr := w.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"github.com/mknyszek/goat"
+	"github.com/mknyszek/goat/simulation"
+)
+
+// sampler decides when a sample of stats is written out.
+type sampler interface {
+	// sample is called after each event is processed, and
+	// reports whether a sample should be written.
+	sample(ev goat.Event, stats *simulation.Stats) bool
+
+	// state returns the sampler's progress towards its next
+	// sample, so that it may be saved in a checkpoint.
+	state() uint64
+
+	// setState restores progress returned by state.
+	setState(v uint64)
+}
+
+// newSampler returns a new sampler for the policy selected
+// by flags.
+func newSampler() sampler {
+	switch samplePolicy {
+	case "gc":
+		return &gcSampler{}
+	case "events":
+		return &eventSampler{every: sampleEvery}
+	}
+	return &periodSampler{period: period}
+}
+
+// periodSampler samples at most once every period CPU ticks.
+type periodSampler struct {
+	period uint64
+	last   uint64
+}
+
+func (s *periodSampler) sample(_ goat.Event, stats *simulation.Stats) bool {
+	if stats.Timestamp-s.last > s.period {
+		s.last = stats.Timestamp
+		return true
+	}
+	return false
+}
+
+func (s *periodSampler) state() uint64     { return s.last }
+func (s *periodSampler) setState(v uint64) { s.last = v }
+
+// gcSampler samples at the start and end of each GC cycle.
+//
+// GC cycles are normally the ones recorded in the trace, but
+// when they're decided by a simulated pacer, both the start and
+// the end happen during a single event, so a sample is instead
+// taken whenever a GC cycle completes.
+type gcSampler struct {
+	cycles uint64
+}
+
+func (s *gcSampler) sample(ev goat.Event, stats *simulation.Stats) bool {
+	if pacer {
+		if stats.GCCycles != s.cycles {
+			s.cycles = stats.GCCycles
+			return true
+		}
+		return false
+	}
+	return ev.Kind == goat.EventGCStart || ev.Kind == goat.EventGCEnd
+}
+
+func (s *gcSampler) state() uint64     { return s.cycles }
+func (s *gcSampler) setState(v uint64) { s.cycles = v }
+
+// eventSampler samples once every so many events.
+type eventSampler struct {
+	every uint64
+	count uint64
+}
+
+func (s *eventSampler) sample(_ goat.Event, _ *simulation.Stats) bool {
+	s.count++
+	if s.count == s.every {
+		s.count = 0
+		return true
+	}
+	return false
+}
+
+func (s *eventSampler) state() uint64     { return s.count }
+func (s *eventSampler) setState(v uint64) { s.count = v }
+
+// gauge is a statistic which may go up and down, whose extremes
+// are tracked between samples.
+type gauge struct {
+	desc  simulation.StatDesc
+	other bool
+	value func(*simulation.Stats) uint64
+}
+
+// extrema tracks the minimum and maximum value of each gauge over
+// the interval since the last sample, and its peak value since the
+// simulation started. These are lost by sampling at a fixed period,
+// since a gauge may spike and recede between two samples.
+//
+// Counters and histograms aren't tracked.
+type extrema struct {
+	gauges         []gauge
+	min, max, peak []uint64
+}
+
+// newExtrema returns extrema for the standard gauges and the
+// implementation-specific gauges registered with stats, starting
+// from their current values.
+func newExtrema(stats *simulation.Stats) *extrema {
+	e := new(extrema)
+	for _, std := range standardStats {
+		if std.Kind == simulation.Gauge {
+			e.gauges = append(e.gauges, gauge{desc: std.StatDesc, value: std.value})
+		}
+	}
+	for _, stat := range stats.OtherStats() {
+		stat := stat
+		if stat.Desc().Kind == simulation.Gauge {
+			e.gauges = append(e.gauges, gauge{
+				desc:  stat.Desc(),
+				other: true,
+				value: func(*simulation.Stats) uint64 { return stat.Value() },
+			})
+		}
+	}
+	e.min = make([]uint64, len(e.gauges))
+	e.max = make([]uint64, len(e.gauges))
+	e.peak = make([]uint64, len(e.gauges))
+	e.reset(stats)
+	return e
+}
+
+// observe incorporates the current state of stats. It should be
+// called after every event.
+func (e *extrema) observe(stats *simulation.Stats) {
+	for i, g := range e.gauges {
+		v := g.value(stats)
+		if v < e.min[i] {
+			e.min[i] = v
+		}
+		if v > e.max[i] {
+			e.max[i] = v
+			if v > e.peak[i] {
+				e.peak[i] = v
+			}
+		}
+	}
+}
+
+// reset starts a new interval at the current state of stats.
+func (e *extrema) reset(stats *simulation.Stats) {
+	for i, g := range e.gauges {
+		v := g.value(stats)
+		e.min[i], e.max[i] = v, v
+		if v > e.peak[i] {
+			e.peak[i] = v
+		}
+	}
+}
+
+// columns calls f with a description and the value of each of the
+// extrema for either the standard or the implementation-specific
+// gauges.
+func (e *extrema) columns(other bool, f func(desc simulation.StatDesc, value uint64)) {
+	if e == nil {
+		return
+	}
+	for i, g := range e.gauges {
+		if g.other != other {
+			continue
+		}
+		derive := func(suffix, what, since string) simulation.StatDesc {
+			return simulation.StatDesc{
+				Name:        g.desc.Name + suffix,
+				Unit:        g.desc.Unit,
+				Description: what + " of " + g.desc.Name + " since " + since,
+			}
+		}
+		f(derive("Min", "minimum", "the last sample"), e.min[i])
+		f(derive("Max", "maximum", "the last sample"), e.max[i])
+		f(derive("Peak", "maximum", "the simulation started"), e.peak[i])
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/mknyszek/goat/simulation"
+	"github.com/mknyszek/goat/simulation/toolbox"
+)
+
+// loadSweep reads a parameter sweep from a file and expands it into
+// a list of named simulation specs.
+func loadSweep(file string) ([]toolbox.Spec, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sweep, err := toolbox.ParseSweep(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	specs, err := sweep.Expand()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	return specs, nil
+}
+
+// summary tracks the peak and time-weighted average of a few key
+// statistics over the course of a simulation.
+type summary struct {
+	name string
+
+	peakUnused, peakFree, peakRSS uint64
+	peakFrag                      float64
+
+	sumUnused, sumFree, sumRSS, sumFrag float64
+	totalTicks                          float64
+	lastTimestamp                       uint64
+	started                             bool
+}
+
+// fragmentation returns the fraction of memory in use by the simulation
+// (that is, not free) which does not contain live objects or stacks.
+func fragmentation(stats *simulation.Stats) float64 {
+	inUse := stats.ObjectBytes + stats.StackBytes + stats.UnusedBytes
+	if inUse == 0 {
+		return 0
+	}
+	return float64(stats.UnusedBytes) / float64(inUse)
+}
+
+// observe incorporates the current state of stats into the summary.
+// It should be called after every event.
+func (s *summary) observe(stats *simulation.Stats) {
+	frag := fragmentation(stats)
+	if stats.UnusedBytes > s.peakUnused {
+		s.peakUnused = stats.UnusedBytes
+	}
+	if stats.FreeBytes > s.peakFree {
+		s.peakFree = stats.FreeBytes
+	}
+	if stats.RSSBytes > s.peakRSS {
+		s.peakRSS = stats.RSSBytes
+	}
+	if frag > s.peakFrag {
+		s.peakFrag = frag
+	}
+	if s.started && stats.Timestamp > s.lastTimestamp {
+		dt := float64(stats.Timestamp - s.lastTimestamp)
+		s.sumUnused += float64(stats.UnusedBytes) * dt
+		s.sumFree += float64(stats.FreeBytes) * dt
+		s.sumRSS += float64(stats.RSSBytes) * dt
+		s.sumFrag += frag * dt
+		s.totalTicks += dt
+	}
+	s.lastTimestamp = stats.Timestamp
+	s.started = true
+}
+
+func (s *summary) averages() (unused, free, rss, frag float64) {
+	if s.totalTicks == 0 {
+		return 0, 0, 0, 0
+	}
+	return s.sumUnused / s.totalTicks, s.sumFree / s.totalTicks, s.sumRSS / s.totalTicks, s.sumFrag / s.totalTicks
+}
+
+// writeSummaries writes out a CSV of sweep summaries to w.
+func writeSummaries(w io.Writer, sums []*summary) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"Config", "PeakUnusedBytes", "AvgUnusedBytes", "PeakFreeBytes", "AvgFreeBytes", "PeakRSSBytes", "AvgRSSBytes", "PeakFragmentation", "AvgFragmentation"})
+	for _, s := range sums {
+		unused, free, rss, frag := s.averages()
+		cw.Write([]string{
+			s.name,
+			strconv.FormatUint(s.peakUnused, 10),
+			strconv.FormatFloat(unused, 'f', 0, 64),
+			strconv.FormatUint(s.peakFree, 10),
+			strconv.FormatFloat(free, 'f', 0, 64),
+			strconv.FormatUint(s.peakRSS, 10),
+			strconv.FormatFloat(rss, 'f', 0, 64),
+			strconv.FormatFloat(s.peakFrag, 'f', 4, 64),
+			strconv.FormatFloat(frag, 'f', 4, 64),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// printSummaries prints a human-readable table of sweep summaries to w.
+func printSummaries(w io.Writer, sums []*summary) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "Config\tPeak Unused\tAvg Unused\tPeak Free\tAvg Free\tPeak RSS\tAvg RSS\tPeak Frag\tAvg Frag\t")
+	for _, s := range sums {
+		unused, free, rss, frag := s.averages()
+		fmt.Fprintf(tw, "%s\t%d\t%.0f\t%d\t%.0f\t%d\t%.0f\t%.2f%%\t%.2f%%\t\n", s.name, s.peakUnused, unused, s.peakFree, free, s.peakRSS, rss, s.peakFrag*100, frag*100)
+	}
+	return tw.Flush()
+}
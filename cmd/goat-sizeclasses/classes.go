@@ -0,0 +1,221 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"math"
+	"sort"
+
+	"github.com/mknyszek/goat/simulation/toolbox"
+	"github.com/mknyszek/goat/simulation/toolbox/object"
+)
+
+const (
+	pageSize     = 8192
+	maxSmallSize = 32 << 10
+	smallSizeMax = 1024
+	largeSizeDiv = 128
+)
+
+// dist is an allocation size distribution.
+type dist struct {
+	sizes  []uint64
+	counts []uint64
+}
+
+func newDist(counts map[uint64]uint64) *dist {
+	d := new(dist)
+	for size := range counts {
+		d.sizes = append(d.sizes, size)
+	}
+	sort.Slice(d.sizes, func(i, j int) bool {
+		return d.sizes[i] < d.sizes[j]
+	})
+	for _, size := range d.sizes {
+		d.counts = append(d.counts, counts[size])
+	}
+	return d
+}
+
+// candidates returns the sizes that may be used as size classes
+// and the number of pages in their spans, chosen the same way as the
+// runtime's mksizeclasses.go.
+func candidates() (sizes, pages []uint64) {
+	npages := make(map[uint64]uint64)
+	add := func(size, n uint64) {
+		if old, ok := npages[size]; !ok {
+			sizes = append(sizes, size)
+		} else if perObject(size, old) <= perObject(size, n) {
+			return
+		}
+		npages[size] = n
+	}
+	align := uint64(8)
+	for size := align; size <= maxSmallSize; size += align {
+		if size&(size-1) == 0 {
+			// Bump the alignment once in a while.
+			if size >= 2048 {
+				align = 256
+			} else if size >= 128 {
+				align = size / 8
+			} else if size >= 32 {
+				align = 16
+			}
+		}
+		n := spanPages(size)
+		add(size, n)
+
+		// Increase object sizes if we can fit the same number of
+		// larger objects into the same number of pages.
+		if size > smallSizeMax {
+			spanBytes := n * pageSize
+			add((spanBytes/(spanBytes/size))&^(largeSizeDiv-1), n)
+		}
+	}
+	sort.Slice(sizes, func(i, j int) bool {
+		return sizes[i] < sizes[j]
+	})
+	for _, size := range sizes {
+		pages = append(pages, npages[size])
+	}
+	return sizes, pages
+}
+
+// spanPages returns the number of pages in a span for objects of the
+// given size, chosen like mksizeclasses.go such that no more than an
+// eighth of the span is wasted at its tail.
+func spanPages(size uint64) uint64 {
+	allocSize := uint64(pageSize)
+	for allocSize%size > allocSize/8 {
+		allocSize += pageSize
+	}
+	return allocSize / pageSize
+}
+
+// perObject returns how many bytes of span each object of the given
+// size costs, including its share of the span's tail waste.
+func perObject(size, pages uint64) float64 {
+	spanBytes := pages * pageSize
+	return float64(spanBytes) / float64(spanBytes/size)
+}
+
+// maxWaste returns the largest fraction of a span that may be wasted
+// for a size class, assuming every object is one byte larger than
+// the previous class.
+func maxWaste(prev, size, pages uint64) float64 {
+	spanBytes := pages * pageSize
+	objects := spanBytes / size
+	tail := spanBytes - objects*size
+	return float64((size-prev-1)*objects+tail) / float64(spanBytes)
+}
+
+// waste returns the number of bytes wasted allocating objects with
+// the distribution d using the size classes classes.
+func (d *dist) waste(classes []object.SizeClass) float64 {
+	total := 0.0
+	c := 0
+	for i, size := range d.sizes {
+		if size > maxSmallSize {
+			break
+		}
+		for c < len(classes) && uint64(classes[c].Size) < size {
+			c++
+		}
+		if c == len(classes) {
+			break
+		}
+		cost := perObject(uint64(classes[c].Size), uint64(classes[c].Pages))
+		total += float64(d.counts[i]) * (cost - float64(size))
+	}
+	return total
+}
+
+// optimize returns the table of at most n size classes which wastes
+// the least memory allocating objects with the distribution d, such
+// that no class's maximum waste exceeds limit. Classes which can't
+// be made any smaller are exempt from the limit.
+func (d *dist) optimize(n int, limit float64) ([]object.SizeClass, error) {
+	sizes, pages := candidates()
+	m := len(sizes)
+
+	// count[j] and bytes[j] are the number and total size of
+	// allocations that are at most sizes[j-1] bytes.
+	count := make([]float64, m+1)
+	bytes := make([]float64, m+1)
+	k := 0
+	for j, size := range sizes {
+		count[j+1], bytes[j+1] = count[j], bytes[j]
+		for ; k < len(d.sizes) && d.sizes[k] <= size; k++ {
+			count[j+1] += float64(d.counts[k])
+			bytes[j+1] += float64(d.counts[k] * d.sizes[k])
+		}
+	}
+
+	// cost[c][j] is the least waste for all allocations up to
+	// sizes[j] bytes using c+1 classes, the largest of which is
+	// sizes[j], and from[c][j] is the class before that one.
+	cost := make([][]float64, n)
+	from := make([][]int, n)
+	for c := range cost {
+		cost[c] = make([]float64, m)
+		from[c] = make([]int, m)
+		for j := range cost[c] {
+			cost[c][j] = math.Inf(1)
+			from[c][j] = -1
+		}
+	}
+	// class returns the waste of allocations larger than sizes[i]
+	// and up to sizes[j] in class j, or false if the class exceeds
+	// the waste limit.
+	class := func(i, j int) (float64, bool) {
+		prev := uint64(0)
+		if i >= 0 {
+			prev = sizes[i]
+		}
+		if i != j-1 && maxWaste(prev, sizes[j], pages[j]) > limit {
+			return 0, false
+		}
+		return (count[j+1]-count[i+1])*perObject(sizes[j], pages[j]) - (bytes[j+1] - bytes[i+1]), true
+	}
+	for j := range sizes {
+		if w, ok := class(-1, j); ok {
+			cost[0][j] = w
+		}
+	}
+	for c := 1; c < n; c++ {
+		for j := c; j < m; j++ {
+			for i := c - 1; i < j; i++ {
+				if math.IsInf(cost[c-1][i], 1) {
+					continue
+				}
+				w, ok := class(i, j)
+				if ok && cost[c-1][i]+w < cost[c][j] {
+					cost[c][j] = cost[c-1][i] + w
+					from[c][j] = i
+				}
+			}
+		}
+	}
+
+	// The largest class must be the largest small object size.
+	best := -1
+	for c := 0; c < n; c++ {
+		if best < 0 || cost[c][m-1] < cost[best][m-1] {
+			best = c
+		}
+	}
+	if math.IsInf(cost[best][m-1], 1) {
+		return nil, errors.New("no size class table satisfies the waste limit; try more classes or a larger limit")
+	}
+	var classes []object.SizeClass
+	for c, j := best, m-1; j >= 0; c, j = c-1, from[c][j] {
+		classes = append(classes, object.SizeClass{Size: toolbox.Bytes(sizes[j]), Pages: toolbox.Pages(pages[j])})
+	}
+	for i, j := 0, len(classes)-1; i < j; i, j = i+1, j-1 {
+		classes[i], classes[j] = classes[j], classes[i]
+	}
+	return classes, nil
+}
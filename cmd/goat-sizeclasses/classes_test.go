@@ -0,0 +1,168 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"math"
+	"testing"
+
+	"github.com/mknyszek/goat/simulation/toolbox"
+	"github.com/mknyszek/goat/simulation/toolbox/object"
+)
+
+func TestSpanPages(t *testing.T) {
+	tests := []struct {
+		size  uint64
+		pages uint64
+	}{
+		{8, 1},
+		{1024, 1},
+		{1152, 1},
+		{3072, 2},
+		{6784, 5},
+		{10240, 4},
+		{32768, 4},
+	}
+	for _, test := range tests {
+		if got := spanPages(test.size); got != test.pages {
+			t.Errorf("spanPages(%d): expected %d, got %d", test.size, test.pages, got)
+		}
+	}
+}
+
+func TestCandidates(t *testing.T) {
+	sizes, pages := candidates()
+	if len(sizes) != len(pages) {
+		t.Fatalf("got %d sizes but %d page counts", len(sizes), len(pages))
+	}
+	if sizes[0] != 8 || sizes[len(sizes)-1] != maxSmallSize {
+		t.Errorf("expected sizes in [8, %d], got [%d, %d]", maxSmallSize, sizes[0], sizes[len(sizes)-1])
+	}
+	index := make(map[uint64]int)
+	for i, size := range sizes {
+		if i > 0 && size <= sizes[i-1] {
+			t.Errorf("sizes not strictly increasing at %d: %d after %d", i, size, sizes[i-1])
+		}
+		if size%8 != 0 {
+			t.Errorf("size %d is not 8-byte aligned", size)
+		}
+		if tail := pages[i]*pageSize - pages[i]*pageSize/size*size; size <= smallSizeMax && tail > pages[i]*pageSize/8 {
+			t.Errorf("size %d wastes %d bytes of a %d page span", size, tail, pages[i])
+		}
+		index[size] = i
+	}
+
+	// Every Go 1.15 size class must be a candidate, and no more
+	// expensive per object than the runtime's.
+	for _, c := range object.Go115SizeClasses() {
+		i, ok := index[uint64(c.Size)]
+		if !ok {
+			t.Errorf("Go 1.15 size class %d is not a candidate", c.Size)
+			continue
+		}
+		if got, want := perObject(sizes[i], pages[i]), perObject(uint64(c.Size), uint64(c.Pages)); got > want {
+			t.Errorf("size %d: expected at most %.1f bytes per object, got %.1f", c.Size, want, got)
+		}
+	}
+}
+
+func TestMaxWaste(t *testing.T) {
+	tests := []struct {
+		prev, size, pages uint64
+		waste             float64
+	}{
+		{0, 8, 1, 7.0 / 8},
+		{8, 16, 1, 7.0 / 16},
+		{1024, 1152, 1, (127*7 + 128) / 8192.0},
+		{0, 8192, 1, 8191.0 / 8192},
+	}
+	for _, test := range tests {
+		if got := maxWaste(test.prev, test.size, test.pages); math.Abs(got-test.waste) > 1e-9 {
+			t.Errorf("maxWaste(%d, %d, %d): expected %f, got %f", test.prev, test.size, test.pages, test.waste, got)
+		}
+	}
+}
+
+// bruteForce returns the least waste for d with at most n classes by
+// trying every table that ends with the largest candidate.
+func bruteForce(d *dist, n int) float64 {
+	sizes, pages := candidates()
+	best := math.Inf(1)
+	var try func(table []object.SizeClass, next int)
+	try = func(table []object.SizeClass, next int) {
+		last := len(sizes) - 1
+		full := append(table, object.SizeClass{Size: toolbox.Bytes(sizes[last]), Pages: toolbox.Pages(pages[last])})
+		if w := d.waste(full); w < best {
+			best = w
+		}
+		if len(table)+1 == n {
+			return
+		}
+		for j := next; j < last; j++ {
+			try(append(table[:len(table):len(table)], object.SizeClass{Size: toolbox.Bytes(sizes[j]), Pages: toolbox.Pages(pages[j])}), j+1)
+		}
+	}
+	try(nil, 0)
+	return best
+}
+
+func TestOptimize(t *testing.T) {
+	dists := []struct {
+		name   string
+		counts map[uint64]uint64
+	}{
+		{"Single", map[uint64]uint64{100: 10}},
+		{"Small", map[uint64]uint64{8: 100, 24: 50, 40: 20, 100: 5}},
+		{"Spread", map[uint64]uint64{16: 1000, 300: 200, 2000: 30, 9000: 4, 30000: 1}},
+		{"Large", map[uint64]uint64{12: 7, 20000: 3, 32768: 2, 100000: 9}},
+	}
+	for _, test := range dists {
+		for n := 1; n <= 3; n++ {
+			d := newDist(test.counts)
+			classes, err := d.optimize(n, 1)
+			if err != nil {
+				t.Fatalf("%s with %d classes: %v", test.name, n, err)
+			}
+			if len(classes) > n {
+				t.Errorf("%s: expected at most %d classes, got %d", test.name, n, len(classes))
+			}
+			if last := classes[len(classes)-1].Size; last != maxSmallSize {
+				t.Errorf("%s: expected largest class of %d bytes, got %d", test.name, maxSmallSize, last)
+			}
+			if got, want := d.waste(classes), bruteForce(d, n); math.Abs(got-want) > 1e-6 {
+				t.Errorf("%s with %d classes: expected waste %.1f, got %.1f (%v)", test.name, n, want, got, classes)
+			}
+		}
+	}
+}
+
+func TestOptimizeLimit(t *testing.T) {
+	d := newDist(map[uint64]uint64{8: 100, 100: 50, 1000: 20, 10000: 2})
+	if _, err := d.optimize(1, 0.2); err == nil {
+		t.Errorf("expected a single class to exceed the waste limit")
+	}
+	const limit = 0.125
+	classes, err := d.optimize(100, limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sizes, _ := candidates()
+	prev := uint64(0)
+	for i, c := range classes {
+		size := uint64(c.Size)
+		// Classes that directly follow the previous candidate can't
+		// be made any smaller, so they're exempt from the limit.
+		exempt := (i == 0 && size == sizes[0])
+		for j := 1; j < len(sizes); j++ {
+			if sizes[j] == size && sizes[j-1] == prev {
+				exempt = true
+			}
+		}
+		if w := maxWaste(prev, size, uint64(c.Pages)); !exempt && w > limit {
+			t.Errorf("class %d (%d bytes) wastes up to %.3f of its span, more than %.3f", i, size, w, limit)
+		}
+		prev = size
+	}
+}
@@ -0,0 +1,173 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/mknyszek/goat"
+	"github.com/mknyszek/goat/cmd/internal/spinner"
+	"github.com/mknyszek/goat/simulation/toolbox"
+	"github.com/mknyszek/goat/simulation/toolbox/object"
+
+	"golang.org/x/exp/mmap"
+)
+
+var (
+	outputFile string
+	simName    string
+	numClasses int
+	wasteLimit float64
+)
+
+func init() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s:\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "Utility that generates a size class table tuned\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "for the allocation sizes in an allocation trace,\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "and a goat-sim spec file which simulates it.\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] <allocation-trace-file>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.StringVar(&outputFile, "o", "./sizeclasses.json", "location to write the goat-sim spec file")
+	flag.StringVar(&simName, "name", "go115-custom", "name of the simulation in the spec file")
+	flag.IntVar(&numClasses, "classes", len(object.Go115SizeClasses()), "maximum number of size classes, not counting large objects")
+	flag.Float64Var(&wasteLimit, "maxwaste", 0.2, "maximum fraction of a span a size class may waste")
+}
+
+func checkFlags() error {
+	if flag.NArg() != 1 {
+		return errors.New("incorrect number of arguments")
+	}
+	if numClasses < 1 || numClasses > 127 {
+		return errors.New("number of size classes must be between 1 and 127")
+	}
+	if wasteLimit <= 0 || wasteLimit > 1 {
+		return errors.New("maximum waste must be in (0, 1]")
+	}
+	return nil
+}
+
+func run() error {
+	r, err := mmap.Open(flag.Arg(0))
+	if err != nil {
+		return fmt.Errorf("failed to map trace: %v", err)
+	}
+	defer r.Close()
+	fmt.Println("Generating parser...")
+	p, err := goat.NewParser(r)
+	if err != nil {
+		return fmt.Errorf("creating parser: %v", err)
+	}
+
+	var pMu sync.Mutex
+	spinner.Start(func() float64 {
+		pMu.Lock()
+		prog := p.Progress()
+		pMu.Unlock()
+		return prog
+	}, spinner.Format("Processing... %.4f%%"))
+
+	counts := make(map[uint64]uint64)
+	for {
+		pMu.Lock()
+		ev, err := p.Next()
+		pMu.Unlock()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			spinner.Stop()
+			return fmt.Errorf("parsing events: %v", err)
+		}
+		if ev.Kind == goat.EventAlloc && ev.Size <= maxSmallSize {
+			counts[ev.Size]++
+		}
+	}
+	spinner.Stop()
+
+	d := newDist(counts)
+	classes, err := d.optimize(numClasses, wasteLimit)
+	if err != nil {
+		return err
+	}
+	printClasses(os.Stdout, classes)
+
+	go115 := d.waste(object.Go115SizeClasses())
+	custom := d.waste(classes)
+	fmt.Printf("\npredicted waste with Go 1.15 size classes: %.0f bytes\n", go115)
+	fmt.Printf("predicted waste with generated size classes: %.0f bytes", custom)
+	if go115 > 0 {
+		fmt.Printf(" (%+.2f%%)", (custom-go115)/go115*100)
+	}
+	fmt.Println()
+
+	return writeSpec(classes)
+}
+
+// printClasses prints a table of size classes in the same format
+// as the runtime's sizeclasses.go.
+func printClasses(w io.Writer, classes []object.SizeClass) {
+	fmt.Fprintf(w, "// class  bytes/obj  bytes/span  objects  tail waste  max waste\n")
+	prev := uint64(0)
+	for i, c := range classes {
+		size, pages := uint64(c.Size), uint64(c.Pages)
+		spanBytes := pages * pageSize
+		objects := spanBytes / size
+		tail := spanBytes - objects*size
+		fmt.Fprintf(w, "// %5d  %9d  %10d  %7d  %10d  %8.2f%%\n", i+1, size, spanBytes, objects, tail, 100*maxWaste(prev, size, pages))
+		prev = size
+	}
+}
+
+// writeSpec writes a goat-sim spec file which simulates the Go 1.15
+// runtime with the size classes classes.
+func writeSpec(classes []object.SizeClass) error {
+	raw, err := json.Marshal(classes)
+	if err != nil {
+		return err
+	}
+	spec := &toolbox.Spec{
+		Name:           simName,
+		AddressSpace:   toolbox.ComponentSpec{Name: "as48"},
+		PageAllocator:  toolbox.ComponentSpec{Name: "go114"},
+		StackAllocator: toolbox.ComponentSpec{Name: "go114"},
+		ObjectAllocator: toolbox.ComponentSpec{
+			Name:   "go115",
+			Params: toolbox.Params{"sizeClasses": raw},
+		},
+	}
+	out, err := os.Create(outputFile)
+	if err != nil {
+		return fmt.Errorf("creating spec file: %v", err)
+	}
+	defer out.Close()
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "\t")
+	if err := enc.Encode(spec); err != nil {
+		return fmt.Errorf("writing spec file: %v", err)
+	}
+	fmt.Printf("wrote %s\n", outputFile)
+	return nil
+}
+
+func main() {
+	flag.Parse()
+	if err := checkFlags(); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		flag.Usage()
+		os.Exit(1)
+	}
+	if err := run(); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/mknyszek/goat/cmd/internal/heapmap"
+	"github.com/mknyszek/goat/simulation/toolbox"
+)
+
+// readHeapMaps returns frames for the simulated heaps in heap map
+// files written by goat-sim, in order of GC cycle.
+func readHeapMaps(files []string) ([]*frame, error) {
+	var frames []*frame
+	var sim string
+	for i, file := range files {
+		m, err := readHeapMap(file)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			sim = m.Sim
+		} else if m.Sim != sim {
+			return nil, fmt.Errorf("heap maps are of different simulations %q and %q", sim, m.Sim)
+		}
+		if gcCycles != nil && !selected(m.GCCycles) {
+			continue
+		}
+		frames = append(frames, heapMapFrame(m))
+	}
+	sort.SliceStable(frames, func(i, j int) bool {
+		return frames[i].gc < frames[j].gc
+	})
+	return frames, nil
+}
+
+func readHeapMap(file string) (*heapmap.HeapMap, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	m, err := heapmap.Read(f)
+	if err != nil {
+		return nil, fmt.Errorf("reading heap map %s: %v", file, err)
+	}
+	return m, nil
+}
+
+// heapMapFrame returns the frame for a simulated heap.
+//
+// Allocated pages which aren't part of a span of the object allocator
+// hold stacks, since those are the only other things allocated from
+// the page allocator.
+func heapMapFrame(m *heapmap.HeapMap) *frame {
+	b := newFrameBuilder()
+	spans := m.Spans
+	for _, r := range m.Pages {
+		if r.Kind != toolbox.SpanAllocated.String() {
+			b.add(r.Base, r.Size, catFree)
+			continue
+		}
+		addr, end := r.Base, r.Base+r.Size
+		for len(spans) != 0 && spans[0].Base < end {
+			if spans[0].Base > addr {
+				b.add(addr, spans[0].Base-addr, catStack)
+			}
+			if e := spans[0].Base + spans[0].Size; e > addr {
+				addr = e
+			}
+			if addr > end {
+				break
+			}
+			spans = spans[1:]
+		}
+		if addr < end {
+			b.add(addr, end-addr, catStack)
+		}
+	}
+	for _, s := range m.Spans {
+		addSpan(b, &s)
+	}
+	return b.frame(m.GCCycles, false)
+}
+
+// addSpan adds a span of the object allocator to b.
+func addSpan(b *frameBuilder, s *heapmap.Span) {
+	switch {
+	case s.Kind == toolbox.SpanCached.String():
+		b.add(s.Base, s.Size, catFree)
+	case s.Kind == toolbox.SpanLarge.String():
+		c := catLive
+		if s.Objects == 0 {
+			c = catUnused
+		}
+		b.add(s.Base, s.ElemSize, c)
+		b.add(s.Base+s.ElemSize, s.Size-s.ElemSize, catUnused)
+	case len(s.Lines) != 0:
+		lineSize := s.Size / uint64(len(s.Lines))
+		for i := 0; i < len(s.Lines); i++ {
+			c := catFree
+			switch s.Lines[i] {
+			case heapmap.LineLive:
+				c = catLive
+			case heapmap.LineDead:
+				c = catUnused
+			}
+			b.add(s.Base+uint64(i)*lineSize, lineSize, c)
+		}
+	default:
+		slots := make([]category, s.Slots)
+		for i := range slots {
+			slots[i] = catLive
+		}
+		for _, i := range s.FreeSlots {
+			slots[i] = catFree
+		}
+		for _, i := range s.DeadSlots {
+			slots[i] = catUnused
+		}
+		for i, c := range slots {
+			b.add(s.Base+uint64(i)*s.ElemSize, s.ElemSize, c)
+		}
+		used := uint64(s.Slots) * s.ElemSize
+		b.add(s.Base+used, s.Size-used, catUnused)
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"image/color"
+)
+
+// category is what a byte of address space is used for.
+type category uint8
+
+const (
+	// catLive is memory holding live objects.
+	catLive category = iota
+
+	// catFree is heap memory which may be allocated into.
+	catFree
+
+	// catUnused is heap memory which is allocated but doesn't hold
+	// a live object, either because it holds a dead object which
+	// hasn't been swept yet, or because it was wasted rounding an
+	// object up to its slot.
+	catUnused
+
+	// catStack is memory holding goroutine stacks.
+	catStack
+
+	numCategories
+)
+
+func (c category) String() string {
+	switch c {
+	case catLive:
+		return "live"
+	case catFree:
+		return "free"
+	case catUnused:
+		return "unused"
+	case catStack:
+		return "stack"
+	}
+	panic("bad category")
+}
+
+var (
+	categoryColors = [numCategories]color.RGBA{
+		catLive:   {0x1f, 0x77, 0xb4, 0xff},
+		catFree:   {0xe0, 0xe0, 0xe0, 0xff},
+		catUnused: {0xff, 0x7f, 0x0e, 0xff},
+		catStack:  {0x2c, 0xa0, 0x2c, 0xff},
+	}
+
+	// backgroundColor is the color of address space which isn't
+	// part of the heap, and of the lines separating rows which
+	// aren't adjacent in the address space.
+	backgroundColor = color.RGBA{0xff, 0xff, 0xff, 0xff}
+)
+
+// frame is a rendered heap map for a single GC cycle.
+type frame struct {
+	gc uint64
+
+	// rows are the colors of each pixel of each row of the heap map
+	// which has something in it, indexed by the address of the start
+	// of the row divided by the size of a row.
+	rows map[uint64][]color.RGBA
+}
+
+// pixel is the number of bytes of each category in a pixel.
+type pixel [numCategories]uint64
+
+// frameBuilder accumulates the memory in a heap map to build a frame.
+type frameBuilder struct {
+	rows map[uint64][]pixel
+}
+
+func newFrameBuilder() *frameBuilder {
+	return &frameBuilder{rows: make(map[uint64][]pixel)}
+}
+
+// add records that size bytes of memory starting at addr are used
+// for c.
+func (b *frameBuilder) add(addr, size uint64, c category) {
+	end := addr + size
+	for addr < end {
+		px := addr / scale
+		n := (px+1)*scale - addr
+		if n > end-addr {
+			n = end - addr
+		}
+		row, ok := b.rows[px/width]
+		if !ok {
+			row = make([]pixel, width)
+			b.rows[px/width] = row
+		}
+		row[px%width][c] += n
+		addr += n
+	}
+}
+
+// frame returns the frame for the given GC cycle. If fillFree is true,
+// any memory which wasn't added in rows with something in them is
+// considered free, rather than not part of the heap.
+func (b *frameBuilder) frame(gc uint64, fillFree bool) *frame {
+	f := &frame{gc: gc, rows: make(map[uint64][]color.RGBA, len(b.rows))}
+	for i, row := range b.rows {
+		colors := make([]color.RGBA, len(row))
+		for j, px := range row {
+			if fillFree {
+				var total uint64
+				for _, n := range px {
+					total += n
+				}
+				// Overlapping memory may be added more than once,
+				// so the pixel may already be over-full.
+				if total < scale {
+					px[catFree] += scale - total
+				}
+			}
+			colors[j] = blend(px)
+		}
+		f.rows[i] = colors
+	}
+	return f
+}
+
+// blend returns the color of a pixel, which is the color of each
+// category weighted by how many bytes of the pixel it covers.
+func blend(px pixel) color.RGBA {
+	var r, g, b, total uint64
+	for c, n := range px {
+		col := categoryColors[c]
+		r += n * uint64(col.R)
+		g += n * uint64(col.G)
+		b += n * uint64(col.B)
+		total += n
+	}
+	if total < scale {
+		rest := scale - total
+		r += rest * uint64(backgroundColor.R)
+		g += rest * uint64(backgroundColor.G)
+		b += rest * uint64(backgroundColor.B)
+		total = scale
+	}
+	return color.RGBA{uint8(r / total), uint8(g / total), uint8(b / total), 0xff}
+}
@@ -0,0 +1,163 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	outputFile string
+	gcList     string
+	gcCycles   []uint64
+	width      uint64
+	scale      uint64
+	delay      time.Duration
+)
+
+func init() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s:\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "Utility that renders heap maps, either of the real heap\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "layout recorded in an allocation trace, or of simulated\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "heaps written by goat-sim -dump-at.\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] <allocation-trace-file | heap-map.json...>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.StringVar(&outputFile, "o", "./heap.png", "location to write the heap map; the extension selects the format, one of .png, .svg, or .gif for an animation")
+	flag.StringVar(&gcList, "gc", "", "comma-separated list of GC cycles to render; defaults to every cycle for .gif output, which are all held in memory, and the last otherwise")
+	flag.Uint64Var(&width, "width", 256, "number of pixels in each row of the heap map")
+	flag.Uint64Var(&scale, "scale", 1024, "number of bytes of address space in each pixel")
+	flag.DurationVar(&delay, "delay", 500*time.Millisecond, "time each GC cycle is shown for in .gif output")
+}
+
+// format returns the output format, given by the extension of the output file.
+func format() string {
+	return strings.TrimPrefix(filepath.Ext(outputFile), ".")
+}
+
+// dumpInput reports whether the inputs are heap maps rather than a trace.
+func dumpInput() bool {
+	return filepath.Ext(flag.Arg(0)) == ".json"
+}
+
+func checkFlags() error {
+	if flag.NArg() == 0 {
+		return errors.New("incorrect number of arguments")
+	}
+	for _, arg := range flag.Args() {
+		if (filepath.Ext(arg) == ".json") != dumpInput() {
+			return errors.New("expected either one allocation trace or any number of heap maps")
+		}
+	}
+	if !dumpInput() && flag.NArg() != 1 {
+		return errors.New("expected one allocation trace")
+	}
+	switch format() {
+	case "png", "svg", "gif":
+	default:
+		return fmt.Errorf("unsupported output format %q", filepath.Ext(outputFile))
+	}
+	if width == 0 {
+		return errors.New("width must be positive")
+	}
+	if scale == 0 {
+		return errors.New("scale must be positive")
+	}
+	if delay < 0 {
+		return errors.New("delay must not be negative")
+	}
+	if gcList != "" {
+		for _, s := range strings.Split(gcList, ",") {
+			c, err := strconv.ParseUint(s, 10, 64)
+			if err != nil {
+				return fmt.Errorf("parsing GC cycle %q: %v", s, err)
+			}
+			gcCycles = append(gcCycles, c)
+		}
+		sort.Slice(gcCycles, func(i, j int) bool {
+			return gcCycles[i] < gcCycles[j]
+		})
+	}
+	return nil
+}
+
+// selected reports whether the heap map for the given GC cycle should
+// be rendered, if the cycles to render were selected with -gc.
+func selected(cycle uint64) bool {
+	i := sort.Search(len(gcCycles), func(i int) bool {
+		return gcCycles[i] >= cycle
+	})
+	return i < len(gcCycles) && gcCycles[i] == cycle
+}
+
+func run() error {
+	var frames []*frame
+	var err error
+	if dumpInput() {
+		frames, err = readHeapMaps(flag.Args())
+	} else {
+		frames, err = readTrace(flag.Arg(0))
+	}
+	if err != nil {
+		return err
+	}
+	if len(frames) == 0 {
+		return errors.New("no heap maps to render")
+	}
+	if gcCycles == nil && format() != "gif" {
+		frames = frames[len(frames)-1:]
+	}
+
+	fmt.Println("Rendering heap map...")
+	switch format() {
+	case "gif":
+		return writeGIF(outputFile, frames)
+	case "png":
+		return writeFrames(frames, writePNG)
+	case "svg":
+		return writeFrames(frames, writeSVG)
+	}
+	panic("unreachable")
+}
+
+// writeFrames writes each frame with write, to the output file if
+// there's just one, and otherwise to a file per frame named after its
+// GC cycle.
+func writeFrames(frames []*frame, write func(string, *layout, *frame) error) error {
+	l := newLayout(frames)
+	for _, f := range frames {
+		file := outputFile
+		if len(frames) > 1 {
+			ext := filepath.Ext(outputFile)
+			file = fmt.Sprintf("%s-gc%d%s", strings.TrimSuffix(outputFile, ext), f.gc, ext)
+		}
+		if err := write(file, l, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func main() {
+	flag.Parse()
+	if err := checkFlags(); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		flag.Usage()
+		os.Exit(1)
+	}
+	if err := run(); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(2)
+	}
+}
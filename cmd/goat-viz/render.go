@@ -0,0 +1,196 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"os"
+	"sort"
+	"time"
+)
+
+// layout is the arrangement of rows of a heap map, shared by every
+// frame so that they line up in an animation.
+type layout struct {
+	lines []line
+}
+
+// line is a line of a heap map. It's either a row of pixels, or a gap
+// separating rows which aren't adjacent in the address space.
+type line struct {
+	row uint64
+	gap bool
+}
+
+// newLayout returns a layout with every row which has something in it
+// in any of the frames.
+func newLayout(frames []*frame) *layout {
+	seen := make(map[uint64]bool)
+	var rows []uint64
+	for _, f := range frames {
+		for row := range f.rows {
+			if !seen[row] {
+				seen[row] = true
+				rows = append(rows, row)
+			}
+		}
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		return rows[i] < rows[j]
+	})
+	l := new(layout)
+	for i, row := range rows {
+		if i > 0 && row != rows[i-1]+1 {
+			l.lines = append(l.lines, line{gap: true})
+		}
+		l.lines = append(l.lines, line{row: row})
+	}
+	return l
+}
+
+// addr returns the address of the start of a row.
+func (l *layout) addr(row uint64) uint64 {
+	return row * width * scale
+}
+
+// image returns the heap map of a frame as an image with a pixel for
+// each pixel of the map.
+func (l *layout) image(f *frame) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, int(width), len(l.lines)))
+	for y, ln := range l.lines {
+		for x := 0; x < int(width); x++ {
+			img.SetRGBA(x, y, l.color(f, ln, x))
+		}
+	}
+	return img
+}
+
+// color returns the color of pixel x of a line of a frame.
+func (l *layout) color(f *frame, ln line, x int) color.RGBA {
+	if row, ok := f.rows[ln.row]; ok && !ln.gap {
+		return row[x]
+	}
+	return backgroundColor
+}
+
+func writePNG(file string, l *layout, f *frame) error {
+	out, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(out, l.image(f)); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// writeGIF writes an animated heap map with a frame for each GC cycle.
+//
+// The frames share a layout, which isn't known until every frame is
+// built, and image/gif can only encode a whole animation at once, so
+// every frame is held in memory until the end. Each frame takes about
+// a byte per pixel of the heap map on top of the frame itself, so long
+// traces with large heaps may need -gc or a larger -scale to fit.
+func writeGIF(file string, frames []*frame) error {
+	l := newLayout(frames)
+	anim := new(gif.GIF)
+	for _, f := range frames {
+		img := l.image(f)
+		pimg := image.NewPaletted(img.Bounds(), palette.Plan9)
+		draw.Draw(pimg, img.Bounds(), img, image.Point{}, draw.Src)
+		anim.Image = append(anim.Image, pimg)
+		anim.Delay = append(anim.Delay, int(delay/(10*time.Millisecond)))
+	}
+	out, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	if err := gif.EncodeAll(out, anim); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+const (
+	// svgCell is the size of a pixel of a heap map in an SVG.
+	svgCell = 4
+
+	// svgLabelWidth and svgHeaderHeight are the space for address
+	// labels to the left of the heap map and for the title and
+	// legend above it.
+	svgLabelWidth   = 130
+	svgHeaderHeight = 40
+
+	// svgLabelEvery is the number of rows between address labels.
+	svgLabelEvery = 16
+)
+
+func svgColor(c color.RGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+// writeSVG writes the heap map of a frame as an SVG, with runs of
+// pixels of the same color drawn as a single rectangle, and address
+// labels for the rows.
+func writeSVG(file string, l *layout, f *frame) error {
+	out, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(out)
+	fmt.Fprintf(w, "<svg xmlns=\"http://www.w3.org/2000/svg\" width=\"%d\" height=\"%d\" font-family=\"monospace\" font-size=\"10\">\n",
+		svgLabelWidth+int(width)*svgCell, svgHeaderHeight+len(l.lines)*svgCell)
+	fmt.Fprintf(w, "<rect width=\"100%%\" height=\"100%%\" fill=\"%s\"/>\n", svgColor(backgroundColor))
+	fmt.Fprintf(w, "<text x=\"0\" y=\"12\">GC cycle %d, %d bytes per pixel</text>\n", f.gc, scale)
+	for c := category(0); c < numCategories; c++ {
+		x := svgLabelWidth + int(c)*80
+		fmt.Fprintf(w, "<rect x=\"%d\" y=\"20\" width=\"10\" height=\"10\" fill=\"%s\"/>\n", x, svgColor(categoryColors[c]))
+		fmt.Fprintf(w, "<text x=\"%d\" y=\"29\">%s</text>\n", x+14, c)
+	}
+
+	lastLabel := -svgLabelEvery * svgCell
+	labelRow := 0
+	for i, ln := range l.lines {
+		y := svgHeaderHeight + i*svgCell
+		if ln.gap {
+			labelRow = 0
+			continue
+		}
+		if labelRow%svgLabelEvery == 0 && y-lastLabel >= 12 {
+			fmt.Fprintf(w, "<text x=\"%d\" y=\"%d\" text-anchor=\"end\">%#x</text>\n",
+				svgLabelWidth-4, y+svgCell, l.addr(ln.row))
+			lastLabel = y
+		}
+		labelRow++
+
+		for x := 0; x < int(width); {
+			c := l.color(f, ln, x)
+			n := 1
+			for x+n < int(width) && l.color(f, ln, x+n) == c {
+				n++
+			}
+			if c != backgroundColor {
+				fmt.Fprintf(w, "<rect x=\"%d\" y=\"%d\" width=\"%d\" height=\"%d\" fill=\"%s\"/>\n",
+					svgLabelWidth+x*svgCell, y, n*svgCell, svgCell, svgColor(c))
+			}
+			x += n
+		}
+	}
+	fmt.Fprintf(w, "</svg>\n")
+	if err := w.Flush(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,147 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/mknyszek/goat"
+	"github.com/mknyszek/goat/cmd/internal/spinner"
+	"github.com/mknyszek/goat/simulation/toolbox/object"
+
+	"golang.org/x/exp/mmap"
+)
+
+// pageSize is the size of the runtime's pages, which large objects
+// are rounded up to.
+const pageSize = 8192
+
+// traceHeap is the real heap layout recorded in an allocation trace.
+type traceHeap struct {
+	// objects and stacks map the addresses of live objects and
+	// stacks to their sizes.
+	objects map[uint64]uint64
+	stacks  map[uint64]uint64
+
+	// classSizes are the sizes of the runtime's size classes, in
+	// increasing order.
+	classSizes []uint64
+}
+
+func newTraceHeap() *traceHeap {
+	h := &traceHeap{
+		objects: make(map[uint64]uint64),
+		stacks:  make(map[uint64]uint64),
+	}
+	for _, c := range object.Go115SizeClasses() {
+		h.classSizes = append(h.classSizes, uint64(c.Size))
+	}
+	return h
+}
+
+// slotSize returns the size of the memory the runtime allocates for
+// an object of the given size.
+func (h *traceHeap) slotSize(size uint64) uint64 {
+	i := sort.Search(len(h.classSizes), func(i int) bool {
+		return h.classSizes[i] >= size
+	})
+	if i < len(h.classSizes) {
+		return h.classSizes[i]
+	}
+	return (size + pageSize - 1) &^ (pageSize - 1)
+}
+
+// frame returns the frame for the heap in the given GC cycle. The
+// trace doesn't record which memory is part of the heap, so all
+// memory near objects and stacks is considered free.
+func (h *traceHeap) frame(gc uint64) *frame {
+	b := newFrameBuilder()
+	for addr, size := range h.objects {
+		b.add(addr, size, catLive)
+		b.add(addr+size, h.slotSize(size)-size, catUnused)
+	}
+	for addr, size := range h.stacks {
+		b.add(addr, size, catStack)
+	}
+	return b.frame(gc, true)
+}
+
+// wanted reports whether the heap should be rendered at the end of
+// the given GC cycle. eof indicates that it's the end of the trace.
+func wanted(cycle uint64, eof bool) bool {
+	if gcCycles != nil {
+		return selected(cycle)
+	}
+	return eof || format() == "gif"
+}
+
+// readTrace returns frames for the heap recorded in an allocation
+// trace, in order of GC cycle. The heap is rendered as it is at the
+// end of each cycle's sweep phase: just before the next cycle starts,
+// or at the end of the trace.
+func readTrace(file string) ([]*frame, error) {
+	r, err := mmap.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to map trace: %v", err)
+	}
+	defer r.Close()
+	fmt.Println("Generating parser...")
+	p, err := goat.NewParser(r)
+	if err != nil {
+		return nil, fmt.Errorf("creating parser: %v", err)
+	}
+
+	var pMu sync.Mutex
+	spinner.Start(func() float64 {
+		pMu.Lock()
+		prog := p.Progress()
+		pMu.Unlock()
+		return prog
+	}, spinner.Format("Processing... %.4f%%"))
+
+	h := newTraceHeap()
+	var frames []*frame
+	gcs := uint64(0)
+	for {
+		pMu.Lock()
+		ev, err := p.Next()
+		pMu.Unlock()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			spinner.Stop()
+			return nil, fmt.Errorf("parsing events: %v", err)
+		}
+
+		switch ev.Kind {
+		case goat.EventAlloc:
+			h.objects[ev.Address] = ev.Size
+		case goat.EventFree:
+			delete(h.objects, ev.Address)
+		case goat.EventStackAlloc:
+			h.stacks[ev.Address] = ev.Size
+		case goat.EventStackFree:
+			delete(h.stacks, ev.Address)
+		case goat.EventGCStart:
+			if wanted(gcs, false) {
+				frames = append(frames, h.frame(gcs))
+			}
+		case goat.EventGCEnd:
+			gcs++
+		}
+	}
+	spinner.Stop()
+
+	// If the trace ends during a GC cycle, the heap was already
+	// rendered when it started.
+	if wanted(gcs, true) && (len(frames) == 0 || frames[len(frames)-1].gc != gcs) {
+		frames = append(frames, h.frame(gcs))
+	}
+	return frames, nil
+}
@@ -0,0 +1,90 @@
+// Package heapmap defines the JSON format of the heap maps written by
+// goat-sim and read by goat-viz.
+package heapmap
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/mknyszek/goat/simulation/toolbox"
+)
+
+// HeapMap is a map of a simulated heap at a point in time.
+type HeapMap struct {
+	Sim       string
+	GCCycles  uint64
+	Timestamp uint64
+
+	// Spans are the spans of the object allocator, and Pages are
+	// the runs of pages of the page allocator. Either is empty if
+	// the allocator can't be inspected.
+	Spans []Span
+	Pages []Span
+}
+
+// Span is the JSON form of a toolbox.SpanInfo. Kind is the string
+// form of its toolbox.SpanKind, and Lines has a character for each
+// line, one of LineFree, LineLive, and LineDead.
+type Span struct {
+	Base      uint64
+	Size      uint64
+	Kind      string
+	Class     int    `json:",omitempty"`
+	ElemSize  uint64 `json:",omitempty"`
+	Slots     int    `json:",omitempty"`
+	FreeSlots []int  `json:",omitempty"`
+	DeadSlots []int  `json:",omitempty"`
+	Objects   int    `json:",omitempty"`
+	Lines     string `json:",omitempty"`
+	Cached    bool   `json:",omitempty"`
+	Released  bool   `json:",omitempty"`
+}
+
+// Characters for the state of each line in a Span's Lines.
+const (
+	LineFree = '.'
+	LineLive = 'L'
+	LineDead = 'D'
+)
+
+var lineChars = [...]byte{
+	toolbox.LineFree: LineFree,
+	toolbox.LineLive: LineLive,
+	toolbox.LineDead: LineDead,
+}
+
+// FromSpanInfo converts spans described by a toolbox.Inspector into
+// their JSON form.
+func FromSpanInfo(spans []toolbox.SpanInfo) []Span {
+	js := make([]Span, 0, len(spans))
+	for _, s := range spans {
+		var lines []byte
+		for _, l := range s.Lines {
+			lines = append(lines, lineChars[l])
+		}
+		js = append(js, Span{
+			Base:      uint64(s.Base),
+			Size:      uint64(s.Size),
+			Kind:      s.Kind.String(),
+			Class:     s.Class,
+			ElemSize:  uint64(s.ElemSize),
+			Slots:     s.Slots,
+			FreeSlots: s.FreeSlots,
+			DeadSlots: s.DeadSlots,
+			Objects:   s.Objects,
+			Lines:     string(lines),
+			Cached:    s.Cached,
+			Released:  s.Released,
+		})
+	}
+	return js
+}
+
+// Read decodes a heap map from r.
+func Read(r io.Reader) (*HeapMap, error) {
+	var m HeapMap
+	if err := json.NewDecoder(r).Decode(&m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
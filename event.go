@@ -47,6 +47,14 @@ type Event struct {
 	// during the trace.
 	PC uint64
 
+	// TinySize is the size of the allocation which triggered
+	// a tiny allocator block allocation. Such events always
+	// have a Size of 16, the size of the tiny block.
+	//
+	// This field is only non-zero if Kind == EventAlloc and the
+	// event is for a tiny block.
+	TinySize uint64
+
 	// Array indicates whether an allocation was for
 	// an array type.
 	Array bool
@@ -5,10 +5,11 @@
 package goat
 
 import (
+	"encoding/binary"
+	"encoding/gob"
 	"errors"
 	"fmt"
 	"io"
-	"math/bits"
 	"runtime"
 	"sort"
 	"sync"
@@ -25,6 +26,7 @@ type Parser struct {
 	index        [][]batchOffset
 	batches      []batchReader
 	totalBatches uint64
+	numP         int
 }
 
 // Source is an allocation trace source.
@@ -39,10 +41,7 @@ type Source interface {
 type batchOffset struct {
 	startTicks uint64
 	fileOffset int64
-}
-
-func (b batchOffset) headerSize() uint64 {
-	return 3 + uint64(bits.Len64(b.startTicks)+6)/7
+	headerSize int
 }
 
 const (
@@ -88,29 +87,41 @@ loop:
 	goto loop
 }
 
-func parseBatchHeader(buf []byte) (int32, uint64, error) {
+// maxPid is the maximum P ID (offset by one, so that 0 represents
+// no P) that the parser will accept in a batch header.
+const maxPid = 1 << 14
+
+// maxBatchHeaderSize is the maximum possible size of a well-formed
+// batch header: two event bytes and two maximally-sized varints.
+const maxBatchHeaderSize = 2 + 2*binary.MaxVarintLen64
+
+func parseBatchHeader(buf []byte) (int32, uint64, int, error) {
 	idx := 0
-	if buf[idx] != atEvBatchStart {
-		return 0, 0, fmt.Errorf("expected batch start event")
+	if idx >= len(buf) || buf[idx] != atEvBatchStart {
+		return 0, 0, 0, fmt.Errorf("expected batch start event")
 	}
 	idx++
 
 	n, pid, err := parseVarint(buf[idx:])
 	if err != nil {
-		return 0, 0, err
+		return 0, 0, 0, err
+	}
+	if pid >= maxPid {
+		return 0, 0, 0, fmt.Errorf("P ID %d out of range", pid)
 	}
 	idx += n
 
-	if buf[idx] != atEvSync {
-		return 0, 0, fmt.Errorf("expected sync event")
+	if idx >= len(buf) || buf[idx] != atEvSync {
+		return 0, 0, 0, fmt.Errorf("expected sync event")
 	}
 	idx++
 
-	_, ticks, err := parseVarint(buf[idx:])
+	n, ticks, err := parseVarint(buf[idx:])
 	if err != nil {
-		return 0, 0, err
+		return 0, 0, 0, err
 	}
-	return int32(pid), ticks, nil
+	idx += n
+	return int32(pid), ticks, idx, nil
 }
 
 const headerSize = 4
@@ -120,7 +131,10 @@ const supportedVersion uint16 = (uint16(1) << 8) | 15
 func parseHeader(r Source) (uint16, error) {
 	var header [headerSize]byte
 	n, err := r.ReadAt(header[:], 0)
-	if n != 4 || err != nil {
+	if n != headerSize {
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
 		return 0, err
 	}
 	version := uint16(header[2])<<8 | uint16(header[3])
@@ -164,8 +178,7 @@ func NewParser(r Source) (*Parser, error) {
 	for i := 0; i < shards; i++ {
 		i := i
 		eg.Go(func() error {
-			const bufSize = 16
-			var buf [bufSize]byte
+			var buf [maxBatchHeaderSize]byte
 
 			// Generate the index for this shard.
 			index := make([][]batchOffset, 16)
@@ -176,12 +189,15 @@ func NewParser(r Source) (*Parser, error) {
 			}
 			for idx := start*batchSize + headerSize; idx < end*batchSize+headerSize; idx += batchSize {
 				n, err := r.ReadAt(buf[:], idx)
-				if n < bufSize {
+				if n < len(buf) {
+					if err == nil {
+						err = io.ErrUnexpectedEOF
+					}
 					return err
 				}
-				pid, ticks, err := parseBatchHeader(buf[:])
+				pid, ticks, hdrSize, err := parseBatchHeader(buf[:])
 				if err != nil {
-					return err
+					return fmt.Errorf("batch at offset %d: %v", idx, err)
 				}
 				if int(pid) >= len(index) {
 					index = append(index, make([][]batchOffset, int(pid)-len(index)+1)...)
@@ -189,6 +205,7 @@ func NewParser(r Source) (*Parser, error) {
 				index[pid] = append(index[pid], batchOffset{
 					startTicks: ticks,
 					fileOffset: idx,
+					headerSize: hdrSize,
 				})
 			}
 			// For each P, sort the batches in the index.
@@ -241,7 +258,7 @@ func NewParser(r Source) (*Parser, error) {
 					minBatch := batchOffset{startTicks: ^uint64(0)}
 					minShard := -1
 					for i := 0; i < shards; i++ {
-						if pid < len(perShardIndex[i]) && len(perShardIndex[i][pid]) > 0 && perShardIndex[i][pid][0].startTicks < minBatch.startTicks {
+						if pid < len(perShardIndex[i]) && len(perShardIndex[i][pid]) > 0 && (minShard < 0 || perShardIndex[i][pid][0].startTicks < minBatch.startTicks) {
 							minBatch = perShardIndex[i][pid][0]
 							minShard = i
 						}
@@ -268,6 +285,12 @@ func NewParser(r Source) (*Parser, error) {
 		batches:      make([]batchReader, maxP),
 		totalBatches: uint64(r.Len()-headerSize) / batchSize,
 	}
+	for pid := range index {
+		if perPidBatches[pid] != 0 {
+			// pid 0 holds the events without a P.
+			p.numP = pid
+		}
+	}
 	for pid := range index {
 		if _, err := p.next(pid); err != nil {
 			return nil, fmt.Errorf("initializing parser: %v", err)
@@ -280,13 +303,23 @@ var doneEvent = Event{Timestamp: ^uint64(0)}
 var streamEnd = errors.New("stream end")
 
 type batchReader struct {
+	batch      batchOffset
 	next       Event
 	syncTick   uint64
-	allocBase  [^uint8(0)]uint64
+	allocBase  [1 << 8]uint64
 	freeBase   uint64
 	sweepStart uint64
 	readBuf    []byte
-	batchBuf   [batchSize]byte
+	batchBuf   []byte
+}
+
+// readByte reads a single byte at offset off in b.readBuf,
+// returning an error if the buffer isn't large enough.
+func (b *batchReader) readByte(off int) (uint8, error) {
+	if off >= len(b.readBuf) {
+		return 0, fmt.Errorf("unexpected end of batch")
+	}
+	return b.readBuf[off], nil
 }
 
 func (b *batchReader) nextEvent() error {
@@ -296,11 +329,17 @@ func (b *batchReader) nextEvent() error {
 	haveEvent := false
 	b.next = Event{}
 	for !haveEvent {
+		if len(b.readBuf) == 0 {
+			return fmt.Errorf("batch ended without batch end event")
+		}
 		size := 1
 		switch evKind := b.readBuf[0]; evKind {
 		case atEvSpanAcquire:
 			// Parse class.
-			class := b.readBuf[size]
+			class, err := b.readByte(size)
+			if err != nil {
+				return fmt.Errorf("parsing span class: %v", err)
+			}
 			size += 1
 
 			// Parse base address.
@@ -318,7 +357,13 @@ func (b *batchReader) nextEvent() error {
 			b.next.Kind = EventAlloc
 
 			// Parse class for alloc event.
-			class := b.readBuf[size]
+			class, err := b.readByte(size)
+			if err != nil {
+				return fmt.Errorf("parsing class for alloc: %v", err)
+			}
+			if int(class>>1) >= numSizeClasses {
+				return fmt.Errorf("invalid span class %d for alloc", class)
+			}
 			size += 1
 
 			// Parse offset for alloc event.
@@ -352,9 +397,15 @@ func (b *batchReader) nextEvent() error {
 			}
 			size += n
 
-			if class >= 2 && b.allocBase[class] == 0 {
+			if class < 2 {
+				return fmt.Errorf("small allocation from large span class %d", class)
+			}
+			if b.allocBase[class] == 0 {
 				return fmt.Errorf("allocation from unacquired span class %d", class)
 			}
+			if allocSizeDiff >= classToSize(class) {
+				return fmt.Errorf("bad size difference %d for span class %d", allocSizeDiff, class)
+			}
 			b.next.Timestamp = b.syncTick + tickDelta
 			b.next.Address = b.allocBase[class] + allocOffset
 			b.next.Size = classToSize(class) - allocSizeDiff
@@ -368,6 +419,7 @@ func (b *batchReader) nextEvent() error {
 				// not trigger a new allocation. So, treat this as a
 				// tiny allocator block (size == 16 and noscan). The
 				// address should be appropriately aligned.
+				b.next.TinySize = b.next.Size
 				b.next.Size = 16
 				b.next.Array = false
 			}
@@ -410,7 +462,10 @@ func (b *batchReader) nextEvent() error {
 			}
 		case atEvSpanRelease:
 			// Parse class.
-			class := b.readBuf[size]
+			class, err := b.readByte(size)
+			if err != nil {
+				return fmt.Errorf("parsing span class for release: %v", err)
+			}
 			size += 1
 
 			if b.allocBase[class] == 0 {
@@ -484,7 +539,13 @@ func (b *batchReader) nextEvent() error {
 			b.next.Kind = EventStackAlloc
 
 			// Parse stack order.
-			order := b.readBuf[size]
+			order, err := b.readByte(size)
+			if err != nil {
+				return fmt.Errorf("parsing stack order: %v", err)
+			}
+			if order >= 64 {
+				return fmt.Errorf("invalid stack order %d", order)
+			}
 			size += 1
 
 			// Parse stack base (stack.lo).
@@ -535,35 +596,47 @@ func (p *Parser) peek(pid int) uint64 {
 }
 
 func (p *Parser) refill(pid int) error {
-	// If we're out of batches, just mark
-	// this P as done.
-	if len(p.index[pid]) == 0 {
-		p.batches[pid].next = doneEvent
-		return nil
-	}
-	// Grab the next batch for this P.
-	bo := p.index[pid][0]
-	p.index[pid] = p.index[pid][1:]
-
-	// Read in the batch.
 	br := &p.batches[pid]
-	n, err := p.src.ReadAt(br.batchBuf[:], bo.fileOffset)
-	if n != len(br.batchBuf) {
-		return err
-	}
+	for {
+		// If we're out of batches, just mark
+		// this P as done.
+		if len(p.index[pid]) == 0 {
+			br.next = doneEvent
+			return nil
+		}
+		// Grab the next batch for this P.
+		bo := p.index[pid][0]
+		p.index[pid] = p.index[pid][1:]
 
-	// Skip the header.
-	br.readBuf = br.batchBuf[bo.headerSize():]
+		// Read in the batch.
+		if br.batchBuf == nil {
+			br.batchBuf = make([]byte, batchSize)
+		}
+		n, err := p.src.ReadAt(br.batchBuf, bo.fileOffset)
+		if n != len(br.batchBuf) {
+			if err == nil {
+				err = io.ErrUnexpectedEOF
+			}
+			return fmt.Errorf("refill: P %d: reading batch: %v", pid, err)
+		}
 
-	// Set the sync event tick for this batch,
-	// which was present in the header.
-	br.syncTick = bo.startTicks
+		// Skip the header.
+		br.batch = bo
+		br.readBuf = br.batchBuf[bo.headerSize:]
 
-	// Read the next event.
-	if err := br.nextEvent(); err != nil && err != streamEnd {
-		return fmt.Errorf("refill: P %d: %v", pid, err)
+		// Set the sync event tick for this batch,
+		// which was present in the header.
+		br.syncTick = bo.startTicks
+
+		// Read the next event. If the batch is empty, move
+		// on to the next one.
+		err = br.nextEvent()
+		if err == nil {
+			return nil
+		} else if err != streamEnd {
+			return fmt.Errorf("refill: P %d: %v", pid, err)
+		}
 	}
-	return nil
 }
 
 func (p *Parser) next(pid int) (Event, error) {
@@ -593,6 +666,12 @@ func (p *Parser) Progress() float64 {
 	return float64(p.totalBatches-left) / float64(p.totalBatches)
 }
 
+// NumP returns the number of Ps in the trace. Events have a P
+// of -1, for events without a P, up to NumP()-1.
+func (p *Parser) NumP() int {
+	return p.numP
+}
+
 // Next returns the next event in the trace, or an error
 // if the parser failed to parse the next event out of the trace.
 func (p *Parser) Next() (Event, error) {
@@ -614,3 +693,108 @@ func (p *Parser) Next() (Event, error) {
 	// Return the event, and compute the next.
 	return p.next(minPid)
 }
+
+// parserState is the saved state of a Parser.
+type parserState struct {
+	Len  int
+	NumP int
+	Ps   []batchReaderState
+}
+
+// batchReaderState is the saved state of a single P in a Parser.
+type batchReaderState struct {
+	// Remaining is the number of batches left in the index.
+	Remaining int
+
+	// HasBatch indicates whether a batch has been read in, and
+	// FileOffset, HeaderSize, and StartTicks describe it. Offset
+	// is the offset of the parser in the batch.
+	HasBatch   bool
+	FileOffset int64
+	HeaderSize int
+	StartTicks uint64
+	Offset     int
+
+	Next       Event
+	SyncTick   uint64
+	AllocBase  [1 << 8]uint64
+	FreeBase   uint64
+	SweepStart uint64
+}
+
+// SaveState encodes the position of the parser in the trace with enc,
+// so that it may be restored later with LoadState.
+func (p *Parser) SaveState(enc *gob.Encoder) error {
+	st := parserState{
+		Len:  p.src.Len(),
+		NumP: p.numP,
+		Ps:   make([]batchReaderState, len(p.batches)),
+	}
+	for pid := range p.batches {
+		br := &p.batches[pid]
+		st.Ps[pid] = batchReaderState{
+			Remaining:  len(p.index[pid]),
+			HasBatch:   br.batchBuf != nil,
+			FileOffset: br.batch.fileOffset,
+			HeaderSize: br.batch.headerSize,
+			StartTicks: br.batch.startTicks,
+			Offset:     len(br.batchBuf) - len(br.readBuf),
+			Next:       br.next,
+			SyncTick:   br.syncTick,
+			AllocBase:  br.allocBase,
+			FreeBase:   br.freeBase,
+			SweepStart: br.sweepStart,
+		}
+	}
+	return enc.Encode(&st)
+}
+
+// LoadState restores the position of the parser in the trace from
+// state written by SaveState. It must be called on a new Parser for
+// the same trace, before any calls to Next.
+func (p *Parser) LoadState(dec *gob.Decoder) error {
+	var st parserState
+	if err := dec.Decode(&st); err != nil {
+		return err
+	}
+	if st.Len != p.src.Len() || st.NumP != p.numP || len(st.Ps) != len(p.batches) {
+		return fmt.Errorf("parser state is for a different trace")
+	}
+	for pid := range p.batches {
+		ps := &st.Ps[pid]
+		if ps.Remaining > len(p.index[pid]) {
+			return fmt.Errorf("parser state is for a different trace")
+		}
+		p.index[pid] = p.index[pid][len(p.index[pid])-ps.Remaining:]
+
+		br := &p.batches[pid]
+		br.batch = batchOffset{
+			startTicks: ps.StartTicks,
+			fileOffset: ps.FileOffset,
+			headerSize: ps.HeaderSize,
+		}
+		br.readBuf = nil
+		if ps.HasBatch {
+			if br.batchBuf == nil {
+				br.batchBuf = make([]byte, batchSize)
+			}
+			n, err := p.src.ReadAt(br.batchBuf, ps.FileOffset)
+			if n != len(br.batchBuf) {
+				if err == nil {
+					err = io.ErrUnexpectedEOF
+				}
+				return fmt.Errorf("P %d: reading batch: %v", pid, err)
+			}
+			if ps.Offset < 0 || ps.Offset > len(br.batchBuf) {
+				return fmt.Errorf("P %d: bad batch offset %d", pid, ps.Offset)
+			}
+			br.readBuf = br.batchBuf[ps.Offset:]
+		}
+		br.next = ps.Next
+		br.syncTick = ps.SyncTick
+		br.allocBase = ps.AllocBase
+		br.freeBase = ps.FreeBase
+		br.sweepStart = ps.SweepStart
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package goat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+func appendVarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	return append(buf, tmp[:n]...)
+}
+
+// batchBody returns the encoded events for a well-formed batch
+// exercising most event kinds, not including the batch header.
+func batchBody() []byte {
+	var b []byte
+	// Acquire a span for span class 4 (size class 2, scan).
+	b = append(b, atEvSpanAcquire, 4)
+	b = appendVarint(b, 0xc000002000)
+	b = append(b, atEvAlloc, 4)
+	b = appendVarint(b, 0)  // offset
+	b = appendVarint(b, 0)  // size diff
+	b = appendVarint(b, 10) // tick delta
+	b = append(b, atEvAllocArrayPC, 4)
+	b = appendVarint(b, 16)       // offset
+	b = appendVarint(b, 4)        // size diff
+	b = appendVarint(b, 0x401000) // pc
+	b = appendVarint(b, 12)       // tick delta
+	b = append(b, atEvAllocLargeNoscan)
+	b = appendVarint(b, 0xc000100000) // address
+	b = appendVarint(b, 40000)        // size
+	b = appendVarint(b, 15)           // tick delta
+	b = append(b, atEvStackAlloc, 13)
+	b = appendVarint(b, 0xc000200000) // stack.lo
+	b = appendVarint(b, 16)           // tick delta
+	b = append(b, atEvSweepTerm)
+	b = appendVarint(b, 20)
+	b = append(b, atEvMarkTerm)
+	b = appendVarint(b, 30)
+	b = append(b, atEvSweep)
+	b = appendVarint(b, 31) // tick delta
+	b = appendVarint(b, 0xc000002000)
+	b = append(b, atEvFree)
+	b = appendVarint(b, 16)
+	b = append(b, atEvStackFree)
+	b = appendVarint(b, 0xc000200000)
+	b = appendVarint(b, 40)
+	b = append(b, atEvSpanRelease, 4)
+	b = append(b, atEvSync)
+	b = appendVarint(b, 1000)
+	b = append(b, atEvBatchEnd)
+	return b
+}
+
+// makeTrace lays out each body as its own batch in a trace, with
+// the given P IDs and starting ticks.
+func makeTrace(bodies [][]byte, pids []uint64, ticks []uint64) []byte {
+	trace := []byte{0, 0, byte(supportedVersion >> 8), byte(supportedVersion & 0xff)}
+	for i, body := range bodies {
+		var batch []byte
+		batch = append(batch, atEvBatchStart)
+		batch = appendVarint(batch, pids[i])
+		batch = append(batch, atEvSync)
+		batch = appendVarint(batch, ticks[i])
+		batch = append(batch, body...)
+		if len(batch) > batchSize {
+			batch = batch[:batchSize]
+		}
+		trace = append(trace, batch...)
+		trace = append(trace, make([]byte, batchSize-len(batch))...)
+	}
+	return trace
+}
+
+// parseAll parses every event out of the trace, stopping at the
+// first error. It must never panic.
+func parseAll(t *testing.T, trace []byte) ([]Event, error) {
+	p, err := NewParser(bytes.NewReader(trace))
+	if err != nil {
+		return nil, err
+	}
+	var evs []Event
+	for {
+		ev, err := p.Next()
+		if err == io.EOF {
+			return evs, nil
+		}
+		if err != nil {
+			return evs, err
+		}
+		if prog := p.Progress(); prog < 0 || prog > 1 {
+			t.Fatalf("progress out of range: %f", prog)
+		}
+		evs = append(evs, ev)
+	}
+}
+
+func TestParseWellFormed(t *testing.T) {
+	trace := makeTrace(
+		[][]byte{batchBody(), batchBody(), {atEvBatchEnd}},
+		[]uint64{1, 2, 200},
+		[]uint64{100, 50, 10},
+	)
+	evs, err := parseAll(t, trace)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(evs) != 16 {
+		t.Fatalf("expected 16 events, got %d", len(evs))
+	}
+	for i := 1; i < len(evs); i++ {
+		if evs[i].Timestamp < evs[i-1].Timestamp {
+			t.Errorf("events out of order: %d then %d", evs[i-1].Timestamp, evs[i].Timestamp)
+		}
+	}
+}
+
+func FuzzParser(f *testing.F) {
+	f.Add(makeTrace([][]byte{batchBody()}, []uint64{1}, []uint64{100}))
+	f.Add(makeTrace([][]byte{batchBody(), batchBody()}, []uint64{0, 300}, []uint64{100, 20}))
+	f.Add([]byte{})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		// Most random inputs are rejected for being the wrong size, so
+		// also try padding the input out into whole batches.
+		parseAll(t, data)
+		if len(data) > headerSize {
+			n := (len(data) - headerSize + batchSize - 1) / batchSize
+			padded := make([]byte, headerSize+n*batchSize)
+			copy(padded, data)
+			parseAll(t, padded)
+		}
+	})
+}
+
+func FuzzNextEvent(f *testing.F) {
+	f.Add(batchBody())
+	f.Add([]byte{atEvSpanAcquire, 0xff, 0x80})
+	f.Add([]byte{atEvAlloc, 0xff, 0, 0, 0})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var br batchReader
+		br.readBuf = data
+		// Each event consumes at least one byte, so this always terminates.
+		for i := 0; i <= len(data); i++ {
+			if err := br.nextEvent(); err != nil {
+				return
+			}
+		}
+		t.Fatalf("parsed more events than there are bytes")
+	})
+}
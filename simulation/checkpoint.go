@@ -0,0 +1,141 @@
+package simulation
+
+import (
+	"encoding/gob"
+	"fmt"
+)
+
+// Checkpointer is an optional interface for a Simulator, or a part of
+// one, whose state may be saved part way through a trace and restored
+// later to resume the simulation from the same point.
+//
+// A Checkpointer saves only the state it owns. The state of anything
+// it's built on top of and shares with others, like a page allocator
+// shared by an object and a stack allocator, is saved by whatever
+// owns that.
+type Checkpointer interface {
+	// SaveState encodes the complete state of the simulation
+	// with enc.
+	SaveState(enc *gob.Encoder) error
+
+	// LoadState decodes state written by SaveState from dec. It
+	// must be called before any events are processed, on a simulation
+	// constructed with the same configuration as the saved one, whose
+	// statistics have been registered. The statistics themselves are
+	// restored by (*Stats).LoadState.
+	LoadState(dec *gob.Decoder) error
+}
+
+// SaveState saves the state of sim with enc, and fails if sim
+// doesn't implement Checkpointer.
+func SaveState(enc *gob.Encoder, sim interface{}) error {
+	c, ok := sim.(Checkpointer)
+	if !ok {
+		return fmt.Errorf("%T does not support checkpointing", sim)
+	}
+	return c.SaveState(enc)
+}
+
+// LoadState restores the state of sim from dec, and fails if sim
+// doesn't implement Checkpointer.
+func LoadState(dec *gob.Decoder, sim interface{}) error {
+	c, ok := sim.(Checkpointer)
+	if !ok {
+		return fmt.Errorf("%T does not support checkpointing", sim)
+	}
+	return c.LoadState(dec)
+}
+
+// statState is the saved state of an implementation-specific statistic.
+type statState struct {
+	Name   string
+	Kind   StatKind
+	Value  uint64
+	Counts []uint64
+	Sum    uint64
+}
+
+// statsState is the saved state of a Stats. Standard only carries
+// the exported fields of a Stats.
+type statsState struct {
+	Standard Stats
+	Other    []statState
+	PerP     map[int32]PStats
+	NoP      PStats
+}
+
+// SaveState encodes the values of all the statistics in s with enc.
+func (s *Stats) SaveState(enc *gob.Encoder) error {
+	st := statsState{
+		Standard: Stats{
+			Timestamp:     s.Timestamp,
+			GCCycles:      s.GCCycles,
+			Allocs:        s.Allocs,
+			Frees:         s.Frees,
+			ObjectBytes:   s.ObjectBytes,
+			StackBytes:    s.StackBytes,
+			UnusedBytes:   s.UnusedBytes,
+			FreeBytes:     s.FreeBytes,
+			ReleasedBytes: s.ReleasedBytes,
+			RSSBytes:      s.RSSBytes,
+		},
+		PerP: make(map[int32]PStats),
+		NoP:  s.noP,
+	}
+	for _, stat := range s.OtherStats() {
+		st.Other = append(st.Other, statState{
+			Name:   stat.desc.Name,
+			Kind:   stat.desc.Kind,
+			Value:  stat.value,
+			Counts: stat.counts,
+			Sum:    stat.sum,
+		})
+	}
+	for p, ps := range s.perP {
+		st.PerP[p] = *ps
+	}
+	return enc.Encode(&st)
+}
+
+// LoadState restores the values of the statistics in s from state
+// written by SaveState. Implementation-specific statistics must
+// already be registered, and are updated in place, so handles to
+// them remain valid.
+func (s *Stats) LoadState(dec *gob.Decoder) error {
+	var st statsState
+	if err := dec.Decode(&st); err != nil {
+		return err
+	}
+	if len(st.Other) != len(s.other) {
+		return fmt.Errorf("checkpoint has %d implementation-specific statistics, but %d are registered", len(st.Other), len(s.other))
+	}
+	for _, o := range st.Other {
+		stat, ok := s.other[o.Name]
+		if !ok {
+			return fmt.Errorf("statistic %s in checkpoint is not registered", o.Name)
+		}
+		if stat.desc.Kind != o.Kind || len(stat.counts) != len(o.Counts) {
+			return fmt.Errorf("statistic %s in checkpoint has a different kind or buckets", o.Name)
+		}
+		stat.value = o.Value
+		copy(stat.counts, o.Counts)
+		stat.sum = o.Sum
+	}
+	s.Timestamp = st.Standard.Timestamp
+	s.GCCycles = st.Standard.GCCycles
+	s.Allocs = st.Standard.Allocs
+	s.Frees = st.Standard.Frees
+	s.ObjectBytes = st.Standard.ObjectBytes
+	s.StackBytes = st.Standard.StackBytes
+	s.UnusedBytes = st.Standard.UnusedBytes
+	s.FreeBytes = st.Standard.FreeBytes
+	s.ReleasedBytes = st.Standard.ReleasedBytes
+	s.RSSBytes = st.Standard.RSSBytes
+	s.perP = make(map[int32]*PStats)
+	for p, ps := range st.PerP {
+		ps := ps
+		s.perP[p] = &ps
+	}
+	s.noP = st.NoP
+	return nil
+}
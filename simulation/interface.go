@@ -43,10 +43,44 @@ type Stats struct {
 	// be used to do so in the future.
 	FreeBytes uint64
 
+	// ReleasedBytes is the amount of free memory in bytes
+	// which has been returned to the OS, and is therefore
+	// not resident. It is a subset of FreeBytes.
+	ReleasedBytes uint64
+
+	// RSSBytes is the amount of mapped memory in bytes
+	// which is resident, that is, all mapped memory less
+	// ReleasedBytes.
+	RSSBytes uint64
+
 	// other represents statistics which are unique to the
 	// implementation, usually representing a breakdown of
 	// other statistics, or something else entirely.
-	other map[string]uint64
+	other map[string]*Stat
+
+	// perP are the statistics for each P, and noP absorbs
+	// statistics for operations without a P.
+	perP map[int32]*PStats
+	noP  PStats
+}
+
+// PStats are statistics for a single P.
+type PStats struct {
+	// Allocs is the number of allocations performed on
+	// the P.
+	Allocs uint64
+
+	// Frees is the number of frees performed on the P.
+	Frees uint64
+
+	// CachedBytes is the amount of free memory in bytes
+	// held in the P's local caches, which only the P may
+	// allocate from.
+	CachedBytes uint64
+
+	// Refills is the number of times the P's local caches
+	// were refilled.
+	Refills uint64
 }
 
 // NewStats creates a new valid Stats object.
@@ -55,54 +89,78 @@ type Stats struct {
 // since there are unexported fields which may need to be initialized.
 func NewStats() *Stats {
 	return &Stats{
-		other: make(map[string]uint64),
+		other: make(map[string]*Stat),
+		perP:  make(map[int32]*PStats),
+	}
+}
+
+// PerP returns the statistics for P p. Operations without a P,
+// with a negative p, aren't counted.
+func (s *Stats) PerP(p int32) *PStats {
+	if p < 0 {
+		return &s.noP
+	}
+	ps, ok := s.perP[p]
+	if !ok {
+		ps = new(PStats)
+		s.perP[p] = ps
 	}
+	return ps
 }
 
-// OtherStats returns a list of registered implementation-specific statistics.
-func (s *Stats) OtherStats() []string {
-	names := make([]string, 0, len(s.other))
-	for name := range s.other {
-		names = append(names, name)
+// OtherStats returns the registered implementation-specific statistics,
+// sorted by name.
+func (s *Stats) OtherStats() []*Stat {
+	stats := make([]*Stat, 0, len(s.other))
+	for _, stat := range s.other {
+		stats = append(stats, stat)
 	}
-	sort.Strings(names)
-	return names
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].desc.Name < stats[j].desc.Name
+	})
+	return stats
+}
+
+// LookupOther returns the implementation-specific statistic with
+// the given name, or nil if it's not registered.
+func (s *Stats) LookupOther(name string) *Stat {
+	return s.other[name]
 }
 
 // GetOther returns the value for a implementation-specific statistic
 // by name. Returns 0 if the statistic is not registered.
 func (s *Stats) GetOther(name string) uint64 {
-	return s.other[name]
+	if stat, ok := s.other[name]; ok {
+		return stat.value
+	}
+	return 0
 }
 
-// RegisterOther registers a new implementation-specific statistic.
+// RegisterOther registers a new implementation-specific statistic,
+// and returns a handle for updating it. Panics if the description
+// is invalid.
 //
 // This operation is idempotent and safe to perform again, even after
-// a statistic has been modified.
-func (s *Stats) RegisterOther(name string) {
-	if _, ok := s.other[name]; !ok {
-		s.other[name] = 0
+// a statistic has been modified, in which case it returns the existing
+// handle. Panics if the statistic was previously registered with a
+// different kind or unit.
+func (s *Stats) RegisterOther(desc StatDesc) *Stat {
+	if err := desc.check(); err != nil {
+		panic(err.Error())
 	}
-}
-
-// AddOther adds an amount to the value to a implementation-specific statistic.
-// Panics if the statistic has not been registered.
-func (s *Stats) AddOther(name string, amount uint64) {
-	if val, ok := s.other[name]; ok {
-		s.other[name] = val + amount
-	} else {
-		panic("attempted to add to non-existing stat")
+	if stat, ok := s.other[desc.Name]; ok {
+		if stat.desc.Kind != desc.Kind || stat.desc.Unit != desc.Unit {
+			panic("statistic " + desc.Name + " registered again with a different kind or unit")
+		}
+		return stat
 	}
-}
-
-// SubOther subtracts an amount from the value of a implementation-specific
-// statistic. Panics if the statistic has not been registered.
-func (s *Stats) SubOther(name string, amount uint64) {
-	if val, ok := s.other[name]; ok {
-		s.other[name] = val - amount
-	} else {
-		panic("attempted to subtract from non-existing stat")
+	stat := &Stat{desc: desc}
+	if desc.Kind == Histogram {
+		stat.desc.Buckets = append([]uint64(nil), desc.Buckets...)
+		stat.counts = make([]uint64, len(desc.Buckets)+1)
 	}
+	s.other[desc.Name] = stat
+	return stat
 }
 
 // Simulator describes a heap allocation simulator for Go.
@@ -115,3 +173,21 @@ type Simulator interface {
 	// into the simulator.
 	Process(goat.Event, *Stats)
 }
+
+// Failer is an optional interface for a Simulator which may stop part
+// way through a trace because it can't go on, for example because it
+// ran out of simulated address space.
+type Failer interface {
+	// Err returns the reason the simulation stopped, or nil if it
+	// hasn't. Once stopped, a Simulator ignores any further events.
+	Err() error
+}
+
+// Err returns the reason sim stopped, or nil if it hasn't stopped or
+// doesn't implement Failer.
+func Err(sim Simulator) error {
+	if f, ok := sim.(Failer); ok {
+		return f.Err()
+	}
+	return nil
+}
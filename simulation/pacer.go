@@ -0,0 +1,325 @@
+package simulation
+
+import (
+	"encoding/gob"
+	"fmt"
+	"math"
+
+	"github.com/mknyszek/goat"
+)
+
+const (
+	// pacerMinHeap is the minimum heap goal at GOGC=100, mirroring
+	// the Go runtime.
+	pacerMinHeap = 4 << 20
+
+	// pacerMinHeadroom is the minimum amount of allocation between
+	// two GC cycles, so that an unachievable memory limit doesn't
+	// result in a GC cycle on every allocation.
+	pacerMinHeadroom = 1 << 20
+)
+
+var (
+	pacerHeapGoalStat = StatDesc{
+		Name:        "PacerHeapGoalBytes",
+		Unit:        UnitBytes,
+		Description: "heap size at which the next GC cycle starts",
+	}
+	pacerHeapMarkedStat = StatDesc{
+		Name:        "PacerHeapMarkedBytes",
+		Unit:        UnitBytes,
+		Description: "heap size at the end of the last GC cycle",
+	}
+	pacerPendingFreeStat = StatDesc{
+		Name:        "PacerPendingFreeBytes",
+		Unit:        UnitBytes,
+		Description: "memory of objects freed in the trace but not yet by a simulated GC cycle",
+	}
+	pacerRecordedCyclesStat = StatDesc{
+		Name:        "PacerRecordedGCCycles",
+		Kind:        Counter,
+		Description: "GC cycles recorded in the trace",
+	}
+)
+
+// pacerStats are handles to the pacer's statistics.
+type pacerStats struct {
+	heapGoal       *Stat
+	heapMarked     *Stat
+	pendingFree    *Stat
+	recordedCycles *Stat
+}
+
+type pacerObject struct {
+	id   uint64
+	size uint64
+}
+
+// Pacer is a Simulator which decides for itself when GC cycles happen,
+// rather than following the GC cycles recorded in the trace.
+//
+// Pacer wraps another Simulator, and feeds it a rewritten event stream.
+// A new GC cycle is started once the simulated heap reaches a goal derived
+// from GOGC and an optional memory limit, and is assumed to complete
+// instantaneously. The recorded GC start and end events are dropped.
+//
+// Object deaths are still derived from the trace: an object dies at the
+// first simulated GC cycle after the recorded GC cycle that found it dead.
+// The runtime sweeps lazily, so the trace may only report an object's
+// death after that simulated GC cycle has already happened, in which case
+// the object is freed immediately.
+// Because this may happen after the runtime reused the object's address,
+// Pacer gives each object a unique ID and uses it as the address in the
+// events it passes along to the wrapped Simulator.
+type Pacer struct {
+	sim         Simulator
+	gcPercent   int
+	memoryLimit uint64
+
+	nextID      uint64
+	objects     map[uint64]pacerObject
+	stacks      map[uint64]uint64
+	pending     []pacerObject
+	pendingSize uint64
+
+	// simCycles is the number of simulated GC cycles, and
+	// recordedSimCycles is its value when the last recorded GC
+	// cycle ended.
+	simCycles         uint64
+	recordedSimCycles uint64
+
+	heapLive   uint64
+	heapMarked uint64
+	heapGoal   uint64
+	stackBytes uint64
+	stats      pacerStats
+}
+
+// PacerOption is a configuration option for a Pacer.
+type PacerOption func(p *Pacer)
+
+// PacerGOGC returns a configuration option that sets the GOGC value
+// used to compute the heap goal. A negative value turns off GOGC-based
+// pacing, leaving only the memory limit, if any.
+//
+// The default is 100.
+func PacerGOGC(gcPercent int) PacerOption {
+	return func(p *Pacer) {
+		p.gcPercent = gcPercent
+	}
+}
+
+// PacerMemoryLimit returns a configuration option that sets a soft limit
+// on the total size of the heap and goroutine stacks. Zero means no limit,
+// which is the default.
+func PacerMemoryLimit(limit uint64) PacerOption {
+	return func(p *Pacer) {
+		p.memoryLimit = limit
+	}
+}
+
+// NewPacer creates a new Pacer which drives sim.
+func NewPacer(sim Simulator, options ...PacerOption) *Pacer {
+	p := &Pacer{
+		sim:       sim,
+		gcPercent: 100,
+		nextID:    1,
+		objects:   make(map[uint64]pacerObject),
+		stacks:    make(map[uint64]uint64),
+	}
+	for _, opt := range options {
+		opt(p)
+	}
+	p.heapGoal = p.goal()
+	return p
+}
+
+// goal computes the heap goal from the current marked heap.
+func (p *Pacer) goal() uint64 {
+	goal := uint64(math.MaxUint64)
+	if p.gcPercent >= 0 {
+		goal = p.heapMarked + (p.heapMarked+p.stackBytes)*uint64(p.gcPercent)/100
+		if min := uint64(pacerMinHeap) * uint64(p.gcPercent) / 100; goal < min {
+			goal = min
+		}
+	}
+	if p.memoryLimit != 0 {
+		limitGoal := uint64(0)
+		if p.memoryLimit > p.stackBytes {
+			limitGoal = p.memoryLimit - p.stackBytes
+		}
+		if limitGoal < goal {
+			goal = limitGoal
+		}
+	}
+	if goal < p.heapMarked+pacerMinHeadroom {
+		goal = p.heapMarked + pacerMinHeadroom
+	}
+	return goal
+}
+
+// RegisterStats registers the pacer's statistics as well as those
+// of the wrapped Simulator.
+func (p *Pacer) RegisterStats(stats *Stats) {
+	p.sim.RegisterStats(stats)
+	p.stats.heapGoal = stats.RegisterOther(pacerHeapGoalStat)
+	p.stats.heapMarked = stats.RegisterOther(pacerHeapMarkedStat)
+	p.stats.pendingFree = stats.RegisterOther(pacerPendingFreeStat)
+	p.stats.recordedCycles = stats.RegisterOther(pacerRecordedCyclesStat)
+	p.stats.heapGoal.Set(p.heapGoal)
+}
+
+// Process implements the Simulator interface.
+func (p *Pacer) Process(ev goat.Event, stats *Stats) {
+	switch ev.Kind {
+	case goat.EventAlloc:
+		obj := pacerObject{id: p.nextID, size: ev.Size}
+		p.nextID++
+		p.objects[ev.Address] = obj
+		p.heapLive += ev.Size
+		ev.Address = obj.id
+		p.sim.Process(ev, stats)
+		if p.heapLive >= p.heapGoal {
+			p.gc(ev, stats)
+		}
+	case goat.EventFree:
+		obj, ok := p.objects[ev.Address]
+		if !ok {
+			return
+		}
+		delete(p.objects, ev.Address)
+
+		// Frees are only ever reported by sweeping, which always
+		// belongs to the last recorded GC cycle, since every span is
+		// swept before the next one starts.
+		if p.simCycles > p.recordedSimCycles {
+			// A simulated GC cycle already happened after the
+			// recorded one that found the object dead.
+			p.sim.Process(goat.Event{Timestamp: ev.Timestamp, Address: obj.id, P: ev.P, Kind: goat.EventFree}, stats)
+			p.heapLive -= obj.size
+			return
+		}
+		p.pending = append(p.pending, obj)
+		p.pendingSize += obj.size
+		p.stats.pendingFree.Add(obj.size)
+	case goat.EventStackAlloc:
+		p.stacks[ev.Address] = ev.Size
+		p.stackBytes += ev.Size
+		p.sim.Process(ev, stats)
+	case goat.EventStackFree:
+		p.stackBytes -= p.stacks[ev.Address]
+		delete(p.stacks, ev.Address)
+		p.sim.Process(ev, stats)
+	case goat.EventGCEnd:
+		p.recordedSimCycles = p.simCycles
+		p.stats.recordedCycles.Add(1)
+	}
+}
+
+// Err implements Failer, and returns the error of the wrapped
+// Simulator, if any.
+func (p *Pacer) Err() error {
+	return Err(p.sim)
+}
+
+// gc simulates a complete GC cycle triggered by the event ev.
+func (p *Pacer) gc(ev goat.Event, stats *Stats) {
+	p.sim.Process(goat.Event{Timestamp: ev.Timestamp, P: ev.P, Kind: goat.EventGCStart}, stats)
+	p.sim.Process(goat.Event{Timestamp: ev.Timestamp, P: ev.P, Kind: goat.EventGCEnd}, stats)
+	p.simCycles++
+	for _, obj := range p.pending {
+		p.sim.Process(goat.Event{Timestamp: ev.Timestamp, Address: obj.id, P: ev.P, Kind: goat.EventFree}, stats)
+		p.heapLive -= obj.size
+	}
+	p.stats.pendingFree.Sub(p.pendingSize)
+	p.pending = p.pending[:0]
+	p.pendingSize = 0
+
+	p.heapMarked = p.heapLive
+	p.heapGoal = p.goal()
+	p.stats.heapMarked.Set(p.heapMarked)
+	p.stats.heapGoal.Set(p.heapGoal)
+}
+
+// pacerState is the saved state of a Pacer.
+type pacerState struct {
+	NextID      uint64
+	Objects     map[uint64]pacerObjectState
+	Stacks      map[uint64]uint64
+	Pending     []pacerObjectState
+	PendingSize uint64
+	HeapLive    uint64
+	HeapMarked  uint64
+	HeapGoal    uint64
+	StackBytes  uint64
+
+	SimCycles         uint64
+	RecordedSimCycles uint64
+}
+
+type pacerObjectState struct {
+	ID, Size uint64
+}
+
+// SaveState implements Checkpointer. It also saves the state of the
+// wrapped Simulator, which must implement Checkpointer.
+func (p *Pacer) SaveState(enc *gob.Encoder) error {
+	st := pacerState{
+		NextID:      p.nextID,
+		Objects:     make(map[uint64]pacerObjectState, len(p.objects)),
+		Stacks:      p.stacks,
+		PendingSize: p.pendingSize,
+		HeapLive:    p.heapLive,
+		HeapMarked:  p.heapMarked,
+		HeapGoal:    p.heapGoal,
+		StackBytes:  p.stackBytes,
+
+		SimCycles:         p.simCycles,
+		RecordedSimCycles: p.recordedSimCycles,
+	}
+	for addr, obj := range p.objects {
+		st.Objects[addr] = pacerObjectState{obj.id, obj.size}
+	}
+	for _, obj := range p.pending {
+		st.Pending = append(st.Pending, pacerObjectState{obj.id, obj.size})
+	}
+	if err := enc.Encode(&st); err != nil {
+		return err
+	}
+	if err := SaveState(enc, p.sim); err != nil {
+		return fmt.Errorf("pacer: %v", err)
+	}
+	return nil
+}
+
+// LoadState implements Checkpointer.
+func (p *Pacer) LoadState(dec *gob.Decoder) error {
+	var st pacerState
+	if err := dec.Decode(&st); err != nil {
+		return err
+	}
+	p.nextID = st.NextID
+	p.objects = make(map[uint64]pacerObject, len(st.Objects))
+	for addr, obj := range st.Objects {
+		p.objects[addr] = pacerObject{obj.ID, obj.Size}
+	}
+	p.stacks = st.Stacks
+	if p.stacks == nil {
+		p.stacks = make(map[uint64]uint64)
+	}
+	p.pending = p.pending[:0]
+	for _, obj := range st.Pending {
+		p.pending = append(p.pending, pacerObject{obj.ID, obj.Size})
+	}
+	p.pendingSize = st.PendingSize
+	p.heapLive = st.HeapLive
+	p.heapMarked = st.HeapMarked
+	p.heapGoal = st.HeapGoal
+	p.stackBytes = st.StackBytes
+	p.simCycles = st.SimCycles
+	p.recordedSimCycles = st.RecordedSimCycles
+	if err := LoadState(dec, p.sim); err != nil {
+		return fmt.Errorf("pacer: %v", err)
+	}
+	return nil
+}
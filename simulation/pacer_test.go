@@ -0,0 +1,136 @@
+package simulation
+
+import (
+	"testing"
+
+	"github.com/mknyszek/goat"
+)
+
+// recorder is a Simulator which records the events it's given.
+type recorder struct {
+	events []goat.Event
+}
+
+func (r *recorder) RegisterStats(*Stats) {}
+
+func (r *recorder) Process(ev goat.Event, _ *Stats) {
+	r.events = append(r.events, ev)
+}
+
+// count returns the number of recorded events of the given kind.
+func (r *recorder) count(kind goat.EventKind) int {
+	n := 0
+	for _, ev := range r.events {
+		if ev.Kind == kind {
+			n++
+		}
+	}
+	return n
+}
+
+func TestPacerGoal(t *testing.T) {
+	tests := []struct {
+		name        string
+		gcPercent   int
+		memoryLimit uint64
+		heapMarked  uint64
+		stackBytes  uint64
+		goal        uint64
+	}{
+		{"MinHeap", 100, 0, 0, 0, 4 << 20},
+		{"MinHeapGOGC50", 50, 0, 0, 0, 2 << 20},
+		{"GOGC100", 100, 0, 10 << 20, 0, 20 << 20},
+		{"GOGC200", 200, 0, 10 << 20, 0, 30 << 20},
+		{"Stacks", 100, 0, 10 << 20, 2 << 20, 22 << 20},
+		{"Limit", 100, 16 << 20, 10 << 20, 2 << 20, 14 << 20},
+		{"LimitAboveGOGC", 100, 64 << 20, 10 << 20, 0, 20 << 20},
+		{"LimitOnly", -1, 16 << 20, 10 << 20, 0, 16 << 20},
+		{"LimitHeadroom", 100, 10 << 20, 10 << 20, 0, 11 << 20},
+		{"LimitBelowStacks", 100, 1 << 20, 10 << 20, 2 << 20, 11 << 20},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := NewPacer(new(recorder), PacerGOGC(test.gcPercent), PacerMemoryLimit(test.memoryLimit))
+			p.heapMarked = test.heapMarked
+			p.stackBytes = test.stackBytes
+			if goal := p.goal(); goal != test.goal {
+				t.Errorf("expected goal %d, got %d", test.goal, goal)
+			}
+		})
+	}
+}
+
+func TestPacerTrigger(t *testing.T) {
+	rec := new(recorder)
+	p := NewPacer(rec)
+	stats := NewStats()
+	p.RegisterStats(stats)
+	if goal := stats.LookupOther(pacerHeapGoalStat.Name).Value(); goal != 4<<20 {
+		t.Fatalf("expected initial heap goal stat %d, got %d", 4<<20, goal)
+	}
+
+	// Allocate up to just below the goal, then over it.
+	p.Process(goat.Event{Kind: goat.EventAlloc, Address: 0x1000, Size: 3 << 20}, stats)
+	p.Process(goat.Event{Kind: goat.EventAlloc, Address: 0x2000, Size: 1<<20 - 1}, stats)
+	if n := rec.count(goat.EventGCStart); n != 0 {
+		t.Fatalf("GC triggered below the heap goal")
+	}
+	p.Process(goat.Event{Kind: goat.EventAlloc, Address: 0x3000, Size: 1}, stats)
+	if n := rec.count(goat.EventGCStart); n != 1 {
+		t.Fatalf("expected 1 GC at the heap goal, got %d", n)
+	}
+	if p.heapMarked != 4<<20 || p.heapGoal != 8<<20 {
+		t.Errorf("expected marked %d and goal %d, got %d and %d", 4<<20, 8<<20, p.heapMarked, p.heapGoal)
+	}
+	if goal := stats.LookupOther(pacerHeapGoalStat.Name).Value(); goal != 8<<20 {
+		t.Errorf("expected heap goal stat %d, got %d", 8<<20, goal)
+	}
+
+	// Recorded GC cycles are dropped.
+	p.Process(goat.Event{Kind: goat.EventGCStart}, stats)
+	p.Process(goat.Event{Kind: goat.EventGCEnd}, stats)
+	if n := rec.count(goat.EventGCStart); n != 1 {
+		t.Errorf("recorded GC cycle was passed through")
+	}
+}
+
+func TestPacerDeaths(t *testing.T) {
+	rec := new(recorder)
+	p := NewPacer(rec)
+	stats := NewStats()
+	p.RegisterStats(stats)
+
+	p.Process(goat.Event{Kind: goat.EventAlloc, Address: 0x1000, Size: 1 << 20}, stats)
+	p.Process(goat.Event{Kind: goat.EventAlloc, Address: 0x2000, Size: 1 << 20}, stats)
+	p.Process(goat.Event{Kind: goat.EventGCStart}, stats)
+	p.Process(goat.Event{Kind: goat.EventGCEnd}, stats)
+
+	// Swept before the next simulated GC, so it's freed by that GC.
+	p.Process(goat.Event{Kind: goat.EventFree, Address: 0x1000}, stats)
+	if n := rec.count(goat.EventFree); n != 0 {
+		t.Fatalf("object freed before a simulated GC")
+	}
+	if pending := stats.LookupOther(pacerPendingFreeStat.Name).Value(); pending != 1<<20 {
+		t.Errorf("expected %d pending bytes, got %d", 1<<20, pending)
+	}
+	p.Process(goat.Event{Kind: goat.EventAlloc, Address: 0x3000, Size: 2 << 20}, stats)
+	if n := rec.count(goat.EventFree); n != 1 {
+		t.Fatalf("expected 1 free at the simulated GC, got %d", n)
+	}
+	if p.heapMarked != 3<<20 {
+		t.Errorf("expected %d marked bytes, got %d", 3<<20, p.heapMarked)
+	}
+
+	// Swept lazily after a simulated GC which followed the recorded
+	// GC that found it dead, so it's freed immediately.
+	p.Process(goat.Event{Kind: goat.EventFree, Address: 0x2000}, stats)
+	if n := rec.count(goat.EventFree); n != 2 {
+		t.Fatalf("expected the lazily swept object to be freed immediately")
+	}
+	if p.heapLive != 2<<20 {
+		t.Errorf("expected %d live bytes, got %d", 2<<20, p.heapLive)
+	}
+	if pending := stats.LookupOther(pacerPendingFreeStat.Name).Value(); pending != 0 {
+		t.Errorf("expected no pending bytes, got %d", pending)
+	}
+}
@@ -0,0 +1,179 @@
+package simulation
+
+import "fmt"
+
+// StatKind is the kind of an implementation-specific statistic,
+// which determines how its values should be interpreted.
+type StatKind uint8
+
+const (
+	// Gauge is a statistic whose value may go up and down,
+	// such as an amount of memory.
+	Gauge StatKind = iota
+
+	// Counter is a statistic whose value only ever increases,
+	// such as a number of events.
+	Counter
+
+	// Histogram is a statistic which is a distribution of
+	// observed values.
+	Histogram
+)
+
+func (k StatKind) String() string {
+	switch k {
+	case Gauge:
+		return "gauge"
+	case Counter:
+		return "counter"
+	case Histogram:
+		return "histogram"
+	}
+	return fmt.Sprintf("StatKind(%d)", uint8(k))
+}
+
+// StatUnit is the unit of an implementation-specific statistic's
+// values.
+type StatUnit uint8
+
+const (
+	// UnitCount is a dimensionless number of things.
+	UnitCount StatUnit = iota
+
+	// UnitBytes is an amount of memory in bytes.
+	UnitBytes
+
+	// UnitPercent is a ratio in hundredths.
+	UnitPercent
+
+	// UnitPermille is a ratio in thousandths.
+	UnitPermille
+)
+
+func (u StatUnit) String() string {
+	switch u {
+	case UnitCount:
+		return "count"
+	case UnitBytes:
+		return "bytes"
+	case UnitPercent:
+		return "percent"
+	case UnitPermille:
+		return "permille"
+	}
+	return fmt.Sprintf("StatUnit(%d)", uint8(u))
+}
+
+// StatDesc describes an implementation-specific statistic.
+type StatDesc struct {
+	// Name uniquely identifies the statistic. By convention it's
+	// in CamelCase, prefixed by the name of the implementation,
+	// and suffixed by the unit.
+	Name string
+
+	Kind StatKind
+	Unit StatUnit
+
+	// Description is a short human-readable explanation of the
+	// statistic.
+	Description string
+
+	// Buckets are the inclusive upper bounds of a Histogram's
+	// buckets, in increasing order. Values larger than the last
+	// bound are counted in an extra overflow bucket.
+	//
+	// Must be empty for other kinds of statistics.
+	Buckets []uint64
+}
+
+func (d *StatDesc) check() error {
+	if d.Name == "" {
+		return fmt.Errorf("statistic has no name")
+	}
+	if d.Kind == Histogram {
+		if len(d.Buckets) == 0 {
+			return fmt.Errorf("histogram %s has no buckets", d.Name)
+		}
+		for i := 1; i < len(d.Buckets); i++ {
+			if d.Buckets[i] <= d.Buckets[i-1] {
+				return fmt.Errorf("histogram %s buckets are not increasing", d.Name)
+			}
+		}
+	} else if len(d.Buckets) != 0 {
+		return fmt.Errorf("%s %s has buckets", d.Kind, d.Name)
+	}
+	return nil
+}
+
+// Stat is a handle to an implementation-specific statistic,
+// returned by (*Stats).RegisterOther.
+//
+// Updating a statistic through its handle is cheap, so handles
+// should be retained by implementations for use on hot paths.
+type Stat struct {
+	desc  StatDesc
+	value uint64
+
+	// counts and sum are only used by histograms.
+	counts []uint64
+	sum    uint64
+}
+
+// Desc returns the statistic's description.
+func (s *Stat) Desc() StatDesc {
+	return s.desc
+}
+
+// Value returns the statistic's current value. For a histogram,
+// it's the number of observed values.
+func (s *Stat) Value() uint64 {
+	return s.value
+}
+
+// Add adds n to a gauge or counter.
+func (s *Stat) Add(n uint64) {
+	s.value += n
+}
+
+// Sub subtracts n from a gauge.
+func (s *Stat) Sub(n uint64) {
+	s.value -= n
+}
+
+// Set sets the value of a gauge.
+func (s *Stat) Set(n uint64) {
+	s.value = n
+}
+
+// Observe adds a value to a histogram.
+func (s *Stat) Observe(v uint64) {
+	i := 0
+	for i < len(s.desc.Buckets) && v > s.desc.Buckets[i] {
+		i++
+	}
+	s.counts[i]++
+	s.sum += v
+	s.value++
+}
+
+// Reset clears all the observed values from a histogram, for
+// histograms which describe a snapshot rather than all time.
+func (s *Stat) Reset() {
+	for i := range s.counts {
+		s.counts[i] = 0
+	}
+	s.sum = 0
+	s.value = 0
+}
+
+// Counts returns the number of observed values in each of a
+// histogram's buckets, with the overflow bucket last. The returned
+// slice must not be modified.
+func (s *Stat) Counts() []uint64 {
+	return s.counts
+}
+
+// Sum returns the sum of all the values observed by a histogram.
+func (s *Stat) Sum() uint64 {
+	return s.sum
+}
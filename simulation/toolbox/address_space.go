@@ -1,6 +1,11 @@
 package toolbox
 
-import "github.com/mknyszek/goat/simulation"
+import (
+	"encoding/gob"
+	"fmt"
+
+	"github.com/mknyszek/goat/simulation"
+)
 
 type AddressSpace48 struct {
 	base     Address
@@ -17,6 +22,22 @@ func NewAddressSpace48(pageSize Bytes) *AddressSpace48 {
 	}
 }
 
+func init() {
+	RegisterAddressSpace("as48", func(p Params) (AddressSpace, error) {
+		if err := p.Check("pageSize"); err != nil {
+			return nil, err
+		}
+		pageSize, err := p.Bytes("pageSize", 4096)
+		if err != nil {
+			return nil, err
+		}
+		if pageSize == 0 || pageSize&(pageSize-1) != 0 {
+			return nil, fmt.Errorf("pageSize must be a power-of-two")
+		}
+		return NewAddressSpace48(pageSize), nil
+	})
+}
+
 func (s *AddressSpace48) RegisterStats(_ *simulation.Stats) {}
 
 func (s *AddressSpace48) MapAligned(ctx Context, size, align Bytes) (Address, Bytes) {
@@ -24,5 +45,16 @@ func (s *AddressSpace48) MapAligned(ctx Context, size, align Bytes) (Address, By
 	base := s.base.AlignUp(align)
 	s.base = base.Add(size)
 	ctx.Stats.FreeBytes += uint64(size)
+	ctx.Stats.RSSBytes += uint64(size)
 	return base, size
 }
+
+// SaveState implements simulation.Checkpointer.
+func (s *AddressSpace48) SaveState(enc *gob.Encoder) error {
+	return enc.Encode(s.base)
+}
+
+// LoadState implements simulation.Checkpointer.
+func (s *AddressSpace48) LoadState(dec *gob.Decoder) error {
+	return dec.Decode(&s.base)
+}
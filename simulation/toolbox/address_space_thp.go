@@ -0,0 +1,404 @@
+package toolbox
+
+import (
+	"encoding/gob"
+	"fmt"
+
+	"github.com/mknyszek/goat/simulation"
+)
+
+// thpHugePageSize is the size and alignment of a transparent huge page.
+const thpHugePageSize Bytes = 2 << 20
+
+const (
+	// thpScanPeriod is the default time between khugepaged wakeups
+	// in CPU ticks, which corresponds to Linux's default 10 second
+	// scan_sleep_millisecs on a 1 GHz clock.
+	thpScanPeriod = 10000000000
+
+	// thpScanRegions is the default number of huge-page-sized
+	// regions khugepaged scans per wakeup, which corresponds to
+	// Linux's default pages_to_scan of 4096 4 KiB pages.
+	thpScanRegions = 8
+)
+
+var (
+	thpMappedStat = simulation.StatDesc{
+		Name:        "THPMappedBytes",
+		Unit:        simulation.UnitBytes,
+		Description: "memory mapped in huge-page-sized regions",
+	}
+	thpResidentStat = simulation.StatDesc{
+		Name:        "THPResidentBytes",
+		Unit:        simulation.UnitBytes,
+		Description: "resident memory, including huge pages",
+	}
+	thpHugeStat = simulation.StatDesc{
+		Name:        "THPHugePageBytes",
+		Unit:        simulation.UnitBytes,
+		Description: "memory backed by huge pages",
+	}
+	thpCollapsesStat = simulation.StatDesc{
+		Name:        "THPCollapses",
+		Kind:        simulation.Counter,
+		Description: "regions collapsed into huge pages by khugepaged",
+	}
+	thpSplitsStat = simulation.StatDesc{
+		Name:        "THPSplits",
+		Kind:        simulation.Counter,
+		Description: "huge pages split by a partial release",
+	}
+)
+
+// thpStats are handles to an AddressSpaceTHP's statistics.
+type thpStats struct {
+	mapped    *simulation.Stat
+	resident  *simulation.Stat
+	huge      *simulation.Stat
+	collapses *simulation.Stat
+	splits    *simulation.Stat
+}
+
+// thpRegion is a huge-page-sized and -aligned region of the
+// address space.
+type thpRegion struct {
+	base Address
+
+	// mapped is the number of base pages in the region
+	// which are mapped.
+	mapped int
+
+	// huge is whether the region is backed by a huge page.
+	huge bool
+
+	// resident has a bit set for each resident base page
+	// when the region is not backed by a huge page.
+	resident  []uint64
+	nresident int
+}
+
+func (r *thpRegion) isResident(i int) bool {
+	return r.resident[i/64]&(uint64(1)<<(i%64)) != 0
+}
+
+// AddressSpaceTHP is an AddressSpace48 which additionally models
+// transparent huge pages.
+//
+// It tracks each 2 MiB region of the address space and whether it's
+// backed by a huge page. A fully-mapped region may be backed by a huge
+// page either when it is first faulted in, or when khugepaged collapses
+// it later. Releasing part of a region backed by a huge page splits the
+// huge page.
+//
+// Residency is only known for memory managed by page allocators which
+// report it through the ResidencyTracker interface.
+type AddressSpaceTHP struct {
+	AddressSpace48
+
+	faultHuge   bool
+	maxPtesNone int
+	scanPeriod  uint64
+	scanRegions int
+
+	pagesPerRegion int
+	regions        []*thpRegion
+	index          map[Address]*thpRegion
+	scanIdx        int
+	lastScan       uint64
+	stats          thpStats
+}
+
+// THPOption is a configuration option for an AddressSpaceTHP.
+type THPOption func(s *AddressSpaceTHP)
+
+// THPFaultHuge returns a configuration option that sets whether
+// faulting in an empty, fully-mapped region backs it with a huge page
+// immediately, as with Linux's "always" THP mode. Otherwise, only
+// khugepaged creates huge pages.
+//
+// The default is true.
+func THPFaultHuge(enabled bool) THPOption {
+	return func(s *AddressSpaceTHP) {
+		s.faultHuge = enabled
+	}
+}
+
+// THPMaxPtesNone returns a configuration option that sets the maximum
+// number of non-resident base pages a region may have for khugepaged
+// to collapse it, mirroring Linux's max_ptes_none.
+//
+// The default is one less than the number of base pages per huge page,
+// so that any region with a resident base page may be collapsed.
+func THPMaxPtesNone(n int) THPOption {
+	return func(s *AddressSpaceTHP) {
+		s.maxPtesNone = n
+	}
+}
+
+// THPKhugepaged returns a configuration option that makes khugepaged
+// wake up every period CPU ticks and scan the given number of regions.
+// A period of zero turns khugepaged off.
+//
+// The default is 8 regions every 10,000,000,000 ticks.
+func THPKhugepaged(period uint64, regions int) THPOption {
+	return func(s *AddressSpaceTHP) {
+		s.scanPeriod = period
+		s.scanRegions = regions
+	}
+}
+
+// NewAddressSpaceTHP creates a new AddressSpaceTHP with base pages
+// of pageSize bytes.
+func NewAddressSpaceTHP(pageSize Bytes, options ...THPOption) *AddressSpaceTHP {
+	if pageSize > thpHugePageSize {
+		panic("page size must not be larger than a huge page")
+	}
+	s := &AddressSpaceTHP{
+		AddressSpace48: *NewAddressSpace48(pageSize),
+		faultHuge:      true,
+		maxPtesNone:    int(thpHugePageSize/pageSize) - 1,
+		scanPeriod:     thpScanPeriod,
+		scanRegions:    thpScanRegions,
+		pagesPerRegion: int(thpHugePageSize / pageSize),
+		index:          make(map[Address]*thpRegion),
+	}
+	for _, opt := range options {
+		opt(s)
+	}
+	return s
+}
+
+func init() {
+	RegisterAddressSpace("as48-thp", func(p Params) (AddressSpace, error) {
+		if err := p.Check("pageSize", "faultHuge", "maxPtesNone", "scanPeriod", "scanRegions"); err != nil {
+			return nil, err
+		}
+		pageSize, err := p.Bytes("pageSize", 4096)
+		if err != nil {
+			return nil, err
+		}
+		if pageSize == 0 || pageSize&(pageSize-1) != 0 || pageSize > thpHugePageSize {
+			return nil, fmt.Errorf("pageSize must be a power-of-two no larger than %d", thpHugePageSize)
+		}
+		faultHuge := true
+		if _, err := p.Decode("faultHuge", &faultHuge); err != nil {
+			return nil, err
+		}
+		maxPtesNone, err := p.Uint64("maxPtesNone", uint64(thpHugePageSize/pageSize)-1)
+		if err != nil {
+			return nil, err
+		}
+		scanPeriod, err := p.Uint64("scanPeriod", thpScanPeriod)
+		if err != nil {
+			return nil, err
+		}
+		scanRegions, err := p.Uint64("scanRegions", thpScanRegions)
+		if err != nil {
+			return nil, err
+		}
+		return NewAddressSpaceTHP(pageSize,
+			THPFaultHuge(faultHuge),
+			THPMaxPtesNone(int(maxPtesNone)),
+			THPKhugepaged(scanPeriod, int(scanRegions)),
+		), nil
+	})
+}
+
+func (s *AddressSpaceTHP) RegisterStats(stats *simulation.Stats) {
+	s.AddressSpace48.RegisterStats(stats)
+	s.stats.mapped = stats.RegisterOther(thpMappedStat)
+	s.stats.resident = stats.RegisterOther(thpResidentStat)
+	s.stats.huge = stats.RegisterOther(thpHugeStat)
+	s.stats.collapses = stats.RegisterOther(thpCollapsesStat)
+	s.stats.splits = stats.RegisterOther(thpSplitsStat)
+}
+
+func (s *AddressSpaceTHP) MapAligned(ctx Context, size, align Bytes) (Address, Bytes) {
+	base, size := s.AddressSpace48.MapAligned(ctx, size, align)
+	s.forEachRegion(base, size, true, func(r *thpRegion, first, n int) {
+		r.mapped += n
+	})
+	s.stats.mapped.Add(uint64(size))
+	s.khugepaged(ctx)
+	return base, size
+}
+
+func (s *AddressSpaceTHP) Populate(ctx Context, addr Address, size Bytes) {
+	s.forEachRegion(addr, size, false, func(r *thpRegion, first, n int) {
+		if r.huge {
+			return
+		}
+		if r.nresident == 0 && s.faultHuge && r.mapped == s.pagesPerRegion {
+			s.makeHuge(ctx, r)
+			return
+		}
+		for i := first; i < first+n; i++ {
+			if !r.isResident(i) {
+				r.resident[i/64] |= uint64(1) << (i % 64)
+				r.nresident++
+				s.stats.resident.Add(uint64(s.pageSize))
+			}
+		}
+	})
+	s.khugepaged(ctx)
+}
+
+func (s *AddressSpaceTHP) Release(ctx Context, addr Address, size Bytes) {
+	s.forEachRegion(addr, size, false, func(r *thpRegion, first, n int) {
+		if r.huge {
+			r.huge = false
+			s.stats.huge.Sub(uint64(thpHugePageSize))
+			if n == s.pagesPerRegion {
+				s.stats.resident.Sub(uint64(thpHugePageSize))
+				return
+			}
+			// Releasing part of a huge page splits it into
+			// resident base pages.
+			s.stats.splits.Add(1)
+			for i := range r.resident {
+				r.resident[i] = ^uint64(0)
+			}
+			r.nresident = s.pagesPerRegion
+		}
+		for i := first; i < first+n; i++ {
+			if r.isResident(i) {
+				r.resident[i/64] &^= uint64(1) << (i % 64)
+				r.nresident--
+				s.stats.resident.Sub(uint64(s.pageSize))
+			}
+		}
+	})
+	s.khugepaged(ctx)
+}
+
+// forEachRegion calls f for each region overlapping [addr, addr+size),
+// along with the index and number of the region's base pages in the
+// range. If create is true, missing regions are created. Otherwise,
+// it panics if a region doesn't exist.
+func (s *AddressSpaceTHP) forEachRegion(addr Address, size Bytes, create bool, f func(r *thpRegion, first, n int)) {
+	end := addr.Add(size)
+	for base := addr.AlignDown(thpHugePageSize); base < end; base = base.Add(thpHugePageSize) {
+		r, ok := s.index[base]
+		if !ok {
+			if !create {
+				panic("operation on unmapped memory")
+			}
+			r = &thpRegion{
+				base:     base,
+				resident: make([]uint64, (s.pagesPerRegion+63)/64),
+			}
+			s.index[base] = r
+			s.regions = append(s.regions, r)
+		}
+		lo, hi := base, base.Add(thpHugePageSize)
+		if addr > lo {
+			lo = addr
+		}
+		if end < hi {
+			hi = end
+		}
+		first := int(lo.Diff(base) / s.pageSize)
+		last := int((hi.Diff(base) + s.pageSize - 1) / s.pageSize)
+		f(r, first, last-first)
+	}
+}
+
+// makeHuge backs r with a huge page.
+func (s *AddressSpaceTHP) makeHuge(ctx Context, r *thpRegion) {
+	s.stats.resident.Add(uint64(s.pagesPerRegion-r.nresident) * uint64(s.pageSize))
+	s.stats.huge.Add(uint64(thpHugePageSize))
+	r.huge = true
+	r.nresident = 0
+	for i := range r.resident {
+		r.resident[i] = 0
+	}
+}
+
+// khugepaged simulates Linux's khugepaged, which periodically scans
+// the address space and collapses regions into huge pages.
+func (s *AddressSpaceTHP) khugepaged(ctx Context) {
+	if s.scanPeriod == 0 || len(s.regions) == 0 {
+		return
+	}
+	if s.lastScan == 0 || ctx.Timestamp < s.lastScan {
+		s.lastScan = ctx.Timestamp
+		return
+	}
+	if ctx.Timestamp-s.lastScan < s.scanPeriod {
+		return
+	}
+	s.lastScan = ctx.Timestamp
+	for i := 0; i < s.scanRegions && i < len(s.regions); i++ {
+		r := s.regions[s.scanIdx]
+		s.scanIdx = (s.scanIdx + 1) % len(s.regions)
+		if r.huge || r.nresident == 0 || r.mapped != s.pagesPerRegion {
+			continue
+		}
+		if s.pagesPerRegion-r.nresident <= s.maxPtesNone {
+			s.makeHuge(ctx, r)
+			s.stats.collapses.Add(1)
+		}
+	}
+}
+
+// thpState is the saved state of an AddressSpaceTHP.
+type thpState struct {
+	Regions  []thpRegionState
+	ScanIdx  int
+	LastScan uint64
+}
+
+// thpRegionState is the saved state of a thpRegion.
+type thpRegionState struct {
+	Base      Address
+	Mapped    int
+	Huge      bool
+	Resident  []uint64
+	NResident int
+}
+
+// SaveState implements simulation.Checkpointer.
+func (s *AddressSpaceTHP) SaveState(enc *gob.Encoder) error {
+	if err := s.AddressSpace48.SaveState(enc); err != nil {
+		return err
+	}
+	st := thpState{ScanIdx: s.scanIdx, LastScan: s.lastScan}
+	for _, r := range s.regions {
+		st.Regions = append(st.Regions, thpRegionState{
+			Base:      r.base,
+			Mapped:    r.mapped,
+			Huge:      r.huge,
+			Resident:  r.resident,
+			NResident: r.nresident,
+		})
+	}
+	return enc.Encode(&st)
+}
+
+// LoadState implements simulation.Checkpointer.
+func (s *AddressSpaceTHP) LoadState(dec *gob.Decoder) error {
+	if err := s.AddressSpace48.LoadState(dec); err != nil {
+		return err
+	}
+	var st thpState
+	if err := dec.Decode(&st); err != nil {
+		return err
+	}
+	s.regions = nil
+	s.index = make(map[Address]*thpRegion)
+	for _, rs := range st.Regions {
+		r := &thpRegion{
+			base:      rs.Base,
+			mapped:    rs.Mapped,
+			huge:      rs.Huge,
+			resident:  make([]uint64, (s.pagesPerRegion+63)/64),
+			nresident: rs.NResident,
+		}
+		copy(r.resident, rs.Resident)
+		s.regions = append(s.regions, r)
+		s.index[r.base] = r
+	}
+	s.scanIdx = st.ScanIdx
+	s.lastScan = st.LastScan
+	return nil
+}
@@ -0,0 +1,218 @@
+package toolbox_test
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/mknyszek/goat"
+	"github.com/mknyszek/goat/simulation"
+	"github.com/mknyszek/goat/simulation/toolbox"
+	_ "github.com/mknyszek/goat/simulation/toolbox/object"
+	_ "github.com/mknyszek/goat/simulation/toolbox/page"
+	_ "github.com/mknyszek/goat/simulation/toolbox/stack"
+)
+
+// testTrace returns a synthetic allocation trace with the given
+// number of GC cycles, and the index of the event just after the
+// GCEnd event of cycle checkpointAt.
+func testTrace(cycles, checkpointAt int) (events []goat.Event, split int) {
+	rng := rand.New(rand.NewSource(1))
+	var live, stacks []uint64
+	id := uint64(0)
+	ts := uint64(0)
+	emit := func(ev goat.Event) {
+		ts++
+		ev.Timestamp = ts
+		ev.P = int32(rng.Intn(4))
+		events = append(events, ev)
+	}
+	for c := 0; c < cycles; c++ {
+		// Allocate, interleaved with the deaths from the last cycle.
+		dead := live[:rng.Intn(len(live)+1)]
+		live = live[len(dead):]
+		for i := 0; i < 500; i++ {
+			if len(dead) != 0 && rng.Intn(3) == 0 {
+				emit(goat.Event{Kind: goat.EventFree, Address: dead[0]})
+				dead = dead[1:]
+				continue
+			}
+			id++
+			ev := goat.Event{
+				Kind:        goat.EventAlloc,
+				Address:     id,
+				PC:          uint64(1 + rng.Intn(8)),
+				Array:       rng.Intn(4) == 0,
+				PointerFree: rng.Intn(2) == 0,
+			}
+			switch r := rng.Intn(20); {
+			case r < 4:
+				ev.Size = 16
+				ev.TinySize = uint64(1 + rng.Intn(15))
+				ev.PointerFree = true
+			case r < 18:
+				ev.Size = uint64(1 + rng.Intn(1024))
+			case r < 19:
+				ev.Size = uint64(1 + rng.Intn(32<<10))
+			default:
+				ev.Size = uint64(32<<10 + rng.Intn(256<<10))
+			}
+			emit(ev)
+			live = append(live, id)
+			if rng.Intn(50) == 0 {
+				id++
+				emit(goat.Event{Kind: goat.EventStackAlloc, Address: id, Size: 2048 << uint(rng.Intn(4))})
+				stacks = append(stacks, id)
+			}
+			if len(stacks) != 0 && rng.Intn(60) == 0 {
+				emit(goat.Event{Kind: goat.EventStackFree, Address: stacks[0]})
+				stacks = stacks[1:]
+			}
+		}
+		for _, x := range dead {
+			emit(goat.Event{Kind: goat.EventFree, Address: x})
+		}
+		rng.Shuffle(len(live), func(i, j int) {
+			live[i], live[j] = live[j], live[i]
+		})
+		emit(goat.Event{Kind: goat.EventGCStart})
+		emit(goat.Event{Kind: goat.EventGCEnd})
+		if c == checkpointAt {
+			split = len(events)
+		}
+	}
+	return events, split
+}
+
+// statsSnapshot returns the values of all the statistics in s.
+func statsSnapshot(s *simulation.Stats) map[string]interface{} {
+	snap := map[string]interface{}{
+		"Timestamp":     s.Timestamp,
+		"GCCycles":      s.GCCycles,
+		"Allocs":        s.Allocs,
+		"Frees":         s.Frees,
+		"ObjectBytes":   s.ObjectBytes,
+		"StackBytes":    s.StackBytes,
+		"UnusedBytes":   s.UnusedBytes,
+		"FreeBytes":     s.FreeBytes,
+		"ReleasedBytes": s.ReleasedBytes,
+		"RSSBytes":      s.RSSBytes,
+	}
+	for p := int32(-1); p < 4; p++ {
+		snap[fmt.Sprintf("P%d", p)] = *s.PerP(p)
+	}
+	for _, stat := range s.OtherStats() {
+		snap[stat.Desc().Name] = [3]interface{}{stat.Value(), stat.Counts(), stat.Sum()}
+	}
+	return snap
+}
+
+func TestCheckpointRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		spec string
+	}{
+		{"Go115", `{
+			"addressSpace": {"name": "as48", "params": {"pageSize": 8192}},
+			"pageAllocator": {"name": "go114"},
+			"stackAllocator": {"name": "go114"},
+			"objectAllocator": {"name": "go115", "params": {"largeCacheBuckets": 4}}
+		}`},
+		{"Go122Radix", `{
+			"addressSpace": {"name": "vas", "params": {"pageSize": 8192}},
+			"pageAllocator": {"name": "radix"},
+			"stackAllocator": {"name": "go114"},
+			"objectAllocator": {"name": "go122"}
+		}`},
+		{"ImmixEvacuation", `{
+			"addressSpace": {"name": "as48", "params": {"pageSize": 8192}},
+			"pageAllocator": {"name": "bestfit"},
+			"stackAllocator": {"name": "go114"},
+			"objectAllocator": {"name": "immix", "params": {"evacuationThreshold": 50}}
+		}`},
+		{"TCMalloc", `{
+			"addressSpace": {"name": "as48", "params": {"pageSize": 8192}},
+			"pageAllocator": {"name": "firstfit"},
+			"stackAllocator": {"name": "go114"},
+			"objectAllocator": {"name": "tcmalloc"}
+		}`},
+		{"StickyMark", `{
+			"addressSpace": {"name": "as48", "params": {"pageSize": 8192}},
+			"pageAllocator": {"name": "buddy"},
+			"stackAllocator": {"name": "go114"},
+			"objectAllocator": {"name": "sticky", "params": {"majorGrowth": 50}}
+		}`},
+		{"Pretenure", `{
+			"addressSpace": {"name": "as48", "params": {"pageSize": 8192}},
+			"pageAllocator": {"name": "go114"},
+			"stackAllocator": {"name": "go114"},
+			"objectAllocator": {"name": "pretenure", "params": {"minSamples": 4}}
+		}`},
+	}
+	events, split := testTrace(8, 3)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var spec toolbox.Spec
+			if err := json.Unmarshal([]byte(test.spec), &spec); err != nil {
+				t.Fatal(err)
+			}
+			build := func() (*toolbox.Simulator, *simulation.Stats) {
+				sim, err := spec.Build()
+				if err != nil {
+					t.Fatal(err)
+				}
+				stats := simulation.NewStats()
+				sim.RegisterStats(stats)
+				return sim, stats
+			}
+			run := func(sim *toolbox.Simulator, stats *simulation.Stats, events []goat.Event) {
+				for _, ev := range events {
+					sim.Process(ev, stats)
+				}
+				if err := sim.Err(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// Run the whole trace without interruption.
+			whole, wholeStats := build()
+			run(whole, wholeStats, events)
+
+			// Run up to the checkpoint, save, and resume in a new
+			// simulation.
+			before, beforeStats := build()
+			run(before, beforeStats, events[:split])
+			var buf bytes.Buffer
+			enc := gob.NewEncoder(&buf)
+			if err := beforeStats.SaveState(enc); err != nil {
+				t.Fatalf("saving stats: %v", err)
+			}
+			if err := before.SaveState(enc); err != nil {
+				t.Fatalf("saving simulation: %v", err)
+			}
+			after, afterStats := build()
+			dec := gob.NewDecoder(&buf)
+			if err := afterStats.LoadState(dec); err != nil {
+				t.Fatalf("loading stats: %v", err)
+			}
+			if err := after.LoadState(dec); err != nil {
+				t.Fatalf("loading simulation: %v", err)
+			}
+			if got, want := statsSnapshot(afterStats), statsSnapshot(beforeStats); !reflect.DeepEqual(got, want) {
+				t.Fatalf("stats differ right after resuming:\ngot  %v\nwant %v", got, want)
+			}
+			run(after, afterStats, events[split:])
+
+			got, want := statsSnapshot(afterStats), statsSnapshot(wholeStats)
+			for name, w := range want {
+				if g := got[name]; !reflect.DeepEqual(g, w) {
+					t.Errorf("%s: resumed run got %v, uninterrupted run got %v", name, g, w)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package toolbox
+
+import (
+	"fmt"
+	"sort"
+)
+
+// SpanKind is the kind of a span of memory described by an Inspector.
+type SpanKind uint8
+
+const (
+	// SpanSmall is a span of an object allocator which holds
+	// small objects.
+	SpanSmall SpanKind = iota
+
+	// SpanLarge is a span of an object allocator which holds a
+	// single large object.
+	SpanLarge
+
+	// SpanAllocated is a run of pages which a page allocator
+	// handed out.
+	SpanAllocated
+
+	// SpanCached is a run of free pages which are held in a cache,
+	// such as a P's page cache, rather than being generally
+	// available for allocation.
+	SpanCached
+
+	// SpanFree is a run of free pages.
+	SpanFree
+)
+
+func (k SpanKind) String() string {
+	switch k {
+	case SpanSmall:
+		return "small"
+	case SpanLarge:
+		return "large"
+	case SpanAllocated:
+		return "allocated"
+	case SpanCached:
+		return "cached"
+	case SpanFree:
+		return "free"
+	}
+	return fmt.Sprintf("SpanKind(%d)", uint8(k))
+}
+
+// LineState is the state of a line of a span, for allocators which
+// track the memory of a span in lines, like Immix.
+type LineState uint8
+
+const (
+	// LineFree is a line with no objects on it.
+	LineFree LineState = iota
+
+	// LineLive is a line in use, usually by at least one live
+	// object.
+	LineLive
+
+	// LineDead is a line whose objects are all dead, but which
+	// hasn't been swept yet.
+	LineDead
+)
+
+func (l LineState) String() string {
+	switch l {
+	case LineFree:
+		return "free"
+	case LineLive:
+		return "live"
+	case LineDead:
+		return "dead"
+	}
+	return fmt.Sprintf("LineState(%d)", uint8(l))
+}
+
+// SpanInfo describes a span of memory managed by an allocator, as
+// reported by an Inspector.
+type SpanInfo struct {
+	// Base is the address of the start of the span.
+	Base Address
+
+	// Size is the size of the span.
+	Size Bytes
+
+	// Kind is what the span is used for.
+	Kind SpanKind
+
+	// Class is the allocator-specific size class of a SpanSmall.
+	Class int
+
+	// ElemSize is the size of each object slot of a SpanSmall, or
+	// the size of the object in a SpanLarge. It's zero if objects
+	// aren't allocated in fixed-size slots.
+	ElemSize Bytes
+
+	// Slots is the number of object slots in the span. FreeSlots
+	// are the indices of the ones which may be allocated into, and
+	// DeadSlots are the indices of the ones holding dead objects
+	// which haven't been swept yet. The rest hold live objects.
+	Slots     int
+	FreeSlots []int
+	DeadSlots []int
+
+	// Objects is the number of live objects in the span.
+	Objects int
+
+	// Lines is the state of each line in the span, for allocators
+	// which track lines. It's nil otherwise.
+	Lines []LineState
+
+	// Cached indicates that the span is in a P's cache.
+	Cached bool
+
+	// Released indicates that a run of free pages has been
+	// returned to the OS.
+	Released bool
+}
+
+// SortSpans sorts spans by address, for Inspectors which don't
+// naturally produce them in order.
+func SortSpans(spans []SpanInfo) {
+	sort.Slice(spans, func(i, j int) bool {
+		return spans[i].Base < spans[j].Base
+	})
+}
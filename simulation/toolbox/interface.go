@@ -1,6 +1,7 @@
 package toolbox
 
 import (
+	"errors"
 	"math/bits"
 
 	"github.com/mknyszek/goat/simulation"
@@ -87,6 +88,15 @@ const NoP P = -1
 type Context struct {
 	P
 	*simulation.Stats
+
+	// PC is the allocation site of the object being allocated,
+	// or zero if it's unknown or nothing is being allocated.
+	PC uint64
+}
+
+// PStats returns the statistics for the context's P.
+func (c Context) PStats() *simulation.PStats {
+	return c.Stats.PerP(int32(c.P))
 }
 
 // Simulation is a marker interface for a simulation, and also
@@ -108,7 +118,8 @@ type ObjectAllocator interface {
 
 	// AllocObject allocates an object, updating statistics
 	// in the context, and returns the base address for the
-	// new object.
+	// new object. The context's PC is the object's allocation
+	// site, if it's known.
 	AllocObject(c Context, size Bytes, array, noscan bool) Address
 
 	// DeadObject marks the object slot that starts at the given
@@ -129,6 +140,38 @@ type ObjectAllocator interface {
 	GCEnd(Context)
 }
 
+// TinyAllocator is an optional interface for an ObjectAllocator
+// which models the runtime's tiny allocator, which combines small
+// pointer-free objects into shared blocks.
+type TinyAllocator interface {
+	// AllocTiny allocates a pointer-free object smaller than 16
+	// bytes, updating statistics in the context, and returns its
+	// address. The object may share memory with other tiny objects,
+	// and will be passed to DeadObject like any other object.
+	AllocTiny(c Context, size Bytes) Address
+}
+
+// Mover is an optional interface for an ObjectAllocator which moves
+// live objects, such as a model of a copying or compacting collector.
+type Mover interface {
+	// SetMoveHandler sets a function which the allocator must call
+	// whenever it moves an object from address from to address to.
+	// After the call, the object is identified by its new address,
+	// including when it's passed to DeadObject.
+	SetMoveHandler(func(from, to Address))
+}
+
+// Inspector is an optional interface for an ObjectAllocator or a
+// PageAllocator which can describe the layout of the memory it
+// manages, for example to visualize fragmentation.
+type Inspector interface {
+	// Inspect returns a description of each span of memory the
+	// allocator manages, in address order. For an ObjectAllocator
+	// these are its spans, and for a PageAllocator these are runs
+	// of pages in the same state.
+	Inspect() []SpanInfo
+}
+
 // StackAllocator represents an interface to a simulated stack
 // allocator.
 type StackAllocator interface {
@@ -177,6 +220,46 @@ type AddressSpace interface {
 
 	// MapAligned simulates an OS's mmap or equivalent except
 	// that the region is aligned to its size.
-	// Updates statistics in the context.
+	// Updates statistics in the context, counting the new
+	// region as free and resident. Page allocators which model
+	// memory being returned to the OS adjust RSSBytes and
+	// ReleasedBytes themselves.
+	//
+	// Returns a zero size if the address space can't fit the region.
 	MapAligned(ctx Context, size, align Bytes) (Address, Bytes)
 }
+
+// ErrOutOfAddressSpace is the value page allocators panic with when
+// their address space can't fit a mapping they need. Simulator
+// recovers it, and stops the simulation with it as its error.
+var ErrOutOfAddressSpace = errors.New("out of address space")
+
+// Unmapper is an optional interface for an AddressSpace which
+// supports giving address space back.
+type Unmapper interface {
+	// Unmap simulates an OS's munmap or equivalent. The range
+	// [addr, addr+size) must have been mapped with MapAligned,
+	// and must be entirely free. released is how much of the
+	// range has since been returned to the OS.
+	// Updates statistics in the context, undoing MapAligned and
+	// any later release: the range stops being counted as free,
+	// its released part stops being counted as released, and
+	// the rest stops being counted as resident.
+	Unmap(ctx Context, addr Address, size, released Bytes)
+}
+
+// ResidencyTracker is an optional interface for an AddressSpace which
+// models which parts of its mappings are resident in memory. Page
+// allocators which model returning memory to the OS should notify
+// their address space through it, if it's implemented.
+//
+// Mapped memory is not resident until it is populated.
+type ResidencyTracker interface {
+	// Populate signals that the range [addr, addr+size) is about
+	// to be used, and so will be faulted in.
+	Populate(ctx Context, addr Address, size Bytes)
+
+	// Release signals that the range [addr, addr+size) was
+	// returned to the OS.
+	Release(ctx Context, addr Address, size Bytes)
+}
@@ -1,6 +1,11 @@
 package object
 
 import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"sort"
+
 	"github.com/mknyszek/goat/simulation"
 	"github.com/mknyszek/goat/simulation/toolbox"
 )
@@ -78,6 +83,8 @@ type go115Span struct {
 	free       [128]uint64
 	freed      [128]uint64
 	tailWaste  toolbox.Bytes
+	heapBits   toolbox.Bytes
+	header     toolbox.Bytes
 	objUnused  toolbox.Bytes
 	scUnused   toolbox.Bytes
 	scFreed    toolbox.Bytes
@@ -97,19 +104,23 @@ func (s *go115Span) allocObject() toolbox.Address {
 	return 0
 }
 
-func (s *go115Span) sweep(ctx toolbox.Context) {
+func (s *go115Span) sweep(ctx toolbox.Context, stats *go115Stats) {
 	for i := uint64(0); i < (s.numElems+63)/64; i++ {
 		s.free[i] |= s.freed[i]
 		s.freed[i] = 0
 	}
+	headers := toolbox.Bytes(s.freedCount) * s.header
 	s.allocCount -= s.freedCount
 	ctx.Stats.Frees += s.freedCount
 	s.freedCount = 0
 	s.scUnused -= s.scFreed
-	ctx.Stats.SubOther(go115SCWasteStat, uint64(s.scFreed))
-	ctx.Stats.SubOther(go115ObjectWasteStat, uint64(s.objUnused))
-	ctx.Stats.FreeBytes += uint64(s.objUnused + s.scFreed)
-	ctx.Stats.UnusedBytes -= uint64(s.objUnused + s.scFreed)
+	stats.scWaste.Sub(uint64(s.scFreed))
+	stats.objectWaste.Sub(uint64(s.objUnused))
+	if headers != 0 {
+		stats.header.Sub(uint64(headers))
+	}
+	ctx.Stats.FreeBytes += uint64(s.objUnused + s.scFreed + headers)
+	ctx.Stats.UnusedBytes -= uint64(s.objUnused + s.scFreed + headers)
 	s.objUnused = 0
 	s.scFreed = 0
 }
@@ -121,42 +132,193 @@ type go115Central struct {
 }
 
 type go115Cache struct {
-	alloc [go115NumSpanClasses]*go115Span
+	alloc []*go115Span
+}
+
+// go115Stats are handles to the statistics an allocator reports,
+// whose names are prefixed by the name of the allocator.
+type go115Stats struct {
+	prefix string
+
+	objectWaste *simulation.Stat
+	scWaste     *simulation.Stat
+	tailWaste   *simulation.Stat
+
+	// header and heapBits are only reported by allocators
+	// that use malloc headers.
+	header   *simulation.Stat
+	heapBits *simulation.Stat
+
+	// tinyWaste is the memory in tiny blocks that no object was
+	// allocated in, and tinyRetained is the memory of dead tiny
+	// objects kept alive by other objects in the same block.
+	tinyWaste    *simulation.Stat
+	tinyRetained *simulation.Stat
+
+	// largeCache is the memory of dead large objects cached for
+	// reuse, and largeReused is the total memory reused from it.
+	largeCache  *simulation.Stat
+	largeReused *simulation.Stat
+
+	// occupancy is the distribution of the percent of slots
+	// occupied by live objects in small object spans, once each
+	// cycle's sweeping is done.
+	occupancy *simulation.Stat
 }
 
+// go115OccupancyBuckets are the buckets of the span occupancy histogram.
+var go115OccupancyBuckets = []uint64{10, 20, 30, 40, 50, 60, 70, 80, 90, 100}
+
 type Go115 struct {
 	sweptIdx      uint
 	pageAllocator toolbox.PageAllocator
 	index         map[toolbox.Address]*go115Span
 	caches        map[toolbox.P]*go115Cache
-	central       [go115NumSpanClasses]go115Central
+	central       []go115Central
 	objectSizes   map[toolbox.Address]toolbox.Bytes
+
+	classes *sizeClasses
+	stats   go115Stats
+	tiny    go115Tiny
+	large   go115LargeCache
+
+	// headers indicates whether small objects that contain pointers
+	// carry a malloc header, or have their heap bitmap stored at the
+	// end of their span.
+	headers bool
+}
+
+// Go115Option is a configuration option for a Go115 object allocator.
+type Go115Option func(g *Go115)
+
+// Go115SizeClassTable returns a configuration option that replaces
+// the allocator's size classes with classes, which must be in
+// increasing order of size. The largest size class determines the
+// largest small object; larger objects get their own spans.
+//
+// The default is the Go 1.15 runtime's size classes.
+func Go115SizeClassTable(classes []SizeClass) Go115Option {
+	return func(g *Go115) {
+		t := makeSizeClasses(classes)
+		g.classes = &t
+	}
 }
 
-func NewGo115(pa toolbox.PageAllocator) *Go115 {
+func NewGo115(pa toolbox.PageAllocator, options ...Go115Option) *Go115 {
 	if pa.BytesPerPage() != 8192 {
 		panic("page allocator must have 8 KiB pages")
 	}
+	return newGo115(pa, &go115SizeClasses, false, go115Stats{prefix: "Go115"}, options)
+}
+
+func newGo115(pa toolbox.PageAllocator, classes *sizeClasses, headers bool, stats go115Stats, options []Go115Option) *Go115 {
 	g := &Go115{
 		pageAllocator: pa,
 		index:         make(map[toolbox.Address]*go115Span),
 		caches:        make(map[toolbox.P]*go115Cache),
 		objectSizes:   make(map[toolbox.Address]toolbox.Bytes),
+		classes:       classes,
+		stats:         stats,
+		headers:       headers,
+		tiny:          newGo115Tiny(),
+		large:         newGo115LargeCache(),
+	}
+	for _, opt := range options {
+		opt(g)
+	}
+	if err := checkSizeClasses(g.classes.classes()); err != nil {
+		panic(err.Error())
 	}
+	if err := checkTinySize(g.tiny.size); err != nil {
+		panic(err.Error())
+	}
+	if err := checkLargeCache(g.large.buckets, g.large.cycles); err != nil {
+		panic(err.Error())
+	}
+	g.central = make([]go115Central, g.classes.numSpanClasses())
 	return g
 }
 
-const (
-	go115ObjectWasteStat = "Go115ObjectUnusedBytes"
-	go115SCWasteStat     = "Go115ObjectTailUnusedBytes"
-	go115TailWasteStat   = "Go115TailUnusedBytes"
-)
+func init() {
+	toolbox.RegisterObjectAllocator("go115", func(pa toolbox.PageAllocator, p toolbox.Params) (toolbox.ObjectAllocator, error) {
+		if err := p.Check(go115Params...); err != nil {
+			return nil, err
+		}
+		if pa.BytesPerPage() != 8192 {
+			return nil, errors.New("page allocator must have 8 KiB pages")
+		}
+		options, err := decodeGo115(p)
+		if err != nil {
+			return nil, err
+		}
+		return NewGo115(pa, options...), nil
+	})
+}
+
+// go115Params are the parameters decoded by decodeGo115.
+var go115Params = []string{"sizeClasses", "tinySize", "largeCacheBuckets", "largeCacheCycles"}
+
+// decodeGo115 returns the configuration options for a Go115 object
+// allocator's parameters.
+func decodeGo115(p toolbox.Params) ([]Go115Option, error) {
+	options, err := decodeTinySize(p)
+	if err != nil {
+		return nil, err
+	}
+	large, err := decodeLargeCache(p)
+	if err != nil {
+		return nil, err
+	}
+	options = append(options, large...)
+	var classes []SizeClass
+	if ok, err := p.Decode("sizeClasses", &classes); err != nil {
+		return nil, err
+	} else if ok {
+		if err := checkSizeClasses(classes); err != nil {
+			return nil, fmt.Errorf("sizeClasses: %v", err)
+		}
+		options = append(options, Go115SizeClassTable(classes))
+	}
+	return options, nil
+}
 
 func (g *Go115) RegisterStats(stats *simulation.Stats) {
 	g.pageAllocator.RegisterStats(stats)
-	stats.RegisterOther(go115ObjectWasteStat)
-	stats.RegisterOther(go115SCWasteStat)
-	stats.RegisterOther(go115TailWasteStat)
+	st := &g.stats
+	gauge := func(name, desc string) *simulation.Stat {
+		return stats.RegisterOther(simulation.StatDesc{
+			Name:        st.prefix + name,
+			Unit:        simulation.UnitBytes,
+			Description: desc,
+		})
+	}
+	st.objectWaste = gauge("ObjectUnusedBytes", "memory of dead objects not yet swept")
+	st.scWaste = gauge("ObjectTailUnusedBytes", "memory lost to rounding objects up to their size class")
+	st.tailWaste = gauge("TailUnusedBytes", "memory at the end of spans too small for another object")
+	if g.headers {
+		st.header = gauge("MallocHeaderBytes", "memory occupied by malloc headers")
+		st.heapBits = gauge("HeapBitsBytes", "memory occupied by heap bitmaps at the end of spans")
+	}
+	if g.tiny.size != 0 {
+		st.tinyWaste = gauge("TinyUnusedBytes", "memory in tiny blocks no object was allocated in")
+		st.tinyRetained = gauge("TinyRetainedBytes", "memory of dead tiny objects kept alive by their block")
+	}
+	if g.large.buckets != 0 {
+		st.largeCache = gauge("LargeCacheBytes", "memory of dead large objects cached for reuse")
+		st.largeReused = stats.RegisterOther(simulation.StatDesc{
+			Name:        st.prefix + "LargeReusedBytes",
+			Kind:        simulation.Counter,
+			Unit:        simulation.UnitBytes,
+			Description: "memory reused from the large object cache",
+		})
+	}
+	st.occupancy = stats.RegisterOther(simulation.StatDesc{
+		Name:        st.prefix + "SpanOccupancyPercent",
+		Kind:        simulation.Histogram,
+		Unit:        simulation.UnitPercent,
+		Description: "slots of small object spans occupied by live objects after sweeping",
+		Buckets:     go115OccupancyBuckets,
+	})
 }
 
 func (g *Go115) refill(ctx toolbox.Context, spc go115SpanClass) {
@@ -177,14 +339,14 @@ func (g *Go115) refill(ctx toolbox.Context, spc go115SpanClass) {
 	if list := &g.central[spc].partial[1-g.sweptIdx]; !list.empty() {
 		list.last.cached = true
 		g.caches[ctx.P].alloc[spc] = list.last
-		list.last.sweep(ctx)
+		list.last.sweep(ctx, &g.stats)
 		list.remove(list.last)
 		return
 	}
 	for {
 		if list := &g.central[spc].full[1-g.sweptIdx]; !list.empty() {
 			s := list.last
-			s.sweep(ctx)
+			s.sweep(ctx, &g.stats)
 			list.remove(s)
 			if s.allocCount < s.numElems {
 				s.cached = true
@@ -197,9 +359,22 @@ func (g *Go115) refill(ctx toolbox.Context, spc go115SpanClass) {
 		}
 	}
 	pageSize := g.pageAllocator.BytesPerPage()
-	npages := go115ClassToPages[spc.sizeClass()]
-	elemSize := go115SizeClassToSize[spc.sizeClass()]
-	numElems := uint64(npages.Bytes(pageSize) / elemSize)
+	npages := g.classes.pages[spc.sizeClass()]
+	elemSize := g.classes.size[spc.sizeClass()]
+	spanBytes := npages.Bytes(pageSize)
+
+	// With malloc headers, small objects with pointers keep their
+	// heap bitmap at the end of the span, and larger ones carry a
+	// header with their type instead.
+	var heapBits, header toolbox.Bytes
+	if g.headers && !spc.noscan() {
+		if elemSize <= go122MinSizeForMallocHeader {
+			heapBits = spanBytes / 64
+		} else {
+			header = go122MallocHeaderSize
+		}
+	}
+	numElems := uint64((spanBytes - heapBits) / elemSize)
 	x := g.pageAllocator.AllocPages(ctx, npages)
 	s = &go115Span{
 		class:      spc,
@@ -208,15 +383,20 @@ func (g *Go115) refill(ctx toolbox.Context, spc go115SpanClass) {
 		elemSize:   elemSize,
 		numElems:   numElems,
 		allocCount: 0,
-		tailWaste:  npages.Bytes(pageSize) - elemSize*toolbox.Bytes(numElems),
+		tailWaste:  spanBytes - heapBits - elemSize*toolbox.Bytes(numElems),
+		heapBits:   heapBits,
+		header:     header,
 		cached:     true,
 	}
 	for i := uint64(0); i < s.numElems; i++ {
 		s.free[i/64] |= uint64(1) << (i % 64)
 	}
-	ctx.Stats.FreeBytes -= uint64(s.tailWaste)
-	ctx.Stats.UnusedBytes += uint64(s.tailWaste)
-	ctx.Stats.AddOther(go115TailWasteStat, uint64(s.tailWaste))
+	ctx.Stats.FreeBytes -= uint64(s.tailWaste + s.heapBits)
+	ctx.Stats.UnusedBytes += uint64(s.tailWaste + s.heapBits)
+	g.stats.tailWaste.Add(uint64(s.tailWaste))
+	if s.heapBits != 0 {
+		g.stats.heapBits.Add(uint64(s.heapBits))
+	}
 	g.addToIndex(s)
 	g.caches[ctx.P].alloc[spc] = s
 }
@@ -235,36 +415,56 @@ func (g *Go115) removeFromIndex(s *go115Span) {
 	}
 }
 
-func (g *Go115) AllocObject(ctx toolbox.Context, size toolbox.Bytes, _, noscan bool) toolbox.Address {
+func (g *Go115) AllocObject(ctx toolbox.Context, size toolbox.Bytes, array, noscan bool) toolbox.Address {
+	if noscan && size < g.tiny.size {
+		return g.AllocTiny(ctx, size)
+	}
+	return g.allocObject(ctx, size, array, noscan)
+}
+
+func (g *Go115) allocObject(ctx toolbox.Context, size toolbox.Bytes, _, noscan bool) toolbox.Address {
 	if ctx.P == toolbox.NoP {
 		panic("allocation must be called with a P")
 	}
-	if size <= go115MaxSmallObjectSize {
+	if size <= g.classes.maxSmall {
 		c, ok := g.caches[ctx.P]
 		if !ok {
-			c = new(go115Cache)
+			c = &go115Cache{alloc: make([]*go115Span, g.classes.numSpanClasses())}
 			g.caches[ctx.P] = c
 		}
-		spc := makeGo115SpanClass(go115SizeToClass(size), noscan)
+		allocSize := size
+		if g.headers && !noscan && size > go122MinSizeForMallocHeader {
+			allocSize += go122MallocHeaderSize
+		}
+		spc := makeGo115SpanClass(g.classes.sizeToClass(allocSize), noscan)
 		x := c.alloc[spc].allocObject()
 		if x == 0 {
 			g.refill(ctx, spc)
-			x = c.alloc[spc].allocObject()
+			s := c.alloc[spc]
+			ps := ctx.PStats()
+			ps.CachedBytes += (s.numElems - s.allocCount) * uint64(s.elemSize)
+			ps.Refills++
+			x = s.allocObject()
 		}
 		g.objectSizes[x] = size
-		diff := c.alloc[spc].elemSize - size
-		c.alloc[spc].scUnused += diff
-		ctx.Stats.AddOther(go115SCWasteStat, uint64(diff))
-		ctx.Stats.FreeBytes -= uint64(c.alloc[spc].elemSize)
+		s := c.alloc[spc]
+		ctx.PStats().CachedBytes -= uint64(s.elemSize)
+		diff := s.elemSize - size - s.header
+		s.scUnused += diff
+		g.stats.scWaste.Add(uint64(diff))
+		if s.header != 0 {
+			g.stats.header.Add(uint64(s.header))
+		}
+		ctx.Stats.FreeBytes -= uint64(s.elemSize)
 		ctx.Stats.ObjectBytes += uint64(size)
-		ctx.Stats.UnusedBytes += uint64(diff)
+		ctx.Stats.UnusedBytes += uint64(diff + s.header)
 		ctx.Stats.Allocs++
 		return x
 	}
 	pageSize := g.pageAllocator.BytesPerPage()
-	npages := size.Pages(pageSize)
+	npages := g.large.bucket(size.Pages(pageSize))
 	spc := makeGo115SpanClass(0, noscan)
-	x := g.pageAllocator.AllocPages(ctx, npages)
+	x := g.allocLarge(ctx, npages)
 	s := &go115Span{
 		class:      spc,
 		base:       x,
@@ -281,12 +481,20 @@ func (g *Go115) AllocObject(ctx toolbox.Context, size toolbox.Bytes, _, noscan b
 	ctx.Stats.FreeBytes -= uint64(s.npages.Bytes(pageSize))
 	ctx.Stats.ObjectBytes += uint64(s.elemSize)
 	ctx.Stats.UnusedBytes += uint64(s.tailWaste)
-	ctx.Stats.AddOther(go115TailWasteStat, uint64(s.tailWaste))
+	g.stats.tailWaste.Add(uint64(s.tailWaste))
 	ctx.Stats.Allocs++
 	return x
 }
 
 func (g *Go115) DeadObject(ctx toolbox.Context, addr toolbox.Address) {
+	if obj, ok := g.tiny.objects[addr]; ok {
+		g.deadTiny(ctx, addr, obj)
+		return
+	}
+	g.deadObject(ctx, addr)
+}
+
+func (g *Go115) deadObject(ctx toolbox.Context, addr toolbox.Address) {
 	a := addr.AlignDown(g.pageAllocator.BytesPerPage())
 	s := g.index[a]
 	size := g.objectSizes[addr]
@@ -299,37 +507,52 @@ func (g *Go115) DeadObject(ctx toolbox.Context, addr toolbox.Address) {
 	}
 	ctx.Stats.ObjectBytes -= uint64(size)
 	ctx.Stats.UnusedBytes += uint64(size)
-	ctx.Stats.AddOther(go115ObjectWasteStat, uint64(size))
+	g.stats.objectWaste.Add(uint64(size))
 	s.objUnused += size
-	s.scFreed += s.elemSize - size
+	s.scFreed += s.elemSize - size - s.header
 	if s.freedCount == s.allocCount {
 		g.removeFromIndex(s)
 		s.currList.remove(s)
-		g.pageAllocator.FreePages(ctx, s.base, s.npages)
-		ctx.Stats.FreeBytes += uint64(s.tailWaste + s.objUnused + s.scUnused)
-		ctx.Stats.UnusedBytes -= uint64(s.tailWaste + s.objUnused + s.scUnused)
-		ctx.Stats.SubOther(go115TailWasteStat, uint64(s.tailWaste))
-		ctx.Stats.SubOther(go115SCWasteStat, uint64(s.scUnused))
-		ctx.Stats.SubOther(go115ObjectWasteStat, uint64(s.objUnused))
+		g.freeSpan(ctx, s)
+		headers := toolbox.Bytes(s.allocCount) * s.header
+		unused := s.tailWaste + s.heapBits + headers + s.objUnused + s.scUnused
+		ctx.Stats.FreeBytes += uint64(unused)
+		ctx.Stats.UnusedBytes -= uint64(unused)
+		g.stats.tailWaste.Sub(uint64(s.tailWaste))
+		g.stats.scWaste.Sub(uint64(s.scUnused))
+		g.stats.objectWaste.Sub(uint64(s.objUnused))
+		if s.heapBits != 0 {
+			g.stats.heapBits.Sub(uint64(s.heapBits))
+		}
+		if headers != 0 {
+			g.stats.header.Sub(uint64(headers))
+		}
 		ctx.Stats.Frees += s.freedCount
 	}
 }
 
 func (g *Go115) GCStart(ctx toolbox.Context) {
+	g.sweepAll(ctx)
+	g.stats.occupancy.Reset()
+	g.observeOccupancy()
+}
+
+// sweepAll sweeps every span which isn't cached.
+func (g *Go115) sweepAll(ctx toolbox.Context) {
 	for spci := range g.central {
 		spc := go115SpanClass(spci)
 		partial := &g.central[spc].partial[1-g.sweptIdx]
 		for !partial.empty() {
 			s := partial.last
 			partial.remove(s)
-			s.sweep(ctx)
+			s.sweep(ctx, &g.stats)
 			g.central[spc].partial[g.sweptIdx].pushFront(s)
 		}
 		full := &g.central[spc].full[1-g.sweptIdx]
 		for !full.empty() {
 			s := full.last
 			full.remove(s)
-			s.sweep(ctx)
+			s.sweep(ctx, &g.stats)
 			if s.allocCount < s.numElems {
 				g.central[spc].partial[g.sweptIdx].pushFront(s)
 			} else {
@@ -339,11 +562,48 @@ func (g *Go115) GCStart(ctx toolbox.Context) {
 	}
 }
 
+// observeOccupancy adds the occupancy of every small object span
+// to the occupancy histogram. All spans must be swept.
+func (g *Go115) observeOccupancy() {
+	observe := func(s *go115Span) {
+		g.stats.occupancy.Observe(s.allocCount * 100 / s.numElems)
+	}
+	for spci := range g.central {
+		spc := go115SpanClass(spci)
+		if spc.sizeClass() == 0 {
+			continue
+		}
+		for s := g.central[spc].partial[g.sweptIdx].first; s != nil; s = s.next {
+			observe(s)
+		}
+		for s := g.central[spc].full[g.sweptIdx].first; s != nil; s = s.next {
+			observe(s)
+		}
+	}
+	for _, c := range g.caches {
+		for _, s := range c.alloc {
+			if s != nil {
+				observe(s)
+			}
+		}
+	}
+}
+
 func (g *Go115) GCEnd(ctx toolbox.Context) {
-	// Flush all caches for sweeping.
-	for _, cache := range g.caches {
+	g.decayLargeCache(ctx)
+
+	// Flush all caches for sweeping, in a fixed order so the span
+	// lists are the same every run.
+	order := make([]toolbox.P, 0, len(g.caches))
+	for p := range g.caches {
+		order = append(order, p)
+	}
+	for _, p := range sortPs(order) {
+		cache := g.caches[p]
+		ps := ctx.Stats.PerP(int32(p))
 		for spc, s := range cache.alloc {
 			if s != nil {
+				ps.CachedBytes -= (s.numElems - s.allocCount) * uint64(s.elemSize)
 				s.cached = false
 				if s.allocCount == s.numElems {
 					g.central[spc].full[g.sweptIdx].pushFront(s)
@@ -359,4 +619,359 @@ func (g *Go115) GCEnd(ctx toolbox.Context) {
 	} else {
 		g.sweptIdx = 1
 	}
+
+	// Drop the current tiny blocks, like the runtime does when it
+	// prepares caches for sweeping. Their spans are no longer cached,
+	// so empty blocks can be freed like any other dead object.
+	g.dropTiny(ctx)
+}
+
+// sortPs sorts ps in increasing order and returns it.
+func sortPs(ps []toolbox.P) []toolbox.P {
+	sort.Slice(ps, func(i, j int) bool {
+		return ps[i] < ps[j]
+	})
+	return ps
+}
+
+// Inspect implements toolbox.Inspector. Pages held in the large object
+// cache are reported as cached.
+func (g *Go115) Inspect() []toolbox.SpanInfo {
+	pageSize := g.pageAllocator.BytesPerPage()
+	var spans []toolbox.SpanInfo
+	for addr, s := range g.index {
+		if addr != s.base {
+			continue
+		}
+		info := toolbox.SpanInfo{
+			Base:     s.base,
+			Size:     s.npages.Bytes(pageSize),
+			ElemSize: s.elemSize,
+			Slots:    int(s.numElems),
+			Objects:  int(s.allocCount - s.freedCount),
+			Cached:   s.cached,
+		}
+		if s.class.sizeClass() == 0 {
+			info.Kind = toolbox.SpanLarge
+		} else {
+			info.Kind = toolbox.SpanSmall
+			info.Class = int(s.class.sizeClass())
+			for i := uint64(0); i < s.numElems; i++ {
+				if s.free[i/64]&(uint64(1)<<(i%64)) != 0 {
+					info.FreeSlots = append(info.FreeSlots, int(i))
+				} else if s.freed[i/64]&(uint64(1)<<(i%64)) != 0 {
+					info.DeadSlots = append(info.DeadSlots, int(i))
+				}
+			}
+		}
+		spans = append(spans, info)
+	}
+	for npages, runs := range g.large.runs {
+		for _, r := range runs {
+			spans = append(spans, toolbox.SpanInfo{
+				Base: r.base,
+				Size: npages.Bytes(pageSize),
+				Kind: toolbox.SpanCached,
+			})
+		}
+	}
+	toolbox.SortSpans(spans)
+	return spans
+}
+
+// go115SpanState is the saved state of a go115Span.
+type go115SpanState struct {
+	Base       toolbox.Address
+	NPages     toolbox.Pages
+	Class      go115SpanClass
+	ElemSize   toolbox.Bytes
+	NumElems   uint64
+	AllocCount uint64
+	FreedCount uint64
+	Cached     bool
+	Free       []uint64
+	Freed      []uint64
+	TailWaste  toolbox.Bytes
+	HeapBits   toolbox.Bytes
+	Header     toolbox.Bytes
+	ObjUnused  toolbox.Bytes
+	ScUnused   toolbox.Bytes
+	ScFreed    toolbox.Bytes
+}
+
+// go115CentralState is the saved state of a go115Central, with
+// spans identified by their base address.
+type go115CentralState struct {
+	Partial [2][]toolbox.Address
+	Full    [2][]toolbox.Address
+}
+
+// go115State is the saved state of a Go115 object allocator.
+type go115State struct {
+	SweptIdx uint
+	Spans    []go115SpanState
+	Central  []go115CentralState
+
+	// Caches holds the base address of each cached span, or zero.
+	Caches      map[toolbox.P][]toolbox.Address
+	ObjectSizes map[toolbox.Address]toolbox.Bytes
+
+	TinyBlocks  []tinyBlockState
+	TinyCurrent map[toolbox.P]int
+	TinyObjects map[toolbox.Address]tinyObjectState
+	TinyEmpty   []int
+
+	LargeCycle uint64
+	LargeRuns  map[toolbox.Pages][]go115LargeRunState
+}
+
+// tinyBlockState is the saved state of a tinyBlock.
+type tinyBlockState struct {
+	Base    toolbox.Address
+	P       toolbox.P
+	Offset  toolbox.Bytes
+	Objects uint64
+	Live    uint64
+	Dead    toolbox.Bytes
+}
+
+// tinyObjectState is the saved state of a tinyObject, which refers
+// to its block by its index in go115State.TinyBlocks.
+type tinyObjectState struct {
+	Block int
+	Size  toolbox.Bytes
+}
+
+// go115LargeRunState is the saved state of a go115LargeRun.
+type go115LargeRunState struct {
+	Base  toolbox.Address
+	Cycle uint64
+}
+
+func saveGo115SpanList(l *go115SpanList) []toolbox.Address {
+	var bases []toolbox.Address
+	for s := l.first; s != nil; s = s.next {
+		bases = append(bases, s.base)
+	}
+	return bases
+}
+
+// SaveState implements simulation.Checkpointer.
+func (g *Go115) SaveState(enc *gob.Encoder) error {
+	st := go115State{
+		SweptIdx:    g.sweptIdx,
+		Central:     make([]go115CentralState, len(g.central)),
+		Caches:      make(map[toolbox.P][]toolbox.Address),
+		ObjectSizes: g.objectSizes,
+		TinyCurrent: make(map[toolbox.P]int),
+		TinyObjects: make(map[toolbox.Address]tinyObjectState),
+		LargeCycle:  g.large.cycle,
+		LargeRuns:   make(map[toolbox.Pages][]go115LargeRunState),
+	}
+	// Every live span is in the index, once for each of its pages.
+	for addr, s := range g.index {
+		if addr != s.base {
+			continue
+		}
+		words := (s.numElems + 63) / 64
+		st.Spans = append(st.Spans, go115SpanState{
+			Base:       s.base,
+			NPages:     s.npages,
+			Class:      s.class,
+			ElemSize:   s.elemSize,
+			NumElems:   s.numElems,
+			AllocCount: s.allocCount,
+			FreedCount: s.freedCount,
+			Cached:     s.cached,
+			Free:       s.free[:words],
+			Freed:      s.freed[:words],
+			TailWaste:  s.tailWaste,
+			HeapBits:   s.heapBits,
+			Header:     s.header,
+			ObjUnused:  s.objUnused,
+			ScUnused:   s.scUnused,
+			ScFreed:    s.scFreed,
+		})
+	}
+	for spc := range g.central {
+		c := &g.central[spc]
+		for i := range c.partial {
+			st.Central[spc].Partial[i] = saveGo115SpanList(&c.partial[i])
+			st.Central[spc].Full[i] = saveGo115SpanList(&c.full[i])
+		}
+	}
+	for p, c := range g.caches {
+		bases := make([]toolbox.Address, len(c.alloc))
+		for spc, s := range c.alloc {
+			if s != nil {
+				bases[spc] = s.base
+			}
+		}
+		st.Caches[p] = bases
+	}
+	blocks := make(map[*tinyBlock]int)
+	blockIndex := func(b *tinyBlock) int {
+		i, ok := blocks[b]
+		if !ok {
+			i = len(st.TinyBlocks)
+			blocks[b] = i
+			st.TinyBlocks = append(st.TinyBlocks, tinyBlockState{
+				Base:    b.base,
+				P:       b.p,
+				Offset:  b.offset,
+				Objects: b.objects,
+				Live:    b.live,
+				Dead:    b.dead,
+			})
+		}
+		return i
+	}
+	for addr, obj := range g.tiny.objects {
+		st.TinyObjects[addr] = tinyObjectState{blockIndex(obj.block), obj.size}
+	}
+	for p, b := range g.tiny.current {
+		st.TinyCurrent[p] = blockIndex(b)
+	}
+	for _, b := range g.tiny.empty {
+		st.TinyEmpty = append(st.TinyEmpty, blockIndex(b))
+	}
+	for npages, runs := range g.large.runs {
+		for _, r := range runs {
+			st.LargeRuns[npages] = append(st.LargeRuns[npages], go115LargeRunState{r.base, r.cycle})
+		}
+	}
+	return enc.Encode(&st)
+}
+
+// LoadState implements simulation.Checkpointer.
+func (g *Go115) LoadState(dec *gob.Decoder) error {
+	var st go115State
+	if err := dec.Decode(&st); err != nil {
+		return err
+	}
+	if len(st.Central) != len(g.central) {
+		return fmt.Errorf("checkpoint has %d span classes, but there are %d", len(st.Central), len(g.central))
+	}
+	g.sweptIdx = st.SweptIdx
+	g.index = make(map[toolbox.Address]*go115Span)
+	spans := make(map[toolbox.Address]*go115Span)
+	for _, ss := range st.Spans {
+		s := &go115Span{
+			base:       ss.Base,
+			npages:     ss.NPages,
+			class:      ss.Class,
+			elemSize:   ss.ElemSize,
+			numElems:   ss.NumElems,
+			allocCount: ss.AllocCount,
+			freedCount: ss.FreedCount,
+			cached:     ss.Cached,
+			tailWaste:  ss.TailWaste,
+			heapBits:   ss.HeapBits,
+			header:     ss.Header,
+			objUnused:  ss.ObjUnused,
+			scUnused:   ss.ScUnused,
+			scFreed:    ss.ScFreed,
+		}
+		copy(s.free[:], ss.Free)
+		copy(s.freed[:], ss.Freed)
+		spans[s.base] = s
+		g.addToIndex(s)
+	}
+	lookup := func(base toolbox.Address) (*go115Span, error) {
+		s, ok := spans[base]
+		if !ok {
+			return nil, fmt.Errorf("checkpoint refers to unknown span %#x", base)
+		}
+		return s, nil
+	}
+	restoreList := func(l *go115SpanList, bases []toolbox.Address) error {
+		*l = go115SpanList{}
+		for _, base := range bases {
+			s, err := lookup(base)
+			if err != nil {
+				return err
+			}
+			l.pushBack(s)
+		}
+		return nil
+	}
+	for spc := range g.central {
+		c := &g.central[spc]
+		for i := range c.partial {
+			if err := restoreList(&c.partial[i], st.Central[spc].Partial[i]); err != nil {
+				return err
+			}
+			if err := restoreList(&c.full[i], st.Central[spc].Full[i]); err != nil {
+				return err
+			}
+		}
+	}
+	g.caches = make(map[toolbox.P]*go115Cache)
+	for p, bases := range st.Caches {
+		c := &go115Cache{alloc: make([]*go115Span, g.classes.numSpanClasses())}
+		for spc, base := range bases {
+			if base == 0 {
+				continue
+			}
+			s, err := lookup(base)
+			if err != nil {
+				return err
+			}
+			c.alloc[spc] = s
+		}
+		g.caches[p] = c
+	}
+	g.objectSizes = st.ObjectSizes
+	if g.objectSizes == nil {
+		g.objectSizes = make(map[toolbox.Address]toolbox.Bytes)
+	}
+	blocks := make([]*tinyBlock, len(st.TinyBlocks))
+	for i, bs := range st.TinyBlocks {
+		blocks[i] = &tinyBlock{
+			base:    bs.Base,
+			p:       bs.P,
+			offset:  bs.Offset,
+			objects: bs.Objects,
+			live:    bs.Live,
+			dead:    bs.Dead,
+		}
+	}
+	block := func(i int) (*tinyBlock, error) {
+		if i < 0 || i >= len(blocks) {
+			return nil, fmt.Errorf("checkpoint refers to unknown tiny block %d", i)
+		}
+		return blocks[i], nil
+	}
+	g.tiny.current = make(map[toolbox.P]*tinyBlock)
+	for p, i := range st.TinyCurrent {
+		b, err := block(i)
+		if err != nil {
+			return err
+		}
+		g.tiny.current[p] = b
+	}
+	g.tiny.objects = make(map[toolbox.Address]tinyObject)
+	for addr, obj := range st.TinyObjects {
+		b, err := block(obj.Block)
+		if err != nil {
+			return err
+		}
+		g.tiny.objects[addr] = tinyObject{block: b, size: obj.Size}
+	}
+	g.tiny.empty = nil
+	for _, i := range st.TinyEmpty {
+		b, err := block(i)
+		if err != nil {
+			return err
+		}
+		g.tiny.empty = append(g.tiny.empty, b)
+	}
+	g.large.cycle = st.LargeCycle
+	g.large.runs = make(map[toolbox.Pages][]go115LargeRun)
+	for npages, runs := range st.LargeRuns {
+		for _, r := range runs {
+			g.large.runs[npages] = append(g.large.runs[npages], go115LargeRun{base: r.Base, cycle: r.Cycle})
+		}
+	}
+	return nil
 }
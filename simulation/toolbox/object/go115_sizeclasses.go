@@ -74,7 +74,6 @@ import (
 
 const (
 	go115NumSizeClasses     = 67
-	go115NumSpanClasses     = go115NumSizeClasses * 2
 	go115MaxSmallObjectSize = 32 << 10
 )
 
@@ -90,13 +89,10 @@ var go115SizeClassToSize = [go115NumSizeClasses]toolbox.Bytes{
 
 var go115ClassToPages = [go115NumSizeClasses]toolbox.Pages{0, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 2, 1, 2, 1, 2, 1, 3, 2, 3, 1, 3, 2, 3, 4, 5, 6, 1, 7, 6, 5, 4, 3, 5, 7, 2, 9, 7, 5, 8, 3, 10, 7, 4}
 
-func go115SizeToClass(size toolbox.Bytes) int8 {
-	for i, s := range go115SizeClassToSize {
-		if size <= s {
-			return int8(i)
-		}
-	}
-	return -1
+var go115SizeClasses = sizeClasses{
+	size:     go115SizeClassToSize[:],
+	pages:    go115ClassToPages[:],
+	maxSmall: go115MaxSmallObjectSize,
 }
 
 type go115SpanClass uint8
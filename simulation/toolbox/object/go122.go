@@ -0,0 +1,61 @@
+package object
+
+import (
+	"errors"
+
+	"github.com/mknyszek/goat/simulation/toolbox"
+)
+
+const (
+	// go122MallocHeaderSize is the size of the header that holds the
+	// type of each small object with pointers that has no heap bitmap.
+	go122MallocHeaderSize = 8
+
+	// go122MinSizeForMallocHeader is the object size above which
+	// objects with pointers get a malloc header. Objects up to this
+	// size instead have their pointer bitmap stored at the end of
+	// their span, which costs 1/64th of the span.
+	go122MinSizeForMallocHeader = 512
+)
+
+// Go122 is an object allocator modeled after the Go runtime's since
+// Go 1.22, when allocation headers replaced the heap bitmap.
+//
+// It differs from Go115 in a few ways:
+//   - It uses the newer size class table, which adds a 24-byte class.
+//   - Objects with pointers that are larger than 512 bytes carry an
+//     8-byte header, which is accounted for before picking a size
+//     class and reported as unused memory.
+//   - Spans of smaller objects with pointers reserve space at their
+//     end for a pointer bitmap, which is also reported as unused.
+//   - Objects larger than 32 KiB minus the header size are large
+//     objects. Large objects have no header, since their type is
+//     stored in their span.
+//
+// It accepts the same configuration options as Go115.
+type Go122 struct {
+	Go115
+}
+
+func NewGo122(pa toolbox.PageAllocator, options ...Go115Option) *Go122 {
+	if pa.BytesPerPage() != 8192 {
+		panic("page allocator must have 8 KiB pages")
+	}
+	return &Go122{*newGo115(pa, &go122SizeClasses, true, go115Stats{prefix: "Go122"}, options)}
+}
+
+func init() {
+	toolbox.RegisterObjectAllocator("go122", func(pa toolbox.PageAllocator, p toolbox.Params) (toolbox.ObjectAllocator, error) {
+		if err := p.Check(go115Params...); err != nil {
+			return nil, err
+		}
+		if pa.BytesPerPage() != 8192 {
+			return nil, errors.New("page allocator must have 8 KiB pages")
+		}
+		options, err := decodeGo115(p)
+		if err != nil {
+			return nil, err
+		}
+		return NewGo122(pa, options...), nil
+	})
+}
@@ -1,6 +1,11 @@
 package object
 
 import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"sort"
+
 	"github.com/mknyszek/goat/simulation"
 	"github.com/mknyszek/goat/simulation/toolbox"
 )
@@ -97,6 +102,11 @@ type immixSpan struct {
 	allocCount   uint64
 	freedCount   uint64
 	unused       [64]toolbox.Bytes
+	stats        *immixStats
+
+	// objects indexes the span's objects by address. It's only
+	// maintained for small object spans when evacuation is on.
+	objects map[toolbox.Address]struct{}
 }
 
 func (s *immixSpan) alloc(ctx toolbox.Context, headerSize, size toolbox.Bytes) toolbox.Address {
@@ -124,15 +134,15 @@ func (s *immixSpan) alloc(ctx toolbox.Context, headerSize, size toolbox.Bytes) t
 	if lo.Add(size) <= s.bumpHi {
 		unused := lo.Add(headerSize).Diff(s.bumpLo)
 		{
-			ctx.Stats.AddOther(immixHeaderStat, uint64(headerSize))
+			s.stats.header.Add(uint64(headerSize))
 			ctx.Stats.FreeBytes -= uint64(unused)
 			ctx.Stats.UnusedBytes += uint64(unused)
 			if s.class == immixTiny {
-				ctx.Stats.AddOther(immixTinyWasteStat, uint64(unused))
+				s.stats.tinyWaste.Add(uint64(unused))
 			} else if s.class == immixSmall {
-				ctx.Stats.AddOther(immixSmallWasteStat, uint64(unused))
+				s.stats.smallWaste.Add(uint64(unused))
 			} else if s.class == immixMedium {
-				ctx.Stats.AddOther(immixMediumWasteStat, uint64(unused))
+				s.stats.mediumWaste.Add(uint64(unused))
 			}
 			startLine := uint64(s.bumpLo.Diff(s.base) / s.lineSize)
 			endLine := uint64(lo.Add(headerSize).Diff(s.base) / s.lineSize)
@@ -161,7 +171,7 @@ func (s *immixSpan) alloc(ctx toolbox.Context, headerSize, size toolbox.Bytes) t
 		endLine := uint64((lo.Diff(s.base) + size - 1) / s.lineSize)
 		for i := startLine; i <= endLine; i++ {
 			if s.lineRefCount[i] == 0 {
-				ctx.Stats.AddOther(immixLinesStat, 1)
+				s.stats.lines.Add(1)
 			}
 			s.lineRefCount[i]++
 		}
@@ -186,11 +196,11 @@ func (s *immixSpan) refill(ctx toolbox.Context) {
 		ctx.Stats.FreeBytes -= uint64(unused)
 		ctx.Stats.UnusedBytes += uint64(unused)
 		if s.class == immixTiny {
-			ctx.Stats.AddOther(immixTinyWasteStat, uint64(unused))
+			s.stats.tinyWaste.Add(uint64(unused))
 		} else if s.class == immixSmall {
-			ctx.Stats.AddOther(immixSmallWasteStat, uint64(unused))
+			s.stats.smallWaste.Add(uint64(unused))
 		} else if s.class == immixMedium {
-			ctx.Stats.AddOther(immixMediumWasteStat, uint64(unused))
+			s.stats.mediumWaste.Add(uint64(unused))
 		}
 		startLine := uint64(s.bumpLo.Diff(s.base) / s.lineSize)
 		endLine := uint64((s.bumpHi.Diff(s.base)) / s.lineSize)
@@ -246,14 +256,14 @@ func (s *immixSpan) sweep(ctx toolbox.Context) {
 			ctx.Stats.FreeBytes += uint64(s.unused[i])
 			ctx.Stats.UnusedBytes -= uint64(s.unused[i])
 			if s.lineRefDec[i] != 0 {
-				ctx.Stats.SubOther(immixLinesStat, 1)
+				s.stats.lines.Sub(1)
 			}
 			if s.class == immixTiny {
-				ctx.Stats.SubOther(immixTinyWasteStat, uint64(s.unused[i]))
+				s.stats.tinyWaste.Sub(uint64(s.unused[i]))
 			} else if s.class == immixSmall {
-				ctx.Stats.SubOther(immixSmallWasteStat, uint64(s.unused[i]))
+				s.stats.smallWaste.Sub(uint64(s.unused[i]))
 			} else if s.class == immixMedium {
-				ctx.Stats.SubOther(immixMediumWasteStat, uint64(s.unused[i]))
+				s.stats.mediumWaste.Sub(uint64(s.unused[i]))
 			}
 			s.unused[i] = 0
 			if i < start {
@@ -291,6 +301,21 @@ type immixCache struct {
 	overflow [immixNumSpanClasses]*immixSpan
 }
 
+// cachedBytes returns the free memory the cache can bump allocate
+// into without a refill.
+func (c *immixCache) cachedBytes() toolbox.Bytes {
+	total := toolbox.Bytes(0)
+	for spc := range c.alloc {
+		if s := c.alloc[spc]; s != nil {
+			total += s.bumpHi.Diff(s.bumpLo)
+		}
+		if s := c.overflow[spc]; s != nil {
+			total += s.bumpHi.Diff(s.bumpLo)
+		}
+	}
+	return total
+}
+
 type Immix struct {
 	sweptIdx      uint
 	pageAllocator toolbox.PageAllocator
@@ -298,35 +323,213 @@ type Immix struct {
 	caches        map[toolbox.P]*immixCache
 	central       [immixNumSpanClasses]immixCentral
 	objectSizes   map[toolbox.Address]toolbox.Bytes
+	lineSizes     [immixNumSpanClasses]toolbox.Bytes
+	tinyMaxSize   toolbox.Bytes
+
+	// evacThreshold is the line occupancy, in percent, at or below
+	// which a span is evacuated. Zero means no evacuation.
+	evacThreshold uint64
+
+	// moved is called whenever an object moves.
+	moved func(from, to toolbox.Address)
+
+	stats immixStats
+}
+
+// ImmixOption is a configuration option for an Immix object allocator.
+type ImmixOption func(g *Immix)
+
+// ImmixLineSizes returns a configuration option that sets the line size
+// for spans of tiny, small, and medium objects respectively.
+//
+// Line sizes must be powers of two, and no span may contain more than 64
+// lines, so the minimum line size for tiny and small spans is 128 bytes,
+// and 2 KiB for medium spans.
+func ImmixLineSizes(tiny, small, medium toolbox.Bytes) ImmixOption {
+	return func(g *Immix) {
+		g.lineSizes[immixTiny] = tiny
+		g.lineSizes[immixSmall] = small
+		g.lineSizes[immixMedium] = medium
+	}
+}
+
+// ImmixTinyMaxSize returns a configuration option that sets the maximum
+// size of an object allocated out of a tiny span. Such objects have no
+// header.
+func ImmixTinyMaxSize(size toolbox.Bytes) ImmixOption {
+	return func(g *Immix) {
+		g.tinyMaxSize = size
+	}
+}
+
+// ImmixEvacuationThreshold returns a configuration option that turns
+// on opportunistic evacuation. When a GC starts, every span whose
+// fraction of occupied lines is at or below percent has its live
+// objects moved into fresh spans, so that it may be freed.
+//
+// Moves are reported to the move handler, so objects are only
+// evacuated once one is set.
+//
+// The default is 0, which turns evacuation off.
+func ImmixEvacuationThreshold(percent uint64) ImmixOption {
+	return func(g *Immix) {
+		g.evacThreshold = percent
+	}
 }
 
-func NewImmix(pa toolbox.PageAllocator) *Immix {
+// NewImmix creates a new Immix object allocator on top of pa, which must
+// have 8 KiB pages. Panics if the configuration is invalid.
+func NewImmix(pa toolbox.PageAllocator, options ...ImmixOption) *Immix {
+	g, err := NewImmixChecked(pa, options...)
+	if err != nil {
+		panic(err.Error())
+	}
+	return g
+}
+
+// NewImmixChecked is like NewImmix, but returns an error instead of
+// panicking if the configuration is invalid.
+func NewImmixChecked(pa toolbox.PageAllocator, options ...ImmixOption) (*Immix, error) {
 	if pa.BytesPerPage() != 8192 {
-		panic("page allocator must have 8 KiB pages")
+		return nil, errors.New("page allocator must have 8 KiB pages")
 	}
-	return &Immix{
+	g := &Immix{
 		pageAllocator: pa,
 		index:         make(map[toolbox.Address]*immixSpan),
 		caches:        make(map[toolbox.P]*immixCache),
 		objectSizes:   make(map[toolbox.Address]toolbox.Bytes),
+		lineSizes:     immixClassToLineSize,
+		tinyMaxSize:   immixTinyMaxSize,
+	}
+	for _, opt := range options {
+		opt(g)
 	}
+	if err := g.checkConfig(); err != nil {
+		return nil, err
+	}
+	return g, nil
 }
 
-const (
-	immixHeaderStat      = "ImmixLiveObjectHeaderBytes"
-	immixLinesStat       = "ImmixLinesOccupied"
-	immixTinyWasteStat   = "ImmixTinyObjectUnusedBytes"
-	immixSmallWasteStat  = "ImmixSmallObjectUnusedBytes"
-	immixMediumWasteStat = "ImmixMediumObjectUnusedBytes"
+func (g *Immix) checkConfig() error {
+	pageSize := g.pageAllocator.BytesPerPage()
+	for spc := immixTiny; spc < immixNumSpanClasses; spc++ {
+		lineSize := g.lineSizes[spc]
+		if lineSize == 0 || lineSize&(lineSize-1) != 0 {
+			return errors.New("immix line sizes must be powers of two")
+		}
+		if lines := immixClassToPages[spc].Bytes(pageSize) / lineSize; lines > 64 || lines < 4 {
+			return fmt.Errorf("immix span class %d must have between 4 and 64 lines", spc)
+		}
+	}
+	if g.tinyMaxSize == 0 || g.tinyMaxSize > 2<<10 {
+		return errors.New("immix tiny object size cutoff must be between 1 and 2048 bytes")
+	}
+	if g.evacThreshold > 100 {
+		return errors.New("immix evacuation threshold must be at most 100 percent")
+	}
+	return nil
+}
+
+var (
+	immixHeaderStat = simulation.StatDesc{
+		Name:        "ImmixLiveObjectHeaderBytes",
+		Unit:        simulation.UnitBytes,
+		Description: "memory occupied by the headers of live objects",
+	}
+	immixLinesStat = simulation.StatDesc{
+		Name:        "ImmixLinesOccupied",
+		Description: "lines occupied by at least one object",
+	}
+	immixTinyWasteStat = simulation.StatDesc{
+		Name:        "ImmixTinyObjectUnusedBytes",
+		Unit:        simulation.UnitBytes,
+		Description: "memory in tiny object spans not usable until swept",
+	}
+	immixSmallWasteStat = simulation.StatDesc{
+		Name:        "ImmixSmallObjectUnusedBytes",
+		Unit:        simulation.UnitBytes,
+		Description: "memory in small object spans not usable until swept",
+	}
+	immixMediumWasteStat = simulation.StatDesc{
+		Name:        "ImmixMediumObjectUnusedBytes",
+		Unit:        simulation.UnitBytes,
+		Description: "memory in medium object spans not usable until swept",
+	}
+	immixEvacBytesStat = simulation.StatDesc{
+		Name:        "ImmixEvacuatedBytes",
+		Kind:        simulation.Counter,
+		Unit:        simulation.UnitBytes,
+		Description: "memory of objects moved by opportunistic evacuation",
+	}
+	immixEvacSpansStat = simulation.StatDesc{
+		Name:        "ImmixEvacuatedSpans",
+		Kind:        simulation.Counter,
+		Description: "spans emptied by opportunistic evacuation",
+	}
 )
 
+// immixStats are handles to an Immix's statistics.
+type immixStats struct {
+	header      *simulation.Stat
+	lines       *simulation.Stat
+	tinyWaste   *simulation.Stat
+	smallWaste  *simulation.Stat
+	mediumWaste *simulation.Stat
+	evacBytes   *simulation.Stat
+	evacSpans   *simulation.Stat
+}
+
+func init() {
+	toolbox.RegisterObjectAllocator("immix", func(pa toolbox.PageAllocator, p toolbox.Params) (toolbox.ObjectAllocator, error) {
+		if err := p.Check("tinyLineSize", "smallLineSize", "mediumLineSize", "tinyMaxSize", "evacuationThreshold"); err != nil {
+			return nil, err
+		}
+		var lineSizes [immixNumSpanClasses]toolbox.Bytes
+		var err error
+		for spc, name := range map[immixSpanClass]string{
+			immixTiny:   "tinyLineSize",
+			immixSmall:  "smallLineSize",
+			immixMedium: "mediumLineSize",
+		} {
+			lineSizes[spc], err = p.Bytes(name, immixClassToLineSize[spc])
+			if err != nil {
+				return nil, err
+			}
+		}
+		tinyMaxSize, err := p.Bytes("tinyMaxSize", immixTinyMaxSize)
+		if err != nil {
+			return nil, err
+		}
+		evacThreshold, err := p.Uint64("evacuationThreshold", 0)
+		if err != nil {
+			return nil, err
+		}
+		g, err := NewImmixChecked(pa,
+			ImmixLineSizes(lineSizes[immixTiny], lineSizes[immixSmall], lineSizes[immixMedium]),
+			ImmixTinyMaxSize(tinyMaxSize),
+			ImmixEvacuationThreshold(evacThreshold),
+		)
+		if err != nil {
+			return nil, err
+		}
+		return g, nil
+	})
+}
+
 func (g *Immix) RegisterStats(stats *simulation.Stats) {
 	g.pageAllocator.RegisterStats(stats)
-	stats.RegisterOther(immixHeaderStat)
-	stats.RegisterOther(immixLinesStat)
-	stats.RegisterOther(immixTinyWasteStat)
-	stats.RegisterOther(immixSmallWasteStat)
-	stats.RegisterOther(immixMediumWasteStat)
+	g.stats.header = stats.RegisterOther(immixHeaderStat)
+	g.stats.lines = stats.RegisterOther(immixLinesStat)
+	g.stats.tinyWaste = stats.RegisterOther(immixTinyWasteStat)
+	g.stats.smallWaste = stats.RegisterOther(immixSmallWasteStat)
+	g.stats.mediumWaste = stats.RegisterOther(immixMediumWasteStat)
+	g.stats.evacBytes = stats.RegisterOther(immixEvacBytesStat)
+	g.stats.evacSpans = stats.RegisterOther(immixEvacSpansStat)
+}
+
+// SetMoveHandler implements toolbox.Mover.
+func (g *Immix) SetMoveHandler(moved func(from, to toolbox.Address)) {
+	g.moved = moved
 }
 
 func (g *Immix) refill(ctx toolbox.Context, spc immixSpanClass, overflow bool) {
@@ -387,13 +590,22 @@ func (g *Immix) refill(ctx toolbox.Context, spc immixSpanClass, overflow bool) {
 		}
 	}
 fresh:
-	// Create small object span.
+	s = g.newSpan(ctx, spc)
+	if overflow {
+		g.caches[ctx.P].overflow[spc] = s
+	} else {
+		g.caches[ctx.P].alloc[spc] = s
+	}
+}
+
+// newSpan allocates a fresh span for the given span class.
+func (g *Immix) newSpan(ctx toolbox.Context, spc immixSpanClass) *immixSpan {
 	pageSize := g.pageAllocator.BytesPerPage()
 	npages := immixClassToPages[spc]
-	lineSize := immixClassToLineSize[spc]
+	lineSize := g.lineSizes[spc]
 	lineCount := uint64(npages.Bytes(pageSize) / lineSize)
 	x := g.pageAllocator.AllocPages(ctx, npages)
-	s = &immixSpan{
+	s := &immixSpan{
 		class:       spc,
 		base:        x,
 		npages:      npages,
@@ -402,6 +614,7 @@ fresh:
 		lineFreeIdx: lineCount,
 		bumpLo:      x,
 		bumpHi:      x.Add(npages.Bytes(pageSize)),
+		stats:       &g.stats,
 	}
 	if spc == immixTiny {
 		// The first line is occupied by ptr-scan bits.
@@ -412,14 +625,13 @@ fresh:
 		s.unused[1] = s.lineSize
 		ctx.Stats.FreeBytes -= uint64(2 * s.lineSize)
 		ctx.Stats.UnusedBytes += uint64(2 * s.lineSize)
-		ctx.Stats.AddOther(immixTinyWasteStat, uint64(2*s.lineSize))
+		g.stats.tinyWaste.Add(uint64(2 * s.lineSize))
 	}
-	g.addToIndex(s)
-	if overflow {
-		g.caches[ctx.P].overflow[spc] = s
-	} else {
-		g.caches[ctx.P].alloc[spc] = s
+	if g.evacThreshold != 0 {
+		s.objects = make(map[toolbox.Address]struct{})
 	}
+	g.addToIndex(s)
+	return s
 }
 
 func (g *Immix) addToIndex(s *immixSpan) {
@@ -442,7 +654,7 @@ func (g *Immix) AllocObject(ctx toolbox.Context, size toolbox.Bytes, array, _ bo
 	}
 	if size <= 32<<10 {
 		headerSize := toolbox.Bytes(0)
-		if size > immixTinyMaxSize {
+		if size > g.tinyMaxSize {
 			headerSize += 8
 			if array && size > 464 {
 				headerSize += 8
@@ -459,9 +671,11 @@ func (g *Immix) AllocObject(ctx toolbox.Context, size toolbox.Bytes, array, _ bo
 		if size <= 2<<10 {
 			spc = immixSmall
 		}
-		if size <= immixTinyMaxSize {
+		if size <= g.tinyMaxSize {
 			spc = immixTiny
 		}
+		ps := ctx.PStats()
+		ps.CachedBytes -= uint64(c.cachedBytes())
 		var x toolbox.Address
 		s := c.alloc[spc]
 	loop:
@@ -472,6 +686,7 @@ func (g *Immix) AllocObject(ctx toolbox.Context, size toolbox.Bytes, array, _ bo
 				if x == 0 {
 					c.overflow[spc].refill(ctx)
 					g.refill(ctx, spc, true)
+					ps.Refills++
 					x = c.overflow[spc].alloc(ctx, headerSize, size)
 				}
 			} else if s != nil && s.lineFreeIdx < s.lineCount {
@@ -482,6 +697,7 @@ func (g *Immix) AllocObject(ctx toolbox.Context, size toolbox.Bytes, array, _ bo
 					s.refill(ctx)
 				}
 				g.refill(ctx, spc, false)
+				ps.Refills++
 				s = c.alloc[spc]
 				goto loop
 			}
@@ -491,6 +707,8 @@ func (g *Immix) AllocObject(ctx toolbox.Context, size toolbox.Bytes, array, _ bo
 			arrayBit = 1 << 1
 		}
 		g.objectSizes[x] = ((dataSize << 2) | 1) | arrayBit
+		g.indexObject(x)
+		ps.CachedBytes += uint64(c.cachedBytes())
 		return x
 	}
 	pageSize := g.pageAllocator.BytesPerPage()
@@ -504,10 +722,11 @@ func (g *Immix) AllocObject(ctx toolbox.Context, size toolbox.Bytes, array, _ bo
 		lineCount:   1,
 		lineSize:    size,
 		allocCount:  1,
+		stats:       &g.stats,
 	}
 	s.unused[0] = npages.Bytes(pageSize) - size
 	s.lineRefCount[0] = 1
-	ctx.Stats.AddOther(immixLinesStat, 1)
+	g.stats.lines.Add(1)
 	g.central[immixLarge].full[g.sweptIdx].pushFront(s)
 	g.addToIndex(s)
 	g.objectSizes[x] = size << 2
@@ -518,14 +737,25 @@ func (g *Immix) AllocObject(ctx toolbox.Context, size toolbox.Bytes, array, _ bo
 	return x
 }
 
+// indexObject adds the small object at x to its span's object index,
+// if the span has one.
+func (g *Immix) indexObject(x toolbox.Address) {
+	if s := g.index[x.AlignDown(g.pageAllocator.BytesPerPage())]; s.objects != nil {
+		s.objects[x] = struct{}{}
+	}
+}
+
 func (g *Immix) DeadObject(ctx toolbox.Context, addr toolbox.Address) {
 	// Get the span, size of the object, and size of the object's header.
 	s := g.index[addr.AlignDown(g.pageAllocator.BytesPerPage())]
 	sizeVal := g.objectSizes[addr]
 	delete(g.objectSizes, addr)
+	if s.objects != nil {
+		delete(s.objects, addr)
+	}
 	headerSize := toolbox.Bytes(0)
 	dataSize := sizeVal >> 2
-	if dataSize > immixTinyMaxSize {
+	if dataSize > g.tinyMaxSize {
 		if sizeVal&1 != 0 {
 			headerSize += 8
 		}
@@ -553,13 +783,13 @@ func (g *Immix) DeadObject(ctx toolbox.Context, addr toolbox.Address) {
 	ctx.Stats.ObjectBytes -= uint64(dataSize)
 	ctx.Stats.UnusedBytes += uint64(dataSize)
 	if s.class == immixTiny {
-		ctx.Stats.AddOther(immixTinyWasteStat, uint64(dataSize))
+		g.stats.tinyWaste.Add(uint64(dataSize))
 	} else if s.class == immixSmall {
-		ctx.Stats.AddOther(immixSmallWasteStat, uint64(dataSize))
+		g.stats.smallWaste.Add(uint64(dataSize))
 	} else if s.class == immixMedium {
-		ctx.Stats.AddOther(immixMediumWasteStat, uint64(dataSize))
+		g.stats.mediumWaste.Add(uint64(dataSize))
 	}
-	ctx.Stats.SubOther(immixHeaderStat, uint64(headerSize))
+	g.stats.header.Sub(uint64(headerSize))
 	if s.class != immixLarge {
 		lo := addr.Add(headerSize)
 		startLine = uint64(lo.Diff(s.base) / s.lineSize)
@@ -590,14 +820,14 @@ func (g *Immix) DeadObject(ctx toolbox.Context, addr toolbox.Address) {
 			ctx.Stats.FreeBytes += uint64(s.unused[i])
 			ctx.Stats.UnusedBytes -= uint64(s.unused[i])
 			if s.class == immixTiny {
-				ctx.Stats.SubOther(immixTinyWasteStat, uint64(s.unused[i]))
+				g.stats.tinyWaste.Sub(uint64(s.unused[i]))
 			} else if s.class == immixSmall {
-				ctx.Stats.SubOther(immixSmallWasteStat, uint64(s.unused[i]))
+				g.stats.smallWaste.Sub(uint64(s.unused[i]))
 			} else if s.class == immixMedium {
-				ctx.Stats.SubOther(immixMediumWasteStat, uint64(s.unused[i]))
+				g.stats.mediumWaste.Sub(uint64(s.unused[i]))
 			}
 			if ((s.class == immixTiny && i > 1) || s.class != immixTiny) && s.lineRefCount[i] != 0 {
-				ctx.Stats.SubOther(immixLinesStat, 1)
+				g.stats.lines.Sub(1)
 			}
 			if ((s.class == immixTiny && i > 1) || s.class != immixTiny) && s.lineRefCount[i] != s.lineRefDec[i] {
 				panic("totally free span doesn't have matching ref count and dec")
@@ -629,11 +859,104 @@ func (g *Immix) GCStart(ctx toolbox.Context) {
 			}
 		}
 	}
+	if g.evacThreshold != 0 && g.moved != nil {
+		g.evacuate(ctx)
+	}
+}
+
+// evacuate moves the live objects out of every span whose line
+// occupancy is at or below the evacuation threshold into fresh spans,
+// freeing the evacuated spans.
+//
+// It must be called after every span has been swept.
+func (g *Immix) evacuate(ctx toolbox.Context) {
+	var candidates []*immixSpan
+	for spc := immixTiny; spc < immixNumSpanClasses; spc++ {
+		for _, list := range []*immixSpanList{&g.central[spc].partial[g.sweptIdx], &g.central[spc].full[g.sweptIdx]} {
+			for s := list.first; s != nil; s = s.next {
+				first := uint64(0)
+				if spc == immixTiny {
+					// Skip the ptr-scan bits.
+					first = 2
+				}
+				occupied := uint64(0)
+				for i := first; i < s.lineCount; i++ {
+					if s.lineRefCount[i] != 0 {
+						occupied++
+					}
+				}
+				if occupied != 0 && occupied*100 <= g.evacThreshold*(s.lineCount-first) {
+					candidates = append(candidates, s)
+				}
+			}
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].base < candidates[j].base
+	})
+
+	var fresh [immixNumSpanClasses]*immixSpan
+	var objects []toolbox.Address
+	for _, s := range candidates {
+		// Move the span's live objects in address order.
+		objects = objects[:0]
+		for x := range s.objects {
+			objects = append(objects, x)
+		}
+		sort.Slice(objects, func(i, j int) bool {
+			return objects[i] < objects[j]
+		})
+		for _, x := range objects {
+			sizeVal := g.objectSizes[x]
+			dataSize := sizeVal >> 2
+			headerSize := toolbox.Bytes(0)
+			if dataSize > g.tinyMaxSize {
+				headerSize += 8
+				if sizeVal&(1<<1) != 0 {
+					headerSize += 8
+				}
+			}
+			size := dataSize + headerSize
+			y := fresh[s.class].alloc(ctx, headerSize, size)
+			if y == 0 {
+				if old := fresh[s.class]; old != nil {
+					old.refill(ctx)
+					g.central[s.class].full[g.sweptIdx].pushFront(old)
+				}
+				fresh[s.class] = g.newSpan(ctx, s.class)
+				y = fresh[s.class].alloc(ctx, headerSize, size)
+			}
+			g.objectSizes[y] = sizeVal
+			fresh[s.class].objects[y] = struct{}{}
+
+			// Moving the object is neither an allocation nor a free.
+			ctx.Stats.Allocs--
+			if s.freedCount+1 == s.allocCount {
+				ctx.Stats.Frees -= s.freedCount + 1
+				g.stats.evacSpans.Add(1)
+			}
+			g.DeadObject(ctx, x)
+			g.stats.evacBytes.Add(uint64(size))
+			g.moved(x, y)
+		}
+	}
+	for _, s := range fresh {
+		if s != nil {
+			g.central[s.class].full[g.sweptIdx].pushFront(s)
+		}
+	}
 }
 
 func (g *Immix) GCEnd(ctx toolbox.Context) {
-	// Flush all caches for sweeping.
-	for _, cache := range g.caches {
+	// Flush all caches for sweeping, in a fixed order so the span
+	// lists are the same every run.
+	order := make([]toolbox.P, 0, len(g.caches))
+	for p := range g.caches {
+		order = append(order, p)
+	}
+	for _, p := range sortPs(order) {
+		cache := g.caches[p]
+		ctx.Stats.PerP(int32(p)).CachedBytes -= uint64(cache.cachedBytes())
 		for spc, s := range cache.alloc {
 			if s != nil {
 				s.cached = false
@@ -663,3 +986,229 @@ func (g *Immix) GCEnd(ctx toolbox.Context) {
 		g.sweptIdx = 1
 	}
 }
+
+// Inspect implements toolbox.Inspector. The class of a span of small
+// objects is 1 for tiny objects, 2 for small objects, and 3 for
+// medium objects.
+func (g *Immix) Inspect() []toolbox.SpanInfo {
+	var spans []toolbox.SpanInfo
+	for addr, s := range g.index {
+		if addr != s.base {
+			continue
+		}
+		info := toolbox.SpanInfo{
+			Base:    s.base,
+			Size:    s.npages.Bytes(g.pageAllocator.BytesPerPage()),
+			Objects: int(s.allocCount - s.freedCount),
+			Cached:  s.cached,
+		}
+		if s.class == immixLarge {
+			info.Kind = toolbox.SpanLarge
+			info.ElemSize = s.lineSize
+		} else {
+			info.Kind = toolbox.SpanSmall
+			info.Class = int(s.class)
+			info.Lines = make([]toolbox.LineState, s.lineCount)
+			for i := range info.Lines {
+				if s.lineRefCount[i] == 0 {
+					info.Lines[i] = toolbox.LineFree
+				} else if s.lineRefCount[i] == s.lineRefDec[i] {
+					info.Lines[i] = toolbox.LineDead
+				} else {
+					info.Lines[i] = toolbox.LineLive
+				}
+			}
+		}
+		spans = append(spans, info)
+	}
+	toolbox.SortSpans(spans)
+	return spans
+}
+
+// immixSpanState is the saved state of an immixSpan.
+type immixSpanState struct {
+	Base         toolbox.Address
+	NPages       toolbox.Pages
+	Class        immixSpanClass
+	Cached       bool
+	LineFreeIdx  uint64
+	LineCount    uint64
+	LineSize     toolbox.Bytes
+	LineRefCount [64]uint16
+	LineRefDec   [64]uint16
+	BumpLo       toolbox.Address
+	BumpHi       toolbox.Address
+	AllocCount   uint64
+	FreedCount   uint64
+	Unused       [64]toolbox.Bytes
+}
+
+// immixCentralState is the saved state of an immixCentral, with
+// spans identified by their base address.
+type immixCentralState struct {
+	Partial [2][]toolbox.Address
+	Full    [2][]toolbox.Address
+}
+
+// immixCacheState is the saved state of an immixCache, with spans
+// identified by their base address, or zero.
+type immixCacheState struct {
+	Alloc    [immixNumSpanClasses]toolbox.Address
+	Overflow [immixNumSpanClasses]toolbox.Address
+}
+
+// immixState is the saved state of an Immix object allocator.
+type immixState struct {
+	SweptIdx    uint
+	Spans       []immixSpanState
+	Central     [immixNumSpanClasses]immixCentralState
+	Caches      map[toolbox.P]immixCacheState
+	ObjectSizes map[toolbox.Address]toolbox.Bytes
+}
+
+func saveImmixSpanList(l *immixSpanList) []toolbox.Address {
+	var bases []toolbox.Address
+	for s := l.first; s != nil; s = s.next {
+		bases = append(bases, s.base)
+	}
+	return bases
+}
+
+// SaveState implements simulation.Checkpointer.
+func (g *Immix) SaveState(enc *gob.Encoder) error {
+	st := immixState{
+		SweptIdx:    g.sweptIdx,
+		Caches:      make(map[toolbox.P]immixCacheState),
+		ObjectSizes: g.objectSizes,
+	}
+	for addr, s := range g.index {
+		if addr != s.base {
+			continue
+		}
+		st.Spans = append(st.Spans, immixSpanState{
+			Base:         s.base,
+			NPages:       s.npages,
+			Class:        s.class,
+			Cached:       s.cached,
+			LineFreeIdx:  s.lineFreeIdx,
+			LineCount:    s.lineCount,
+			LineSize:     s.lineSize,
+			LineRefCount: s.lineRefCount,
+			LineRefDec:   s.lineRefDec,
+			BumpLo:       s.bumpLo,
+			BumpHi:       s.bumpHi,
+			AllocCount:   s.allocCount,
+			FreedCount:   s.freedCount,
+			Unused:       s.unused,
+		})
+	}
+	for spc := range g.central {
+		c := &g.central[spc]
+		for i := range c.partial {
+			st.Central[spc].Partial[i] = saveImmixSpanList(&c.partial[i])
+			st.Central[spc].Full[i] = saveImmixSpanList(&c.full[i])
+		}
+	}
+	for p, c := range g.caches {
+		var cs immixCacheState
+		for spc := range c.alloc {
+			if s := c.alloc[spc]; s != nil {
+				cs.Alloc[spc] = s.base
+			}
+			if s := c.overflow[spc]; s != nil {
+				cs.Overflow[spc] = s.base
+			}
+		}
+		st.Caches[p] = cs
+	}
+	return enc.Encode(&st)
+}
+
+// LoadState implements simulation.Checkpointer.
+func (g *Immix) LoadState(dec *gob.Decoder) error {
+	var st immixState
+	if err := dec.Decode(&st); err != nil {
+		return err
+	}
+	g.sweptIdx = st.SweptIdx
+	g.index = make(map[toolbox.Address]*immixSpan)
+	spans := make(map[toolbox.Address]*immixSpan)
+	for _, ss := range st.Spans {
+		s := &immixSpan{
+			base:         ss.Base,
+			npages:       ss.NPages,
+			class:        ss.Class,
+			cached:       ss.Cached,
+			lineFreeIdx:  ss.LineFreeIdx,
+			lineCount:    ss.LineCount,
+			lineSize:     ss.LineSize,
+			lineRefCount: ss.LineRefCount,
+			lineRefDec:   ss.LineRefDec,
+			bumpLo:       ss.BumpLo,
+			bumpHi:       ss.BumpHi,
+			allocCount:   ss.AllocCount,
+			freedCount:   ss.FreedCount,
+			unused:       ss.Unused,
+			stats:        &g.stats,
+		}
+		if g.evacThreshold != 0 && s.class != immixLarge {
+			s.objects = make(map[toolbox.Address]struct{})
+		}
+		spans[s.base] = s
+		g.addToIndex(s)
+	}
+	lookup := func(base toolbox.Address) (*immixSpan, error) {
+		if base == 0 {
+			return nil, nil
+		}
+		s, ok := spans[base]
+		if !ok {
+			return nil, fmt.Errorf("checkpoint refers to unknown span %#x", base)
+		}
+		return s, nil
+	}
+	restoreList := func(l *immixSpanList, bases []toolbox.Address) error {
+		*l = immixSpanList{}
+		for _, base := range bases {
+			s, err := lookup(base)
+			if err != nil {
+				return err
+			}
+			l.pushBack(s)
+		}
+		return nil
+	}
+	for spc := range g.central {
+		c := &g.central[spc]
+		for i := range c.partial {
+			if err := restoreList(&c.partial[i], st.Central[spc].Partial[i]); err != nil {
+				return err
+			}
+			if err := restoreList(&c.full[i], st.Central[spc].Full[i]); err != nil {
+				return err
+			}
+		}
+	}
+	g.caches = make(map[toolbox.P]*immixCache)
+	for p, cs := range st.Caches {
+		c := new(immixCache)
+		for spc := range c.alloc {
+			var err error
+			if c.alloc[spc], err = lookup(cs.Alloc[spc]); err != nil {
+				return err
+			}
+			if c.overflow[spc], err = lookup(cs.Overflow[spc]); err != nil {
+				return err
+			}
+		}
+		g.caches[p] = c
+	}
+	g.objectSizes = st.ObjectSizes
+	if g.objectSizes == nil {
+		g.objectSizes = make(map[toolbox.Address]toolbox.Bytes)
+	}
+	for x := range g.objectSizes {
+		g.indexObject(x)
+	}
+	return nil
+}
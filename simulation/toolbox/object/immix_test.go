@@ -0,0 +1,114 @@
+package object
+
+import (
+	"testing"
+
+	"github.com/mknyszek/goat/simulation"
+	"github.com/mknyszek/goat/simulation/toolbox"
+	"github.com/mknyszek/goat/simulation/toolbox/page"
+)
+
+func TestImmixEvacuation(t *testing.T) {
+	const (
+		objects = 4 * 39 // four full spans
+		size    = 200
+	)
+	tests := []struct {
+		name      string
+		threshold uint64
+		handler   bool
+		live      func(i int) bool
+		moved     bool
+	}{
+		{"Sparse", 50, true, func(i int) bool { return i%16 == 0 }, true},
+		{"Dense", 50, true, func(i int) bool { return i%2 == 0 }, false},
+		{"Off", 0, true, func(i int) bool { return i%16 == 0 }, false},
+		{"NoHandler", 50, false, func(i int) bool { return i%16 == 0 }, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			g := NewImmix(page.NewGo114(toolbox.NewAddressSpace48(8192), page.Go114Scavenge(false)), ImmixEvacuationThreshold(test.threshold))
+			stats := simulation.NewStats()
+			g.RegisterStats(stats)
+			ctx := toolbox.Context{P: 0, Stats: stats}
+			moves := make(map[toolbox.Address]toolbox.Address)
+			if test.handler {
+				g.SetMoveHandler(func(from, to toolbox.Address) {
+					if _, ok := moves[from]; ok {
+						t.Errorf("object at %#x moved twice", from)
+					}
+					moves[from] = to
+				})
+			}
+
+			// Allocate the objects, and let most of them die.
+			var live, dead []toolbox.Address
+			spans := make(map[toolbox.Address]bool)
+			for i := 0; i < objects; i++ {
+				x := g.AllocObject(ctx, size, false, false)
+				if test.live(i) {
+					live = append(live, x)
+					spans[x.AlignDown(8192)] = true
+				} else {
+					dead = append(dead, x)
+				}
+			}
+			g.GCStart(ctx)
+			g.GCEnd(ctx)
+			for _, x := range dead {
+				g.DeadObject(ctx, x)
+			}
+			liveBytes := stats.ObjectBytes
+			g.GCStart(ctx)
+
+			if !test.moved {
+				if len(moves) != 0 {
+					t.Fatalf("expected no moves, got %d", len(moves))
+				}
+			} else {
+				if len(moves) != len(live) {
+					t.Fatalf("expected %d moves, got %d", len(live), len(moves))
+				}
+				if n := stats.LookupOther(immixEvacSpansStat.Name).Value(); n != uint64(len(spans)) {
+					t.Errorf("expected %d evacuated spans, got %d", len(spans), n)
+				}
+				for i, x := range live {
+					to := moves[x]
+					if spans[to.AlignDown(8192)] {
+						t.Errorf("object at %#x moved into an evacuated span at %#x", x, to)
+					}
+					if _, ok := g.objectSizes[x]; ok {
+						t.Errorf("object at %#x still present after moving", x)
+					}
+					if _, ok := g.objectSizes[to]; !ok {
+						t.Errorf("object at %#x missing at %#x", x, to)
+					}
+					live[i] = to
+				}
+				if _, ok := g.index[live[0].AlignDown(8192)]; !ok {
+					t.Errorf("expected destination span to be indexed")
+				}
+				for base := range spans {
+					if _, ok := g.index[base]; ok {
+						t.Errorf("expected evacuated span %#x to be freed", base)
+					}
+				}
+			}
+			if stats.ObjectBytes != liveBytes || stats.Allocs != objects || stats.Frees != uint64(len(dead)) {
+				t.Errorf("expected object bytes/allocs/frees %d/%d/%d, got %d/%d/%d",
+					liveBytes, objects, len(dead), stats.ObjectBytes, stats.Allocs, stats.Frees)
+			}
+
+			// Objects are identified by their new address from now on.
+			g.GCEnd(ctx)
+			for _, x := range live {
+				g.DeadObject(ctx, x)
+			}
+			g.GCStart(ctx)
+			if stats.ObjectBytes != 0 || stats.Frees != objects || len(g.objectSizes) != 0 {
+				t.Errorf("expected everything freed, got %d object bytes, %d frees, and %d objects",
+					stats.ObjectBytes, stats.Frees, len(g.objectSizes))
+			}
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package object
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/mknyszek/goat/simulation/toolbox"
+)
+
+// defaultLargeCacheCycles is the default number of GC cycles a
+// freed large object's pages stay cached.
+const defaultLargeCacheCycles = 2
+
+// maxLargeCacheBuckets is the largest allowed number of size buckets
+// per doubling of large object size.
+const maxLargeCacheBuckets = 64
+
+type go115LargeRun struct {
+	base toolbox.Address
+
+	// cycle is the GC cycle the run was cached in.
+	cycle uint64
+}
+
+// go115LargeCache is an alternative policy for large objects, which
+// rounds their sizes up to buckets, and caches the page runs of dead
+// large objects for reuse by later large objects in the same bucket.
+// Cached runs which aren't reused within some number of GC cycles
+// are freed.
+type go115LargeCache struct {
+	// buckets is the number of buckets per doubling of size. Zero
+	// means large objects aren't bucketed or cached.
+	buckets uint64
+	cycles  uint64
+
+	// cycle counts GC cycles, and runs holds the cached runs for
+	// each bucket, oldest first.
+	cycle uint64
+	runs  map[toolbox.Pages][]go115LargeRun
+}
+
+func newGo115LargeCache() go115LargeCache {
+	return go115LargeCache{
+		cycles: defaultLargeCacheCycles,
+		runs:   make(map[toolbox.Pages][]go115LargeRun),
+	}
+}
+
+func checkLargeCache(buckets, cycles uint64) error {
+	if buckets&(buckets-1) != 0 || buckets > maxLargeCacheBuckets {
+		return errors.New("large object buckets per doubling must be zero or a power of two no larger than 64")
+	}
+	if buckets != 0 && cycles == 0 {
+		return errors.New("large object cache must keep runs for at least one GC cycle")
+	}
+	return nil
+}
+
+// decodeLargeCache returns the configuration options for the
+// largeCacheBuckets and largeCacheCycles parameters.
+func decodeLargeCache(p toolbox.Params) ([]Go115Option, error) {
+	buckets, err := p.Uint64("largeCacheBuckets", 0)
+	if err != nil {
+		return nil, err
+	}
+	cycles, err := p.Uint64("largeCacheCycles", defaultLargeCacheCycles)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkLargeCache(buckets, cycles); err != nil {
+		return nil, err
+	}
+	return []Go115Option{Go115LargeObjectCache(buckets, cycles)}, nil
+}
+
+// Go115LargeObjectCache returns a configuration option that rounds
+// large objects up to one of buckets sizes per doubling of size, and
+// keeps the pages of dead large objects for reuse by other large
+// objects of the same bucket. Pages that aren't reused within cycles
+// GC cycles are freed. Zero buckets turns off the cache, giving each
+// large object its own exactly-sized pages, which are freed as soon
+// as it dies.
+//
+// buckets must be zero or a power of two no larger than 64.
+// The default is no cache.
+func Go115LargeObjectCache(buckets, cycles uint64) Go115Option {
+	return func(g *Go115) {
+		g.large.buckets = buckets
+		g.large.cycles = cycles
+	}
+}
+
+// bucket rounds a large object's pages up to its bucket.
+func (c *go115LargeCache) bucket(npages toolbox.Pages) toolbox.Pages {
+	if c.buckets == 0 || npages <= toolbox.Pages(c.buckets) {
+		return npages
+	}
+	step := toolbox.Pages(1) << (toolbox.Bytes(npages).Log2() - toolbox.Bytes(c.buckets).Log2())
+	return (npages + step - 1) &^ (step - 1)
+}
+
+// allocLarge returns the pages for a large object with npages pages,
+// reusing cached pages if there are any.
+func (g *Go115) allocLarge(ctx toolbox.Context, npages toolbox.Pages) toolbox.Address {
+	runs := g.large.runs[npages]
+	if len(runs) == 0 {
+		return g.pageAllocator.AllocPages(ctx, npages)
+	}
+	r := runs[len(runs)-1]
+	g.large.runs[npages] = runs[:len(runs)-1]
+	bytes := uint64(npages.Bytes(g.pageAllocator.BytesPerPage()))
+	g.stats.largeCache.Sub(bytes)
+	g.stats.largeReused.Add(bytes)
+	return r.base
+}
+
+// freeSpan frees the pages of a span, caching them if it's a large
+// object span and the large object cache is on.
+func (g *Go115) freeSpan(ctx toolbox.Context, s *go115Span) {
+	if g.large.buckets == 0 || s.class.sizeClass() != 0 {
+		g.pageAllocator.FreePages(ctx, s.base, s.npages)
+		return
+	}
+	g.large.runs[s.npages] = append(g.large.runs[s.npages], go115LargeRun{base: s.base, cycle: g.large.cycle})
+	g.stats.largeCache.Add(uint64(s.npages.Bytes(g.pageAllocator.BytesPerPage())))
+}
+
+// decayLargeCache frees the cached pages which weren't reused within
+// the configured number of GC cycles.
+func (g *Go115) decayLargeCache(ctx toolbox.Context) {
+	g.large.cycle++
+	if len(g.large.runs) == 0 {
+		return
+	}
+	buckets := make([]toolbox.Pages, 0, len(g.large.runs))
+	for npages := range g.large.runs {
+		buckets = append(buckets, npages)
+	}
+	sort.Slice(buckets, func(i, j int) bool {
+		return buckets[i] < buckets[j]
+	})
+	pageSize := g.pageAllocator.BytesPerPage()
+	for _, npages := range buckets {
+		runs := g.large.runs[npages]
+		n := 0
+		for n < len(runs) && g.large.cycle-runs[n].cycle >= g.large.cycles {
+			g.pageAllocator.FreePages(ctx, runs[n].base, npages)
+			g.stats.largeCache.Sub(uint64(npages.Bytes(pageSize)))
+			n++
+		}
+		if n == len(runs) {
+			delete(g.large.runs, npages)
+		} else {
+			g.large.runs[npages] = runs[n:]
+		}
+	}
+}
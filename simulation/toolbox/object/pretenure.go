@@ -0,0 +1,396 @@
+package object
+
+import (
+	"encoding/gob"
+	"errors"
+
+	"github.com/mknyszek/goat/simulation"
+	"github.com/mknyszek/goat/simulation/toolbox"
+)
+
+var (
+	pretenureShortSpanStat = simulation.StatDesc{
+		Name:        "PretenureShortSpanBytes",
+		Unit:        simulation.UnitBytes,
+		Description: "memory in spans for short-lived objects",
+	}
+	pretenureLongSpanStat = simulation.StatDesc{
+		Name:        "PretenureLongSpanBytes",
+		Unit:        simulation.UnitBytes,
+		Description: "memory in spans for long-lived objects",
+	}
+	pretenureLongAllocStat = simulation.StatDesc{
+		Name:        "PretenureLongAllocBytes",
+		Kind:        simulation.Counter,
+		Unit:        simulation.UnitBytes,
+		Description: "memory allocated for objects predicted long-lived",
+	}
+	pretenureCorrectStat = simulation.StatDesc{
+		Name:        "PretenureCorrectPredictions",
+		Kind:        simulation.Counter,
+		Description: "dead objects whose lifetime was predicted correctly",
+	}
+	pretenureWrongStat = simulation.StatDesc{
+		Name:        "PretenureMispredictions",
+		Kind:        simulation.Counter,
+		Description: "dead objects whose lifetime was predicted incorrectly",
+	}
+	pretenureFragStat = simulation.StatDesc{
+		Name:        "PretenureFragmentationPermille",
+		Unit:        simulation.UnitPermille,
+		Description: "fraction of span memory not occupied by live objects after sweeping",
+	}
+)
+
+const (
+	// defaultPretenureMinSamples is the default number of frees
+	// seen from a site before its lifetime is predicted.
+	defaultPretenureMinSamples = 16
+
+	// defaultPretenureThreshold is the default percent of a site's
+	// freed objects which must have been long-lived for the site to
+	// be predicted long-lived.
+	defaultPretenureThreshold = 50
+)
+
+// spanCounter is a PageAllocator which keeps a count of the pages
+// allocated through it, in an implementation-specific stat.
+type spanCounter struct {
+	toolbox.PageAllocator
+	desc simulation.StatDesc
+	stat *simulation.Stat
+}
+
+func (c *spanCounter) RegisterStats(stats *simulation.Stats) {
+	c.PageAllocator.RegisterStats(stats)
+	c.stat = stats.RegisterOther(c.desc)
+}
+
+func (c *spanCounter) AllocPages(ctx toolbox.Context, npages toolbox.Pages) toolbox.Address {
+	c.stat.Add(uint64(npages.Bytes(c.BytesPerPage())))
+	return c.PageAllocator.AllocPages(ctx, npages)
+}
+
+func (c *spanCounter) FreePages(ctx toolbox.Context, addr toolbox.Address, npages toolbox.Pages) {
+	c.stat.Sub(uint64(npages.Bytes(c.BytesPerPage())))
+	c.PageAllocator.FreePages(ctx, addr, npages)
+}
+
+// pretenureSite is what's been learned about an allocation site
+// from the objects it allocated that died.
+type pretenureSite struct {
+	short, long uint64
+}
+
+type pretenureObject struct {
+	site  uint64
+	cycle uint64
+	long  bool
+}
+
+// Pretenure is an object allocator which segregates objects into
+// separate spans by their predicted lifetime, on top of a pair of
+// Go115 heaps that share a page allocator.
+//
+// An object is long-lived if it survives the first GC cycle after
+// it's allocated. The lifetime of objects is predicted from their
+// allocation site, which is learned online: once enough objects from
+// a site have died, the site is predicted long-lived if enough of them
+// were long-lived. Objects with no known site are short-lived.
+//
+// The intent is that objects in the same span die at around the same
+// time, so that fewer spans are kept around by a few live objects.
+// How well that works is reported as the fraction of span memory not
+// occupied by live objects once each cycle's sweeping is done, which
+// can be compared with prediction turned off.
+type Pretenure struct {
+	short, long           *Go115
+	shortSpans, longSpans *spanCounter
+
+	objects map[toolbox.Address]pretenureObject
+	sites   map[uint64]*pretenureSite
+	cycle   uint64
+
+	minSamples uint64
+	threshold  uint64
+	predict    bool
+
+	longAlloc *simulation.Stat
+	correct   *simulation.Stat
+	wrong     *simulation.Stat
+	frag      *simulation.Stat
+}
+
+// PretenureOption is a configuration option for a Pretenure object
+// allocator.
+type PretenureOption func(g *Pretenure)
+
+// PretenureMinSamples returns a configuration option that sets how
+// many of a site's objects must have died before its lifetime is
+// predicted.
+//
+// The default is 16.
+func PretenureMinSamples(n uint64) PretenureOption {
+	return func(g *Pretenure) {
+		g.minSamples = n
+	}
+}
+
+// PretenureThreshold returns a configuration option that sets the
+// percent of a site's dead objects which must have been long-lived
+// for the site to be predicted long-lived.
+//
+// The default is 50 percent.
+func PretenureThreshold(percent uint64) PretenureOption {
+	return func(g *Pretenure) {
+		g.threshold = percent
+	}
+}
+
+// PretenurePrediction returns a configuration option that turns
+// lifetime prediction on or off. With prediction off, every object
+// is allocated as short-lived, but the predictions that would have
+// been made are still reported, making it a baseline.
+//
+// The default is on.
+func PretenurePrediction(on bool) PretenureOption {
+	return func(g *Pretenure) {
+		g.predict = on
+	}
+}
+
+// NewPretenure creates a new Pretenure object allocator on top of pa,
+// which must have 8 KiB pages. Panics if the configuration is invalid.
+func NewPretenure(pa toolbox.PageAllocator, options ...PretenureOption) *Pretenure {
+	g, err := NewPretenureChecked(pa, options...)
+	if err != nil {
+		panic(err.Error())
+	}
+	return g
+}
+
+// NewPretenureChecked is like NewPretenure, but returns an error
+// instead of panicking if the configuration is invalid.
+func NewPretenureChecked(pa toolbox.PageAllocator, options ...PretenureOption) (*Pretenure, error) {
+	if pa.BytesPerPage() != 8192 {
+		return nil, errors.New("page allocator must have 8 KiB pages")
+	}
+	g := &Pretenure{
+		shortSpans: &spanCounter{PageAllocator: pa, desc: pretenureShortSpanStat},
+		longSpans:  &spanCounter{PageAllocator: pa, desc: pretenureLongSpanStat},
+		objects:    make(map[toolbox.Address]pretenureObject),
+		sites:      make(map[uint64]*pretenureSite),
+		minSamples: defaultPretenureMinSamples,
+		threshold:  defaultPretenureThreshold,
+		predict:    true,
+	}
+	g.short = NewGo115(g.shortSpans)
+	g.long = NewGo115(g.longSpans)
+	for _, opt := range options {
+		opt(g)
+	}
+	if err := g.checkConfig(); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+func (g *Pretenure) checkConfig() error {
+	if g.minSamples == 0 {
+		return errors.New("pretenuring needs at least one sample per site")
+	}
+	if g.threshold > 100 {
+		return errors.New("pretenuring threshold must be at most 100 percent")
+	}
+	return nil
+}
+
+func init() {
+	toolbox.RegisterObjectAllocator("pretenure", func(pa toolbox.PageAllocator, p toolbox.Params) (toolbox.ObjectAllocator, error) {
+		if err := p.Check("minSamples", "threshold", "predict"); err != nil {
+			return nil, err
+		}
+		minSamples, err := p.Uint64("minSamples", defaultPretenureMinSamples)
+		if err != nil {
+			return nil, err
+		}
+		threshold, err := p.Uint64("threshold", defaultPretenureThreshold)
+		if err != nil {
+			return nil, err
+		}
+		predict := true
+		if _, err := p.Decode("predict", &predict); err != nil {
+			return nil, err
+		}
+		g, err := NewPretenureChecked(pa,
+			PretenureMinSamples(minSamples),
+			PretenureThreshold(threshold),
+			PretenurePrediction(predict),
+		)
+		if err != nil {
+			return nil, err
+		}
+		return g, nil
+	})
+}
+
+func (g *Pretenure) RegisterStats(stats *simulation.Stats) {
+	g.short.RegisterStats(stats)
+	g.long.RegisterStats(stats)
+	g.longAlloc = stats.RegisterOther(pretenureLongAllocStat)
+	g.correct = stats.RegisterOther(pretenureCorrectStat)
+	g.wrong = stats.RegisterOther(pretenureWrongStat)
+	g.frag = stats.RegisterOther(pretenureFragStat)
+}
+
+// longLived predicts whether objects from a site are long-lived.
+func (g *Pretenure) longLived(site uint64) bool {
+	s := g.sites[site]
+	if s == nil || s.short+s.long < g.minSamples {
+		return false
+	}
+	return s.long*100 >= g.threshold*(s.short+s.long)
+}
+
+func (g *Pretenure) AllocObject(ctx toolbox.Context, size toolbox.Bytes, array, noscan bool) toolbox.Address {
+	long := ctx.PC != 0 && g.longLived(ctx.PC)
+	heap := g.short
+	if long && g.predict {
+		heap = g.long
+		g.longAlloc.Add(uint64(size))
+	}
+	addr := heap.AllocObject(ctx, size, array, noscan)
+	g.objects[addr] = pretenureObject{site: ctx.PC, cycle: g.cycle, long: long}
+	return addr
+}
+
+func (g *Pretenure) DeadObject(ctx toolbox.Context, addr toolbox.Address) {
+	obj := g.objects[addr]
+	delete(g.objects, addr)
+	if obj.long && g.predict {
+		g.long.DeadObject(ctx, addr)
+	} else {
+		g.short.DeadObject(ctx, addr)
+	}
+	if obj.site == 0 {
+		return
+	}
+
+	// Learn from the object's lifetime.
+	s := g.sites[obj.site]
+	if s == nil {
+		s = new(pretenureSite)
+		g.sites[obj.site] = s
+	}
+	long := g.cycle-obj.cycle > 1
+	if long {
+		s.long++
+	} else {
+		s.short++
+	}
+	if long == obj.long {
+		g.correct.Add(1)
+	} else {
+		g.wrong.Add(1)
+	}
+}
+
+func (g *Pretenure) GCStart(ctx toolbox.Context) {
+	g.short.sweepAll(ctx)
+	g.long.sweepAll(ctx)
+
+	// The two heaps share their statistics, including the span
+	// occupancy histogram.
+	g.short.stats.occupancy.Reset()
+	g.short.observeOccupancy()
+	g.long.observeOccupancy()
+
+	// Everything is swept now, so all the span memory that isn't
+	// occupied by objects is either free slots or waste.
+	spans := g.shortSpans.stat.Value() + g.longSpans.stat.Value()
+	frag := uint64(0)
+	if spans != 0 && spans > ctx.Stats.ObjectBytes {
+		frag = (spans - ctx.Stats.ObjectBytes) * 1000 / spans
+	}
+	g.frag.Set(frag)
+}
+
+func (g *Pretenure) GCEnd(ctx toolbox.Context) {
+	g.short.GCEnd(ctx)
+	g.long.GCEnd(ctx)
+	g.cycle++
+}
+
+// Inspect implements toolbox.Inspector, describing the spans of both
+// the short-lived and the long-lived heaps.
+func (g *Pretenure) Inspect() []toolbox.SpanInfo {
+	spans := append(g.short.Inspect(), g.long.Inspect()...)
+	toolbox.SortSpans(spans)
+	return spans
+}
+
+// pretenureState is the saved state of a Pretenure object allocator,
+// apart from its two heaps.
+type pretenureState struct {
+	Objects map[toolbox.Address]pretenureObjectState
+	Sites   map[uint64]pretenureSiteState
+	Cycle   uint64
+}
+
+// pretenureObjectState is the saved state of a pretenureObject.
+type pretenureObjectState struct {
+	Site  uint64
+	Cycle uint64
+	Long  bool
+}
+
+// pretenureSiteState is the saved state of a pretenureSite.
+type pretenureSiteState struct {
+	Short, Long uint64
+}
+
+// SaveState implements simulation.Checkpointer.
+func (g *Pretenure) SaveState(enc *gob.Encoder) error {
+	if err := g.short.SaveState(enc); err != nil {
+		return err
+	}
+	if err := g.long.SaveState(enc); err != nil {
+		return err
+	}
+	st := pretenureState{
+		Objects: make(map[toolbox.Address]pretenureObjectState, len(g.objects)),
+		Sites:   make(map[uint64]pretenureSiteState, len(g.sites)),
+		Cycle:   g.cycle,
+	}
+	for addr, o := range g.objects {
+		st.Objects[addr] = pretenureObjectState{o.site, o.cycle, o.long}
+	}
+	for pc, site := range g.sites {
+		st.Sites[pc] = pretenureSiteState{site.short, site.long}
+	}
+	return enc.Encode(&st)
+}
+
+// LoadState implements simulation.Checkpointer.
+func (g *Pretenure) LoadState(dec *gob.Decoder) error {
+	if err := g.short.LoadState(dec); err != nil {
+		return err
+	}
+	if err := g.long.LoadState(dec); err != nil {
+		return err
+	}
+	var st pretenureState
+	if err := dec.Decode(&st); err != nil {
+		return err
+	}
+	g.objects = make(map[toolbox.Address]pretenureObject, len(st.Objects))
+	for addr, o := range st.Objects {
+		g.objects[addr] = pretenureObject{o.Site, o.Cycle, o.Long}
+	}
+	g.sites = make(map[uint64]*pretenureSite, len(st.Sites))
+	for pc, site := range st.Sites {
+		g.sites[pc] = &pretenureSite{site.Short, site.Long}
+	}
+	g.cycle = st.Cycle
+	return nil
+}
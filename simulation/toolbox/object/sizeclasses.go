@@ -0,0 +1,98 @@
+package object
+
+import (
+	"fmt"
+
+	"github.com/mknyszek/goat/simulation/toolbox"
+)
+
+// SizeClass is a size class for small objects.
+type SizeClass struct {
+	// Size is the size of objects in the class.
+	Size toolbox.Bytes `json:"size"`
+
+	// Pages is the number of 8 KiB pages in each of the class's spans.
+	Pages toolbox.Pages `json:"pages"`
+}
+
+// Go115SizeClasses returns the Go 1.15 runtime's size classes, in
+// increasing order of size.
+func Go115SizeClasses() []SizeClass {
+	return go115SizeClasses.classes()
+}
+
+// maxSizeClasses is the largest number of size classes a table may
+// have, not counting the class reserved for large objects, so that
+// span classes fit in a byte.
+const maxSizeClasses = 127
+
+// maxObjsPerSpan is the largest number of objects a span may contain.
+const maxObjsPerSpan = 1024
+
+// checkSizeClasses returns an error if classes isn't a valid table
+// of size classes with 8 KiB pages.
+func checkSizeClasses(classes []SizeClass) error {
+	if len(classes) == 0 || len(classes) > maxSizeClasses {
+		return fmt.Errorf("need between 1 and %d size classes, got %d", maxSizeClasses, len(classes))
+	}
+	var prev toolbox.Bytes
+	for i, c := range classes {
+		if c.Size <= prev || c.Size%8 != 0 {
+			return fmt.Errorf("size class %d: size %d is not an increasing multiple of 8", i+1, c.Size)
+		}
+		spanBytes := c.Pages.Bytes(8192)
+		if c.Pages == 0 || spanBytes < c.Size {
+			return fmt.Errorf("size class %d: %d pages can't fit a %d-byte object", i+1, c.Pages, c.Size)
+		}
+		if spanBytes/c.Size > maxObjsPerSpan {
+			return fmt.Errorf("size class %d: more than %d objects per span", i+1, maxObjsPerSpan)
+		}
+		prev = c.Size
+	}
+	return nil
+}
+
+// sizeClasses is a table of size classes for small objects, along
+// with the number of pages in each class's spans. Class 0 is reserved
+// for large objects.
+type sizeClasses struct {
+	size     []toolbox.Bytes
+	pages    []toolbox.Pages
+	maxSmall toolbox.Bytes
+}
+
+// makeSizeClasses creates a table from classes, the largest of which
+// determines the largest small object size.
+func makeSizeClasses(classes []SizeClass) sizeClasses {
+	t := sizeClasses{
+		size:  []toolbox.Bytes{0},
+		pages: []toolbox.Pages{0},
+	}
+	for _, c := range classes {
+		t.size = append(t.size, c.Size)
+		t.pages = append(t.pages, c.Pages)
+	}
+	t.maxSmall = t.size[len(t.size)-1]
+	return t
+}
+
+func (c *sizeClasses) classes() []SizeClass {
+	classes := make([]SizeClass, 0, len(c.size)-1)
+	for i := 1; i < len(c.size); i++ {
+		classes = append(classes, SizeClass{Size: c.size[i], Pages: c.pages[i]})
+	}
+	return classes
+}
+
+func (c *sizeClasses) numSpanClasses() int {
+	return len(c.size) * 2
+}
+
+func (c *sizeClasses) sizeToClass(size toolbox.Bytes) int8 {
+	for i, s := range c.size {
+		if size <= s {
+			return int8(i)
+		}
+	}
+	return -1
+}
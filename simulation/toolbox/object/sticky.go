@@ -0,0 +1,349 @@
+package object
+
+import (
+	"encoding/gob"
+	"errors"
+
+	"github.com/mknyszek/goat/simulation"
+	"github.com/mknyszek/goat/simulation/toolbox"
+)
+
+var (
+	stickyMinorCyclesStat = simulation.StatDesc{
+		Name:        "StickyMarkMinorCycles",
+		Kind:        simulation.Counter,
+		Description: "GC cycles which only marked young objects",
+	}
+	stickyMajorCyclesStat = simulation.StatDesc{
+		Name:        "StickyMarkMajorCycles",
+		Kind:        simulation.Counter,
+		Description: "GC cycles which marked the whole heap",
+	}
+	stickyMinorWorkStat = simulation.StatDesc{
+		Name:        "StickyMarkMinorWorkBytes",
+		Kind:        simulation.Counter,
+		Unit:        simulation.UnitBytes,
+		Description: "memory of live objects marked by minor cycles",
+	}
+	stickyMajorWorkStat = simulation.StatDesc{
+		Name:        "StickyMarkMajorWorkBytes",
+		Kind:        simulation.Counter,
+		Unit:        simulation.UnitBytes,
+		Description: "memory of live objects marked by major cycles",
+	}
+	stickyPromotedStat = simulation.StatDesc{
+		Name:        "StickyMarkPromotedBytes",
+		Kind:        simulation.Counter,
+		Unit:        simulation.UnitBytes,
+		Description: "memory of young objects promoted to the old generation",
+	}
+	stickyTenuredStat = simulation.StatDesc{
+		Name:        "StickyMarkTenuredGarbageBytes",
+		Unit:        simulation.UnitBytes,
+		Description: "memory of dead old objects kept until the next major cycle",
+	}
+	stickyFragStat = simulation.StatDesc{
+		Name:        "StickyMarkFragmentationPermille",
+		Unit:        simulation.UnitPermille,
+		Description: "fraction of the heap not occupied by live objects",
+	}
+)
+
+// stickyStats are handles to a StickyMark's statistics.
+type stickyStats struct {
+	minorCycles *simulation.Stat
+	majorCycles *simulation.Stat
+	minorWork   *simulation.Stat
+	majorWork   *simulation.Stat
+	promoted    *simulation.Stat
+	tenured     *simulation.Stat
+	frag        *simulation.Stat
+}
+
+// defaultMajorGrowth is the default growth of the old generation, in
+// percent, which triggers a major cycle.
+const defaultMajorGrowth = 100
+
+type stickyObject struct {
+	size  toolbox.Bytes
+	epoch uint64
+}
+
+// StickyMark is an object allocator which models a non-moving
+// generational collector that uses sticky mark bits, on top of a
+// Go115 heap.
+//
+// Mark bits aren't cleared between minor cycles, so objects which
+// survive a cycle stay marked and become old, and only young objects,
+// which were allocated since the last cycle, are collected. Old
+// objects which die are only freed by a major cycle, which clears
+// all mark bits. Until then, they're retained as tenured garbage.
+//
+// A cycle is major if the old generation, including tenured garbage,
+// has grown by some percent since the last major cycle.
+//
+// The work of each kind of cycle is estimated as the bytes of live
+// objects it has to mark: the surviving young objects for a minor
+// cycle, and all live objects for a major cycle. The cost of the
+// write barrier and remembered set isn't modeled.
+type StickyMark struct {
+	heap *Go115
+
+	// objects are all the objects that haven't been freed, and
+	// the epoch they were allocated in. Objects from before the
+	// current epoch are old.
+	objects map[toolbox.Address]stickyObject
+	epoch   uint64
+
+	youngBytes toolbox.Bytes
+	oldBytes   toolbox.Bytes
+
+	// tenured are old objects which died in a minor cycle.
+	tenured      []toolbox.Address
+	tenuredBytes toolbox.Bytes
+
+	majorGrowth  uint64
+	lastMajorOld toolbox.Bytes
+
+	// major indicates whether the current cycle is a major cycle,
+	// and sweeping indicates that the cycle ended, but its dead
+	// objects may still be arriving.
+	major    bool
+	sweeping bool
+
+	heapOptions []Go115Option
+	stats       stickyStats
+}
+
+// StickyMarkOption is a configuration option for a StickyMark
+// object allocator.
+type StickyMarkOption func(g *StickyMark)
+
+// StickyMarkMajorGrowth returns a configuration option that sets how
+// much the old generation must grow since the last major cycle, in
+// percent, to trigger the next major cycle.
+//
+// The default is 100 percent.
+func StickyMarkMajorGrowth(percent uint64) StickyMarkOption {
+	return func(g *StickyMark) {
+		g.majorGrowth = percent
+	}
+}
+
+// StickyMarkHeap returns a configuration option that configures the
+// Go115 heap objects are allocated from with options.
+func StickyMarkHeap(options ...Go115Option) StickyMarkOption {
+	return func(g *StickyMark) {
+		g.heapOptions = append(g.heapOptions, options...)
+	}
+}
+
+func NewStickyMark(pa toolbox.PageAllocator, options ...StickyMarkOption) *StickyMark {
+	g := &StickyMark{
+		objects:     make(map[toolbox.Address]stickyObject),
+		majorGrowth: defaultMajorGrowth,
+	}
+	for _, opt := range options {
+		opt(g)
+	}
+	g.heap = NewGo115(pa, g.heapOptions...)
+	return g
+}
+
+func init() {
+	toolbox.RegisterObjectAllocator("sticky", func(pa toolbox.PageAllocator, p toolbox.Params) (toolbox.ObjectAllocator, error) {
+		if err := p.Check(append([]string{"majorGrowth"}, go115Params...)...); err != nil {
+			return nil, err
+		}
+		if pa.BytesPerPage() != 8192 {
+			return nil, errors.New("page allocator must have 8 KiB pages")
+		}
+		majorGrowth, err := p.Uint64("majorGrowth", defaultMajorGrowth)
+		if err != nil {
+			return nil, err
+		}
+		heap, err := decodeGo115(p)
+		if err != nil {
+			return nil, err
+		}
+		return NewStickyMark(pa, StickyMarkMajorGrowth(majorGrowth), StickyMarkHeap(heap...)), nil
+	})
+}
+
+func (g *StickyMark) RegisterStats(stats *simulation.Stats) {
+	g.heap.RegisterStats(stats)
+	g.stats.minorCycles = stats.RegisterOther(stickyMinorCyclesStat)
+	g.stats.majorCycles = stats.RegisterOther(stickyMajorCyclesStat)
+	g.stats.minorWork = stats.RegisterOther(stickyMinorWorkStat)
+	g.stats.majorWork = stats.RegisterOther(stickyMajorWorkStat)
+	g.stats.promoted = stats.RegisterOther(stickyPromotedStat)
+	g.stats.tenured = stats.RegisterOther(stickyTenuredStat)
+	g.stats.frag = stats.RegisterOther(stickyFragStat)
+}
+
+func (g *StickyMark) AllocObject(ctx toolbox.Context, size toolbox.Bytes, array, noscan bool) toolbox.Address {
+	g.finishCycle(ctx)
+	addr := g.heap.AllocObject(ctx, size, array, noscan)
+	g.track(addr, size)
+	return addr
+}
+
+// AllocTiny implements toolbox.TinyAllocator.
+func (g *StickyMark) AllocTiny(ctx toolbox.Context, size toolbox.Bytes) toolbox.Address {
+	g.finishCycle(ctx)
+	addr := g.heap.AllocTiny(ctx, size)
+	g.track(addr, size)
+	return addr
+}
+
+func (g *StickyMark) track(addr toolbox.Address, size toolbox.Bytes) {
+	g.objects[addr] = stickyObject{size: size, epoch: g.epoch}
+	g.youngBytes += size
+}
+
+func (g *StickyMark) DeadObject(ctx toolbox.Context, addr toolbox.Address) {
+	obj := g.objects[addr]
+	if obj.epoch < g.epoch {
+		g.oldBytes -= obj.size
+		if !g.major {
+			// Old objects stay marked until the next major cycle.
+			g.tenured = append(g.tenured, addr)
+			g.tenuredBytes += obj.size
+			ctx.Stats.ObjectBytes -= uint64(obj.size)
+			ctx.Stats.UnusedBytes += uint64(obj.size)
+			g.stats.tenured.Add(uint64(obj.size))
+			return
+		}
+	} else {
+		g.youngBytes -= obj.size
+	}
+	delete(g.objects, addr)
+	g.heap.DeadObject(ctx, addr)
+}
+
+func (g *StickyMark) GCStart(ctx toolbox.Context) {
+	g.finishCycle(ctx)
+	g.heap.GCStart(ctx)
+}
+
+func (g *StickyMark) GCEnd(ctx toolbox.Context) {
+	g.heap.GCEnd(ctx)
+	old := g.oldBytes + g.tenuredBytes
+	g.major = old > g.lastMajorOld+g.lastMajorOld*toolbox.Bytes(g.majorGrowth)/100
+	if g.major {
+		// Free all the tenured garbage.
+		for _, addr := range g.tenured {
+			obj := g.objects[addr]
+			delete(g.objects, addr)
+			ctx.Stats.ObjectBytes += uint64(obj.size)
+			ctx.Stats.UnusedBytes -= uint64(obj.size)
+			g.heap.DeadObject(ctx, addr)
+		}
+		g.stats.tenured.Sub(uint64(g.tenuredBytes))
+		g.tenured = g.tenured[:0]
+		g.tenuredBytes = 0
+		g.stats.majorCycles.Add(1)
+	} else {
+		g.stats.minorCycles.Add(1)
+	}
+	g.sweeping = true
+}
+
+// finishCycle accounts for the work of the last cycle once all its
+// dead objects are known, and promotes its surviving young objects.
+func (g *StickyMark) finishCycle(ctx toolbox.Context) {
+	if !g.sweeping {
+		return
+	}
+	g.sweeping = false
+	if g.major {
+		g.stats.majorWork.Add(uint64(g.youngBytes + g.oldBytes))
+	} else {
+		g.stats.minorWork.Add(uint64(g.youngBytes))
+	}
+	g.stats.promoted.Add(uint64(g.youngBytes))
+	g.oldBytes += g.youngBytes
+	g.youngBytes = 0
+	g.epoch++
+	if g.major {
+		g.lastMajorOld = g.oldBytes
+	}
+
+	// Report how much of the heap isn't occupied by live objects.
+	frag := uint64(0)
+	if total := ctx.Stats.ObjectBytes + ctx.Stats.UnusedBytes; total != 0 {
+		frag = ctx.Stats.UnusedBytes * 1000 / total
+	}
+	g.stats.frag.Set(frag)
+}
+
+// Inspect implements toolbox.Inspector.
+func (g *StickyMark) Inspect() []toolbox.SpanInfo {
+	return g.heap.Inspect()
+}
+
+// stickyState is the saved state of a StickyMark object allocator,
+// apart from its heap.
+type stickyState struct {
+	Objects      map[toolbox.Address]stickyObjectState
+	Epoch        uint64
+	YoungBytes   toolbox.Bytes
+	OldBytes     toolbox.Bytes
+	Tenured      []toolbox.Address
+	TenuredBytes toolbox.Bytes
+	LastMajorOld toolbox.Bytes
+	Major        bool
+	Sweeping     bool
+}
+
+// stickyObjectState is the saved state of a stickyObject.
+type stickyObjectState struct {
+	Size  toolbox.Bytes
+	Epoch uint64
+}
+
+// SaveState implements simulation.Checkpointer.
+func (g *StickyMark) SaveState(enc *gob.Encoder) error {
+	if err := g.heap.SaveState(enc); err != nil {
+		return err
+	}
+	st := stickyState{
+		Objects:      make(map[toolbox.Address]stickyObjectState, len(g.objects)),
+		Epoch:        g.epoch,
+		YoungBytes:   g.youngBytes,
+		OldBytes:     g.oldBytes,
+		Tenured:      g.tenured,
+		TenuredBytes: g.tenuredBytes,
+		LastMajorOld: g.lastMajorOld,
+		Major:        g.major,
+		Sweeping:     g.sweeping,
+	}
+	for addr, o := range g.objects {
+		st.Objects[addr] = stickyObjectState{o.size, o.epoch}
+	}
+	return enc.Encode(&st)
+}
+
+// LoadState implements simulation.Checkpointer.
+func (g *StickyMark) LoadState(dec *gob.Decoder) error {
+	if err := g.heap.LoadState(dec); err != nil {
+		return err
+	}
+	var st stickyState
+	if err := dec.Decode(&st); err != nil {
+		return err
+	}
+	g.objects = make(map[toolbox.Address]stickyObject, len(st.Objects))
+	for addr, o := range st.Objects {
+		g.objects[addr] = stickyObject{o.Size, o.Epoch}
+	}
+	g.epoch = st.Epoch
+	g.youngBytes = st.YoungBytes
+	g.oldBytes = st.OldBytes
+	g.tenured = st.Tenured
+	g.tenuredBytes = st.TenuredBytes
+	g.lastMajorOld = st.LastMajorOld
+	g.major = st.Major
+	g.sweeping = st.Sweeping
+	return nil
+}
@@ -0,0 +1,784 @@
+package object
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/mknyszek/goat/simulation"
+	"github.com/mknyszek/goat/simulation/toolbox"
+)
+
+const (
+	// tcMaxDynamicFreeListLength is the longest a thread cache's free
+	// list may grow.
+	tcMaxDynamicFreeListLength = 8192
+
+	// tcMaxOverages is the number of times a free list may exceed its
+	// maximum length before that maximum is lowered.
+	tcMaxOverages = 3
+
+	// tcMinThreadCacheSize and tcMaxThreadCacheSize bound the size of
+	// each thread cache, and tcStealAmount is how much thread caches
+	// grow by, taking memory from the overall budget or other caches.
+	tcMinThreadCacheSize toolbox.Bytes = 512 << 10
+	tcMaxThreadCacheSize toolbox.Bytes = 4 << 20
+	tcStealAmount        toolbox.Bytes = 64 << 10
+
+	// defaultTCOverallCacheSize is the default budget for all thread
+	// caches together.
+	defaultTCOverallCacheSize toolbox.Bytes = 32 << 20
+
+	// defaultTCTransferSlots is the default number of batches each
+	// transfer cache holds.
+	defaultTCTransferSlots = 64
+)
+
+var (
+	tcThreadCacheStat = simulation.StatDesc{
+		Name:        "TCMallocThreadCacheBytes",
+		Unit:        simulation.UnitBytes,
+		Description: "memory of free objects in thread caches",
+	}
+	tcTransferCacheStat = simulation.StatDesc{
+		Name:        "TCMallocTransferCacheBytes",
+		Unit:        simulation.UnitBytes,
+		Description: "memory of free objects in transfer caches",
+	}
+	tcCentralCacheStat = simulation.StatDesc{
+		Name:        "TCMallocCentralCacheBytes",
+		Unit:        simulation.UnitBytes,
+		Description: "memory of free objects in central free lists",
+	}
+	tcSCWasteStat = simulation.StatDesc{
+		Name:        "TCMallocObjectTailUnusedBytes",
+		Unit:        simulation.UnitBytes,
+		Description: "memory lost to rounding objects up to their size class",
+	}
+	tcTailWasteStat = simulation.StatDesc{
+		Name:        "TCMallocTailUnusedBytes",
+		Unit:        simulation.UnitBytes,
+		Description: "memory at the end of spans too small for another object",
+	}
+)
+
+// tcStats are handles to a TCMalloc's statistics.
+type tcStats struct {
+	threadCache   *simulation.Stat
+	transferCache *simulation.Stat
+	centralCache  *simulation.Stat
+	scWaste       *simulation.Stat
+	tailWaste     *simulation.Stat
+}
+
+type tcSpan struct {
+	base     toolbox.Address
+	npages   toolbox.Pages
+	class    int8
+	elemSize toolbox.Bytes
+
+	// free are the span's objects in the central free list, and
+	// inUse is the number of its objects that are anywhere else.
+	free  []toolbox.Address
+	inUse uint64
+
+	tailWaste toolbox.Bytes
+	nonempty  bool
+}
+
+// tcFreeList is a thread cache's free list for a size class.
+type tcFreeList struct {
+	objs      []toolbox.Address
+	maxLength int
+	lowWater  int
+	overages  int
+}
+
+type tcThreadCache struct {
+	lists   []tcFreeList
+	size    toolbox.Bytes
+	maxSize toolbox.Bytes
+}
+
+type tcCentral struct {
+	// nonempty are the spans with objects in the central free list.
+	nonempty []*tcSpan
+
+	// transfer are full batches of free objects.
+	transfer [][]toolbox.Address
+}
+
+// TCMalloc is an object allocator modeled after TCMalloc, which
+// shards its free lists across a hierarchy of caches.
+//
+// Each P has a thread cache with a free list of objects per size
+// class. Free lists start short and grow as they're used, up to a
+// maximum which shrinks again when a list keeps overflowing. Each
+// thread cache has a size limit, which grows by stealing from an
+// overall budget, or from other thread caches. When a thread cache
+// exceeds its limit, it returns half of each list's unused objects.
+//
+// Thread caches move objects to and from the central free list in
+// batches, and the transfer cache holds a number of full batches for
+// each size class so they can move between thread caches cheaply.
+// Spans for the central free list come from the page allocator, and
+// are returned to it once all their objects are free. Large objects
+// are allocated from the page allocator directly.
+//
+// It uses the same size classes as Go115, and frees objects as soon
+// as they're found to be dead.
+type TCMalloc struct {
+	pageAllocator toolbox.PageAllocator
+	classes       *sizeClasses
+	index         map[toolbox.Address]*tcSpan
+	objectSizes   map[toolbox.Address]toolbox.Bytes
+	central       []tcCentral
+
+	// threads are the thread caches in the order they were created,
+	// so that memory is stolen from them round-robin.
+	threads   []*tcThreadCache
+	byP       map[toolbox.P]*tcThreadCache
+	nextSteal int
+	unclaimed toolbox.Bytes
+
+	overallCacheSize toolbox.Bytes
+	transferSlots    int
+
+	stats tcStats
+}
+
+// TCMallocOption is a configuration option for a TCMalloc object
+// allocator.
+type TCMallocOption func(g *TCMalloc)
+
+// TCMallocOverallCacheSize returns a configuration option that sets
+// the budget for the size of all thread caches together.
+//
+// The default is 32 MiB.
+func TCMallocOverallCacheSize(size toolbox.Bytes) TCMallocOption {
+	return func(g *TCMalloc) {
+		g.overallCacheSize = size
+	}
+}
+
+// TCMallocTransferSlots returns a configuration option that sets the
+// number of batches of objects each size class's transfer cache may
+// hold. Zero turns off the transfer cache.
+//
+// The default is 64.
+func TCMallocTransferSlots(n int) TCMallocOption {
+	return func(g *TCMalloc) {
+		g.transferSlots = n
+	}
+}
+
+// NewTCMalloc creates a new TCMalloc object allocator on top of pa,
+// which must have 8 KiB pages. Panics if the configuration is invalid.
+func NewTCMalloc(pa toolbox.PageAllocator, options ...TCMallocOption) *TCMalloc {
+	g, err := NewTCMallocChecked(pa, options...)
+	if err != nil {
+		panic(err.Error())
+	}
+	return g
+}
+
+// NewTCMallocChecked is like NewTCMalloc, but returns an error instead
+// of panicking if the configuration is invalid.
+func NewTCMallocChecked(pa toolbox.PageAllocator, options ...TCMallocOption) (*TCMalloc, error) {
+	if pa.BytesPerPage() != 8192 {
+		return nil, errors.New("page allocator must have 8 KiB pages")
+	}
+	g := &TCMalloc{
+		pageAllocator:    pa,
+		classes:          &go115SizeClasses,
+		index:            make(map[toolbox.Address]*tcSpan),
+		objectSizes:      make(map[toolbox.Address]toolbox.Bytes),
+		central:          make([]tcCentral, len(go115SizeClasses.size)),
+		byP:              make(map[toolbox.P]*tcThreadCache),
+		overallCacheSize: defaultTCOverallCacheSize,
+		transferSlots:    defaultTCTransferSlots,
+	}
+	for _, opt := range options {
+		opt(g)
+	}
+	if err := g.checkConfig(); err != nil {
+		return nil, err
+	}
+	g.unclaimed = g.overallCacheSize
+	return g, nil
+}
+
+func (g *TCMalloc) checkConfig() error {
+	if g.overallCacheSize < tcMinThreadCacheSize {
+		return errors.New("overall thread cache size must be at least 512 KiB")
+	}
+	if g.transferSlots < 0 {
+		return errors.New("transfer cache slots must be non-negative")
+	}
+	return nil
+}
+
+func init() {
+	toolbox.RegisterObjectAllocator("tcmalloc", func(pa toolbox.PageAllocator, p toolbox.Params) (toolbox.ObjectAllocator, error) {
+		if err := p.Check("threadCacheSize", "transferSlots"); err != nil {
+			return nil, err
+		}
+		size, err := p.Bytes("threadCacheSize", defaultTCOverallCacheSize)
+		if err != nil {
+			return nil, err
+		}
+		slots, err := p.Uint64("transferSlots", defaultTCTransferSlots)
+		if err != nil {
+			return nil, err
+		}
+		g, err := NewTCMallocChecked(pa, TCMallocOverallCacheSize(size), TCMallocTransferSlots(int(slots)))
+		if err != nil {
+			return nil, err
+		}
+		return g, nil
+	})
+}
+
+func (g *TCMalloc) RegisterStats(stats *simulation.Stats) {
+	g.pageAllocator.RegisterStats(stats)
+	g.stats.threadCache = stats.RegisterOther(tcThreadCacheStat)
+	g.stats.transferCache = stats.RegisterOther(tcTransferCacheStat)
+	g.stats.centralCache = stats.RegisterOther(tcCentralCacheStat)
+	g.stats.scWaste = stats.RegisterOther(tcSCWasteStat)
+	g.stats.tailWaste = stats.RegisterOther(tcTailWasteStat)
+}
+
+// batchSize returns the number of objects moved between a thread
+// cache and the central free list at once for a size class.
+func (g *TCMalloc) batchSize(class int8) int {
+	n := int((64 << 10) / g.classes.size[class])
+	if n < 2 {
+		n = 2
+	} else if n > 32 {
+		n = 32
+	}
+	return n
+}
+
+func (g *TCMalloc) threadCache(p toolbox.P) *tcThreadCache {
+	t, ok := g.byP[p]
+	if ok {
+		return t
+	}
+	t = &tcThreadCache{lists: make([]tcFreeList, len(g.classes.size))}
+	for i := range t.lists {
+		t.lists[i].maxLength = 1
+	}
+	g.threads = append(g.threads, t)
+	g.byP[p] = t
+	g.increaseCacheLimit(t)
+	if t.maxSize == 0 {
+		t.maxSize = tcMinThreadCacheSize
+		if g.unclaimed >= tcMinThreadCacheSize {
+			g.unclaimed -= tcMinThreadCacheSize
+		} else {
+			g.unclaimed = 0
+		}
+	}
+	return t
+}
+
+// increaseCacheLimit grows a thread cache's size limit, taking
+// memory from the overall budget if there's any left, or from
+// another thread cache otherwise.
+func (g *TCMalloc) increaseCacheLimit(t *tcThreadCache) {
+	if t.maxSize >= tcMaxThreadCacheSize {
+		return
+	}
+	if g.unclaimed >= tcStealAmount {
+		g.unclaimed -= tcStealAmount
+		t.maxSize += tcStealAmount
+		return
+	}
+	for i := 0; i < 10 && i < len(g.threads); i++ {
+		victim := g.threads[g.nextSteal]
+		g.nextSteal = (g.nextSteal + 1) % len(g.threads)
+		if victim == t || victim.maxSize <= tcMinThreadCacheSize {
+			continue
+		}
+		victim.maxSize -= tcStealAmount
+		t.maxSize += tcStealAmount
+		return
+	}
+}
+
+func (g *TCMalloc) AllocObject(ctx toolbox.Context, size toolbox.Bytes, _, _ bool) toolbox.Address {
+	if size > g.classes.maxSmall {
+		return g.allocLarge(ctx, size)
+	}
+	class := g.classes.sizeToClass(size)
+	elemSize := g.classes.size[class]
+	var x toolbox.Address
+	if ctx.P == toolbox.NoP {
+		x = g.removeRange(ctx, class, 1)[0]
+		g.stats.centralCache.Sub(uint64(elemSize))
+	} else {
+		t := g.threadCache(ctx.P)
+		l := &t.lists[class]
+		if len(l.objs) == 0 {
+			g.fetchFromCentral(ctx, t, class)
+		}
+		x = l.objs[len(l.objs)-1]
+		l.objs = l.objs[:len(l.objs)-1]
+		if len(l.objs) < l.lowWater {
+			l.lowWater = len(l.objs)
+		}
+		t.size -= elemSize
+		ctx.PStats().CachedBytes -= uint64(elemSize)
+		g.stats.threadCache.Sub(uint64(elemSize))
+	}
+	g.objectSizes[x] = size
+	ctx.Stats.FreeBytes -= uint64(elemSize)
+	ctx.Stats.ObjectBytes += uint64(size)
+	ctx.Stats.UnusedBytes += uint64(elemSize - size)
+	g.stats.scWaste.Add(uint64(elemSize - size))
+	ctx.Stats.Allocs++
+	return x
+}
+
+func (g *TCMalloc) allocLarge(ctx toolbox.Context, size toolbox.Bytes) toolbox.Address {
+	pageSize := g.pageAllocator.BytesPerPage()
+	npages := size.Pages(pageSize)
+	x := g.pageAllocator.AllocPages(ctx, npages)
+	s := &tcSpan{
+		base:      x,
+		npages:    npages,
+		elemSize:  size,
+		inUse:     1,
+		tailWaste: npages.Bytes(pageSize) - size,
+	}
+	g.addToIndex(s)
+	g.objectSizes[x] = size
+	ctx.Stats.FreeBytes -= uint64(npages.Bytes(pageSize))
+	ctx.Stats.ObjectBytes += uint64(size)
+	ctx.Stats.UnusedBytes += uint64(s.tailWaste)
+	g.stats.tailWaste.Add(uint64(s.tailWaste))
+	ctx.Stats.Allocs++
+	return x
+}
+
+func (g *TCMalloc) DeadObject(ctx toolbox.Context, addr toolbox.Address) {
+	size := g.objectSizes[addr]
+	delete(g.objectSizes, addr)
+	ctx.Stats.Frees++
+	if size > g.classes.maxSmall {
+		s := g.index[addr]
+		g.removeFromIndex(s)
+		g.pageAllocator.FreePages(ctx, s.base, s.npages)
+		ctx.Stats.FreeBytes += uint64(s.npages.Bytes(g.pageAllocator.BytesPerPage()))
+		ctx.Stats.ObjectBytes -= uint64(size)
+		ctx.Stats.UnusedBytes -= uint64(s.tailWaste)
+		g.stats.tailWaste.Sub(uint64(s.tailWaste))
+		return
+	}
+	class := g.classes.sizeToClass(size)
+	elemSize := g.classes.size[class]
+	ctx.Stats.FreeBytes += uint64(elemSize)
+	ctx.Stats.ObjectBytes -= uint64(size)
+	ctx.Stats.UnusedBytes -= uint64(elemSize - size)
+	g.stats.scWaste.Sub(uint64(elemSize - size))
+	if ctx.P == toolbox.NoP {
+		g.stats.centralCache.Add(uint64(elemSize))
+		g.insertRange(ctx, class, []toolbox.Address{addr})
+		return
+	}
+	t := g.threadCache(ctx.P)
+	l := &t.lists[class]
+	l.objs = append(l.objs, addr)
+	t.size += elemSize
+	ctx.PStats().CachedBytes += uint64(elemSize)
+	g.stats.threadCache.Add(uint64(elemSize))
+	if len(l.objs) > l.maxLength {
+		g.listTooLong(ctx, t, class)
+	}
+	if t.size > t.maxSize {
+		g.scavenge(ctx, t)
+	}
+}
+
+func (g *TCMalloc) GCStart(ctx toolbox.Context) {}
+
+func (g *TCMalloc) GCEnd(ctx toolbox.Context) {}
+
+// fetchFromCentral refills an empty free list from the central free
+// list, growing the list's maximum length.
+func (g *TCMalloc) fetchFromCentral(ctx toolbox.Context, t *tcThreadCache, class int8) {
+	l := &t.lists[class]
+	batch := g.batchSize(class)
+	n := batch
+	if l.maxLength < n {
+		n = l.maxLength
+	}
+	l.objs = append(l.objs, g.removeRange(ctx, class, n)...)
+	elemSize := g.classes.size[class]
+	moved := elemSize * toolbox.Bytes(len(l.objs))
+	t.size += moved
+	ps := ctx.PStats()
+	ps.CachedBytes += uint64(moved)
+	ps.Refills++
+	g.stats.threadCache.Add(uint64(moved))
+	g.stats.centralCache.Sub(uint64(moved))
+
+	// Grow the maximum length slowly at first, then a batch at a time.
+	if l.maxLength < batch {
+		l.maxLength++
+	} else {
+		l.maxLength += batch
+		if max := tcMaxDynamicFreeListLength - tcMaxDynamicFreeListLength%batch; l.maxLength > max {
+			l.maxLength = max
+		}
+		l.overages = 0
+	}
+}
+
+// listTooLong returns a batch of objects from a free list that
+// exceeded its maximum length, adjusting the maximum length.
+func (g *TCMalloc) listTooLong(ctx toolbox.Context, t *tcThreadCache, class int8) {
+	l := &t.lists[class]
+	batch := g.batchSize(class)
+	g.releaseToCentral(ctx, t, class, batch)
+	if l.maxLength < batch {
+		l.maxLength++
+	} else if l.maxLength > batch {
+		if l.overages++; l.overages > tcMaxOverages {
+			l.maxLength -= batch
+			l.overages = 0
+		}
+	}
+}
+
+// scavenge returns half of the objects each free list didn't use
+// since the last scavenge, and grows the thread cache's limit.
+func (g *TCMalloc) scavenge(ctx toolbox.Context, t *tcThreadCache) {
+	for class := range t.lists {
+		l := &t.lists[class]
+		if l.lowWater > 0 {
+			drop := l.lowWater / 2
+			if drop == 0 {
+				drop = 1
+			}
+			g.releaseToCentral(ctx, t, int8(class), drop)
+			if batch := g.batchSize(int8(class)); l.maxLength > batch {
+				l.maxLength -= batch
+				if l.maxLength < batch {
+					l.maxLength = batch
+				}
+			}
+		}
+		l.lowWater = len(l.objs)
+	}
+	g.increaseCacheLimit(t)
+}
+
+// releaseToCentral moves up to n objects from a free list to the
+// central free list.
+func (g *TCMalloc) releaseToCentral(ctx toolbox.Context, t *tcThreadCache, class int8, n int) {
+	l := &t.lists[class]
+	if n > len(l.objs) {
+		n = len(l.objs)
+	}
+	if n == 0 {
+		return
+	}
+	objs := make([]toolbox.Address, n)
+	copy(objs, l.objs[len(l.objs)-n:])
+	l.objs = l.objs[:len(l.objs)-n]
+	if len(l.objs) < l.lowWater {
+		l.lowWater = len(l.objs)
+	}
+	moved := g.classes.size[class] * toolbox.Bytes(n)
+	t.size -= moved
+	ctx.PStats().CachedBytes -= uint64(moved)
+	g.stats.threadCache.Sub(uint64(moved))
+	g.stats.centralCache.Add(uint64(moved))
+	g.insertRange(ctx, class, objs)
+}
+
+// removeRange takes n objects from the central free list, preferring
+// a full batch from the transfer cache, and counts them as moving out
+// of the central cache.
+func (g *TCMalloc) removeRange(ctx toolbox.Context, class int8, n int) []toolbox.Address {
+	c := &g.central[class]
+	elemSize := g.classes.size[class]
+	if n == g.batchSize(class) && len(c.transfer) != 0 {
+		objs := c.transfer[len(c.transfer)-1]
+		c.transfer = c.transfer[:len(c.transfer)-1]
+		moved := uint64(elemSize) * uint64(n)
+		g.stats.transferCache.Sub(moved)
+		g.stats.centralCache.Add(moved)
+		return objs
+	}
+	objs := make([]toolbox.Address, 0, n)
+	for len(objs) < n {
+		if len(c.nonempty) == 0 {
+			g.populate(ctx, class)
+		}
+		s := c.nonempty[len(c.nonempty)-1]
+		k := n - len(objs)
+		if k > len(s.free) {
+			k = len(s.free)
+		}
+		objs = append(objs, s.free[len(s.free)-k:]...)
+		s.free = s.free[:len(s.free)-k]
+		s.inUse += uint64(k)
+		if len(s.free) == 0 {
+			c.nonempty = c.nonempty[:len(c.nonempty)-1]
+			s.nonempty = false
+		}
+	}
+	return objs
+}
+
+// insertRange returns objects to the central free list, keeping them
+// as a batch in the transfer cache if they're a full batch and there's
+// room, and returning spans to the page allocator once all their
+// objects are free.
+func (g *TCMalloc) insertRange(ctx toolbox.Context, class int8, objs []toolbox.Address) {
+	c := &g.central[class]
+	elemSize := g.classes.size[class]
+	if len(objs) == g.batchSize(class) && len(c.transfer) < g.transferSlots {
+		c.transfer = append(c.transfer, objs)
+		moved := uint64(elemSize) * uint64(len(objs))
+		g.stats.centralCache.Sub(moved)
+		g.stats.transferCache.Add(moved)
+		return
+	}
+	pageSize := g.pageAllocator.BytesPerPage()
+	for _, x := range objs {
+		s := g.index[x.AlignDown(pageSize)]
+		s.free = append(s.free, x)
+		s.inUse--
+		if s.inUse != 0 {
+			if !s.nonempty {
+				c.nonempty = append(c.nonempty, s)
+				s.nonempty = true
+			}
+			continue
+		}
+		// The span is entirely free, so return it.
+		if s.nonempty {
+			for i, t := range c.nonempty {
+				if t == s {
+					c.nonempty = append(c.nonempty[:i], c.nonempty[i+1:]...)
+					break
+				}
+			}
+		}
+		g.removeFromIndex(s)
+		g.pageAllocator.FreePages(ctx, s.base, s.npages)
+		free := elemSize * toolbox.Bytes(len(s.free))
+		g.stats.centralCache.Sub(uint64(free))
+		ctx.Stats.FreeBytes += uint64(s.tailWaste)
+		ctx.Stats.UnusedBytes -= uint64(s.tailWaste)
+		g.stats.tailWaste.Sub(uint64(s.tailWaste))
+	}
+}
+
+// populate allocates a new span for the central free list.
+func (g *TCMalloc) populate(ctx toolbox.Context, class int8) {
+	pageSize := g.pageAllocator.BytesPerPage()
+	npages := g.classes.pages[class]
+	elemSize := g.classes.size[class]
+	spanBytes := npages.Bytes(pageSize)
+	numElems := spanBytes / elemSize
+	s := &tcSpan{
+		base:      g.pageAllocator.AllocPages(ctx, npages),
+		npages:    npages,
+		class:     class,
+		elemSize:  elemSize,
+		tailWaste: spanBytes - numElems*elemSize,
+		nonempty:  true,
+	}
+	// Objects are handed out from the end of the list, so put the
+	// lowest addresses last.
+	for i := numElems; i > 0; i-- {
+		s.free = append(s.free, s.base.Add((i-1)*elemSize))
+	}
+	g.addToIndex(s)
+	c := &g.central[class]
+	c.nonempty = append(c.nonempty, s)
+	ctx.Stats.FreeBytes -= uint64(s.tailWaste)
+	ctx.Stats.UnusedBytes += uint64(s.tailWaste)
+	g.stats.tailWaste.Add(uint64(s.tailWaste))
+	g.stats.centralCache.Add(uint64(numElems * elemSize))
+}
+
+func (g *TCMalloc) addToIndex(s *tcSpan) {
+	for i := toolbox.Pages(0); i < s.npages; i++ {
+		g.index[s.base.Add(i.Bytes(g.pageAllocator.BytesPerPage()))] = s
+	}
+}
+
+func (g *TCMalloc) removeFromIndex(s *tcSpan) {
+	for i := toolbox.Pages(0); i < s.npages; i++ {
+		delete(g.index, s.base.Add(i.Bytes(g.pageAllocator.BytesPerPage())))
+	}
+}
+
+// tcSpanState is the saved state of a tcSpan.
+type tcSpanState struct {
+	Base      toolbox.Address
+	NPages    toolbox.Pages
+	Class     int8
+	ElemSize  toolbox.Bytes
+	Free      []toolbox.Address
+	InUse     uint64
+	TailWaste toolbox.Bytes
+	Nonempty  bool
+}
+
+// tcCentralState is the saved state of a tcCentral, with spans
+// identified by their base address.
+type tcCentralState struct {
+	Nonempty []toolbox.Address
+	Transfer [][]toolbox.Address
+}
+
+// tcFreeListState is the saved state of a tcFreeList.
+type tcFreeListState struct {
+	Objs      []toolbox.Address
+	MaxLength int
+	LowWater  int
+	Overages  int
+}
+
+// tcThreadCacheState is the saved state of a tcThreadCache.
+type tcThreadCacheState struct {
+	Lists   []tcFreeListState
+	Size    toolbox.Bytes
+	MaxSize toolbox.Bytes
+}
+
+// tcState is the saved state of a TCMalloc object allocator.
+type tcState struct {
+	Spans       []tcSpanState
+	ObjectSizes map[toolbox.Address]toolbox.Bytes
+	Central     []tcCentralState
+	Threads     []tcThreadCacheState
+
+	// ByP holds the index in Threads of each P's thread cache.
+	ByP       map[toolbox.P]int
+	NextSteal int
+	Unclaimed toolbox.Bytes
+}
+
+// SaveState implements simulation.Checkpointer.
+func (g *TCMalloc) SaveState(enc *gob.Encoder) error {
+	st := tcState{
+		ObjectSizes: g.objectSizes,
+		Central:     make([]tcCentralState, len(g.central)),
+		ByP:         make(map[toolbox.P]int),
+		NextSteal:   g.nextSteal,
+		Unclaimed:   g.unclaimed,
+	}
+	for addr, s := range g.index {
+		if addr != s.base {
+			continue
+		}
+		st.Spans = append(st.Spans, tcSpanState{
+			Base:      s.base,
+			NPages:    s.npages,
+			Class:     s.class,
+			ElemSize:  s.elemSize,
+			Free:      s.free,
+			InUse:     s.inUse,
+			TailWaste: s.tailWaste,
+			Nonempty:  s.nonempty,
+		})
+	}
+	sort.Slice(st.Spans, func(i, j int) bool {
+		return st.Spans[i].Base < st.Spans[j].Base
+	})
+	for class := range g.central {
+		c := &g.central[class]
+		for _, s := range c.nonempty {
+			st.Central[class].Nonempty = append(st.Central[class].Nonempty, s.base)
+		}
+		st.Central[class].Transfer = c.transfer
+	}
+	threads := make(map[*tcThreadCache]int)
+	for i, t := range g.threads {
+		threads[t] = i
+		ts := tcThreadCacheState{
+			Lists:   make([]tcFreeListState, len(t.lists)),
+			Size:    t.size,
+			MaxSize: t.maxSize,
+		}
+		for class, l := range t.lists {
+			ts.Lists[class] = tcFreeListState{l.objs, l.maxLength, l.lowWater, l.overages}
+		}
+		st.Threads = append(st.Threads, ts)
+	}
+	for p, t := range g.byP {
+		st.ByP[p] = threads[t]
+	}
+	return enc.Encode(&st)
+}
+
+// LoadState implements simulation.Checkpointer.
+func (g *TCMalloc) LoadState(dec *gob.Decoder) error {
+	var st tcState
+	if err := dec.Decode(&st); err != nil {
+		return err
+	}
+	if len(st.Central) != len(g.central) {
+		return fmt.Errorf("checkpoint has %d size classes, but there are %d", len(st.Central), len(g.central))
+	}
+	g.index = make(map[toolbox.Address]*tcSpan)
+	for _, ss := range st.Spans {
+		g.addToIndex(&tcSpan{
+			base:      ss.Base,
+			npages:    ss.NPages,
+			class:     ss.Class,
+			elemSize:  ss.ElemSize,
+			free:      ss.Free,
+			inUse:     ss.InUse,
+			tailWaste: ss.TailWaste,
+			nonempty:  ss.Nonempty,
+		})
+	}
+	g.objectSizes = st.ObjectSizes
+	if g.objectSizes == nil {
+		g.objectSizes = make(map[toolbox.Address]toolbox.Bytes)
+	}
+	for class := range g.central {
+		c := &g.central[class]
+		c.nonempty = nil
+		for _, base := range st.Central[class].Nonempty {
+			s, ok := g.index[base]
+			if !ok || s.base != base {
+				return fmt.Errorf("checkpoint refers to unknown span %#x", base)
+			}
+			c.nonempty = append(c.nonempty, s)
+		}
+		c.transfer = st.Central[class].Transfer
+	}
+	g.threads = nil
+	for _, ts := range st.Threads {
+		t := &tcThreadCache{
+			lists:   make([]tcFreeList, len(ts.Lists)),
+			size:    ts.Size,
+			maxSize: ts.MaxSize,
+		}
+		for class, l := range ts.Lists {
+			t.lists[class] = tcFreeList{l.Objs, l.MaxLength, l.LowWater, l.Overages}
+		}
+		g.threads = append(g.threads, t)
+	}
+	g.byP = make(map[toolbox.P]*tcThreadCache)
+	for p, i := range st.ByP {
+		if i < 0 || i >= len(g.threads) {
+			return fmt.Errorf("checkpoint refers to unknown thread cache %d", i)
+		}
+		g.byP[p] = g.threads[i]
+	}
+	g.nextSteal = st.NextSteal
+	g.unclaimed = st.Unclaimed
+	return nil
+}
@@ -0,0 +1,203 @@
+package object
+
+import (
+	"fmt"
+
+	"github.com/mknyszek/goat/simulation/toolbox"
+)
+
+// defaultTinySize is the size of the Go runtime's tiny blocks.
+const defaultTinySize = 16
+
+// tinyBlock is a block of memory that small pointer-free objects
+// are combined into.
+type tinyBlock struct {
+	base   toolbox.Address
+	p      toolbox.P
+	offset toolbox.Bytes
+
+	// objects is the number of objects allocated in the block,
+	// live is how many of them are still live, and dead is the
+	// number of bytes of objects which died.
+	objects uint64
+	live    uint64
+	dead    toolbox.Bytes
+}
+
+type tinyObject struct {
+	block *tinyBlock
+	size  toolbox.Bytes
+}
+
+// go115Tiny models the runtime's tiny allocator, which combines
+// pointer-free objects smaller than the tiny block size into shared
+// blocks. A block is only freed once every object in it is dead,
+// so dead objects may be retained by live neighbors.
+//
+// Traces only contain the tiny objects that caused the traced
+// program to allocate a new block, so the simulation only sees
+// a fraction of the program's tiny objects.
+type go115Tiny struct {
+	size    toolbox.Bytes
+	current map[toolbox.P]*tinyBlock
+	objects map[toolbox.Address]tinyObject
+
+	// empty holds blocks with no live objects which stopped being
+	// a P's current block. Their spans may still be cached, so
+	// they're freed at the end of the next GC cycle.
+	empty []*tinyBlock
+}
+
+func newGo115Tiny() go115Tiny {
+	return go115Tiny{
+		size:    defaultTinySize,
+		current: make(map[toolbox.P]*tinyBlock),
+		objects: make(map[toolbox.Address]tinyObject),
+	}
+}
+
+// maxTinySize is the largest allowed tiny block size.
+const maxTinySize = 1024
+
+func checkTinySize(size toolbox.Bytes) error {
+	if size&(size-1) != 0 || size > maxTinySize {
+		return fmt.Errorf("tiny block size must be zero or a power of two no larger than %d", maxTinySize)
+	}
+	return nil
+}
+
+// decodeTinySize returns the configuration options for the
+// tinySize parameter.
+func decodeTinySize(p toolbox.Params) ([]Go115Option, error) {
+	size, err := p.Bytes("tinySize", defaultTinySize)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkTinySize(size); err != nil {
+		return nil, err
+	}
+	return []Go115Option{Go115TinySize(size)}, nil
+}
+
+// tinyAlign returns the offset at which an object of the given size
+// is placed in a tiny block with offset bytes already allocated,
+// aligned the same way the runtime aligns tiny objects.
+func tinyAlign(offset, size toolbox.Bytes) toolbox.Bytes {
+	switch {
+	case size&7 == 0:
+		return offset.AlignUp(8)
+	case size&3 == 0:
+		return offset.AlignUp(4)
+	case size&1 == 0:
+		return offset.AlignUp(2)
+	}
+	return offset
+}
+
+// Go115TinySize returns a configuration option that sets the size
+// of the blocks pointer-free objects are combined into by the tiny
+// allocator. Pointer-free objects smaller than size are tiny objects.
+// A size of zero turns off the tiny allocator, giving every object
+// its own slot.
+//
+// The size must be zero or a power of two no larger than 1 KiB.
+// The default is 16 bytes.
+func Go115TinySize(size toolbox.Bytes) Go115Option {
+	return func(g *Go115) {
+		g.tiny.size = size
+	}
+}
+
+// AllocTiny implements toolbox.TinyAllocator.
+func (g *Go115) AllocTiny(ctx toolbox.Context, size toolbox.Bytes) toolbox.Address {
+	if size >= g.tiny.size {
+		return g.allocObject(ctx, size, false, true)
+	}
+	b := g.tiny.current[ctx.P]
+	offset := toolbox.Bytes(0)
+	if b != nil {
+		offset = tinyAlign(b.offset, size)
+	}
+	if b == nil || offset+size > g.tiny.size {
+		// Allocate a new block. Only the objects count as
+		// allocations, so don't count the block.
+		nb := &tinyBlock{
+			base: g.allocObject(ctx, g.tiny.size, false, true),
+			p:    ctx.P,
+		}
+		ctx.Stats.Allocs--
+		ctx.Stats.ObjectBytes -= uint64(g.tiny.size)
+		ctx.Stats.UnusedBytes += uint64(g.tiny.size)
+		g.stats.tinyWaste.Add(uint64(g.tiny.size))
+
+		// Like the runtime, keep whichever block has more space left.
+		if b == nil || size < b.offset {
+			g.tiny.current[ctx.P] = nb
+			if b != nil && b.live == 0 {
+				g.tiny.empty = append(g.tiny.empty, b)
+			}
+		}
+		b, offset = nb, 0
+	}
+	b.offset = offset + size
+	b.objects++
+	b.live++
+	addr := b.base.Add(offset)
+	g.tiny.objects[addr] = tinyObject{block: b, size: size}
+	g.stats.tinyWaste.Sub(uint64(size))
+	ctx.Stats.ObjectBytes += uint64(size)
+	ctx.Stats.UnusedBytes -= uint64(size)
+	ctx.Stats.Allocs++
+	return addr
+}
+
+// deadTiny marks a tiny object as dead, and frees its block if it
+// was the last live object in it. The current block of a P is never
+// freed, since more objects may still be allocated in it; it's freed
+// once it's replaced or dropped at the end of a GC cycle instead.
+func (g *Go115) deadTiny(ctx toolbox.Context, addr toolbox.Address, obj tinyObject) {
+	delete(g.tiny.objects, addr)
+	b := obj.block
+	b.live--
+	b.dead += obj.size
+	ctx.Stats.ObjectBytes -= uint64(obj.size)
+	ctx.Stats.UnusedBytes += uint64(obj.size)
+	g.stats.tinyRetained.Add(uint64(obj.size))
+	if b.live != 0 || g.tiny.current[b.p] == b {
+		return
+	}
+	g.freeTinyBlock(ctx, b)
+}
+
+// dropTiny drops the current tiny block of every P, and frees those
+// and any replaced blocks with no live objects.
+func (g *Go115) dropTiny(ctx toolbox.Context) {
+	order := make([]toolbox.P, 0, len(g.tiny.current))
+	for p := range g.tiny.current {
+		order = append(order, p)
+	}
+	for _, p := range sortPs(order) {
+		b := g.tiny.current[p]
+		delete(g.tiny.current, p)
+		if b.live == 0 {
+			g.tiny.empty = append(g.tiny.empty, b)
+		}
+	}
+	for _, b := range g.tiny.empty {
+		g.freeTinyBlock(ctx, b)
+	}
+	g.tiny.empty = g.tiny.empty[:0]
+}
+
+// freeTinyBlock frees a tiny block with no live objects.
+func (g *Go115) freeTinyBlock(ctx toolbox.Context, b *tinyBlock) {
+	g.stats.tinyRetained.Sub(uint64(b.dead))
+	g.stats.tinyWaste.Sub(uint64(g.tiny.size - b.dead))
+
+	// Hand the block back to the allocator as a dead object. The
+	// block will only be counted as one free, so count the rest.
+	ctx.Stats.ObjectBytes += uint64(g.tiny.size)
+	ctx.Stats.UnusedBytes -= uint64(g.tiny.size)
+	ctx.Stats.Frees += b.objects - 1
+	g.deadObject(ctx, b.base)
+}
@@ -0,0 +1,126 @@
+package object
+
+import (
+	"testing"
+
+	"github.com/mknyszek/goat/simulation"
+	"github.com/mknyszek/goat/simulation/toolbox"
+	"github.com/mknyszek/goat/simulation/toolbox/page"
+)
+
+func newTestGo115(options ...Go115Option) (*Go115, *simulation.Stats) {
+	g := NewGo115(page.NewGo114(toolbox.NewAddressSpace48(8192), page.Go114Scavenge(false)), options...)
+	stats := simulation.NewStats()
+	g.RegisterStats(stats)
+	return g, stats
+}
+
+func TestTinyCombine(t *testing.T) {
+	type placement struct {
+		block  int
+		offset toolbox.Bytes
+	}
+	tests := []struct {
+		name  string
+		sizes []toolbox.Bytes
+		want  []placement
+	}{
+		{"Packed", []toolbox.Bytes{1, 1, 1}, []placement{{0, 0}, {0, 1}, {0, 2}}},
+		{"Aligned", []toolbox.Bytes{1, 2, 4, 8}, []placement{{0, 0}, {0, 2}, {0, 4}, {0, 8}}},
+		{"Full", []toolbox.Bytes{8, 8, 1}, []placement{{0, 0}, {0, 8}, {1, 0}}},
+		{"KeepNew", []toolbox.Bytes{12, 8, 2}, []placement{{0, 0}, {1, 0}, {1, 8}}},
+		{"KeepOld", []toolbox.Bytes{6, 12, 2}, []placement{{0, 0}, {1, 0}, {0, 6}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			g, stats := newTestGo115()
+			ctx := toolbox.Context{P: 0, Stats: stats}
+			var blocks []toolbox.Address
+			for i, size := range test.sizes {
+				addr := g.AllocTiny(ctx, size)
+				want := test.want[i]
+				if want.block == len(blocks) {
+					blocks = append(blocks, addr.Add(-want.offset))
+				}
+				if got := blocks[want.block].Add(want.offset); addr != got {
+					t.Errorf("object %d: expected %#x, got %#x", i, got, addr)
+				}
+			}
+			allocated := toolbox.Bytes(0)
+			for _, size := range test.sizes {
+				allocated += size
+			}
+			unused := toolbox.Bytes(len(blocks))*defaultTinySize - allocated
+			if stats.Allocs != uint64(len(test.sizes)) || stats.ObjectBytes != uint64(allocated) {
+				t.Errorf("expected %d allocs of %d bytes, got %d of %d", len(test.sizes), allocated, stats.Allocs, stats.ObjectBytes)
+			}
+			if waste := stats.LookupOther("Go115TinyUnusedBytes").Value(); waste != uint64(unused) {
+				t.Errorf("expected %d unused tiny bytes, got %d", unused, waste)
+			}
+		})
+	}
+}
+
+func TestTinyDeath(t *testing.T) {
+	g, stats := newTestGo115()
+	ctx := toolbox.Context{P: 0, Stats: stats}
+	retained := stats.LookupOther("Go115TinyRetainedBytes")
+	waste := stats.LookupOther("Go115TinyUnusedBytes")
+
+	// Fill one block, and start another which stays current.
+	full := []toolbox.Address{g.AllocTiny(ctx, 8), g.AllocTiny(ctx, 8)}
+	current := g.AllocTiny(ctx, 4)
+	g.GCStart(ctx)
+	g.GCEnd(ctx)
+
+	// The full block is retained until its last object dies.
+	g.DeadObject(ctx, full[0])
+	if retained.Value() != 8 || stats.Frees != 0 {
+		t.Errorf("expected 8 retained bytes and no frees, got %d and %d", retained.Value(), stats.Frees)
+	}
+	g.DeadObject(ctx, full[1])
+	g.DeadObject(ctx, current)
+	if retained.Value() != 0 || waste.Value() != 0 || stats.Frees != 3 {
+		t.Errorf("expected no retained or unused bytes and 3 frees, got %d, %d, and %d", retained.Value(), waste.Value(), stats.Frees)
+	}
+	if stats.ObjectBytes != 0 || stats.UnusedBytes != 0 {
+		t.Errorf("expected no object or unused bytes, got %d and %d", stats.ObjectBytes, stats.UnusedBytes)
+	}
+}
+
+func TestTinyCurrentBlockKept(t *testing.T) {
+	g, stats := newTestGo115()
+	ctx := toolbox.Context{P: 0, Stats: stats}
+	retained := stats.LookupOther("Go115TinyRetainedBytes")
+	waste := stats.LookupOther("Go115TinyUnusedBytes")
+
+	// Objects in the current block die before the cycle ends, but
+	// the block stays current.
+	a := g.AllocTiny(ctx, 12)
+	g.DeadObject(ctx, a)
+	b := g.AllocTiny(ctx, 2)
+	if b != a.Add(12) {
+		t.Errorf("expected the current block to be reused at %#x, got %#x", a.Add(12), b)
+	}
+	g.DeadObject(ctx, b)
+	if retained.Value() != 14 || g.tiny.current[0] == nil {
+		t.Errorf("expected the current block to retain 14 bytes, got %d", retained.Value())
+	}
+
+	// Replacing the empty block frees it at the end of the cycle.
+	g.AllocTiny(ctx, 8)
+	if len(g.tiny.empty) != 1 || retained.Value() != 14 {
+		t.Errorf("expected 1 empty block retaining 14 bytes, got %d retaining %d", len(g.tiny.empty), retained.Value())
+	}
+	g.GCStart(ctx)
+	g.GCEnd(ctx)
+	if len(g.tiny.empty) != 0 || len(g.tiny.current) != 0 {
+		t.Errorf("expected no empty or current blocks, got %d and %d", len(g.tiny.empty), len(g.tiny.current))
+	}
+	if retained.Value() != 0 || waste.Value() != 8 {
+		t.Errorf("expected 0 retained and 8 unused bytes, got %d and %d", retained.Value(), waste.Value())
+	}
+	if stats.ObjectBytes != 8 {
+		t.Errorf("expected 8 object bytes, got %d", stats.ObjectBytes)
+	}
+}
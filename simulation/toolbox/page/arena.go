@@ -0,0 +1,75 @@
+package page
+
+import (
+	"github.com/mknyszek/goat/simulation/toolbox"
+)
+
+// heapArenaSize is the granularity at which the runtime's heap
+// reserves address space, heapArenaBytes.
+const heapArenaSize toolbox.Bytes = 64 << 20
+
+// arenas models how the runtime's heap has grown since Go 1.13: it
+// reserves address space in whole arenas, but only hands out as much
+// of the current arena as it needs.
+//
+// Reserved memory isn't counted in the statistics until it's handed
+// out; users of arenas count it as free when they receive it.
+type arenas struct {
+	addressSpace toolbox.AddressSpace
+
+	// curBase and curEnd are the bounds of the part of the
+	// current arena not yet handed out.
+	curBase, curEnd toolbox.Address
+}
+
+// grow hands out at least ask bytes of new memory, reserving a new
+// arena if necessary, by calling f with each new region. It returns
+// the total number of bytes handed out.
+func (a *arenas) grow(ctx toolbox.Context, ask toolbox.Bytes, f func(base toolbox.Address, size toolbox.Bytes)) toolbox.Bytes {
+	total := toolbox.Bytes(0)
+	nBase := a.curBase.Add(ask)
+	if nBase > a.curEnd || nBase < a.curBase {
+		av, asize := a.addressSpace.MapAligned(ctx, ask.AlignUp(heapArenaSize), heapArenaSize)
+		if asize == 0 {
+			panic(toolbox.ErrOutOfAddressSpace)
+		}
+		// The arena is only reserved; it's counted once it's used.
+		ctx.FreeBytes -= uint64(asize)
+		ctx.RSSBytes -= uint64(asize)
+		if av == a.curEnd {
+			a.curEnd = av.Add(asize)
+		} else {
+			// Hand out what's left of the current arena
+			// and switch to the new one.
+			if size := a.curEnd.Diff(a.curBase); size != 0 {
+				f(a.curBase, size)
+				total += size
+			}
+			a.curBase, a.curEnd = av, av.Add(asize)
+		}
+		nBase = a.curBase.Add(ask)
+	}
+	v := a.curBase
+	a.curBase = nBase
+	f(v, ask)
+	return total + ask
+}
+
+// handedOut reports whether all of the arena at base, which must be
+// aligned to heapArenaSize, has been handed out.
+func (a *arenas) handedOut(base toolbox.Address) bool {
+	return a.curBase == a.curEnd || base.Add(heapArenaSize) <= a.curBase || base >= a.curEnd
+}
+
+// arenasState is the saved state of an arenas.
+type arenasState struct {
+	CurBase, CurEnd toolbox.Address
+}
+
+func (a *arenas) save() arenasState {
+	return arenasState{a.curBase, a.curEnd}
+}
+
+func (a *arenas) restore(st arenasState) {
+	a.curBase, a.curEnd = st.CurBase, st.CurEnd
+}
@@ -0,0 +1,101 @@
+package page
+
+import (
+	"testing"
+
+	"github.com/mknyszek/goat/simulation"
+	"github.com/mknyszek/goat/simulation/toolbox"
+)
+
+// allocOutOfAddressSpace allocates n pages from pa, and reports
+// whether it ran out of address space.
+func allocOutOfAddressSpace(ctx toolbox.Context, pa toolbox.PageAllocator, n toolbox.Pages) (addr toolbox.Address, oom bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			if r != toolbox.ErrOutOfAddressSpace {
+				panic(r)
+			}
+			oom = true
+		}
+	}()
+	return pa.AllocPages(ctx, n), false
+}
+
+func TestUnmapArenas(t *testing.T) {
+	// Each allocator gets an address space that fits exactly two of
+	// its arenas.
+	tests := []struct {
+		name  string
+		arena toolbox.Bytes
+		new   func(as toolbox.AddressSpace, unmap bool) toolbox.PageAllocator
+	}{
+		{
+			name:  "Go114",
+			arena: go114ChunkBytes,
+			new: func(as toolbox.AddressSpace, unmap bool) toolbox.PageAllocator {
+				return NewGo114(as, Go114ArenaSize(go114ChunkBytes), Go114Scavenge(false), Go114UnmapArenas(unmap))
+			},
+		},
+		{
+			name:  "Radix",
+			arena: heapArenaSize,
+			new: func(as toolbox.AddressSpace, unmap bool) toolbox.PageAllocator {
+				return NewRadix(as, RadixScavenge(false), RadixUnmapArenas(unmap))
+			},
+		},
+	}
+	for _, test := range tests {
+		for _, unmap := range []bool{false, true} {
+			name := test.name
+			if unmap {
+				name += "Unmap"
+			}
+			t.Run(name, func(t *testing.T) {
+				lo := toolbox.Address(test.arena)
+				as := toolbox.NewVirtualAddressSpace(48, 4096, toolbox.VASRange(lo, lo.Add(2*test.arena)), toolbox.VASHint(lo))
+				pa := test.new(as, unmap)
+				stats := simulation.NewStats()
+				pa.RegisterStats(stats)
+				ctx := toolbox.Context{P: toolbox.NoP, Stats: stats}
+
+				arenaPages := test.arena.Pages(pa.BytesPerPage())
+				a, oom := allocOutOfAddressSpace(ctx, pa, arenaPages)
+				if oom {
+					t.Fatalf("ran out of address space on the first arena")
+				}
+				if _, oom := allocOutOfAddressSpace(ctx, pa, arenaPages); oom {
+					t.Fatalf("ran out of address space on the second arena")
+				}
+				if _, oom := allocOutOfAddressSpace(ctx, pa, 1); !oom {
+					t.Fatalf("expected to run out of address space")
+				}
+
+				pa.FreePages(ctx, a, arenaPages)
+				mapped := stats.LookupOther(vasMappedStatName).Value()
+				if !unmap {
+					if mapped != uint64(2*test.arena) {
+						t.Errorf("expected %d bytes mapped, got %d", 2*test.arena, mapped)
+					}
+					if _, oom := allocOutOfAddressSpace(ctx, pa, arenaPages+1); !oom {
+						t.Errorf("expected to run out of address space")
+					}
+					return
+				}
+				if mapped != uint64(test.arena) {
+					t.Errorf("expected %d bytes mapped, got %d", test.arena, mapped)
+				}
+				if stats.FreeBytes != uint64(test.arena) || stats.RSSBytes != uint64(test.arena) || stats.ReleasedBytes != 0 {
+					t.Errorf("expected free/rss/released %d/%d/0, got %d/%d/%d",
+						test.arena, test.arena, stats.FreeBytes, stats.RSSBytes, stats.ReleasedBytes)
+				}
+				if got, oom := allocOutOfAddressSpace(ctx, pa, arenaPages); oom || got != a {
+					t.Errorf("expected the unmapped arena at %#x to be reused, got %#x (out of address space: %v)", a, got, oom)
+				}
+			})
+		}
+	}
+}
+
+// vasMappedStatName is the name of toolbox.VirtualAddressSpace's
+// mapped bytes statistic.
+const vasMappedStatName = "VASMappedBytes"
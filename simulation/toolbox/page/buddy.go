@@ -0,0 +1,236 @@
+package page
+
+import (
+	"encoding/gob"
+	"math/bits"
+
+	"github.com/mknyszek/goat/simulation"
+	"github.com/mknyszek/goat/simulation/toolbox"
+)
+
+const (
+	buddyPageSize = 8192
+
+	// buddyArenaOrder is the order of the blocks the buddy allocator
+	// maps when it needs to grow, such that blocks are heap arenas.
+	buddyArenaOrder = 13
+
+	// buddyMaxOrder is the largest block order the buddy allocator
+	// supports.
+	buddyMaxOrder = 40
+)
+
+var buddyInternalStat = simulation.StatDesc{
+	Name:        "BuddyInternalUnusedBytes",
+	Unit:        simulation.UnitBytes,
+	Description: "memory lost to rounding allocations up to a power-of-two number of pages",
+}
+
+// Buddy is a binary buddy page allocator.
+//
+// Allocations are rounded up to a power-of-two number of pages, and
+// are placed in the lowest-addressed free block of that size, which
+// is created by splitting larger blocks if necessary. Free blocks are
+// coalesced with their buddy whenever it's also free.
+//
+// The pages lost to rounding are reported as unused memory. Scavenging
+// is not modeled, so all mapped memory is considered resident.
+type Buddy struct {
+	addressSpace toolbox.AddressSpace
+
+	// free contains the free blocks of each order, ordered by
+	// address, and freeAt indexes them by their base address.
+	free   [buddyMaxOrder + 1]treap
+	freeAt [buddyMaxOrder + 1]map[toolbox.Address]*treapNode
+
+	// orders is the order of each allocated block.
+	orders map[toolbox.Address]uint8
+
+	freePages toolbox.Pages
+	stats     fragmentationStats
+	internal  *simulation.Stat
+}
+
+func NewBuddy(a toolbox.AddressSpace) *Buddy {
+	b := &Buddy{
+		addressSpace: a,
+		orders:       make(map[toolbox.Address]uint8),
+		stats:        newFragmentationStats("Buddy", "FreeBlocks"),
+	}
+	for i := range b.freeAt {
+		b.freeAt[i] = make(map[toolbox.Address]*treapNode)
+	}
+	return b
+}
+
+func init() {
+	toolbox.RegisterPageAllocator("buddy", func(a toolbox.AddressSpace, p toolbox.Params) (toolbox.PageAllocator, error) {
+		if err := p.Check(); err != nil {
+			return nil, err
+		}
+		return NewBuddy(a), nil
+	})
+}
+
+func (b *Buddy) RegisterStats(s *simulation.Stats) {
+	b.addressSpace.RegisterStats(s)
+	b.stats.register(s)
+	b.internal = s.RegisterOther(buddyInternalStat)
+}
+
+func (b *Buddy) BytesPerPage() toolbox.Bytes {
+	return buddyPageSize
+}
+
+func buddyBlockBytes(order uint8) toolbox.Bytes {
+	return toolbox.Pages(1 << order).Bytes(buddyPageSize)
+}
+
+// insertFree adds a free block to the free lists, coalescing it with
+// its buddy as far as possible.
+func (b *Buddy) insertFree(addr toolbox.Address, order uint8) {
+	b.freePages += toolbox.Pages(1) << order
+	for order < buddyMaxOrder {
+		buddy := addr ^ toolbox.Address(buddyBlockBytes(order))
+		n, ok := b.freeAt[order][buddy]
+		if !ok {
+			break
+		}
+		b.free[order].remove(n)
+		delete(b.freeAt[order], buddy)
+		if buddy < addr {
+			addr = buddy
+		}
+		order++
+	}
+	n := &treapNode{base: addr, npages: toolbox.Pages(1) << order}
+	b.free[order].insert(n)
+	b.freeAt[order][addr] = n
+}
+
+// takeFree removes the lowest-addressed free block of the given
+// order from the free lists and returns its address, or zero if
+// there is none.
+func (b *Buddy) takeFree(order uint8) toolbox.Address {
+	n := b.free[order].first()
+	if n == nil {
+		return 0
+	}
+	b.free[order].remove(n)
+	delete(b.freeAt[order], n.base)
+	b.freePages -= n.npages
+	return n.base
+}
+
+func (b *Buddy) AllocPages(ctx toolbox.Context, n toolbox.Pages) toolbox.Address {
+	order := uint8(0)
+	if n > 1 {
+		order = uint8(bits.Len64(uint64(n - 1)))
+	}
+	if order > buddyMaxOrder {
+		panic("allocation too large")
+	}
+
+	// Find the smallest free block that fits, growing if there is none.
+	j := order
+	for j <= buddyMaxOrder && b.free[j].root == nil {
+		j++
+	}
+	if j > buddyMaxOrder {
+		j = order
+		if j < buddyArenaOrder {
+			j = buddyArenaOrder
+		}
+		size := buddyBlockBytes(j)
+		base, mapped := b.addressSpace.MapAligned(ctx, size, size)
+		if mapped == 0 {
+			panic(toolbox.ErrOutOfAddressSpace)
+		}
+		// Insert the new block without coalescing so that it's
+		// available at order j.
+		node := &treapNode{base: base, npages: toolbox.Pages(1) << j}
+		b.free[j].insert(node)
+		b.freeAt[j][base] = node
+		b.freePages += node.npages
+	}
+	addr := b.takeFree(j)
+
+	// Split the block down to the size we need.
+	for j > order {
+		j--
+		b.insertFree(addr.Add(buddyBlockBytes(j)), j)
+	}
+	b.orders[addr] = order
+
+	waste := buddyBlockBytes(order) - n.Bytes(buddyPageSize)
+	ctx.FreeBytes -= uint64(waste)
+	ctx.UnusedBytes += uint64(waste)
+	b.internal.Add(uint64(waste))
+	b.updateStats(ctx)
+	return addr
+}
+
+func (b *Buddy) FreePages(ctx toolbox.Context, addr toolbox.Address, n toolbox.Pages) {
+	order, ok := b.orders[addr]
+	if !ok {
+		panic("attempted to free unallocated block")
+	}
+	delete(b.orders, addr)
+
+	waste := buddyBlockBytes(order) - n.Bytes(buddyPageSize)
+	ctx.FreeBytes += uint64(waste)
+	ctx.UnusedBytes -= uint64(waste)
+	b.internal.Sub(uint64(waste))
+
+	b.insertFree(addr, order)
+	b.updateStats(ctx)
+}
+
+func (b *Buddy) updateStats(ctx toolbox.Context) {
+	blocks := 0
+	largest := toolbox.Bytes(0)
+	for order := range b.free {
+		blocks += b.free[order].count
+		if b.free[order].root != nil {
+			largest = buddyBlockBytes(uint8(order))
+		}
+	}
+	b.stats.update(blocks, largest, b.freePages.Bytes(buddyPageSize))
+}
+
+// buddyState is the saved state of a Buddy.
+type buddyState struct {
+	Free      [buddyMaxOrder + 1]treapState
+	Orders    map[toolbox.Address]uint8
+	FreePages toolbox.Pages
+}
+
+// SaveState implements simulation.Checkpointer.
+func (b *Buddy) SaveState(enc *gob.Encoder) error {
+	st := buddyState{Orders: b.orders, FreePages: b.freePages}
+	for i := range b.free {
+		st.Free[i] = b.free[i].save()
+	}
+	return enc.Encode(&st)
+}
+
+// LoadState implements simulation.Checkpointer.
+func (b *Buddy) LoadState(dec *gob.Decoder) error {
+	var st buddyState
+	if err := dec.Decode(&st); err != nil {
+		return err
+	}
+	for i := range b.free {
+		freeAt := make(map[toolbox.Address]*treapNode)
+		b.free[i].restore(st.Free[i], func(n *treapNode) {
+			freeAt[n.base] = n
+		})
+		b.freeAt[i] = freeAt
+	}
+	b.orders = st.Orders
+	if b.orders == nil {
+		b.orders = make(map[toolbox.Address]uint8)
+	}
+	b.freePages = st.FreePages
+	return nil
+}
@@ -0,0 +1,67 @@
+package page
+
+import (
+	"testing"
+
+	"github.com/mknyszek/goat/simulation"
+	"github.com/mknyszek/goat/simulation/toolbox"
+)
+
+// checkBuddyFree checks that the buddy allocator's free blocks of
+// each order match counts.
+func checkBuddyFree(t *testing.T, b *Buddy, counts map[int]int) {
+	t.Helper()
+	for order := range b.free {
+		if got := b.free[order].count; got != counts[order] || len(b.freeAt[order]) != got {
+			t.Errorf("order %d: expected %d free blocks, got %d (%d indexed)", order, counts[order], got, len(b.freeAt[order]))
+		}
+	}
+}
+
+func TestBuddySplitCoalesce(t *testing.T) {
+	b := NewBuddy(toolbox.NewAddressSpace48(buddyPageSize))
+	stats := simulation.NewStats()
+	b.RegisterStats(stats)
+	ctx := toolbox.Context{P: toolbox.NoP, Stats: stats}
+
+	// The first allocation maps an arena and splits it all the
+	// way down, leaving one free block of every smaller order.
+	a := b.AllocPages(ctx, 1)
+	all := make(map[int]int)
+	for order := 0; order < buddyArenaOrder; order++ {
+		all[order] = 1
+	}
+	checkBuddyFree(t, b, all)
+
+	// The next allocation takes a's buddy.
+	a2 := b.AllocPages(ctx, 1)
+	if a2 != a.Add(buddyPageSize) {
+		t.Errorf("expected buddy of %#x at %#x, got %#x", a, a.Add(buddyPageSize), a2)
+	}
+	delete(all, 0)
+	checkBuddyFree(t, b, all)
+
+	// Three pages are rounded up to four, and come from the lowest
+	// free block of order 2.
+	a3 := b.AllocPages(ctx, 3)
+	if a3 != a.Add(4*buddyPageSize) {
+		t.Errorf("expected order 2 block at %#x, got %#x", a.Add(4*buddyPageSize), a3)
+	}
+	if stats.UnusedBytes != buddyPageSize {
+		t.Errorf("expected %d bytes of internal waste, got %d", buddyPageSize, stats.UnusedBytes)
+	}
+	delete(all, 2)
+	checkBuddyFree(t, b, all)
+
+	// Freeing everything coalesces back into a single arena.
+	b.FreePages(ctx, a, 1)
+	b.FreePages(ctx, a3, 3)
+	b.FreePages(ctx, a2, 1)
+	checkBuddyFree(t, b, map[int]int{buddyArenaOrder: 1})
+	if stats.UnusedBytes != 0 {
+		t.Errorf("expected no internal waste, got %d bytes", stats.UnusedBytes)
+	}
+	if b.freePages != 1<<buddyArenaOrder {
+		t.Errorf("expected %d free pages, got %d", 1<<buddyArenaOrder, b.freePages)
+	}
+}
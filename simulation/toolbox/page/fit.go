@@ -0,0 +1,146 @@
+package page
+
+import (
+	"encoding/gob"
+
+	"github.com/mknyszek/goat/simulation"
+	"github.com/mknyszek/goat/simulation/toolbox"
+)
+
+const fitPageSize = 8192
+
+// fitMinGrowth is the minimum amount the heap grows by, like the
+// pre-Go 1.14 runtime's _HeapAllocChunk.
+const fitMinGrowth toolbox.Bytes = 1 << 20
+
+// fitAllocator is a page allocator which keeps free memory as a set
+// of coalesced free spans in a treap, and allocates from the start
+// of a span chosen either by best fit or first fit.
+type fitAllocator struct {
+	arenas  arenas
+	spans   freeSpans
+	stats   fragmentationStats
+	bestFit bool
+}
+
+func newFitAllocator(a toolbox.AddressSpace, bestFit bool, prefix string) fitAllocator {
+	return fitAllocator{
+		arenas:  arenas{addressSpace: a},
+		spans:   newFreeSpans(fitPageSize, bestFit),
+		stats:   newFragmentationStats(prefix, "FreeSpans"),
+		bestFit: bestFit,
+	}
+}
+
+func (f *fitAllocator) RegisterStats(s *simulation.Stats) {
+	f.arenas.addressSpace.RegisterStats(s)
+	f.stats.register(s)
+}
+
+func (f *fitAllocator) BytesPerPage() toolbox.Bytes {
+	return fitPageSize
+}
+
+func (f *fitAllocator) find(n toolbox.Pages) *treapNode {
+	if f.bestFit {
+		return f.spans.bestFit(n)
+	}
+	return f.spans.firstFit(n)
+}
+
+func (f *fitAllocator) AllocPages(ctx toolbox.Context, n toolbox.Pages) toolbox.Address {
+	s := f.find(n)
+	if s == nil {
+		ask := n.Bytes(fitPageSize)
+		if ask < fitMinGrowth {
+			ask = fitMinGrowth
+		}
+		f.arenas.grow(ctx, ask, func(base toolbox.Address, size toolbox.Bytes) {
+			f.spans.insert(base, size.Pages(fitPageSize))
+			ctx.FreeBytes += uint64(size)
+			ctx.RSSBytes += uint64(size)
+		})
+		s = f.find(n)
+		if s == nil {
+			panic("out of memory?")
+		}
+	}
+	addr := f.spans.take(s, n)
+	f.updateStats(ctx)
+	return addr
+}
+
+func (f *fitAllocator) FreePages(ctx toolbox.Context, addr toolbox.Address, n toolbox.Pages) {
+	if addr%fitPageSize != 0 {
+		panic("unaligned free address")
+	}
+	f.spans.insert(addr, n)
+	f.updateStats(ctx)
+}
+
+func (f *fitAllocator) updateStats(ctx toolbox.Context) {
+	f.stats.update(f.spans.count, f.spans.largest().Bytes(fitPageSize), f.spans.free.Bytes(fitPageSize))
+}
+
+// BestFit is a page allocator modeled on the Go runtime's before Go 1.13.
+// Free spans are kept in a treap ordered by size, and each allocation
+// takes the smallest span that fits, preferring lower addresses.
+//
+// Scavenging is not modeled, so all mapped memory is considered resident.
+type BestFit struct {
+	fitAllocator
+}
+
+func NewBestFit(a toolbox.AddressSpace) *BestFit {
+	return &BestFit{newFitAllocator(a, true, "BestFit")}
+}
+
+// FirstFit is a page allocator modeled on the Go runtime's in Go 1.13.
+// Free spans are kept in a treap ordered by address, and each allocation
+// takes the lowest-addressed span that fits.
+//
+// Scavenging is not modeled, so all mapped memory is considered resident.
+type FirstFit struct {
+	fitAllocator
+}
+
+func NewFirstFit(a toolbox.AddressSpace) *FirstFit {
+	return &FirstFit{newFitAllocator(a, false, "FirstFit")}
+}
+
+func init() {
+	toolbox.RegisterPageAllocator("bestfit", func(a toolbox.AddressSpace, p toolbox.Params) (toolbox.PageAllocator, error) {
+		if err := p.Check(); err != nil {
+			return nil, err
+		}
+		return NewBestFit(a), nil
+	})
+	toolbox.RegisterPageAllocator("firstfit", func(a toolbox.AddressSpace, p toolbox.Params) (toolbox.PageAllocator, error) {
+		if err := p.Check(); err != nil {
+			return nil, err
+		}
+		return NewFirstFit(a), nil
+	})
+}
+
+// fitState is the saved state of a fitAllocator.
+type fitState struct {
+	Arenas arenasState
+	Spans  freeSpansState
+}
+
+// SaveState implements simulation.Checkpointer.
+func (f *fitAllocator) SaveState(enc *gob.Encoder) error {
+	return enc.Encode(&fitState{f.arenas.save(), f.spans.save()})
+}
+
+// LoadState implements simulation.Checkpointer.
+func (f *fitAllocator) LoadState(dec *gob.Decoder) error {
+	var st fitState
+	if err := dec.Decode(&st); err != nil {
+		return err
+	}
+	f.arenas.restore(st.Arenas)
+	f.spans.restore(st.Spans)
+	return nil
+}
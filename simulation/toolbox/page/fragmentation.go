@@ -0,0 +1,48 @@
+package page
+
+import (
+	"github.com/mknyszek/goat/simulation"
+	"github.com/mknyszek/goat/simulation/toolbox"
+)
+
+// fragmentationStats are statistics describing the external
+// fragmentation of a page allocator.
+type fragmentationStats struct {
+	prefix, spansName    string
+	spans, largest, frag *simulation.Stat
+}
+
+func newFragmentationStats(prefix, spans string) fragmentationStats {
+	return fragmentationStats{prefix: prefix, spansName: spans}
+}
+
+func (f *fragmentationStats) register(s *simulation.Stats) {
+	f.spans = s.RegisterOther(simulation.StatDesc{
+		Name:        f.prefix + f.spansName,
+		Description: "number of free ranges of pages",
+	})
+	f.largest = s.RegisterOther(simulation.StatDesc{
+		Name:        f.prefix + "LargestFreeBytes",
+		Unit:        simulation.UnitBytes,
+		Description: "largest free range of pages",
+	})
+	f.frag = s.RegisterOther(simulation.StatDesc{
+		Name:        f.prefix + "ExternalFragmentationPermille",
+		Unit:        simulation.UnitPermille,
+		Description: "fraction of free memory outside the largest free range",
+	})
+}
+
+// update sets the statistics given the number of free ranges, the
+// size of the largest, and the total amount of free memory. External
+// fragmentation is one minus the ratio of the largest free range to
+// all free memory, in permille.
+func (f *fragmentationStats) update(spans int, largest, free toolbox.Bytes) {
+	frag := uint64(0)
+	if free != 0 {
+		frag = uint64(1000 - largest*1000/free)
+	}
+	f.spans.Set(uint64(spans))
+	f.largest.Set(uint64(largest))
+	f.frag.Set(frag)
+}
@@ -1,6 +1,10 @@
 package page
 
 import (
+	"encoding/gob"
+	"fmt"
+	"math/bits"
+
 	"github.com/mknyszek/goat/simulation"
 	"github.com/mknyszek/goat/simulation/toolbox"
 )
@@ -10,6 +14,7 @@ const go114PageSize = 8192
 type go114PageCache struct {
 	base  toolbox.Address
 	cache uint64
+	scav  uint64
 }
 
 var emptyGo114PageCache = go114PageCache{
@@ -20,9 +25,11 @@ func (c *go114PageCache) empty() bool {
 	return c.cache == ^uint64(0)
 }
 
-func (c *go114PageCache) alloc(npages toolbox.Pages) toolbox.Address {
+// alloc allocates npages contiguous pages from the cache, and returns
+// the base address along with the number of pages that were scavenged.
+func (c *go114PageCache) alloc(npages toolbox.Pages) (toolbox.Address, toolbox.Pages) {
 	if c.cache == ^uint64(0) {
-		return 0
+		return 0, 0
 	}
 	offset := toolbox.Pages(0)
 	freeSize := toolbox.Pages(0)
@@ -33,14 +40,17 @@ func (c *go114PageCache) alloc(npages toolbox.Pages) toolbox.Address {
 			}
 			freeSize++
 			if freeSize >= npages {
-				c.cache |= ((uint64(1) << freeSize) - 1) << offset
-				return c.base.Add(offset.Bytes(go114PageSize))
+				mask := ((uint64(1) << freeSize) - 1) << offset
+				scav := toolbox.Pages(bits.OnesCount64(c.scav & mask))
+				c.cache |= mask
+				c.scav &^= mask
+				return c.base.Add(offset.Bytes(go114PageSize)), scav
 			}
 		} else {
 			freeSize = 0
 		}
 	}
-	return 0
+	return 0, 0
 }
 
 const go114ChunkPages = 512
@@ -51,6 +61,10 @@ type go114PageBits struct {
 	next *go114PageBits
 	prev *go114PageBits
 	bits [go114ChunkPages / 64]uint64
+
+	// scav has a bit set for each free page that has been
+	// returned to the OS.
+	scav [go114ChunkPages / 64]uint64
 }
 
 func (g *go114PageBits) get(i toolbox.Pages) bool {
@@ -65,17 +79,31 @@ func (g *go114PageBits) clear(i toolbox.Pages) {
 	g.bits[i/64] &^= uint64(1) << (i % 64)
 }
 
-func (g *go114PageBits) allocCache(i toolbox.Pages) (toolbox.Pages, uint64) {
+// unscavenge marks page i as resident, and reports whether
+// it was scavenged.
+func (g *go114PageBits) unscavenge(i toolbox.Pages) bool {
+	mask := uint64(1) << (i % 64)
+	scav := g.scav[i/64]&mask != 0
+	g.scav[i/64] &^= mask
+	return scav
+}
+
+func (g *go114PageBits) allocCache(i toolbox.Pages) (toolbox.Pages, uint64, uint64) {
 	idx := i / 64
-	cache := g.bits[idx]
+	cache, scav := g.bits[idx], g.scav[idx]
 	g.bits[idx] = ^uint64(0)
-	return idx * 64, cache
+	g.scav[idx] = 0
+	return idx * 64, cache, scav
 }
 
 type go114Pages struct {
 	head, tail *go114PageBits
 	curr       *go114PageBits
 	currIdx    toolbox.Pages
+
+	// unscav is the number of free pages which are resident
+	// and not in any page cache, i.e. those that may be scavenged.
+	unscav toolbox.Pages
 }
 
 func (p *go114Pages) grow(base toolbox.Address, size toolbox.Bytes) {
@@ -88,6 +116,11 @@ func (p *go114Pages) grow(base toolbox.Address, size toolbox.Bytes) {
 			base: base.Add(i),
 			prev: tail,
 		}
+		// Freshly-mapped memory hasn't been faulted in yet,
+		// so treat it as scavenged.
+		for j := range n.scav {
+			n.scav[j] = ^uint64(0)
+		}
 		if head == nil {
 			head = n
 		}
@@ -110,7 +143,7 @@ func (p *go114Pages) grow(base toolbox.Address, size toolbox.Bytes) {
 		c := p.head
 		var p *go114PageBits
 		for c != nil {
-			if base > c.base {
+			if c.base > base {
 				break
 			}
 			p = c
@@ -173,25 +206,31 @@ func (p *go114Pages) find(n toolbox.Pages) (*go114PageBits, toolbox.Pages) {
 	return nil, 0
 }
 
-func (p *go114Pages) alloc(basePtr *go114PageBits, baseIdx toolbox.Pages, size toolbox.Pages) {
+// alloc marks size pages starting at baseIdx in basePtr as allocated,
+// and returns how many of them were scavenged.
+func (p *go114Pages) alloc(basePtr *go114PageBits, baseIdx toolbox.Pages, size toolbox.Pages) toolbox.Pages {
+	scav := toolbox.Pages(0)
 	for basePtr != nil {
 		for i := baseIdx; i < go114ChunkPages; i++ {
 			basePtr.set(i)
+			if basePtr.unscavenge(i) {
+				scav++
+			} else {
+				p.unscav--
+			}
 			size--
 			if size == 0 {
-				return
+				return scav
 			}
 		}
 		basePtr = basePtr.next
 		baseIdx = 0
 	}
-	if size > 0 {
-		panic("ran out of pages to alloc")
-	}
+	panic("ran out of pages to alloc")
 }
 
 func (p *go114Pages) free(basePtr *go114PageBits, baseIdx toolbox.Pages, size toolbox.Pages) {
-	if (basePtr == p.curr && baseIdx < p.currIdx) || basePtr.base < p.curr.base {
+	if p.curr == nil || (basePtr == p.curr && baseIdx < p.currIdx) || basePtr.base < p.curr.base {
 		p.curr = basePtr
 		p.currIdx = baseIdx
 	}
@@ -201,6 +240,7 @@ func (p *go114Pages) free(basePtr *go114PageBits, baseIdx toolbox.Pages, size to
 				panic("attempted to double free page")
 			}
 			basePtr.clear(i)
+			p.unscav++
 			size--
 			if size == 0 {
 				return
@@ -214,35 +254,230 @@ func (p *go114Pages) free(basePtr *go114PageBits, baseIdx toolbox.Pages, size to
 	}
 }
 
+// shrink removes the chunks covering [base, base+size) if all of their
+// pages are free, and reports whether it did, along with the number of
+// those pages that were scavenged. The chunks must exist.
+func (p *go114Pages) shrink(base toolbox.Address, size toolbox.Bytes) (toolbox.Pages, bool) {
+	first := p.tail
+	for first != nil && first.base > base {
+		first = first.prev
+	}
+	if first == nil || first.base != base {
+		panic("shrinking chunks that don't exist")
+	}
+	scav := toolbox.Pages(0)
+	last := first
+	for n := size / go114ChunkBytes; ; n-- {
+		for j := range last.bits {
+			if last.bits[j] != 0 {
+				return 0, false
+			}
+			scav += toolbox.Pages(bits.OnesCount64(last.scav[j]))
+		}
+		if n == 1 {
+			break
+		}
+		last = last.next
+	}
+	p.unscav -= size.Pages(go114PageSize) - scav
+
+	// Every page before the current chunk is allocated, so if it's
+	// one of the removed chunks, the next one is a fine replacement.
+	for c := first; ; c = c.next {
+		if c == p.curr {
+			p.curr, p.currIdx = last.next, 0
+		}
+		if c == last {
+			break
+		}
+	}
+	if first.prev != nil {
+		first.prev.next = last.next
+	} else {
+		p.head = last.next
+	}
+	if last.next != nil {
+		last.next.prev = first.prev
+	} else {
+		p.tail = first.prev
+	}
+	return scav, true
+}
+
 func (p *go114Pages) allocToCache() *go114PageCache {
 	curr, currIdx := p.findFirstFree()
 	if curr == nil {
 		return &emptyGo114PageCache
 	}
-	baseIdx, cache := curr.allocCache(currIdx)
+	baseIdx, cache, scav := curr.allocCache(currIdx)
+	p.unscav -= toolbox.Pages(bits.OnesCount64(^cache &^ scav))
 	return &go114PageCache{
 		base:  curr.base.Add(baseIdx.Bytes(go114PageSize)),
 		cache: cache,
+		scav:  scav,
 	}
 }
 
+// scavenge returns up to n free pages to the OS, preferring pages at
+// higher addresses, and returns the number of pages scavenged. If
+// release is not nil, it is called with the address of each page.
+func (p *go114Pages) scavenge(n toolbox.Pages, release func(toolbox.Address)) toolbox.Pages {
+	released := toolbox.Pages(0)
+	for c := p.tail; c != nil && released < n && p.unscav > 0; c = c.prev {
+		for j := len(c.bits) - 1; j >= 0 && released < n; j-- {
+			avail := ^(c.bits[j] | c.scav[j])
+			for avail != 0 && released < n {
+				i := 63 - bits.LeadingZeros64(avail)
+				bit := uint64(1) << i
+				c.scav[j] |= bit
+				if release != nil {
+					release(c.base.Add(toolbox.Pages(j*64 + i).Bytes(go114PageSize)))
+				}
+				avail &^= bit
+				released++
+				p.unscav--
+			}
+		}
+	}
+	return released
+}
+
 const go114ArenaSize toolbox.Bytes = toolbox.Bytes(1 << 26)
 
 type Go114 struct {
 	addressSpace toolbox.AddressSpace
+	tracker      toolbox.ResidencyTracker
+	unmapper     toolbox.Unmapper
+	arenaSize    toolbox.Bytes
+	unmapArenas  bool
 	pageCaches   map[toolbox.P]*go114PageCache
 	pages        go114Pages
+	scav         scavenger
 }
 
-func NewGo114(a toolbox.AddressSpace) *Go114 {
-	return &Go114{
+// Go114Option is a configuration option for a Go114 page allocator.
+type Go114Option func(g *Go114)
+
+// Go114ArenaSize returns a configuration option that sets the size
+// and alignment of the arenas the Go114 page allocator maps from its
+// address space when it needs to grow.
+//
+// The size must be a power-of-two multiple of the chunk size (4 MiB).
+func Go114ArenaSize(size toolbox.Bytes) Go114Option {
+	return func(g *Go114) {
+		g.arenaSize = size
+	}
+}
+
+// Go114UnmapArenas returns a configuration option that makes the page
+// allocator give whole arenas back to its address space once all of
+// their pages are free, if the address space supports Unmap. The Go
+// runtime never does this, but it lets freed address space be reused
+// for other mappings when address space is constrained.
+//
+// The default is off.
+func Go114UnmapArenas(enabled bool) Go114Option {
+	return func(g *Go114) {
+		g.unmapArenas = enabled
+	}
+}
+
+// Go114Scavenge returns a configuration option that turns the
+// scavenger on or off. When off, free memory is never returned to
+// the OS, though freshly-mapped memory still isn't resident until
+// it's allocated.
+//
+// The scavenger is on by default.
+func Go114Scavenge(enabled bool) Go114Option {
+	return func(g *Go114) {
+		g.scav.enabled = enabled
+	}
+}
+
+// Go114ScavengeRetain returns a configuration option that sets the
+// scavenger's retain target: the amount of resident memory below which
+// the scavenger leaves free memory alone. The target is the larger of
+// bytes and in-use memory (objects, stacks, and unused memory) plus
+// percent percent.
+//
+// The default is 0 bytes and 120 percent.
+func Go114ScavengeRetain(bytes toolbox.Bytes, percent uint64) Go114Option {
+	return func(g *Go114) {
+		g.scav.retain = bytes
+		g.scav.percent = percent
+	}
+}
+
+// Go114ScavengeRate returns a configuration option that sets the rate
+// of the background scavenger, which releases up to bytes of memory
+// every period CPU ticks while resident memory exceeds the retain target.
+// A rate of zero turns off background scavenging, leaving only
+// allocation-triggered scavenging.
+//
+// The default is 64 KiB every 1,000,000 ticks.
+func Go114ScavengeRate(bytes toolbox.Bytes, period uint64) Go114Option {
+	return func(g *Go114) {
+		g.scav.rate = bytes
+		g.scav.period = period
+	}
+}
+
+func NewGo114(a toolbox.AddressSpace, options ...Go114Option) *Go114 {
+	g := &Go114{
 		addressSpace: a,
+		arenaSize:    go114ArenaSize,
 		pageCaches:   make(map[toolbox.P]*go114PageCache),
+		scav:         newScavenger(),
 	}
+	for _, opt := range options {
+		opt(g)
+	}
+	g.tracker, _ = a.(toolbox.ResidencyTracker)
+	if g.unmapArenas {
+		g.unmapper, _ = a.(toolbox.Unmapper)
+	}
+	if g.arenaSize&(g.arenaSize-1) != 0 || g.arenaSize < go114ChunkBytes {
+		panic("arena size must be a power-of-two multiple of the chunk size")
+	}
+	if err := g.scav.checkConfig(); err != nil {
+		panic(err.Error())
+	}
+	return g
+}
+
+func init() {
+	toolbox.RegisterPageAllocator("go114", func(a toolbox.AddressSpace, p toolbox.Params) (toolbox.PageAllocator, error) {
+		if err := p.Check(append([]string{"arenaSize", "unmapArenas"}, scavengerParams...)...); err != nil {
+			return nil, err
+		}
+		arenaSize, err := p.Bytes("arenaSize", go114ArenaSize)
+		if err != nil {
+			return nil, err
+		}
+		if arenaSize&(arenaSize-1) != 0 || arenaSize < go114ChunkBytes {
+			return nil, fmt.Errorf("arenaSize must be a power-of-two multiple of %d", go114ChunkBytes)
+		}
+		var unmapArenas bool
+		if _, err := p.Decode("unmapArenas", &unmapArenas); err != nil {
+			return nil, err
+		}
+		scav := newScavenger()
+		if err := scav.decodeParams(p); err != nil {
+			return nil, err
+		}
+		return NewGo114(a,
+			Go114ArenaSize(arenaSize),
+			Go114UnmapArenas(unmapArenas),
+			Go114Scavenge(scav.enabled),
+			Go114ScavengeRetain(scav.retain, scav.percent),
+			Go114ScavengeRate(scav.rate, scav.period),
+		), nil
+	})
 }
 
 func (g *Go114) RegisterStats(s *simulation.Stats) {
 	g.addressSpace.RegisterStats(s)
+	g.scav.registerStats(s, "Go114")
 }
 
 func (g *Go114) BytesPerPage() toolbox.Bytes {
@@ -255,26 +490,87 @@ func (g *Go114) AllocPages(ctx toolbox.Context, n toolbox.Pages) toolbox.Address
 		if !ok || cache.empty() {
 			cache = g.pages.allocToCache()
 			g.pageCaches[ctx.P] = cache
+			if !cache.empty() {
+				ps := ctx.PStats()
+				ps.CachedBytes += uint64(toolbox.Pages(bits.OnesCount64(^cache.cache)).Bytes(go114PageSize))
+				ps.Refills++
+			}
 		}
-		if base := cache.alloc(n); base != 0 {
+		if base, scav := cache.alloc(n); base != 0 {
+			ctx.PStats().CachedBytes -= uint64(n.Bytes(go114PageSize))
+			g.faultIn(ctx, base, n, scav)
 			return base
 		}
 	}
 	basePtr, baseIdx := g.pages.find(n)
 	if basePtr == nil {
 		ask := n.Bytes(go114PageSize)
-		ask = ask.AlignUp(go114ArenaSize)
-		g.pages.grow(g.addressSpace.MapAligned(ctx, ask, go114ArenaSize))
+		ask = ask.AlignUp(g.arenaSize)
+		base, size := g.addressSpace.MapAligned(ctx, ask, g.arenaSize)
+		if size == 0 {
+			panic(toolbox.ErrOutOfAddressSpace)
+		}
+		g.pages.grow(base, size)
+
+		// The address space counts new mappings as resident, but
+		// nothing has touched this memory yet.
+		ctx.RSSBytes -= uint64(size)
+		ctx.ReleasedBytes += uint64(size)
+
 		basePtr, baseIdx = g.pages.find(n)
 		if basePtr == nil {
 			panic("out of memory?")
 		}
 	}
-	g.pages.alloc(basePtr, baseIdx, n)
+	scav := g.pages.alloc(basePtr, baseIdx, n)
 	addr := basePtr.base.Add(baseIdx.Bytes(go114PageSize))
+	g.faultIn(ctx, addr, n, scav)
 	return addr
 }
 
+// faultIn accounts for n scavenged pages becoming resident after
+// the npages pages at addr were allocated. If this pushes resident
+// memory over the retain target, then it scavenges up to the same
+// amount of memory elsewhere.
+func (g *Go114) faultIn(ctx toolbox.Context, addr toolbox.Address, npages, n toolbox.Pages) {
+	if n != 0 {
+		if g.tracker != nil {
+			g.tracker.Populate(ctx, addr, npages.Bytes(go114PageSize))
+		}
+		size := n.Bytes(go114PageSize)
+		ctx.ReleasedBytes -= uint64(size)
+		ctx.RSSBytes += uint64(size)
+		if over := g.scav.overage(ctx, 0, size); over != 0 {
+			released := g.release(ctx, over.Pages(go114PageSize))
+			g.scav.allocStat.Add(uint64(released))
+		}
+	}
+	g.scavengeBackground(ctx)
+}
+
+// scavengeBackground runs the background scavenger.
+func (g *Go114) scavengeBackground(ctx toolbox.Context) {
+	if budget := g.scav.background(ctx); budget != 0 {
+		released := g.release(ctx, budget.Pages(go114PageSize))
+		g.scav.bgStat.Add(uint64(released))
+	}
+}
+
+// release scavenges up to n pages, updates statistics, and returns
+// the number of bytes released.
+func (g *Go114) release(ctx toolbox.Context, n toolbox.Pages) toolbox.Bytes {
+	var release func(toolbox.Address)
+	if g.tracker != nil {
+		release = func(addr toolbox.Address) {
+			g.tracker.Release(ctx, addr, go114PageSize)
+		}
+	}
+	size := g.pages.scavenge(n, release).Bytes(go114PageSize)
+	ctx.RSSBytes -= uint64(size)
+	ctx.ReleasedBytes += uint64(size)
+	return size
+}
+
 func (g *Go114) FreePages(ctx toolbox.Context, addr toolbox.Address, size toolbox.Pages) {
 	if addr%go114PageSize != 0 {
 		panic("unaligned free address")
@@ -288,4 +584,132 @@ func (g *Go114) FreePages(ctx toolbox.Context, addr toolbox.Address, size toolbo
 	}
 	idx := addr.Diff(c.base).Pages(go114PageSize)
 	g.pages.free(c, idx, size)
+	if g.unmapper != nil {
+		g.unmap(ctx, addr, size.Bytes(go114PageSize))
+	}
+	g.scavengeBackground(ctx)
+}
+
+// unmap gives back each arena overlapping [addr, addr+size) whose
+// pages are all free.
+func (g *Go114) unmap(ctx toolbox.Context, addr toolbox.Address, size toolbox.Bytes) {
+	end := addr.Add(size)
+	for base := addr.AlignDown(g.arenaSize); base < end; base = base.Add(g.arenaSize) {
+		scav, ok := g.pages.shrink(base, g.arenaSize)
+		if !ok {
+			continue
+		}
+		g.unmapper.Unmap(ctx, base, g.arenaSize, scav.Bytes(go114PageSize))
+	}
+}
+
+// Inspect implements toolbox.Inspector.
+func (g *Go114) Inspect() []toolbox.SpanInfo {
+	cached := make(map[toolbox.Address]bool)
+	for _, c := range g.pageCaches {
+		if !c.empty() {
+			addCachedPages(cached, go114PageSize, c.base, ^c.cache, c.scav)
+		}
+	}
+	r := pageRuns{pageSize: go114PageSize}
+	for c := g.pages.head; c != nil; c = c.next {
+		for i := toolbox.Pages(0); i < go114ChunkPages; i++ {
+			addr := c.base.Add(i.Bytes(go114PageSize))
+			if scav, ok := cached[addr]; ok {
+				r.add(addr, toolbox.SpanCached, scav)
+			} else if c.get(i) {
+				r.add(addr, toolbox.SpanAllocated, false)
+			} else {
+				r.add(addr, toolbox.SpanFree, c.scav[i/64]&(uint64(1)<<(i%64)) != 0)
+			}
+		}
+	}
+	return r.runs
+}
+
+// go114State is the saved state of a Go114 page allocator.
+type go114State struct {
+	PageCaches map[toolbox.P]go114PageCacheState
+
+	// Chunks are the chunks in address order, and Curr is the
+	// index of the current chunk, or -1 if there is none.
+	Chunks   []go114ChunkState
+	Curr     int
+	CurrIdx  toolbox.Pages
+	Unscav   toolbox.Pages
+	ScavLast uint64
+}
+
+// go114PageCacheState is the saved state of a go114PageCache.
+type go114PageCacheState struct {
+	Base  toolbox.Address
+	Cache uint64
+	Scav  uint64
+}
+
+// go114ChunkState is the saved state of a go114PageBits.
+type go114ChunkState struct {
+	Base toolbox.Address
+	Bits [go114ChunkPages / 64]uint64
+	Scav [go114ChunkPages / 64]uint64
+}
+
+// SaveState implements simulation.Checkpointer.
+func (g *Go114) SaveState(enc *gob.Encoder) error {
+	st := go114State{
+		PageCaches: make(map[toolbox.P]go114PageCacheState),
+		Curr:       -1,
+		CurrIdx:    g.pages.currIdx,
+		Unscav:     g.pages.unscav,
+		ScavLast:   g.scav.last,
+	}
+	for p, c := range g.pageCaches {
+		st.PageCaches[p] = go114PageCacheState{c.base, c.cache, c.scav}
+	}
+	for c := g.pages.head; c != nil; c = c.next {
+		if c == g.pages.curr {
+			st.Curr = len(st.Chunks)
+		}
+		st.Chunks = append(st.Chunks, go114ChunkState{c.base, c.bits, c.scav})
+	}
+	return enc.Encode(&st)
+}
+
+// LoadState implements simulation.Checkpointer.
+func (g *Go114) LoadState(dec *gob.Decoder) error {
+	var st go114State
+	if err := dec.Decode(&st); err != nil {
+		return err
+	}
+	g.pageCaches = make(map[toolbox.P]*go114PageCache)
+	for p, c := range st.PageCaches {
+		if c.Cache == ^uint64(0) {
+			g.pageCaches[p] = &emptyGo114PageCache
+			continue
+		}
+		g.pageCaches[p] = &go114PageCache{c.Base, c.Cache, c.Scav}
+	}
+	g.pages = go114Pages{
+		currIdx: st.CurrIdx,
+		unscav:  st.Unscav,
+	}
+	for i, cs := range st.Chunks {
+		c := &go114PageBits{
+			base: cs.Base,
+			prev: g.pages.tail,
+			bits: cs.Bits,
+			scav: cs.Scav,
+		}
+		if g.pages.head == nil {
+			g.pages.head = c
+		} else {
+			g.pages.tail.next = c
+		}
+		g.pages.tail = c
+		if i == st.Curr {
+			g.pages.curr = c
+		}
+	}
+	g.scav.last = st.ScavLast
+	return nil
 }
@@ -0,0 +1,41 @@
+package page
+
+import (
+	"github.com/mknyszek/goat/simulation/toolbox"
+)
+
+// pageRuns builds the runs of pages reported by a page allocator's
+// Inspect method, merging adjacent pages in the same state.
+type pageRuns struct {
+	pageSize toolbox.Bytes
+	runs     []toolbox.SpanInfo
+}
+
+// add adds the page at addr, which must be at a higher address than
+// every page added before it.
+func (r *pageRuns) add(addr toolbox.Address, kind toolbox.SpanKind, released bool) {
+	if n := len(r.runs); n != 0 {
+		last := &r.runs[n-1]
+		if last.Base.Add(last.Size) == addr && last.Kind == kind && last.Released == released {
+			last.Size += r.pageSize
+			return
+		}
+	}
+	r.runs = append(r.runs, toolbox.SpanInfo{
+		Base:     addr,
+		Size:     r.pageSize,
+		Kind:     kind,
+		Released: released,
+	})
+}
+
+// addCachedPages adds the free pages of a page cache starting at base
+// to pages, keyed by address, with whether each one is scavenged. Bits
+// in free are set for the cache's free pages.
+func addCachedPages(pages map[toolbox.Address]bool, pageSize toolbox.Bytes, base toolbox.Address, free, scav uint64) {
+	for i := uint(0); i < 64; i++ {
+		if free&(uint64(1)<<i) != 0 {
+			pages[base.Add(toolbox.Pages(i).Bytes(pageSize))] = scav&(uint64(1)<<i) != 0
+		}
+	}
+}
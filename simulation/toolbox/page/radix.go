@@ -0,0 +1,963 @@
+package page
+
+import (
+	"encoding/gob"
+	"math/bits"
+	"sort"
+
+	"github.com/mknyszek/goat/simulation"
+	"github.com/mknyszek/goat/simulation/toolbox"
+)
+
+const (
+	radixPageSize      = 8192
+	radixChunkPages    = 512
+	radixLogChunkBytes = 22
+	radixChunkBytes    = radixChunkPages * radixPageSize
+
+	// radixCachePages is the number of pages in a per-P page cache.
+	radixCachePages = 64
+
+	// radixMaxSearchAddr is the searchAddr value indicating that
+	// there's no free memory left.
+	radixMaxSearchAddr toolbox.Address = 1<<radixHeapAddrBits - 1
+)
+
+// Parameters of the summary radix tree, for a 48-bit address space.
+const (
+	radixHeapAddrBits = 48
+	radixLevels       = 5
+	radixLevelBits    = 3
+	radixL0Bits       = radixHeapAddrBits - radixLogChunkBytes - (radixLevels-1)*radixLevelBits
+)
+
+var (
+	// radixLevelBitsOf is the number of bits of address each level
+	// of the radix tree resolves.
+	radixLevelBitsOf = [radixLevels]uint{radixL0Bits, radixLevelBits, radixLevelBits, radixLevelBits, radixLevelBits}
+
+	// radixLevelShift is the amount to shift an address by to get
+	// its index at each level of the radix tree.
+	radixLevelShift = [radixLevels]uint{34, 31, 28, 25, 22}
+
+	// radixLevelLogPages is the base-2 logarithm of the number of
+	// pages covered by a single summary at each level.
+	radixLevelLogPages = [radixLevels]uint{21, 18, 15, 12, 9}
+)
+
+// radixSum summarizes the free pages of a region of memory: the
+// number of free pages at its start, the largest run of free pages
+// anywhere in it, and the number of free pages at its end. The zero
+// value describes a region with no free pages.
+type radixSum struct {
+	start, max, end uint32
+}
+
+// radixMergeSummaries merges adjacent summaries, each of which covers
+// 1<<logMaxPagesPerSum pages, into a single summary.
+func radixMergeSummaries(sums []radixSum, logMaxPagesPerSum uint) radixSum {
+	start, max, end := uint(sums[0].start), uint(sums[0].max), uint(sums[0].end)
+	for i := 1; i < len(sums); i++ {
+		si, mi, ei := uint(sums[i].start), uint(sums[i].max), uint(sums[i].end)
+		if start == uint(i)<<logMaxPagesPerSum {
+			start += si
+		}
+		if end+si > max {
+			max = end + si
+		}
+		if mi > max {
+			max = mi
+		}
+		if ei == 1<<logMaxPagesPerSum {
+			end += 1 << logMaxPagesPerSum
+		} else {
+			end = ei
+		}
+	}
+	return radixSum{uint32(start), uint32(max), uint32(end)}
+}
+
+// radixBlockEntries is the number of summaries in a block of sparse
+// summary storage.
+const radixBlockEntries = 512
+
+// radixLevel is the summary storage for a single level of the radix
+// tree. The root level is stored densely, while other levels are
+// sparse, since most of the address space is never used.
+type radixLevel struct {
+	dense  []radixSum
+	blocks map[uint64]*[radixBlockEntries]radixSum
+}
+
+func (l *radixLevel) get(i uint64) radixSum {
+	if l.dense != nil {
+		return l.dense[i]
+	}
+	if b := l.blocks[i/radixBlockEntries]; b != nil {
+		return b[i%radixBlockEntries]
+	}
+	return radixSum{}
+}
+
+func (l *radixLevel) set(i uint64, sum radixSum) {
+	if l.dense != nil {
+		l.dense[i] = sum
+		return
+	}
+	b := l.blocks[i/radixBlockEntries]
+	if b == nil {
+		b = new([radixBlockEntries]radixSum)
+		l.blocks[i/radixBlockEntries] = b
+	}
+	b[i%radixBlockEntries] = sum
+}
+
+// radixBits is a bitmap of the pages in a chunk.
+type radixBits [radixChunkPages / 64]uint64
+
+// radixChunk is the state of a single chunk of pages. Bits in alloc
+// are set for allocated pages, and bits in scav are set for free
+// pages that have been returned to the OS.
+type radixChunk struct {
+	alloc radixBits
+	scav  radixBits
+}
+
+// summarize computes the summary of the free pages in b.
+func (b *radixBits) summarize() radixSum {
+	var start, max, cur uint
+	startSet := false
+	for _, x := range b {
+		if x == 0 {
+			cur += 64
+			continue
+		}
+		for i := uint(0); i < 64; {
+			// Count the free pages starting at i, if any.
+			free := uint(bits.TrailingZeros64(x >> i))
+			if i+free > 64 {
+				free = 64 - i
+			}
+			cur += free
+			i += free
+			if i == 64 {
+				break
+			}
+			if !startSet {
+				start, startSet = cur, true
+			}
+			if cur > max {
+				max = cur
+			}
+			cur = 0
+			// Skip the allocated pages.
+			i += uint(bits.TrailingZeros64(^(x >> i)))
+		}
+	}
+	if !startSet {
+		return radixSum{radixChunkPages, radixChunkPages, radixChunkPages}
+	}
+	if cur > max {
+		max = cur
+	}
+	return radixSum{uint32(start), uint32(max), uint32(cur)}
+}
+
+// findBitRange64 returns the bit index of the first set of n
+// consecutive 1 bits in c, or 64 if there is none.
+func findBitRange64(c uint64, n uint) uint {
+	p := n - 1
+	k := uint(1)
+	for p > 0 {
+		if p <= k {
+			c &= c >> (p & 63)
+			break
+		}
+		c &= c >> (k & 63)
+		if c == 0 {
+			return 64
+		}
+		p -= k
+		k *= 2
+	}
+	return uint(bits.TrailingZeros64(c))
+}
+
+// find searches for npages contiguous free pages in b, starting from
+// searchIdx. It returns the index of the first page of the range,
+// or ^uint(0) if there is none, and the index of the first free page
+// at or after searchIdx, which is a new search index.
+func (b *radixBits) find(npages uint, searchIdx uint) (uint, uint) {
+	if npages == 1 {
+		addr := b.find1(searchIdx)
+		return addr, addr
+	} else if npages <= 64 {
+		return b.findSmallN(npages, searchIdx)
+	}
+	return b.findLargeN(npages, searchIdx)
+}
+
+func (b *radixBits) find1(searchIdx uint) uint {
+	for i := searchIdx / 64; i < uint(len(b)); i++ {
+		x := b[i]
+		if x == ^uint64(0) {
+			continue
+		}
+		return i*64 + uint(bits.TrailingZeros64(^x))
+	}
+	return ^uint(0)
+}
+
+func (b *radixBits) findSmallN(npages uint, searchIdx uint) (uint, uint) {
+	end, newSearchIdx := uint(0), ^uint(0)
+	for i := searchIdx / 64; i < uint(len(b)); i++ {
+		bi := b[i]
+		if bi == ^uint64(0) {
+			end = 0
+			continue
+		}
+		start := uint(bits.TrailingZeros64(bi))
+		if newSearchIdx == ^uint(0) {
+			newSearchIdx = i*64 + uint(bits.TrailingZeros64(^bi))
+		}
+		if end+start >= npages {
+			return i*64 - end, newSearchIdx
+		}
+		j := findBitRange64(^bi, npages)
+		if j < 64 {
+			return i*64 + j, newSearchIdx
+		}
+		end = uint(bits.LeadingZeros64(bi))
+	}
+	return ^uint(0), newSearchIdx
+}
+
+func (b *radixBits) findLargeN(npages uint, searchIdx uint) (uint, uint) {
+	start, size, newSearchIdx := ^uint(0), uint(0), ^uint(0)
+	for i := searchIdx / 64; i < uint(len(b)); i++ {
+		x := b[i]
+		if x == ^uint64(0) {
+			size = 0
+			continue
+		}
+		if newSearchIdx == ^uint(0) {
+			newSearchIdx = i*64 + uint(bits.TrailingZeros64(^x))
+		}
+		if size == 0 {
+			size = uint(bits.LeadingZeros64(x))
+			start = i*64 + 64 - size
+			continue
+		}
+		s := uint(bits.TrailingZeros64(x))
+		if s+size >= npages {
+			return start, newSearchIdx
+		}
+		if s < 64 {
+			size = uint(bits.LeadingZeros64(x))
+			start = i*64 + 64 - size
+			continue
+		}
+		size += 64
+	}
+	if size < npages {
+		return ^uint(0), newSearchIdx
+	}
+	return start, newSearchIdx
+}
+
+// radixCache is a per-P cache of up to 64 contiguous pages. Bits
+// in cache are set for free pages, and bits in scav are set for
+// free pages which are scavenged.
+type radixCache struct {
+	base  toolbox.Address
+	cache uint64
+	scav  uint64
+}
+
+func (c *radixCache) empty() bool {
+	return c.cache == 0
+}
+
+// alloc allocates npages from the cache and returns the base address
+// and the number of scavenged pages allocated, or zero if the cache
+// can't satisfy the allocation.
+func (c *radixCache) alloc(npages toolbox.Pages) (toolbox.Address, toolbox.Pages) {
+	if c.cache == 0 {
+		return 0, 0
+	}
+	if npages == 1 {
+		i := uint(bits.TrailingZeros64(c.cache))
+		scav := (c.scav >> i) & 1
+		c.cache &^= 1 << i
+		c.scav &^= 1 << i
+		return c.base.Add(toolbox.Pages(i).Bytes(radixPageSize)), toolbox.Pages(scav)
+	}
+	i := findBitRange64(c.cache, uint(npages))
+	if i >= 64 {
+		return 0, 0
+	}
+	mask := ((uint64(1) << npages) - 1) << i
+	scav := bits.OnesCount64(c.scav & mask)
+	c.cache &^= mask
+	c.scav &^= mask
+	return c.base.Add(toolbox.Pages(i).Bytes(radixPageSize)), toolbox.Pages(scav)
+}
+
+func radixChunkIndex(addr toolbox.Address) uint64 {
+	return uint64(addr) >> radixLogChunkBytes
+}
+
+func radixChunkBase(ci uint64) toolbox.Address {
+	return toolbox.Address(ci << radixLogChunkBytes)
+}
+
+func radixChunkPageIndex(addr toolbox.Address) uint {
+	return uint(uint64(addr)%radixChunkBytes) / radixPageSize
+}
+
+// Radix is a faithful model of the Go runtime's page allocator since
+// Go 1.14.
+//
+// Free pages are tracked with a bitmap per 4 MiB chunk, and a radix
+// tree of summaries over the chunks is used to find free pages
+// quickly. Allocations are placed at the lowest address that fits,
+// using a search address hint below which all pages are known to be
+// allocated, and small allocations go through per-P page caches of up
+// to 64 pages.
+//
+// The heap grows by reserving 64 MiB arenas from the address space,
+// but only makes as much of the current arena available to the page
+// allocator as it needs.
+//
+// Unlike Go114, allocation-triggered scavenging happens when the heap
+// grows, as it does in the runtime.
+type Radix struct {
+	addressSpace toolbox.AddressSpace
+	tracker      toolbox.ResidencyTracker
+	unmapper     toolbox.Unmapper
+	arenas       arenas
+	unmapArenas  bool
+
+	caches map[toolbox.P]*radixCache
+
+	chunks     map[uint64]*radixChunk
+	chunkList  []uint64
+	summary    [radixLevels]radixLevel
+	searchAddr toolbox.Address
+	start, end uint64
+
+	// unscav is the number of free pages which are resident
+	// and not in any page cache, i.e. those that may be scavenged.
+	unscav toolbox.Pages
+	scav   scavenger
+}
+
+// RadixOption is a configuration option for a Radix page allocator.
+type RadixOption func(r *Radix)
+
+// RadixUnmapArenas returns a configuration option that makes the page
+// allocator give whole arenas back to its address space once all of
+// their pages are free. See Go114UnmapArenas.
+func RadixUnmapArenas(enabled bool) RadixOption {
+	return func(r *Radix) {
+		r.unmapArenas = enabled
+	}
+}
+
+// RadixScavenge returns a configuration option that turns the
+// scavenger on or off. See Go114Scavenge.
+func RadixScavenge(enabled bool) RadixOption {
+	return func(r *Radix) {
+		r.scav.enabled = enabled
+	}
+}
+
+// RadixScavengeRetain returns a configuration option that sets the
+// scavenger's retain target. See Go114ScavengeRetain.
+func RadixScavengeRetain(bytes toolbox.Bytes, percent uint64) RadixOption {
+	return func(r *Radix) {
+		r.scav.retain = bytes
+		r.scav.percent = percent
+	}
+}
+
+// RadixScavengeRate returns a configuration option that sets the
+// rate of the background scavenger. See Go114ScavengeRate.
+func RadixScavengeRate(bytes toolbox.Bytes, period uint64) RadixOption {
+	return func(r *Radix) {
+		r.scav.rate = bytes
+		r.scav.period = period
+	}
+}
+
+func NewRadix(a toolbox.AddressSpace, options ...RadixOption) *Radix {
+	r := &Radix{
+		addressSpace: a,
+		arenas:       arenas{addressSpace: a},
+		caches:       make(map[toolbox.P]*radixCache),
+		chunks:       make(map[uint64]*radixChunk),
+		searchAddr:   radixMaxSearchAddr,
+		scav:         newScavenger(),
+	}
+	r.summary[0].dense = make([]radixSum, 1<<radixL0Bits)
+	for l := 1; l < radixLevels; l++ {
+		r.summary[l].blocks = make(map[uint64]*[radixBlockEntries]radixSum)
+	}
+	for _, opt := range options {
+		opt(r)
+	}
+	r.tracker, _ = a.(toolbox.ResidencyTracker)
+	if r.unmapArenas {
+		r.unmapper, _ = a.(toolbox.Unmapper)
+	}
+	if err := r.scav.checkConfig(); err != nil {
+		panic(err.Error())
+	}
+	return r
+}
+
+func init() {
+	toolbox.RegisterPageAllocator("radix", func(a toolbox.AddressSpace, p toolbox.Params) (toolbox.PageAllocator, error) {
+		if err := p.Check(append([]string{"unmapArenas"}, scavengerParams...)...); err != nil {
+			return nil, err
+		}
+		var unmapArenas bool
+		if _, err := p.Decode("unmapArenas", &unmapArenas); err != nil {
+			return nil, err
+		}
+		scav := newScavenger()
+		if err := scav.decodeParams(p); err != nil {
+			return nil, err
+		}
+		return NewRadix(a,
+			RadixUnmapArenas(unmapArenas),
+			RadixScavenge(scav.enabled),
+			RadixScavengeRetain(scav.retain, scav.percent),
+			RadixScavengeRate(scav.rate, scav.period),
+		), nil
+	})
+}
+
+func (r *Radix) RegisterStats(s *simulation.Stats) {
+	r.addressSpace.RegisterStats(s)
+	r.scav.registerStats(s, "Radix")
+}
+
+func (r *Radix) BytesPerPage() toolbox.Bytes {
+	return radixPageSize
+}
+
+func (r *Radix) AllocPages(ctx toolbox.Context, n toolbox.Pages) toolbox.Address {
+	if ctx.P != toolbox.NoP && n < radixCachePages/4 {
+		c, ok := r.caches[ctx.P]
+		if !ok {
+			c = new(radixCache)
+			r.caches[ctx.P] = c
+		}
+		if c.empty() {
+			*c = r.allocToCache()
+			if !c.empty() {
+				ps := ctx.PStats()
+				ps.CachedBytes += uint64(toolbox.Pages(bits.OnesCount64(c.cache)).Bytes(radixPageSize))
+				ps.Refills++
+			}
+		}
+		if base, scav := c.alloc(n); base != 0 {
+			ctx.PStats().CachedBytes -= uint64(n.Bytes(radixPageSize))
+			r.faultIn(ctx, base, n, scav)
+			return base
+		}
+	}
+	addr, scav := r.alloc(n)
+	if addr == 0 {
+		r.grow(ctx, n)
+		addr, scav = r.alloc(n)
+		if addr == 0 {
+			panic("out of memory?")
+		}
+	}
+	r.faultIn(ctx, addr, n, scav)
+	return addr
+}
+
+func (r *Radix) FreePages(ctx toolbox.Context, addr toolbox.Address, n toolbox.Pages) {
+	if addr%radixPageSize != 0 {
+		panic("unaligned free address")
+	}
+	if addr < r.searchAddr {
+		r.searchAddr = addr
+	}
+	limit := addr.Add(n.Bytes(radixPageSize) - 1)
+	sc, ec := radixChunkIndex(addr), radixChunkIndex(limit)
+	for ci := sc; ci <= ec; ci++ {
+		si, ei := uint(0), uint(radixChunkPages-1)
+		if ci == sc {
+			si = radixChunkPageIndex(addr)
+		}
+		if ci == ec {
+			ei = radixChunkPageIndex(limit)
+		}
+		chunk := r.chunks[ci]
+		for i := si; i <= ei; i++ {
+			mask := uint64(1) << (i % 64)
+			if chunk.alloc[i/64]&mask == 0 {
+				panic("attempted to double free page")
+			}
+			chunk.alloc[i/64] &^= mask
+		}
+	}
+	r.unscav += n
+	r.update(addr, n)
+	if r.unmapper != nil {
+		r.unmap(ctx, addr, n.Bytes(radixPageSize))
+	}
+	r.scavengeBackground(ctx)
+}
+
+// unmap gives back each arena overlapping [addr, addr+size) which has
+// been completely handed out to the page allocator, and whose pages
+// are all free.
+func (r *Radix) unmap(ctx toolbox.Context, addr toolbox.Address, size toolbox.Bytes) {
+	const arenaChunks = uint64(heapArenaSize / radixChunkBytes)
+	end := addr.Add(size)
+	for base := addr.AlignDown(heapArenaSize); base < end; base = base.Add(heapArenaSize) {
+		if !r.arenas.handedOut(base) {
+			continue
+		}
+		sc := radixChunkIndex(base)
+		free := true
+		for ci := sc; ci < sc+arenaChunks && free; ci++ {
+			free = r.chunks[ci] != nil && r.summary[radixLevels-1].get(ci).max == radixChunkPages
+		}
+		if !free {
+			continue
+		}
+		scav := toolbox.Pages(0)
+		for ci := sc; ci < sc+arenaChunks; ci++ {
+			for _, x := range r.chunks[ci].scav {
+				scav += toolbox.Pages(bits.OnesCount64(x))
+			}
+			delete(r.chunks, ci)
+		}
+		r.unscav -= heapArenaSize.Pages(radixPageSize) - scav
+		i := sort.Search(len(r.chunkList), func(i int) bool {
+			return r.chunkList[i] >= sc
+		})
+		r.chunkList = append(r.chunkList[:i], r.chunkList[i+int(arenaChunks):]...)
+		r.update(base, heapArenaSize.Pages(radixPageSize))
+		r.unmapper.Unmap(ctx, base, heapArenaSize, scav.Bytes(radixPageSize))
+	}
+}
+
+// faultIn accounts for n scavenged pages becoming resident after
+// the npages pages at addr were allocated.
+func (r *Radix) faultIn(ctx toolbox.Context, addr toolbox.Address, npages, n toolbox.Pages) {
+	if n != 0 {
+		if r.tracker != nil {
+			r.tracker.Populate(ctx, addr, npages.Bytes(radixPageSize))
+		}
+		size := uint64(n.Bytes(radixPageSize))
+		ctx.ReleasedBytes -= size
+		ctx.RSSBytes += size
+	}
+	r.scavengeBackground(ctx)
+}
+
+// scavengeBackground runs the background scavenger.
+func (r *Radix) scavengeBackground(ctx toolbox.Context) {
+	if budget := r.scav.background(ctx); budget != 0 {
+		released := r.release(ctx, budget.Pages(radixPageSize))
+		r.scav.bgStat.Add(uint64(released))
+	}
+}
+
+// alloc allocates npages contiguous pages, and returns the base
+// address and the number of scavenged pages allocated. Returns
+// a zero address if there isn't enough contiguous free memory.
+func (r *Radix) alloc(npages toolbox.Pages) (toolbox.Address, toolbox.Pages) {
+	if radixChunkIndex(r.searchAddr) >= r.end {
+		return 0, 0
+	}
+	var addr, searchAddr toolbox.Address
+	if uint(radixChunkPages)-radixChunkPageIndex(r.searchAddr) >= uint(npages) {
+		// Try the chunk the search address points into first.
+		ci := radixChunkIndex(r.searchAddr)
+		if sum := r.summary[radixLevels-1].get(ci); uint(sum.max) >= uint(npages) {
+			j, searchIdx := r.chunks[ci].alloc.find(uint(npages), radixChunkPageIndex(r.searchAddr))
+			if j == ^uint(0) {
+				panic("bad summary data")
+			}
+			addr = radixChunkBase(ci).Add(toolbox.Pages(j).Bytes(radixPageSize))
+			searchAddr = radixChunkBase(ci).Add(toolbox.Pages(searchIdx).Bytes(radixPageSize))
+		}
+	}
+	if addr == 0 {
+		addr, searchAddr = r.find(npages)
+		if addr == 0 {
+			if npages == 1 {
+				// The heap is completely exhausted.
+				r.searchAddr = radixMaxSearchAddr
+			}
+			return 0, 0
+		}
+	}
+	scav := r.allocRange(addr, npages)
+	if r.searchAddr < searchAddr {
+		r.searchAddr = searchAddr
+	}
+	return addr, scav
+}
+
+// find searches the radix tree for npages contiguous free pages and
+// returns the base address along with a new search address. Returns
+// a zero address if there isn't enough contiguous free memory.
+func (r *Radix) find(npages toolbox.Pages) (toolbox.Address, toolbox.Address) {
+	// firstFree is the smallest known range that contains the
+	// first free page, and becomes the new search address.
+	firstFree := struct{ base, bound toolbox.Address }{0, radixMaxSearchAddr}
+	foundFree := func(addr toolbox.Address, size toolbox.Bytes) {
+		if firstFree.base <= addr && addr.Add(size-1) <= firstFree.bound {
+			firstFree.base = addr
+			firstFree.bound = addr.Add(size - 1)
+		} else if !(addr.Add(size-1) < firstFree.base || firstFree.bound < addr) {
+			panic("range partially overlaps")
+		}
+	}
+
+	i := uint64(0)
+	n := uint(npages)
+nextLevel:
+	for l := 0; l < radixLevels; l++ {
+		entriesPerBlock := uint64(1) << radixLevelBitsOf[l]
+		logMaxPages := radixLevelLogPages[l]
+		i <<= radixLevelBitsOf[l]
+
+		j0 := uint64(0)
+		if searchIdx := uint64(r.searchAddr) >> radixLevelShift[l]; searchIdx&^(entriesPerBlock-1) == i {
+			j0 = searchIdx & (entriesPerBlock - 1)
+		}
+
+		// Look for a run of free pages within or across the entries.
+		var base, size uint
+		for j := j0; j < entriesPerBlock; j++ {
+			sum := r.summary[l].get(i + j)
+			if sum == (radixSum{}) {
+				size = 0
+				continue
+			}
+			foundFree(toolbox.Address((i+j)<<radixLevelShift[l]), toolbox.Bytes(1<<logMaxPages)*radixPageSize)
+
+			s := uint(sum.start)
+			if size+s >= n {
+				if size == 0 {
+					base = uint(j) << logMaxPages
+				}
+				size += s
+				break
+			}
+			if uint(sum.max) >= n {
+				// The run is entirely inside this entry, so descend.
+				i += j
+				continue nextLevel
+			}
+			if size == 0 || s < 1<<logMaxPages {
+				size = uint(sum.end)
+				base = uint(j+1)<<logMaxPages - size
+				continue
+			}
+			size += 1 << logMaxPages
+		}
+		if size >= n {
+			addr := toolbox.Address(i << radixLevelShift[l]).Add(toolbox.Pages(base).Bytes(radixPageSize))
+			return addr, firstFree.base
+		}
+		if l == 0 {
+			return 0, radixMaxSearchAddr
+		}
+		panic("bad summary data")
+	}
+
+	// The run is inside a single chunk.
+	ci := i
+	j, searchIdx := r.chunks[ci].alloc.find(n, 0)
+	if j == ^uint(0) {
+		panic("bad summary data")
+	}
+	addr := radixChunkBase(ci).Add(toolbox.Pages(j).Bytes(radixPageSize))
+	searchAddr := radixChunkBase(ci).Add(toolbox.Pages(searchIdx).Bytes(radixPageSize))
+	foundFree(searchAddr, radixChunkBase(ci+1).Diff(searchAddr))
+	return addr, firstFree.base
+}
+
+// allocRange marks npages pages at addr as allocated and returns how
+// many of those pages were scavenged.
+func (r *Radix) allocRange(addr toolbox.Address, npages toolbox.Pages) toolbox.Pages {
+	limit := addr.Add(npages.Bytes(radixPageSize) - 1)
+	sc, ec := radixChunkIndex(addr), radixChunkIndex(limit)
+	scav := toolbox.Pages(0)
+	for ci := sc; ci <= ec; ci++ {
+		si, ei := uint(0), uint(radixChunkPages-1)
+		if ci == sc {
+			si = radixChunkPageIndex(addr)
+		}
+		if ci == ec {
+			ei = radixChunkPageIndex(limit)
+		}
+		chunk := r.chunks[ci]
+		for i := si; i <= ei; i++ {
+			mask := uint64(1) << (i % 64)
+			if chunk.alloc[i/64]&mask != 0 {
+				continue
+			}
+			chunk.alloc[i/64] |= mask
+			if chunk.scav[i/64]&mask != 0 {
+				chunk.scav[i/64] &^= mask
+				scav++
+			} else {
+				r.unscav--
+			}
+		}
+	}
+	r.update(addr, npages)
+	return scav
+}
+
+// update recomputes the summaries for the npages pages at addr.
+func (r *Radix) update(addr toolbox.Address, npages toolbox.Pages) {
+	sc := radixChunkIndex(addr)
+	ec := radixChunkIndex(addr.Add(npages.Bytes(radixPageSize) - 1))
+	for ci := sc; ci <= ec; ci++ {
+		// Chunks which were given back have no free pages.
+		var sum radixSum
+		if chunk := r.chunks[ci]; chunk != nil {
+			sum = chunk.alloc.summarize()
+		}
+		r.summary[radixLevels-1].set(ci, sum)
+	}
+	var children [1 << radixLevelBits]radixSum
+	for l := radixLevels - 2; l >= 0; l-- {
+		shift := radixLevelShift[l] - radixLogChunkBytes
+		for i := sc >> shift; i <= ec>>shift; i++ {
+			for j := range children {
+				children[j] = r.summary[l+1].get(i<<radixLevelBits + uint64(j))
+			}
+			r.summary[l].set(i, radixMergeSummaries(children[:], radixLevelLogPages[l+1]))
+		}
+	}
+}
+
+// allocToCache takes the 64-page block containing the first free page
+// out of the page allocator to fill a page cache.
+func (r *Radix) allocToCache() radixCache {
+	if radixChunkIndex(r.searchAddr) >= r.end {
+		return radixCache{}
+	}
+	var addr toolbox.Address
+	ci := radixChunkIndex(r.searchAddr)
+	if r.summary[radixLevels-1].get(ci) != (radixSum{}) {
+		// There are free pages at or near the search address.
+		j, _ := r.chunks[ci].alloc.find(1, radixChunkPageIndex(r.searchAddr))
+		if j == ^uint(0) {
+			panic("bad summary data")
+		}
+		addr = radixChunkBase(ci).Add(toolbox.Pages(j).Bytes(radixPageSize))
+	} else {
+		addr, _ = r.find(1)
+		if addr == 0 {
+			r.searchAddr = radixMaxSearchAddr
+			return radixCache{}
+		}
+		ci = radixChunkIndex(addr)
+	}
+	chunk := r.chunks[ci]
+	w := radixChunkPageIndex(addr) / 64
+	c := radixCache{
+		base:  addr.AlignDown(radixCachePages * radixPageSize),
+		cache: ^chunk.alloc[w],
+		scav:  chunk.scav[w],
+	}
+	r.allocRange(c.base, radixCachePages)
+
+	// Every page before the end of the cache is now allocated. The
+	// search address can't point to unmapped memory, so point it at
+	// the last page in the cache.
+	r.searchAddr = c.base.Add((radixCachePages - 1) * radixPageSize)
+	return c
+}
+
+// grow adds enough memory to the page allocator for an allocation
+// of npages, mapping a new arena if necessary.
+func (r *Radix) grow(ctx toolbox.Context, npages toolbox.Pages) {
+	ask := toolbox.Bytes(npages).AlignUp(radixChunkPages) * radixPageSize
+	total := r.arenas.grow(ctx, ask, func(base toolbox.Address, size toolbox.Bytes) {
+		r.growPages(ctx, base, size)
+	})
+
+	// The new memory is about to be faulted in, so make room for it.
+	if over := r.scav.overage(ctx, total, total); over != 0 {
+		released := r.release(ctx, over.Pages(radixPageSize))
+		r.scav.allocStat.Add(uint64(released))
+	}
+}
+
+// growPages makes [base, base+size) available for allocation.
+func (r *Radix) growPages(ctx toolbox.Context, base toolbox.Address, size toolbox.Bytes) {
+	start, end := radixChunkIndex(base), radixChunkIndex(base.Add(size))
+	for ci := start; ci < end; ci++ {
+		chunk := new(radixChunk)
+		// Newly-grown memory is always considered scavenged.
+		for i := range chunk.scav {
+			chunk.scav[i] = ^uint64(0)
+		}
+		r.chunks[ci] = chunk
+	}
+	i := sort.Search(len(r.chunkList), func(i int) bool {
+		return r.chunkList[i] >= start
+	})
+	grown := make([]uint64, 0, end-start)
+	for ci := start; ci < end; ci++ {
+		grown = append(grown, ci)
+	}
+	r.chunkList = append(r.chunkList[:i], append(grown, r.chunkList[i:]...)...)
+	if r.start == 0 || start < r.start {
+		r.start = start
+	}
+	if end > r.end {
+		r.end = end
+	}
+	if base < r.searchAddr {
+		r.searchAddr = base
+	}
+	r.update(base, size.Pages(radixPageSize))
+
+	ctx.FreeBytes += uint64(size)
+	ctx.ReleasedBytes += uint64(size)
+}
+
+// release returns up to n free pages to the OS, preferring pages at
+// higher addresses, and returns the number of bytes released.
+func (r *Radix) release(ctx toolbox.Context, n toolbox.Pages) toolbox.Bytes {
+	released := toolbox.Pages(0)
+	for k := len(r.chunkList) - 1; k >= 0 && released < n && r.unscav > 0; k-- {
+		ci := r.chunkList[k]
+		chunk := r.chunks[ci]
+		for j := len(chunk.scav) - 1; j >= 0 && released < n; j-- {
+			avail := ^(chunk.alloc[j] | chunk.scav[j])
+			for avail != 0 && released < n {
+				i := 63 - bits.LeadingZeros64(avail)
+				bit := uint64(1) << i
+				chunk.scav[j] |= bit
+				avail &^= bit
+				released++
+				r.unscav--
+				if r.tracker != nil {
+					addr := radixChunkBase(ci).Add(toolbox.Pages(j*64 + i).Bytes(radixPageSize))
+					r.tracker.Release(ctx, addr, radixPageSize)
+				}
+			}
+		}
+	}
+	size := released.Bytes(radixPageSize)
+	ctx.RSSBytes -= uint64(size)
+	ctx.ReleasedBytes += uint64(size)
+	return size
+}
+
+// Inspect implements toolbox.Inspector.
+func (r *Radix) Inspect() []toolbox.SpanInfo {
+	cached := make(map[toolbox.Address]bool)
+	for _, c := range r.caches {
+		addCachedPages(cached, radixPageSize, c.base, c.cache, c.scav)
+	}
+	runs := pageRuns{pageSize: radixPageSize}
+	for _, ci := range r.chunkList {
+		chunk := r.chunks[ci]
+		base := radixChunkBase(ci)
+		for i := 0; i < radixChunkPages; i++ {
+			addr := base.Add(toolbox.Pages(i).Bytes(radixPageSize))
+			mask := uint64(1) << (i % 64)
+			if scav, ok := cached[addr]; ok {
+				runs.add(addr, toolbox.SpanCached, scav)
+			} else if chunk.alloc[i/64]&mask != 0 {
+				runs.add(addr, toolbox.SpanAllocated, false)
+			} else {
+				runs.add(addr, toolbox.SpanFree, chunk.scav[i/64]&mask != 0)
+			}
+		}
+	}
+	return runs.runs
+}
+
+// radixState is the saved state of a Radix page allocator.
+type radixState struct {
+	Arenas     arenasState
+	Caches     map[toolbox.P]radixCacheState
+	Chunks     []radixChunkState
+	SearchAddr toolbox.Address
+	Start, End uint64
+	Unscav     toolbox.Pages
+	ScavLast   uint64
+}
+
+// radixCacheState is the saved state of a radixCache.
+type radixCacheState struct {
+	Base  toolbox.Address
+	Cache uint64
+	Scav  uint64
+}
+
+// radixChunkState is the saved state of a radixChunk.
+type radixChunkState struct {
+	Index uint64
+	Alloc radixBits
+	Scav  radixBits
+}
+
+// SaveState implements simulation.Checkpointer.
+func (r *Radix) SaveState(enc *gob.Encoder) error {
+	st := radixState{
+		Arenas:     r.arenas.save(),
+		Caches:     make(map[toolbox.P]radixCacheState),
+		SearchAddr: r.searchAddr,
+		Start:      r.start,
+		End:        r.end,
+		Unscav:     r.unscav,
+		ScavLast:   r.scav.last,
+	}
+	for p, c := range r.caches {
+		st.Caches[p] = radixCacheState{c.base, c.cache, c.scav}
+	}
+	for _, ci := range r.chunkList {
+		chunk := r.chunks[ci]
+		st.Chunks = append(st.Chunks, radixChunkState{ci, chunk.alloc, chunk.scav})
+	}
+	return enc.Encode(&st)
+}
+
+// LoadState implements simulation.Checkpointer. The summaries aren't
+// saved, and are instead recomputed from the chunks.
+func (r *Radix) LoadState(dec *gob.Decoder) error {
+	var st radixState
+	if err := dec.Decode(&st); err != nil {
+		return err
+	}
+	r.arenas.restore(st.Arenas)
+	r.caches = make(map[toolbox.P]*radixCache)
+	for p, c := range st.Caches {
+		r.caches[p] = &radixCache{c.Base, c.Cache, c.Scav}
+	}
+	r.chunks = make(map[uint64]*radixChunk)
+	r.chunkList = nil
+	for _, cs := range st.Chunks {
+		r.chunks[cs.Index] = &radixChunk{alloc: cs.Alloc, scav: cs.Scav}
+		r.chunkList = append(r.chunkList, cs.Index)
+	}
+	for _, ci := range r.chunkList {
+		r.update(radixChunkBase(ci), radixChunkPages)
+	}
+	r.searchAddr = st.SearchAddr
+	r.start, r.end = st.Start, st.End
+	r.unscav = st.Unscav
+	r.scav.last = st.ScavLast
+	return nil
+}
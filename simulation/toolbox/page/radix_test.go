@@ -0,0 +1,229 @@
+package page
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/mknyszek/goat/simulation"
+	"github.com/mknyszek/goat/simulation/toolbox"
+)
+
+// makeRadixBits returns a chunk bitmap with the pages in each of the
+// given [start, end) ranges allocated.
+func makeRadixBits(alloc ...[2]uint) radixBits {
+	var b radixBits
+	for _, r := range alloc {
+		for i := r[0]; i < r[1]; i++ {
+			b[i/64] |= 1 << (i % 64)
+		}
+	}
+	return b
+}
+
+func TestRadixSummarize(t *testing.T) {
+	tests := []struct {
+		name  string
+		alloc [][2]uint
+		sum   radixSum
+	}{
+		{"Free", nil, radixSum{512, 512, 512}},
+		{"Full", [][2]uint{{0, 512}}, radixSum{0, 0, 0}},
+		{"First", [][2]uint{{0, 1}}, radixSum{0, 511, 511}},
+		{"Last", [][2]uint{{511, 512}}, radixSum{511, 511, 0}},
+		{"Middle", [][2]uint{{100, 200}}, radixSum{100, 312, 312}},
+		{"Largest", [][2]uint{{10, 20}, {30, 500}}, radixSum{10, 12, 12}},
+		{"AcrossWords", [][2]uint{{0, 60}, {140, 512}}, radixSum{0, 80, 0}},
+		{"Alternating", [][2]uint{{1, 2}, {3, 4}, {5, 512}}, radixSum{1, 1, 0}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := makeRadixBits(test.alloc...)
+			if sum := b.summarize(); sum != test.sum {
+				t.Errorf("expected %+v, got %+v", test.sum, sum)
+			}
+		})
+	}
+}
+
+func TestRadixMergeSummaries(t *testing.T) {
+	const logPages = 9
+	free := radixSum{512, 512, 512}
+	tests := []struct {
+		name string
+		sums []radixSum
+		sum  radixSum
+	}{
+		{"AllFree", []radixSum{free, free, free}, radixSum{1536, 1536, 1536}},
+		{"NoneFree", []radixSum{{}, {}}, radixSum{}},
+		{"Bridge", []radixSum{{0, 10, 10}, {20, 30, 0}}, radixSum{0, 30, 0}},
+		{"BridgeLargest", []radixSum{{0, 10, 100}, {50, 50, 0}}, radixSum{0, 150, 0}},
+		{"FreeMiddle", []radixSum{{0, 5, 5}, free, {7, 7, 0}}, radixSum{0, 524, 0}},
+		{"Start", []radixSum{free, {3, 3, 0}}, radixSum{515, 515, 0}},
+		{"End", []radixSum{{0, 1, 0}, {0, 0, 0}, {0, 4, 4}, free}, radixSum{0, 516, 516}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if sum := radixMergeSummaries(test.sums, logPages); sum != test.sum {
+				t.Errorf("expected %+v, got %+v", test.sum, sum)
+			}
+		})
+	}
+}
+
+func TestFindBitRange64(t *testing.T) {
+	tests := []struct {
+		c    uint64
+		n    uint
+		want uint
+	}{
+		{0, 1, 64},
+		{1, 1, 0},
+		{0b1100, 2, 2},
+		{0b1100, 3, 64},
+		{0b11101111, 4, 0},
+		{0b11101110, 4, 64},
+		{0b1110111000, 3, 3},
+		{^uint64(0), 64, 0},
+		{0xfffffffffffffffe, 64, 64},
+		{0xffffffff00000000, 32, 32},
+	}
+	for _, test := range tests {
+		if got := findBitRange64(test.c, test.n); got != test.want {
+			t.Errorf("findBitRange64(%#b, %d): expected %d, got %d", test.c, test.n, test.want, got)
+		}
+	}
+}
+
+func TestRadixBitsFind(t *testing.T) {
+	tests := []struct {
+		name      string
+		alloc     [][2]uint
+		npages    uint
+		searchIdx uint
+		idx       uint
+		newSearch uint
+	}{
+		{"One", [][2]uint{{0, 5}}, 1, 0, 5, 5},
+		{"OneFull", [][2]uint{{0, 512}}, 1, 0, ^uint(0), ^uint(0)},
+		{"Small", [][2]uint{{0, 5}, {7, 10}}, 3, 0, 10, 5},
+		{"SmallAcrossWords", [][2]uint{{0, 62}, {66, 512}}, 4, 0, 62, 62},
+		{"SmallSearchIdx", [][2]uint{{0, 64}, {70, 512}}, 2, 64, 64, 64},
+		{"SmallNone", [][2]uint{{0, 100}, {101, 512}}, 2, 0, ^uint(0), 100},
+		{"Large", [][2]uint{{0, 10}, {100, 200}}, 100, 0, 200, 10},
+		{"LargeAcrossWords", [][2]uint{{0, 60}, {260, 512}}, 200, 0, 60, 60},
+		{"LargeNone", [][2]uint{{0, 60}, {259, 512}}, 200, 0, ^uint(0), 60},
+		{"LargeWholeChunk", nil, 512, 0, 0, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := makeRadixBits(test.alloc...)
+			idx, newSearch := b.find(test.npages, test.searchIdx)
+			if idx != test.idx || newSearch != test.newSearch {
+				t.Errorf("expected (%d, %d), got (%d, %d)", test.idx, test.newSearch, idx, newSearch)
+			}
+		})
+	}
+}
+
+// checkRadixSummaries checks that every summary in r's radix tree
+// agrees with the chunks beneath it.
+func checkRadixSummaries(t *testing.T, r *Radix) {
+	t.Helper()
+	for _, ci := range r.chunkList {
+		if got, want := r.summary[radixLevels-1].get(ci), r.chunks[ci].alloc.summarize(); got != want {
+			t.Fatalf("chunk %d: expected summary %+v, got %+v", ci, want, got)
+		}
+	}
+	for l := radixLevels - 2; l >= 0; l-- {
+		shift := radixLevelShift[l] - radixLogChunkBytes
+		seen := make(map[uint64]bool)
+		for _, ci := range r.chunkList {
+			i := ci >> shift
+			if seen[i] {
+				continue
+			}
+			seen[i] = true
+			var children [1 << radixLevelBits]radixSum
+			for j := range children {
+				children[j] = r.summary[l+1].get(i<<radixLevelBits + uint64(j))
+			}
+			if got, want := r.summary[l].get(i), radixMergeSummaries(children[:], radixLevelLogPages[l+1]); got != want {
+				t.Fatalf("level %d entry %d: expected summary %+v, got %+v", l, i, want, got)
+			}
+		}
+	}
+}
+
+// TestRadixLowestFit checks that, without page caches, Radix always
+// places allocations at the lowest address that fits, like the
+// runtime, and keeps its summaries up to date.
+func TestRadixLowestFit(t *testing.T) {
+	const heapPages = 8 * radixChunkPages
+	r := NewRadix(toolbox.NewAddressSpace48(4096), RadixScavenge(false))
+	stats := simulation.NewStats()
+	r.RegisterStats(stats)
+	ctx := toolbox.Context{P: toolbox.NoP, Stats: stats}
+
+	// Grow the heap up front, so the reference model doesn't need
+	// to know how it grows.
+	heap := r.AllocPages(ctx, heapPages)
+	r.FreePages(ctx, heap, heapPages)
+	checkRadixSummaries(t, r)
+
+	// ref is the reference model: whether each page is allocated.
+	ref := make([]bool, heapPages)
+	refFind := func(n toolbox.Pages) (int, bool) {
+		run := 0
+		for i, alloc := range ref {
+			if alloc {
+				run = 0
+				continue
+			}
+			run++
+			if run == int(n) {
+				return i - run + 1, true
+			}
+		}
+		return 0, false
+	}
+	type alloc struct {
+		addr toolbox.Address
+		n    toolbox.Pages
+	}
+	var live []alloc
+	rng := rand.New(rand.NewSource(1))
+	for iter := 0; iter < 5000; iter++ {
+		if len(live) != 0 && rng.Intn(5) < 2 {
+			k := rng.Intn(len(live))
+			a := live[k]
+			live[k] = live[len(live)-1]
+			live = live[:len(live)-1]
+			r.FreePages(ctx, a.addr, a.n)
+			start := int(a.addr.Diff(heap) / radixPageSize)
+			for i := start; i < start+int(a.n); i++ {
+				ref[i] = false
+			}
+		} else {
+			n := toolbox.Pages(1 + rng.Intn(16))
+			if rng.Intn(20) == 0 {
+				n = toolbox.Pages(1 + rng.Intn(2*radixChunkPages))
+			}
+			want, ok := refFind(n)
+			if !ok {
+				continue
+			}
+			addr := r.AllocPages(ctx, n)
+			if got := int(addr.Diff(heap) / radixPageSize); got != want {
+				t.Fatalf("iteration %d: allocating %d pages: expected page %d, got %d", iter, n, want, got)
+			}
+			for i := want; i < want+int(n); i++ {
+				ref[i] = true
+			}
+			live = append(live, alloc{addr, n})
+		}
+		if iter%500 == 0 {
+			checkRadixSummaries(t, r)
+		}
+	}
+	checkRadixSummaries(t, r)
+}
@@ -0,0 +1,163 @@
+package page
+
+import (
+	"fmt"
+
+	"github.com/mknyszek/goat/simulation"
+	"github.com/mknyszek/goat/simulation/toolbox"
+)
+
+const (
+	// defaultRetainPercent is the default amount of resident memory the
+	// scavenger retains beyond in-use memory, as a percent of in-use memory.
+	// The runtime retains 10% over the heap goal, which at GOGC=100 is
+	// roughly 2.2x the in-use heap.
+	defaultRetainPercent = 120
+
+	// defaultScavengeRate and defaultScavengePeriod together describe the
+	// default background scavenger rate: 64 KiB every 1,000,000 ticks,
+	// or roughly 64 MiB/s on a 1 GHz clock.
+	defaultScavengeRate   toolbox.Bytes = 64 << 10
+	defaultScavengePeriod               = 1000000
+)
+
+// scavengerParams are the names of the parameters understood by
+// (*scavenger).decodeParams.
+var scavengerParams = []string{"scavenge", "retainBytes", "retainPercent", "scavengeRate", "scavengePeriod"}
+
+// scavenger models the policy of the runtime's scavenger, which
+// returns free memory to the OS, for page allocators that track which
+// of their pages are scavenged.
+//
+// There are two ways memory is scavenged. The background scavenger
+// wakes up periodically and releases memory at a fixed rate, while
+// allocation-triggered scavenging releases memory immediately when
+// an allocation pushes resident memory over the retain target.
+type scavenger struct {
+	enabled bool
+	retain  toolbox.Bytes
+	percent uint64
+	rate    toolbox.Bytes
+	period  uint64
+	last    uint64
+
+	// bgStat and allocStat count the memory released by the
+	// background and allocation-triggered scavengers.
+	bgStat    *simulation.Stat
+	allocStat *simulation.Stat
+}
+
+func newScavenger() scavenger {
+	return scavenger{
+		enabled: true,
+		percent: defaultRetainPercent,
+		rate:    defaultScavengeRate,
+		period:  defaultScavengePeriod,
+	}
+}
+
+// registerStats registers the scavenger's statistics, with names
+// prefixed by prefix.
+func (s *scavenger) registerStats(stats *simulation.Stats, prefix string) {
+	s.bgStat = stats.RegisterOther(simulation.StatDesc{
+		Name:        prefix + "ScavengedBackgroundBytes",
+		Kind:        simulation.Counter,
+		Unit:        simulation.UnitBytes,
+		Description: "memory released to the OS by the background scavenger",
+	})
+	s.allocStat = stats.RegisterOther(simulation.StatDesc{
+		Name:        prefix + "ScavengedAllocBytes",
+		Kind:        simulation.Counter,
+		Unit:        simulation.UnitBytes,
+		Description: "memory released to the OS by allocation-triggered scavenging",
+	})
+}
+
+func (s *scavenger) checkConfig() error {
+	if s.rate != 0 && s.period == 0 {
+		return fmt.Errorf("scavengePeriod must be non-zero")
+	}
+	return nil
+}
+
+// decodeParams configures the scavenger from parameters.
+func (s *scavenger) decodeParams(p toolbox.Params) error {
+	if _, err := p.Decode("scavenge", &s.enabled); err != nil {
+		return err
+	}
+	var err error
+	if s.retain, err = p.Bytes("retainBytes", s.retain); err != nil {
+		return err
+	}
+	if s.percent, err = p.Uint64("retainPercent", s.percent); err != nil {
+		return err
+	}
+	if s.rate, err = p.Bytes("scavengeRate", s.rate); err != nil {
+		return err
+	}
+	if s.period, err = p.Uint64("scavengePeriod", s.period); err != nil {
+		return err
+	}
+	return s.checkConfig()
+}
+
+// retainGoal returns the amount of resident memory the scavenger
+// tries to stay under.
+func (s *scavenger) retainGoal(ctx toolbox.Context) uint64 {
+	inUse := ctx.ObjectBytes + ctx.StackBytes + ctx.UnusedBytes
+	goal := inUse + inUse*s.percent/100
+	if goal < uint64(s.retain) {
+		goal = uint64(s.retain)
+	}
+	return goal
+}
+
+// overage returns how much memory must be scavenged immediately for
+// resident memory to stay under the retain target once another
+// extra bytes become resident, but no more than max bytes.
+func (s *scavenger) overage(ctx toolbox.Context, extra, max toolbox.Bytes) toolbox.Bytes {
+	if !s.enabled {
+		return 0
+	}
+	goal := s.retainGoal(ctx)
+	rss := ctx.RSSBytes + uint64(extra)
+	if rss <= goal {
+		return 0
+	}
+	if over := toolbox.Bytes(rss - goal); over < max {
+		return over
+	}
+	return max
+}
+
+// background returns how much memory the background scavenger
+// releases as of the current event.
+func (s *scavenger) background(ctx toolbox.Context) toolbox.Bytes {
+	if !s.enabled || s.rate == 0 {
+		return 0
+	}
+	if ctx.Timestamp < s.last+s.period {
+		if ctx.Timestamp < s.last {
+			// Timestamps are only mostly monotonic.
+			s.last = ctx.Timestamp
+		}
+		return 0
+	}
+	periods := (ctx.Timestamp - s.last) / s.period
+	if s.last == 0 {
+		// First event: just start the clock.
+		periods = 0
+	}
+	s.last = ctx.Timestamp
+	goal := s.retainGoal(ctx)
+	if periods == 0 || ctx.RSSBytes <= goal {
+		return 0
+	}
+	over := toolbox.Bytes(ctx.RSSBytes - goal)
+	if periods < uint64(over/s.rate)+1 {
+		if budget := toolbox.Bytes(periods) * s.rate; budget < over {
+			return budget
+		}
+	}
+	return over
+}
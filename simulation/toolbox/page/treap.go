@@ -0,0 +1,323 @@
+package page
+
+import (
+	"github.com/mknyszek/goat/simulation/toolbox"
+)
+
+// treapNode is a free span of pages in a treap.
+type treapNode struct {
+	base   toolbox.Address
+	npages toolbox.Pages
+
+	// maxPages is the largest npages in the subtree rooted
+	// at this node.
+	maxPages toolbox.Pages
+
+	prio        uint32
+	left, right *treapNode
+}
+
+func (n *treapNode) update() {
+	n.maxPages = n.npages
+	if n.left != nil && n.left.maxPages > n.maxPages {
+		n.maxPages = n.left.maxPages
+	}
+	if n.right != nil && n.right.maxPages > n.maxPages {
+		n.maxPages = n.right.maxPages
+	}
+}
+
+// treap is a randomized balanced binary search tree of free spans,
+// ordered either by address, or by size and then address, like the
+// pre-Go 1.14 runtime's mTreap.
+type treap struct {
+	root   *treapNode
+	bySize bool
+	seed   uint32
+	count  int
+}
+
+func (t *treap) less(a, b *treapNode) bool {
+	if t.bySize && a.npages != b.npages {
+		return a.npages < b.npages
+	}
+	return a.base < b.base
+}
+
+// random returns a pseudo-random priority. A fixed sequence keeps
+// simulations reproducible.
+func (t *treap) random() uint32 {
+	if t.seed == 0 {
+		t.seed = 0x9e3779b9
+	}
+	t.seed ^= t.seed << 13
+	t.seed ^= t.seed >> 17
+	t.seed ^= t.seed << 5
+	return t.seed
+}
+
+func rotateLeft(n *treapNode) *treapNode {
+	r := n.right
+	n.right = r.left
+	r.left = n
+	n.update()
+	r.update()
+	return r
+}
+
+func rotateRight(n *treapNode) *treapNode {
+	l := n.left
+	n.left = l.right
+	l.right = n
+	n.update()
+	l.update()
+	return l
+}
+
+func (t *treap) insert(n *treapNode) {
+	n.prio = t.random()
+	n.left, n.right = nil, nil
+	n.update()
+	t.root = t.insertAt(t.root, n)
+	t.count++
+}
+
+func (t *treap) insertAt(root, n *treapNode) *treapNode {
+	if root == nil {
+		return n
+	}
+	if t.less(n, root) {
+		root.left = t.insertAt(root.left, n)
+		if root.left.prio > root.prio {
+			return rotateRight(root)
+		}
+	} else {
+		root.right = t.insertAt(root.right, n)
+		if root.right.prio > root.prio {
+			return rotateLeft(root)
+		}
+	}
+	root.update()
+	return root
+}
+
+func (t *treap) remove(n *treapNode) {
+	t.root = t.removeAt(t.root, n)
+	t.count--
+}
+
+func (t *treap) removeAt(root, n *treapNode) *treapNode {
+	if root == nil {
+		panic("removing span not in treap")
+	}
+	if root == n {
+		return merge(root.left, root.right)
+	}
+	if t.less(n, root) {
+		root.left = t.removeAt(root.left, n)
+	} else {
+		root.right = t.removeAt(root.right, n)
+	}
+	root.update()
+	return root
+}
+
+func merge(a, b *treapNode) *treapNode {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	if a.prio > b.prio {
+		a.right = merge(a.right, b)
+		a.update()
+		return a
+	}
+	b.left = merge(a, b.left)
+	b.update()
+	return b
+}
+
+// first returns the least span in the treap's order, or nil.
+func (t *treap) first() *treapNode {
+	n := t.root
+	for n != nil && n.left != nil {
+		n = n.left
+	}
+	return n
+}
+
+// bestFit returns the smallest span with at least npages pages,
+// preferring lower addresses. The treap must be ordered by size.
+func (t *treap) bestFit(npages toolbox.Pages) *treapNode {
+	var best *treapNode
+	for n := t.root; n != nil; {
+		if n.npages >= npages {
+			best = n
+			n = n.left
+		} else {
+			n = n.right
+		}
+	}
+	return best
+}
+
+// firstFit returns the lowest-addressed span with at least npages
+// pages. The treap must be ordered by address.
+func (t *treap) firstFit(npages toolbox.Pages) *treapNode {
+	n := t.root
+	if n == nil || n.maxPages < npages {
+		return nil
+	}
+	for {
+		if n.left != nil && n.left.maxPages >= npages {
+			n = n.left
+		} else if n.npages >= npages {
+			return n
+		} else {
+			n = n.right
+		}
+	}
+}
+
+// largest returns the number of pages in the largest span.
+func (t *treap) largest() toolbox.Pages {
+	if t.root == nil {
+		return 0
+	}
+	return t.root.maxPages
+}
+
+// freeSpans is a set of free spans of pages which coalesces
+// adjacent spans, backed by a treap.
+type freeSpans struct {
+	treap
+	pageSize toolbox.Bytes
+	byStart  map[toolbox.Address]*treapNode
+	byEnd    map[toolbox.Address]*treapNode
+	free     toolbox.Pages
+}
+
+func newFreeSpans(pageSize toolbox.Bytes, bySize bool) freeSpans {
+	return freeSpans{
+		treap:    treap{bySize: bySize},
+		pageSize: pageSize,
+		byStart:  make(map[toolbox.Address]*treapNode),
+		byEnd:    make(map[toolbox.Address]*treapNode),
+	}
+}
+
+func (s *freeSpans) end(n *treapNode) toolbox.Address {
+	return n.base.Add(n.npages.Bytes(s.pageSize))
+}
+
+func (s *freeSpans) add(n *treapNode) {
+	s.treap.insert(n)
+	s.byStart[n.base] = n
+	s.byEnd[s.end(n)] = n
+}
+
+func (s *freeSpans) del(n *treapNode) {
+	s.treap.remove(n)
+	delete(s.byStart, n.base)
+	delete(s.byEnd, s.end(n))
+}
+
+// insert adds npages free pages at base to the set, coalescing
+// them with any adjacent free spans.
+func (s *freeSpans) insert(base toolbox.Address, npages toolbox.Pages) {
+	s.free += npages
+	n := &treapNode{base: base, npages: npages}
+	if prev, ok := s.byEnd[base]; ok {
+		s.del(prev)
+		n.base = prev.base
+		n.npages += prev.npages
+	}
+	if next, ok := s.byStart[s.end(n)]; ok {
+		s.del(next)
+		n.npages += next.npages
+	}
+	s.add(n)
+}
+
+// take allocates npages pages from the start of the free span n,
+// returning the remainder to the set.
+func (s *freeSpans) take(n *treapNode, npages toolbox.Pages) toolbox.Address {
+	s.del(n)
+	s.free -= npages
+	if n.npages > npages {
+		s.add(&treapNode{base: n.base.Add(npages.Bytes(s.pageSize)), npages: n.npages - npages})
+	}
+	return n.base
+}
+
+// treapState is the saved state of a treap.
+type treapState struct {
+	// Nodes are the treap's nodes in preorder.
+	Nodes []treapNodeState
+	Seed  uint32
+	Count int
+}
+
+// treapNodeState is the saved state of a treapNode.
+type treapNodeState struct {
+	Base   toolbox.Address
+	NPages toolbox.Pages
+	Prio   uint32
+}
+
+// save returns the state of the treap.
+func (t *treap) save() treapState {
+	st := treapState{Seed: t.seed, Count: t.count}
+	var walk func(n *treapNode)
+	walk = func(n *treapNode) {
+		if n == nil {
+			return
+		}
+		st.Nodes = append(st.Nodes, treapNodeState{n.base, n.npages, n.prio})
+		walk(n.left)
+		walk(n.right)
+	}
+	walk(t.root)
+	return st
+}
+
+// restore replaces the contents of the treap with st, calling f
+// with each new node.
+//
+// Inserting the nodes in preorder with their original priorities
+// never rotates, so the treap ends up with exactly the same shape.
+func (t *treap) restore(st treapState, f func(n *treapNode)) {
+	t.root = nil
+	for _, ns := range st.Nodes {
+		n := &treapNode{base: ns.Base, npages: ns.NPages, prio: ns.Prio}
+		n.update()
+		t.root = t.insertAt(t.root, n)
+		f(n)
+	}
+	t.seed = st.Seed
+	t.count = st.Count
+}
+
+// freeSpansState is the saved state of a freeSpans.
+type freeSpansState struct {
+	Treap treapState
+	Free  toolbox.Pages
+}
+
+// save returns the state of the set.
+func (s *freeSpans) save() freeSpansState {
+	return freeSpansState{Treap: s.treap.save(), Free: s.free}
+}
+
+// restore replaces the contents of the set with st.
+func (s *freeSpans) restore(st freeSpansState) {
+	s.byStart = make(map[toolbox.Address]*treapNode)
+	s.byEnd = make(map[toolbox.Address]*treapNode)
+	s.treap.restore(st.Treap, func(n *treapNode) {
+		s.byStart[n.base] = n
+		s.byEnd[s.end(n)] = n
+	})
+	s.free = st.Free
+}
@@ -0,0 +1,114 @@
+package page
+
+import (
+	"testing"
+
+	"github.com/mknyszek/goat/simulation/toolbox"
+)
+
+// testSpan is a span of pages, in units of pages.
+type testSpan struct {
+	base, npages uint64
+}
+
+func newTestFreeSpans(bySize bool, spans []testSpan) *freeSpans {
+	s := newFreeSpans(1, bySize)
+	for _, span := range spans {
+		s.insert(toolbox.Address(span.base), toolbox.Pages(span.npages))
+	}
+	return &s
+}
+
+func TestTreapFit(t *testing.T) {
+	spans := []testSpan{{100, 8}, {10, 4}, {200, 4}, {50, 16}, {300, 2}}
+	tests := []struct {
+		name      string
+		npages    uint64
+		bestFit   uint64
+		firstFit  uint64
+		wantFound bool
+	}{
+		{"One", 1, 300, 10, true},
+		{"ExactSmallest", 2, 300, 10, true},
+		{"TieLowestAddress", 3, 10, 10, true},
+		{"Middle", 5, 100, 50, true},
+		{"Largest", 16, 50, 50, true},
+		{"TooLarge", 17, 0, 0, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, bySize := range []bool{true, false} {
+				s := newTestFreeSpans(bySize, spans)
+				var n *treapNode
+				want := test.firstFit
+				if bySize {
+					n = s.bestFit(toolbox.Pages(test.npages))
+					want = test.bestFit
+				} else {
+					n = s.firstFit(toolbox.Pages(test.npages))
+				}
+				if !test.wantFound {
+					if n != nil {
+						t.Errorf("bySize=%v: expected no span, got one at %d", bySize, n.base)
+					}
+					continue
+				}
+				if n == nil || uint64(n.base) != want {
+					t.Errorf("bySize=%v: expected span at %d, got %v", bySize, want, n)
+				}
+			}
+		})
+	}
+}
+
+func TestFreeSpansCoalesce(t *testing.T) {
+	tests := []struct {
+		name    string
+		spans   []testSpan
+		count   int
+		largest uint64
+		free    uint64
+	}{
+		{"Disjoint", []testSpan{{0, 4}, {10, 4}}, 2, 4, 8},
+		{"Before", []testSpan{{10, 4}, {6, 4}}, 1, 8, 8},
+		{"After", []testSpan{{10, 4}, {14, 2}}, 1, 6, 6},
+		{"Between", []testSpan{{0, 4}, {8, 4}, {4, 4}}, 1, 12, 12},
+		{"Partial", []testSpan{{0, 4}, {9, 4}, {4, 4}}, 2, 8, 12},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, bySize := range []bool{true, false} {
+				s := newTestFreeSpans(bySize, test.spans)
+				if s.count != test.count || uint64(s.largest()) != test.largest || uint64(s.free) != test.free {
+					t.Errorf("bySize=%v: expected count/largest/free %d/%d/%d, got %d/%d/%d",
+						bySize, test.count, test.largest, test.free, s.count, s.largest(), s.free)
+				}
+				if len(s.byStart) != s.count || len(s.byEnd) != s.count {
+					t.Errorf("bySize=%v: indexes have %d and %d spans, expected %d", bySize, len(s.byStart), len(s.byEnd), s.count)
+				}
+			}
+		})
+	}
+}
+
+func TestFreeSpansTake(t *testing.T) {
+	s := newTestFreeSpans(false, []testSpan{{0, 4}, {10, 8}})
+	if addr := s.take(s.firstFit(6), 6); addr != 10 {
+		t.Fatalf("expected to take pages at 10, got %d", addr)
+	}
+	if s.count != 2 || s.free != 6 {
+		t.Errorf("expected 2 spans with 6 free pages, got %d spans with %d", s.count, s.free)
+	}
+	if n := s.firstFit(2); n == nil || n.base != 0 {
+		t.Errorf("expected first fit of 2 pages at 0, got %v", n)
+	}
+	if n := s.byStart[16]; n == nil || n.npages != 2 {
+		t.Errorf("expected a 2 page remainder at 16, got %v", n)
+	}
+
+	// Freeing the taken pages coalesces everything after them.
+	s.insert(10, 6)
+	if n := s.byStart[10]; n == nil || n.npages != 8 || s.count != 2 {
+		t.Errorf("expected the span at 10 to be restored, got %v", n)
+	}
+}
@@ -0,0 +1,254 @@
+package toolbox
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Params is a set of named parameters used to construct a simulation
+// component. Values are kept in their raw JSON form until a
+// component's factory asks for them.
+type Params map[string]json.RawMessage
+
+// Check returns an error if p contains any parameter not in names.
+func (p Params) Check(names ...string) error {
+	var unknown []string
+	for name := range p {
+		found := false
+		for _, n := range names {
+			if n == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) != 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("unknown parameters: %s", strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+// Decode decodes the named parameter into v, and reports whether
+// the parameter was present.
+func (p Params) Decode(name string, v interface{}) (bool, error) {
+	raw, ok := p[name]
+	if !ok {
+		return false, nil
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		return true, fmt.Errorf("parameter %s: %v", name, err)
+	}
+	return true, nil
+}
+
+// Uint64 returns the named parameter as a uint64, or def if the
+// parameter isn't present.
+func (p Params) Uint64(name string, def uint64) (uint64, error) {
+	v := def
+	_, err := p.Decode(name, &v)
+	return v, err
+}
+
+// Bytes returns the named parameter as an amount of bytes, or def if
+// the parameter isn't present.
+func (p Params) Bytes(name string, def Bytes) (Bytes, error) {
+	v, err := p.Uint64(name, uint64(def))
+	return Bytes(v), err
+}
+
+// AddressSpaceFactory constructs an AddressSpace from parameters.
+type AddressSpaceFactory func(Params) (AddressSpace, error)
+
+// PageAllocatorFactory constructs a PageAllocator on top of an
+// AddressSpace from parameters.
+type PageAllocatorFactory func(AddressSpace, Params) (PageAllocator, error)
+
+// StackAllocatorFactory constructs a StackAllocator on top of a
+// PageAllocator from parameters.
+type StackAllocatorFactory func(PageAllocator, Params) (StackAllocator, error)
+
+// ObjectAllocatorFactory constructs an ObjectAllocator on top of a
+// PageAllocator from parameters.
+type ObjectAllocatorFactory func(PageAllocator, Params) (ObjectAllocator, error)
+
+var registry struct {
+	sync.Mutex
+	addressSpaces    map[string]AddressSpaceFactory
+	pageAllocators   map[string]PageAllocatorFactory
+	stackAllocators  map[string]StackAllocatorFactory
+	objectAllocators map[string]ObjectAllocatorFactory
+}
+
+func checkRegister(kind, name string, exists bool) {
+	if name == "" {
+		panic(fmt.Sprintf("registering %s with empty name", kind))
+	}
+	if exists {
+		panic(fmt.Sprintf("%s %q registered twice", kind, name))
+	}
+}
+
+// RegisterAddressSpace makes an AddressSpace implementation available
+// by name to simulation specs. Panics if name is already registered.
+func RegisterAddressSpace(name string, f AddressSpaceFactory) {
+	registry.Lock()
+	defer registry.Unlock()
+	if registry.addressSpaces == nil {
+		registry.addressSpaces = make(map[string]AddressSpaceFactory)
+	}
+	_, ok := registry.addressSpaces[name]
+	checkRegister("address space", name, ok)
+	registry.addressSpaces[name] = f
+}
+
+// RegisterPageAllocator makes a PageAllocator implementation available
+// by name to simulation specs. Panics if name is already registered.
+func RegisterPageAllocator(name string, f PageAllocatorFactory) {
+	registry.Lock()
+	defer registry.Unlock()
+	if registry.pageAllocators == nil {
+		registry.pageAllocators = make(map[string]PageAllocatorFactory)
+	}
+	_, ok := registry.pageAllocators[name]
+	checkRegister("page allocator", name, ok)
+	registry.pageAllocators[name] = f
+}
+
+// RegisterStackAllocator makes a StackAllocator implementation available
+// by name to simulation specs. Panics if name is already registered.
+func RegisterStackAllocator(name string, f StackAllocatorFactory) {
+	registry.Lock()
+	defer registry.Unlock()
+	if registry.stackAllocators == nil {
+		registry.stackAllocators = make(map[string]StackAllocatorFactory)
+	}
+	_, ok := registry.stackAllocators[name]
+	checkRegister("stack allocator", name, ok)
+	registry.stackAllocators[name] = f
+}
+
+// RegisterObjectAllocator makes an ObjectAllocator implementation available
+// by name to simulation specs. Panics if name is already registered.
+func RegisterObjectAllocator(name string, f ObjectAllocatorFactory) {
+	registry.Lock()
+	defer registry.Unlock()
+	if registry.objectAllocators == nil {
+		registry.objectAllocators = make(map[string]ObjectAllocatorFactory)
+	}
+	_, ok := registry.objectAllocators[name]
+	checkRegister("object allocator", name, ok)
+	registry.objectAllocators[name] = f
+}
+
+// Registered returns the sorted names of all registered address spaces,
+// page allocators, stack allocators, and object allocators.
+func Registered() (addressSpaces, pageAllocators, stackAllocators, objectAllocators []string) {
+	registry.Lock()
+	defer registry.Unlock()
+	for name := range registry.addressSpaces {
+		addressSpaces = append(addressSpaces, name)
+	}
+	for name := range registry.pageAllocators {
+		pageAllocators = append(pageAllocators, name)
+	}
+	for name := range registry.stackAllocators {
+		stackAllocators = append(stackAllocators, name)
+	}
+	for name := range registry.objectAllocators {
+		objectAllocators = append(objectAllocators, name)
+	}
+	sort.Strings(addressSpaces)
+	sort.Strings(pageAllocators)
+	sort.Strings(stackAllocators)
+	sort.Strings(objectAllocators)
+	return
+}
+
+// ComponentSpec selects a registered simulation component by name
+// and provides parameters for its construction.
+type ComponentSpec struct {
+	Name   string `json:"name"`
+	Params Params `json:"params,omitempty"`
+}
+
+// Spec describes how to assemble a Simulator from registered
+// components.
+//
+// The page allocator is built on top of the address space, and the
+// stack and object allocators share the page allocator. For example:
+//
+//	{
+//		"name": "go115-big-arenas",
+//		"addressSpace": {"name": "as48", "params": {"pageSize": 4096}},
+//		"pageAllocator": {"name": "go114", "params": {"arenaSize": 268435456}},
+//		"stackAllocator": {"name": "go114"},
+//		"objectAllocator": {"name": "go115"}
+//	}
+type Spec struct {
+	// Name is an optional name for the simulation.
+	Name string `json:"name,omitempty"`
+
+	AddressSpace    ComponentSpec `json:"addressSpace"`
+	PageAllocator   ComponentSpec `json:"pageAllocator"`
+	StackAllocator  ComponentSpec `json:"stackAllocator"`
+	ObjectAllocator ComponentSpec `json:"objectAllocator"`
+}
+
+// ParseSpec reads a JSON-encoded Spec from r.
+func ParseSpec(r io.Reader) (*Spec, error) {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	s := new(Spec)
+	if err := dec.Decode(s); err != nil {
+		return nil, fmt.Errorf("decoding simulation spec: %v", err)
+	}
+	return s, nil
+}
+
+// Build constructs a new Simulator from the spec.
+func (s *Spec) Build() (*Simulator, error) {
+	registry.Lock()
+	asf, asOK := registry.addressSpaces[s.AddressSpace.Name]
+	paf, paOK := registry.pageAllocators[s.PageAllocator.Name]
+	saf, saOK := registry.stackAllocators[s.StackAllocator.Name]
+	oaf, oaOK := registry.objectAllocators[s.ObjectAllocator.Name]
+	registry.Unlock()
+
+	if !asOK {
+		return nil, fmt.Errorf("unknown address space %q", s.AddressSpace.Name)
+	}
+	if !paOK {
+		return nil, fmt.Errorf("unknown page allocator %q", s.PageAllocator.Name)
+	}
+	if !saOK {
+		return nil, fmt.Errorf("unknown stack allocator %q", s.StackAllocator.Name)
+	}
+	if !oaOK {
+		return nil, fmt.Errorf("unknown object allocator %q", s.ObjectAllocator.Name)
+	}
+	as, err := asf(s.AddressSpace.Params)
+	if err != nil {
+		return nil, fmt.Errorf("address space %s: %v", s.AddressSpace.Name, err)
+	}
+	pa, err := paf(as, s.PageAllocator.Params)
+	if err != nil {
+		return nil, fmt.Errorf("page allocator %s: %v", s.PageAllocator.Name, err)
+	}
+	sa, err := saf(pa, s.StackAllocator.Params)
+	if err != nil {
+		return nil, fmt.Errorf("stack allocator %s: %v", s.StackAllocator.Name, err)
+	}
+	oa, err := oaf(pa, s.ObjectAllocator.Params)
+	if err != nil {
+		return nil, fmt.Errorf("object allocator %s: %v", s.ObjectAllocator.Name, err)
+	}
+	return NewSimulator(oa, sa, SimulatorShared(as, pa)), nil
+}
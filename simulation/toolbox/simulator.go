@@ -1,6 +1,10 @@
 package toolbox
 
 import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+
 	"github.com/mknyszek/goat"
 	"github.com/mknyszek/goat/simulation"
 )
@@ -17,24 +21,62 @@ type stack struct {
 // by the two must never overlap.
 type Simulator struct {
 	oa            ObjectAllocator
+	ta            TinyAllocator
 	sa            StackAllocator
 	collectEvents bool
 	gcEvents      []goat.Event
 	idToAddress   map[uint64]Address
 	idToStack     map[uint64]stack
+
+	// addressToID is the inverse of idToAddress, which is only
+	// maintained if the ObjectAllocator is a Mover.
+	addressToID map[Address]uint64
+
+	// as and pa are the address space and page allocator shared
+	// by the allocators, if known.
+	as AddressSpace
+	pa PageAllocator
+
+	// err is the reason the simulation stopped, if it has.
+	err error
+}
+
+// SimulatorOption is a configuration option for a Simulator.
+type SimulatorOption func(s *Simulator)
+
+// SimulatorShared returns a configuration option that tells the
+// Simulator which address space and page allocator its allocators
+// share.
+//
+// It's required for checkpointing, since the state of the shared
+// components is saved by the Simulator, rather than by either of
+// the allocators.
+func SimulatorShared(as AddressSpace, pa PageAllocator) SimulatorOption {
+	return func(s *Simulator) {
+		s.as, s.pa = as, pa
+	}
 }
 
 // NewSimulator constructs a new simulator from the given allocators.
 //
 // The allocators should share an address space and their allocations
 // must never overlap.
-func NewSimulator(oa ObjectAllocator, sa StackAllocator) *Simulator {
-	return &Simulator{
+func NewSimulator(oa ObjectAllocator, sa StackAllocator, options ...SimulatorOption) *Simulator {
+	s := &Simulator{
 		oa:          oa,
 		sa:          sa,
 		idToAddress: make(map[uint64]Address),
 		idToStack:   make(map[uint64]stack),
 	}
+	for _, opt := range options {
+		opt(s)
+	}
+	s.ta, _ = oa.(TinyAllocator)
+	if m, ok := oa.(Mover); ok {
+		s.addressToID = make(map[Address]uint64)
+		m.SetMoveHandler(s.move)
+	}
+	return s
 }
 
 // RegisterStats registers additional implementation-specific statistics
@@ -45,17 +87,39 @@ func (s *Simulator) RegisterStats(stats *simulation.Stats) {
 }
 
 // Process implements the simulation.Simulator interface.
+//
+// If the simulation runs out of address space, it stops, and ignores
+// any further events. The allocators' state is left as it was at the
+// time, which may be inconsistent.
 func (s *Simulator) Process(ev goat.Event, stats *simulation.Stats) {
+	if s.err != nil {
+		return
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			if r != ErrOutOfAddressSpace {
+				panic(r)
+			}
+			s.err = fmt.Errorf("at timestamp %d: %v", ev.Timestamp, ErrOutOfAddressSpace)
+		}
+	}()
+	s.process(ev, stats)
+}
+
+// Err implements simulation.Failer.
+func (s *Simulator) Err() error {
+	return s.err
+}
+
+func (s *Simulator) process(ev goat.Event, stats *simulation.Stats) {
 	if s.collectEvents {
 		// Find all the free events so we can mark objects as dead.
 		// This lets the object allocator know which objects are dead
 		// up-front so that it can control its own sweep scheduling.
-		ctx := Context{P(ev.P), stats}
+		ctx := Context{P: P(ev.P), Stats: stats}
 		switch ev.Kind {
 		case goat.EventFree:
-			addr := s.idToAddress[ev.Address]
-			delete(s.idToAddress, ev.Address)
-			s.oa.DeadObject(ctx, addr)
+			s.oa.DeadObject(ctx, s.freeObject(ctx, ev))
 			return
 		case goat.EventGCStart:
 			s.collectEvents = false
@@ -70,7 +134,7 @@ func (s *Simulator) Process(ev goat.Event, stats *simulation.Stats) {
 		// so there should be no GC events and all the free events should
 		// have been filtered out above.
 		for _, ev := range s.gcEvents {
-			ctx := Context{P(ev.P), stats}
+			ctx := Context{P: P(ev.P), Stats: stats}
 			switch ev.Kind {
 			case goat.EventStackAlloc:
 				lo, hi := s.sa.AllocStack(ctx, Bytes(ev.Size))
@@ -80,7 +144,7 @@ func (s *Simulator) Process(ev goat.Event, stats *simulation.Stats) {
 				delete(s.idToStack, ev.Address)
 				s.sa.FreeStack(ctx, stk.lo, stk.hi)
 			case goat.EventAlloc:
-				s.idToAddress[ev.Address] = s.oa.AllocObject(ctx, Bytes(ev.Size), ev.Array, ev.PointerFree)
+				s.allocObject(ctx, ev)
 			default:
 				panic("unexpected gc event")
 			}
@@ -89,7 +153,7 @@ func (s *Simulator) Process(ev goat.Event, stats *simulation.Stats) {
 	}
 	stats.Timestamp = ev.Timestamp
 	// Handle an event; we know now that there's a GC running.
-	ctx := Context{P(ev.P), stats}
+	ctx := Context{P: P(ev.P), Stats: stats}
 	switch ev.Kind {
 	case goat.EventStackAlloc:
 		lo, hi := s.sa.AllocStack(ctx, Bytes(ev.Size))
@@ -99,14 +163,12 @@ func (s *Simulator) Process(ev goat.Event, stats *simulation.Stats) {
 		delete(s.idToStack, ev.Address)
 		s.sa.FreeStack(ctx, stk.lo, stk.hi)
 	case goat.EventAlloc:
-		s.idToAddress[ev.Address] = s.oa.AllocObject(ctx, Bytes(ev.Size), ev.Array, ev.PointerFree)
+		s.allocObject(ctx, ev)
 	case goat.EventFree:
 		// This isn't generally possible with most GC implementations,
 		// but we let this case go through to support simulating implementations
 		// which may free objects concurrently with marking.
-		addr := s.idToAddress[ev.Address]
-		delete(s.idToAddress, ev.Address)
-		s.oa.DeadObject(ctx, addr)
+		s.oa.DeadObject(ctx, s.freeObject(ctx, ev))
 	case goat.EventGCStart:
 		s.oa.GCStart(ctx)
 		s.sa.GCStart(ctx)
@@ -119,3 +181,148 @@ func (s *Simulator) Process(ev goat.Event, stats *simulation.Stats) {
 		s.collectEvents = true
 	}
 }
+
+// allocObject allocates the object for an allocation event, using
+// the tiny allocator for tiny blocks if the ObjectAllocator has one.
+func (s *Simulator) allocObject(ctx Context, ev goat.Event) {
+	ctx.PC = ev.PC
+	ctx.PStats().Allocs++
+	var addr Address
+	if s.ta != nil && ev.TinySize != 0 {
+		addr = s.ta.AllocTiny(ctx, Bytes(ev.TinySize))
+	} else {
+		addr = s.oa.AllocObject(ctx, Bytes(ev.Size), ev.Array, ev.PointerFree)
+	}
+	s.idToAddress[ev.Address] = addr
+	if s.addressToID != nil {
+		s.addressToID[addr] = ev.Address
+	}
+}
+
+// freeObject forgets the object for a free event, and returns its
+// simulated address.
+func (s *Simulator) freeObject(ctx Context, ev goat.Event) Address {
+	ctx.PStats().Frees++
+	addr := s.idToAddress[ev.Address]
+	delete(s.idToAddress, ev.Address)
+	if s.addressToID != nil {
+		delete(s.addressToID, addr)
+	}
+	return addr
+}
+
+// move is the Mover's move handler, which keeps track of where
+// objects moved.
+func (s *Simulator) move(from, to Address) {
+	id, ok := s.addressToID[from]
+	if !ok {
+		return
+	}
+	delete(s.addressToID, from)
+	s.idToAddress[id] = to
+	s.addressToID[to] = id
+}
+
+// simulatorState is the saved state of a Simulator.
+type simulatorState struct {
+	CollectEvents bool
+	GCEvents      []goat.Event
+	IDToAddress   map[uint64]Address
+	IDToStack     map[uint64][2]Address
+	AddressToID   map[Address]uint64
+	Err           string
+}
+
+// Inspect returns descriptions of the spans of the Simulator's object
+// allocator and of the page runs of its page allocator, in address
+// order. Either is nil if that allocator isn't an Inspector. The page
+// allocator is only known if the Simulator was constructed with
+// SimulatorShared.
+func (s *Simulator) Inspect() (spans, pages []SpanInfo) {
+	if i, ok := s.oa.(Inspector); ok {
+		spans = i.Inspect()
+	}
+	if i, ok := s.pa.(Inspector); ok {
+		pages = i.Inspect()
+	}
+	return spans, pages
+}
+
+// components returns the components of the simulation in the order
+// their state is saved, along with their names.
+func (s *Simulator) components() ([]interface{}, []string, error) {
+	if s.as == nil || s.pa == nil {
+		return nil, nil, errors.New("simulator was constructed without SimulatorShared")
+	}
+	return []interface{}{s.as, s.pa, s.sa, s.oa},
+		[]string{"address space", "page allocator", "stack allocator", "object allocator"}, nil
+}
+
+// SaveState implements simulation.Checkpointer. Every component of
+// the simulation must implement simulation.Checkpointer as well.
+func (s *Simulator) SaveState(enc *gob.Encoder) error {
+	comps, names, err := s.components()
+	if err != nil {
+		return err
+	}
+	st := simulatorState{
+		CollectEvents: s.collectEvents,
+		GCEvents:      s.gcEvents,
+		IDToAddress:   s.idToAddress,
+		IDToStack:     make(map[uint64][2]Address, len(s.idToStack)),
+		AddressToID:   s.addressToID,
+	}
+	if s.err != nil {
+		st.Err = s.err.Error()
+	}
+	for id, stk := range s.idToStack {
+		st.IDToStack[id] = [2]Address{stk.lo, stk.hi}
+	}
+	if err := enc.Encode(&st); err != nil {
+		return err
+	}
+	for i, c := range comps {
+		if err := simulation.SaveState(enc, c); err != nil {
+			return fmt.Errorf("%s: %v", names[i], err)
+		}
+	}
+	return nil
+}
+
+// LoadState implements simulation.Checkpointer.
+func (s *Simulator) LoadState(dec *gob.Decoder) error {
+	comps, names, err := s.components()
+	if err != nil {
+		return err
+	}
+	var st simulatorState
+	if err := dec.Decode(&st); err != nil {
+		return err
+	}
+	s.collectEvents = st.CollectEvents
+	s.err = nil
+	if st.Err != "" {
+		s.err = errors.New(st.Err)
+	}
+	s.gcEvents = st.GCEvents
+	s.idToAddress = st.IDToAddress
+	if s.idToAddress == nil {
+		s.idToAddress = make(map[uint64]Address)
+	}
+	s.idToStack = make(map[uint64]stack, len(st.IDToStack))
+	for id, stk := range st.IDToStack {
+		s.idToStack[id] = stack{stk[0], stk[1]}
+	}
+	if s.addressToID != nil {
+		s.addressToID = st.AddressToID
+		if s.addressToID == nil {
+			s.addressToID = make(map[Address]uint64)
+		}
+	}
+	for i, c := range comps {
+		if err := simulation.LoadState(dec, c); err != nil {
+			return fmt.Errorf("%s: %v", names[i], err)
+		}
+	}
+	return nil
+}
@@ -1,6 +1,10 @@
 package stack
 
 import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+
 	"github.com/mknyszek/goat/simulation"
 	"github.com/mknyszek/goat/simulation/toolbox"
 )
@@ -107,11 +111,13 @@ const (
 	go114LogMinStackSize               = 11
 	go114MinStackSize    toolbox.Bytes = 1 << go114LogMinStackSize
 	go114NumOrders                     = 4
-	go114CacheSize       toolbox.Bytes = go114MinStackSize << go114NumOrders
+	go114LargeStackSize  toolbox.Bytes = go114MinStackSize << go114NumOrders
+	go114CacheSize       toolbox.Bytes = 32 << 10
 )
 
 type Go114 struct {
 	pageAllocator toolbox.PageAllocator
+	cacheSize     toolbox.Bytes
 	cache         map[toolbox.P]*[go114NumOrders]stackFreeList
 	pool          [go114NumOrders]stackSpanList
 	poolFull      [go114NumOrders]stackSpanList
@@ -122,12 +128,12 @@ type Go114 struct {
 func (g *Go114) allocFromPool(ctx toolbox.Context, size toolbox.Bytes) *stack {
 	order := size.Log2() - go114LogMinStackSize
 	if g.pool[order].first == nil {
-		base := g.pageAllocator.AllocPages(ctx, go114CacheSize.Pages(g.pageAllocator.BytesPerPage()))
+		base := g.pageAllocator.AllocPages(ctx, g.cacheSize.Pages(g.pageAllocator.BytesPerPage()))
 		s := &stackSpan{
 			base:      base,
 			stackSize: size,
 		}
-		for i := toolbox.Bytes(0); i < go114CacheSize; i += size {
+		for i := toolbox.Bytes(0); i < g.cacheSize; i += size {
 			stk := &stack{lo: base.Add(i), hi: base.Add(i + size)}
 			stk.next = s.list
 			s.list = stk
@@ -150,13 +156,13 @@ func (g *Go114) freeToPool(ctx toolbox.Context, stk *stack) {
 	s := g.pool[order].first
 	for s != nil {
 		n := s.next
-		if stk.lo >= s.base && stk.hi <= s.base.Add(go114CacheSize) {
+		if stk.lo >= s.base && stk.hi <= s.base.Add(g.cacheSize) {
 			stk.next = s.list
 			s.list = stk
 			s.allocCount--
 			if s.allocCount == 0 && !g.gcEnabled {
 				g.pool[order].remove(s)
-				g.pageAllocator.FreePages(ctx, s.base, go114CacheSize.Pages(g.pageAllocator.BytesPerPage()))
+				g.pageAllocator.FreePages(ctx, s.base, g.cacheSize.Pages(g.pageAllocator.BytesPerPage()))
 			}
 			return
 		}
@@ -165,13 +171,13 @@ func (g *Go114) freeToPool(ctx toolbox.Context, stk *stack) {
 	s = g.poolFull[order].first
 	for s != nil {
 		n := s.next
-		if stk.lo >= s.base && stk.hi <= s.base.Add(go114CacheSize) {
+		if stk.lo >= s.base && stk.hi <= s.base.Add(g.cacheSize) {
 			stk.next = s.list
 			s.list = stk
 			s.allocCount--
 			g.poolFull[order].remove(s)
 			if s.allocCount == 0 && !g.gcEnabled {
-				g.pageAllocator.FreePages(ctx, s.base, go114CacheSize.Pages(g.pageAllocator.BytesPerPage()))
+				g.pageAllocator.FreePages(ctx, s.base, g.cacheSize.Pages(g.pageAllocator.BytesPerPage()))
 			} else {
 				g.pool[order].pushFront(s)
 			}
@@ -182,14 +188,55 @@ func (g *Go114) freeToPool(ctx toolbox.Context, stk *stack) {
 	panic("failed to find span for stack")
 }
 
-func NewGo114(pa toolbox.PageAllocator) *Go114 {
+// Go114Option is a configuration option for a Go114 stack allocator.
+type Go114Option func(g *Go114)
+
+// Go114CacheSize returns a configuration option that sets the size of
+// the spans small stacks are carved out of, which is also the amount of
+// memory each per-P stack cache may hold per stack order.
+//
+// The size must be a power-of-two of at least 32 KiB.
+func Go114CacheSize(size toolbox.Bytes) Go114Option {
+	return func(g *Go114) {
+		g.cacheSize = size
+	}
+}
+
+func NewGo114(pa toolbox.PageAllocator, options ...Go114Option) *Go114 {
 	if pa.BytesPerPage() != 8192 {
 		panic("stack allocator requires a page size of exactly 8192 bytes")
 	}
-	return &Go114{
+	g := &Go114{
 		pageAllocator: pa,
+		cacheSize:     go114CacheSize,
 		cache:         make(map[toolbox.P]*[go114NumOrders]stackFreeList),
 	}
+	for _, opt := range options {
+		opt(g)
+	}
+	if g.cacheSize&(g.cacheSize-1) != 0 || g.cacheSize < go114LargeStackSize {
+		panic("stack cache size must be a power-of-two of at least 32 KiB")
+	}
+	return g
+}
+
+func init() {
+	toolbox.RegisterStackAllocator("go114", func(pa toolbox.PageAllocator, p toolbox.Params) (toolbox.StackAllocator, error) {
+		if err := p.Check("cacheSize"); err != nil {
+			return nil, err
+		}
+		if pa.BytesPerPage() != 8192 {
+			return nil, errors.New("stack allocator requires a page size of exactly 8192 bytes")
+		}
+		cacheSize, err := p.Bytes("cacheSize", go114CacheSize)
+		if err != nil {
+			return nil, err
+		}
+		if cacheSize&(cacheSize-1) != 0 || cacheSize < go114LargeStackSize {
+			return nil, fmt.Errorf("cacheSize must be a power-of-two of at least %d", go114LargeStackSize)
+		}
+		return NewGo114(pa, Go114CacheSize(cacheSize)), nil
+	})
 }
 
 func (g *Go114) RegisterStats(s *simulation.Stats) {
@@ -203,7 +250,7 @@ func (g *Go114) AllocStack(ctx toolbox.Context, size toolbox.Bytes) (lo, hi tool
 	if size < go114MinStackSize {
 		panic("stack too small")
 	}
-	if size < go114CacheSize {
+	if size < go114LargeStackSize {
 		if ctx.P == toolbox.NoP {
 			stk := g.allocFromPool(ctx, size)
 			lo, hi = stk.lo, stk.hi
@@ -214,13 +261,17 @@ func (g *Go114) AllocStack(ctx toolbox.Context, size toolbox.Bytes) (lo, hi tool
 				cache = new([go114NumOrders]stackFreeList)
 				g.cache[ctx.P] = cache
 			}
+			ps := ctx.PStats()
+			ps.CachedBytes -= uint64(cache[order].size)
 			stk := cache[order].pop()
 			if stk == nil {
-				for cache[order].size < go114CacheSize/2 {
+				for cache[order].size < g.cacheSize/2 {
 					cache[order].push(g.allocFromPool(ctx, size))
 				}
 				stk = cache[order].pop()
+				ps.Refills++
 			}
+			ps.CachedBytes += uint64(cache[order].size)
 			lo, hi = stk.lo, stk.hi
 		}
 	} else {
@@ -247,7 +298,7 @@ func (g *Go114) FreeStack(ctx toolbox.Context, lo, hi toolbox.Address) {
 		panic("stack too small")
 	}
 	stk := &stack{lo: lo, hi: hi}
-	if size < go114CacheSize {
+	if size < go114LargeStackSize {
 		if ctx.P == toolbox.NoP {
 			g.freeToPool(ctx, stk)
 		} else {
@@ -257,12 +308,15 @@ func (g *Go114) FreeStack(ctx toolbox.Context, lo, hi toolbox.Address) {
 				cache = new([go114NumOrders]stackFreeList)
 				g.cache[ctx.P] = cache
 			}
-			if cache[order].size >= go114CacheSize {
-				for cache[order].size > go114CacheSize/2 {
+			ps := ctx.PStats()
+			ps.CachedBytes -= uint64(cache[order].size)
+			if cache[order].size >= g.cacheSize {
+				for cache[order].size > g.cacheSize/2 {
 					g.freeToPool(ctx, cache[order].pop())
 				}
 			}
 			cache[order].push(stk)
+			ps.CachedBytes += uint64(cache[order].size)
 		}
 	} else {
 		order := size.Log2() - go114NumOrders - go114LogMinStackSize
@@ -288,7 +342,7 @@ func (g *Go114) GCEnd(ctx toolbox.Context) {
 			n := c.next
 			if c.allocCount == 0 {
 				g.pool[order].remove(c)
-				g.pageAllocator.FreePages(ctx, c.base, go114CacheSize.Pages(g.pageAllocator.BytesPerPage()))
+				g.pageAllocator.FreePages(ctx, c.base, g.cacheSize.Pages(g.pageAllocator.BytesPerPage()))
 			}
 			c = n
 		}
@@ -301,3 +355,116 @@ func (g *Go114) GCEnd(ctx toolbox.Context) {
 		}
 	}
 }
+
+// saveStacks returns the bounds of each stack in the list starting
+// at s, in order.
+func saveStacks(s *stack) [][2]toolbox.Address {
+	var stks [][2]toolbox.Address
+	for ; s != nil; s = s.next {
+		stks = append(stks, [2]toolbox.Address{s.lo, s.hi})
+	}
+	return stks
+}
+
+// restoreStacks is the inverse of saveStacks.
+func restoreStacks(stks [][2]toolbox.Address) *stack {
+	var list *stack
+	for i := len(stks) - 1; i >= 0; i-- {
+		list = &stack{next: list, lo: stks[i][0], hi: stks[i][1]}
+	}
+	return list
+}
+
+// restoreFreeList is the inverse of saveStacks for a stackFreeList.
+func restoreFreeList(stks [][2]toolbox.Address) stackFreeList {
+	var l stackFreeList
+	for i := len(stks) - 1; i >= 0; i-- {
+		l.push(&stack{lo: stks[i][0], hi: stks[i][1]})
+	}
+	return l
+}
+
+// go114StackSpanState is the saved state of a stackSpan.
+type go114StackSpanState struct {
+	Base       toolbox.Address
+	Stacks     [][2]toolbox.Address
+	AllocCount uint32
+	StackSize  toolbox.Bytes
+}
+
+func saveStackSpans(l *stackSpanList) []go114StackSpanState {
+	var spans []go114StackSpanState
+	for s := l.first; s != nil; s = s.next {
+		spans = append(spans, go114StackSpanState{s.base, saveStacks(s.list), s.allocCount, s.stackSize})
+	}
+	return spans
+}
+
+func restoreStackSpans(l *stackSpanList, spans []go114StackSpanState) {
+	*l = stackSpanList{}
+	for _, ss := range spans {
+		l.pushBack(&stackSpan{
+			base:       ss.Base,
+			list:       restoreStacks(ss.Stacks),
+			allocCount: ss.AllocCount,
+			stackSize:  ss.StackSize,
+		})
+	}
+}
+
+// go114State is the saved state of a Go114 stack allocator.
+type go114State struct {
+	Cache     map[toolbox.P][go114NumOrders][][2]toolbox.Address
+	Pool      [go114NumOrders][]go114StackSpanState
+	PoolFull  [go114NumOrders][]go114StackSpanState
+	Large     [64 - go114NumOrders - go114LogMinStackSize][][2]toolbox.Address
+	GCEnabled bool
+}
+
+// SaveState implements simulation.Checkpointer.
+func (g *Go114) SaveState(enc *gob.Encoder) error {
+	st := go114State{
+		Cache:     make(map[toolbox.P][go114NumOrders][][2]toolbox.Address),
+		GCEnabled: g.gcEnabled,
+	}
+	for p, cache := range g.cache {
+		var c [go114NumOrders][][2]toolbox.Address
+		for order := range cache {
+			c[order] = saveStacks(cache[order].list)
+		}
+		st.Cache[p] = c
+	}
+	for order := range g.pool {
+		st.Pool[order] = saveStackSpans(&g.pool[order])
+		st.PoolFull[order] = saveStackSpans(&g.poolFull[order])
+	}
+	for order := range g.large {
+		st.Large[order] = saveStacks(g.large[order].list)
+	}
+	return enc.Encode(&st)
+}
+
+// LoadState implements simulation.Checkpointer.
+func (g *Go114) LoadState(dec *gob.Decoder) error {
+	var st go114State
+	if err := dec.Decode(&st); err != nil {
+		return err
+	}
+	g.cache = make(map[toolbox.P]*[go114NumOrders]stackFreeList)
+	for p, c := range st.Cache {
+		cache := new([go114NumOrders]stackFreeList)
+		for order := range cache {
+			cache[order] = restoreFreeList(c[order])
+		}
+		g.cache[p] = cache
+	}
+	for order := range g.pool {
+		restoreStackSpans(&g.pool[order], st.Pool[order])
+		restoreStackSpans(&g.poolFull[order], st.PoolFull[order])
+	}
+	for order := range g.large {
+		g.large[order] = restoreFreeList(st.Large[order])
+	}
+	g.gcEnabled = st.GCEnabled
+	return nil
+}
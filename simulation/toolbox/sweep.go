@@ -0,0 +1,166 @@
+package toolbox
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// SweepRange is an inclusive range of integer parameter values.
+//
+// Values start at Start, and each subsequent value is produced by
+// multiplying the previous one by Mul (if non-zero) or otherwise
+// adding Step, until End is exceeded.
+type SweepRange struct {
+	Start uint64 `json:"start"`
+	End   uint64 `json:"end"`
+	Step  uint64 `json:"step,omitempty"`
+	Mul   uint64 `json:"mul,omitempty"`
+}
+
+func (r *SweepRange) values() ([]json.RawMessage, error) {
+	if r.Step == 0 && r.Mul < 2 {
+		return nil, fmt.Errorf("range must have a non-zero step or a multiplier of at least 2")
+	}
+	if r.Start > r.End {
+		return nil, fmt.Errorf("range start %d is greater than end %d", r.Start, r.End)
+	}
+	if r.Mul != 0 && r.Start == 0 {
+		return nil, fmt.Errorf("multiplicative range must not start at zero")
+	}
+	var vals []json.RawMessage
+	for v := r.Start; v <= r.End; {
+		vals = append(vals, json.RawMessage(fmt.Sprint(v)))
+		next := v + r.Step
+		if r.Mul != 0 {
+			next = v * r.Mul
+		}
+		if next <= v {
+			// Overflow.
+			break
+		}
+		v = next
+	}
+	return vals, nil
+}
+
+// SweepParam describes the values to try for a single parameter of
+// a simulation component.
+type SweepParam struct {
+	// Component is the component the parameter belongs to, which
+	// is one of "addressSpace", "pageAllocator", "stackAllocator",
+	// or "objectAllocator".
+	Component string `json:"component"`
+
+	// Name is the name of the parameter.
+	Name string `json:"name"`
+
+	// Values is an explicit list of values for the parameter.
+	Values []json.RawMessage `json:"values,omitempty"`
+
+	// Range is a range of integer values for the parameter, and
+	// is used instead of Values if present.
+	Range *SweepRange `json:"range,omitempty"`
+}
+
+// Sweep describes a grid of simulation configurations, produced by
+// taking every combination of parameter values on top of a base Spec.
+type Sweep struct {
+	Base   Spec         `json:"base"`
+	Params []SweepParam `json:"params"`
+}
+
+// ParseSweep reads a JSON-encoded Sweep from r.
+func ParseSweep(r io.Reader) (*Sweep, error) {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	s := new(Sweep)
+	if err := dec.Decode(s); err != nil {
+		return nil, fmt.Errorf("decoding sweep: %v", err)
+	}
+	return s, nil
+}
+
+func (s *Spec) component(name string) *ComponentSpec {
+	switch name {
+	case "addressSpace":
+		return &s.AddressSpace
+	case "pageAllocator":
+		return &s.PageAllocator
+	case "stackAllocator":
+		return &s.StackAllocator
+	case "objectAllocator":
+		return &s.ObjectAllocator
+	}
+	return nil
+}
+
+func (s *Spec) clone() Spec {
+	c := *s
+	for _, name := range []string{"addressSpace", "pageAllocator", "stackAllocator", "objectAllocator"} {
+		cs := c.component(name)
+		params := make(Params, len(cs.Params))
+		for k, v := range cs.Params {
+			params[k] = v
+		}
+		cs.Params = params
+	}
+	return c
+}
+
+// Expand produces a Spec for every point in the sweep's parameter
+// grid. Each Spec is named after the base Spec and the parameter
+// values it was given.
+func (s *Sweep) Expand() ([]Spec, error) {
+	values := make([][]json.RawMessage, len(s.Params))
+	for i := range s.Params {
+		p := &s.Params[i]
+		if s.Base.component(p.Component) == nil {
+			return nil, fmt.Errorf("unknown component %q for parameter %s", p.Component, p.Name)
+		}
+		if p.Range != nil {
+			vals, err := p.Range.values()
+			if err != nil {
+				return nil, fmt.Errorf("parameter %s: %v", p.Name, err)
+			}
+			values[i] = vals
+		} else {
+			values[i] = p.Values
+		}
+		if len(values[i]) == 0 {
+			return nil, fmt.Errorf("parameter %s has no values", p.Name)
+		}
+	}
+	var specs []Spec
+	idx := make([]int, len(s.Params))
+	for {
+		spec := s.Base.clone()
+		var desc []string
+		for i := range s.Params {
+			p := &s.Params[i]
+			spec.component(p.Component).Params[p.Name] = values[i][idx[i]]
+			desc = append(desc, fmt.Sprintf("%s=%s", p.Name, values[i][idx[i]]))
+		}
+		name := strings.Join(desc, ",")
+		if s.Base.Name != "" {
+			name = s.Base.Name + "[" + name + "]"
+		}
+		spec.Name = name
+		specs = append(specs, spec)
+
+		// Advance to the next point in the grid.
+		i := len(idx) - 1
+		for ; i >= 0; i-- {
+			idx[i]++
+			if idx[i] < len(values[i]) {
+				break
+			}
+			idx[i] = 0
+		}
+		if i < 0 {
+			break
+		}
+	}
+	return specs, nil
+}
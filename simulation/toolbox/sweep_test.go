@@ -0,0 +1,134 @@
+package toolbox
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSweepExpand(t *testing.T) {
+	tests := []struct {
+		name  string
+		sweep string
+		specs []string
+		err   string
+	}{
+		{
+			name: "Values",
+			sweep: `{"base": {"name": "b", "pageAllocator": {"name": "go114"}},
+				"params": [{"component": "pageAllocator", "name": "arenaSize", "values": [1, 2]}]}`,
+			specs: []string{"b[arenaSize=1]", "b[arenaSize=2]"},
+		},
+		{
+			name: "Step",
+			sweep: `{"base": {"pageAllocator": {"name": "go114"}},
+				"params": [{"component": "pageAllocator", "name": "n", "range": {"start": 1, "end": 7, "step": 3}}]}`,
+			specs: []string{"n=1", "n=4", "n=7"},
+		},
+		{
+			name: "Mul",
+			sweep: `{"base": {"pageAllocator": {"name": "go114"}},
+				"params": [{"component": "pageAllocator", "name": "n", "range": {"start": 2, "end": 20, "mul": 3}}]}`,
+			specs: []string{"n=2", "n=6", "n=18"},
+		},
+		{
+			name: "Overflow",
+			sweep: `{"base": {"pageAllocator": {"name": "go114"}},
+				"params": [{"component": "pageAllocator", "name": "n", "range": {"start": 18446744073709551614, "end": 18446744073709551615, "step": 4}}]}`,
+			specs: []string{"n=18446744073709551614"},
+		},
+		{
+			name: "Grid",
+			sweep: `{"base": {"pageAllocator": {"name": "go114"}, "objectAllocator": {"name": "go115"}},
+				"params": [
+					{"component": "pageAllocator", "name": "a", "values": [1, 2]},
+					{"component": "objectAllocator", "name": "b", "values": ["x", "y", "z"]}
+				]}`,
+			specs: []string{
+				`a=1,b="x"`, `a=1,b="y"`, `a=1,b="z"`,
+				`a=2,b="x"`, `a=2,b="y"`, `a=2,b="z"`,
+			},
+		},
+		{
+			name: "UnknownComponent",
+			sweep: `{"base": {},
+				"params": [{"component": "gc", "name": "n", "values": [1]}]}`,
+			err: "unknown component",
+		},
+		{
+			name: "NoValues",
+			sweep: `{"base": {},
+				"params": [{"component": "pageAllocator", "name": "n", "values": []}]}`,
+			err: "no values",
+		},
+		{
+			name: "NoStep",
+			sweep: `{"base": {},
+				"params": [{"component": "pageAllocator", "name": "n", "range": {"start": 1, "end": 2}}]}`,
+			err: "non-zero step",
+		},
+		{
+			name: "Backwards",
+			sweep: `{"base": {},
+				"params": [{"component": "pageAllocator", "name": "n", "range": {"start": 2, "end": 1, "step": 1}}]}`,
+			err: "greater than end",
+		},
+		{
+			name: "MulFromZero",
+			sweep: `{"base": {},
+				"params": [{"component": "pageAllocator", "name": "n", "range": {"start": 0, "end": 8, "mul": 2}}]}`,
+			err: "must not start at zero",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sweep, err := ParseSweep(strings.NewReader(test.sweep))
+			if err != nil {
+				t.Fatalf("parsing sweep: %v", err)
+			}
+			specs, err := sweep.Expand()
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(specs) != len(test.specs) {
+				t.Fatalf("expected %d specs, got %d", len(test.specs), len(specs))
+			}
+			for i, spec := range specs {
+				if spec.Name != test.specs[i] {
+					t.Errorf("spec %d: expected name %q, got %q", i, test.specs[i], spec.Name)
+				}
+			}
+		})
+	}
+}
+
+func TestSweepExpandIndependentParams(t *testing.T) {
+	sweep, err := ParseSweep(strings.NewReader(`{
+		"base": {"pageAllocator": {"name": "go114", "params": {"fixed": 7}}},
+		"params": [{"component": "pageAllocator", "name": "n", "values": [1, 2]}]
+	}`))
+	if err != nil {
+		t.Fatalf("parsing sweep: %v", err)
+	}
+	specs, err := sweep.Expand()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i, want := range []string{"1", "2"} {
+		params := specs[i].PageAllocator.Params
+		if got := string(params["n"]); got != want {
+			t.Errorf("spec %d: expected n=%s, got %s", i, want, got)
+		}
+		if got := string(params["fixed"]); got != "7" {
+			t.Errorf("spec %d: expected fixed=7, got %s", i, got)
+		}
+	}
+	if _, ok := sweep.Base.PageAllocator.Params["n"]; ok {
+		t.Errorf("expanding the sweep modified the base spec")
+	}
+}
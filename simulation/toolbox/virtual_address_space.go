@@ -0,0 +1,411 @@
+package toolbox
+
+import (
+	"encoding/gob"
+	"fmt"
+	"sort"
+
+	"github.com/mknyszek/goat/simulation"
+)
+
+var (
+	vasMappedStat = simulation.StatDesc{
+		Name:        "VASMappedBytes",
+		Unit:        simulation.UnitBytes,
+		Description: "address space mapped",
+	}
+	vasFreeStat = simulation.StatDesc{
+		Name:        "VASFreeBytes",
+		Unit:        simulation.UnitBytes,
+		Description: "address space neither mapped nor reserved",
+	}
+	vasLargestStat = simulation.StatDesc{
+		Name:        "VASLargestFreeBytes",
+		Unit:        simulation.UnitBytes,
+		Description: "largest contiguous range of free address space",
+	}
+	vasFragStat = simulation.StatDesc{
+		Name:        "VASFragmentationPermille",
+		Unit:        simulation.UnitPermille,
+		Description: "fraction of free address space outside the largest free range",
+	}
+	vasFailuresStat = simulation.StatDesc{
+		Name:        "VASMapFailures",
+		Kind:        simulation.Counter,
+		Description: "mappings that failed for lack of address space",
+	}
+)
+
+// vasStats are handles to a VirtualAddressSpace's statistics.
+type vasStats struct {
+	mapped   *simulation.Stat
+	free     *simulation.Stat
+	largest  *simulation.Stat
+	frag     *simulation.Stat
+	failures *simulation.Stat
+}
+
+// vasMinAddress is the lowest address available for mappings,
+// mirroring Linux's default vm.mmap_min_addr.
+const vasMinAddress Address = 0x10000
+
+// vasGoHint is the first address the Go runtime tries to place
+// its heap at on 64-bit platforms.
+const vasGoHint Address = 0x00c0 << 32
+
+// vasRange is a mapped or reserved range of the address space.
+type vasRange struct {
+	base Address
+	size Bytes
+	hole bool
+}
+
+func (r vasRange) end() Address {
+	return r.base.Add(r.size)
+}
+
+// VirtualAddressSpace is an AddressSpace with a limited range of
+// addresses that may contain pre-reserved holes, and supports Unmap.
+//
+// Mappings are placed like a Go program on Linux would get them: the
+// first fit at or above a hint address, advancing the hint past each
+// new mapping. If nothing fits above the hint, the highest fit in the
+// whole range is used instead, like the kernel's top-down allocator.
+//
+// Alongside the mapped and free address space, it reports how
+// fragmented the free address space is, as one minus the ratio of
+// the largest free range to all free address space, in permille.
+type VirtualAddressSpace struct {
+	lo, hi   Address
+	hint     Address
+	pageSize Bytes
+
+	// ranges are the mapped and reserved ranges of the address
+	// space, sorted by base address.
+	ranges []vasRange
+	mapped Bytes
+	stats  vasStats
+}
+
+// VASOption is a configuration option for a VirtualAddressSpace.
+type VASOption func(s *VirtualAddressSpace)
+
+// VASRange returns a configuration option that limits mappings
+// to the range of addresses [lo, hi).
+func VASRange(lo, hi Address) VASOption {
+	return func(s *VirtualAddressSpace) {
+		s.lo, s.hi = lo, hi
+	}
+}
+
+// VASHint returns a configuration option that sets the address at
+// which the address space first tries to place mappings. A hint
+// outside of the address range means mappings are always placed
+// top-down.
+//
+// The default is 0xc000000000 for 39- and 48-bit address spaces,
+// and the bottom of the range for 32-bit address spaces.
+func VASHint(hint Address) VASOption {
+	return func(s *VirtualAddressSpace) {
+		s.hint = hint
+	}
+}
+
+// VASReserve returns a configuration option that reserves the range
+// [base, base+size) so that it is never mapped, for example to model
+// mappings made by something other than the Go heap.
+func VASReserve(base Address, size Bytes) VASOption {
+	return func(s *VirtualAddressSpace) {
+		s.ranges = append(s.ranges, vasRange{base: base, size: size, hole: true})
+	}
+}
+
+// NewVirtualAddressSpace creates a new address space which models
+// a user address space of the given number of bits, which must be
+// one of 32, 39, or 48.
+func NewVirtualAddressSpace(bits int, pageSize Bytes, options ...VASOption) *VirtualAddressSpace {
+	s, err := newVirtualAddressSpace(bits, pageSize, options...)
+	if err != nil {
+		panic(err.Error())
+	}
+	return s
+}
+
+// vasDefaults returns the default address range and hint for an
+// address space of the given number of bits.
+func vasDefaults(bits int) (lo, hi, hint Address, err error) {
+	switch bits {
+	case 32:
+		// Linux's default 3 GiB/1 GiB user/kernel split.
+		return vasMinAddress, 0xc0000000, vasMinAddress, nil
+	case 39:
+		return vasMinAddress, 1 << 39, vasGoHint, nil
+	case 48:
+		// The top half of the address space belongs to the kernel.
+		return vasMinAddress, 1 << 47, vasGoHint, nil
+	}
+	return 0, 0, 0, fmt.Errorf("unsupported address space size %d bits", bits)
+}
+
+func newVirtualAddressSpace(bits int, pageSize Bytes, options ...VASOption) (*VirtualAddressSpace, error) {
+	lo, hi, hint, err := vasDefaults(bits)
+	if err != nil {
+		return nil, err
+	}
+	s := &VirtualAddressSpace{
+		lo:       lo,
+		hi:       hi,
+		hint:     hint,
+		pageSize: pageSize,
+	}
+	for _, opt := range options {
+		opt(s)
+	}
+	if err := s.checkConfig(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *VirtualAddressSpace) checkConfig() error {
+	if s.pageSize == 0 || s.pageSize&(s.pageSize-1) != 0 {
+		return fmt.Errorf("page size must be a power-of-two")
+	}
+	if s.lo >= s.hi {
+		return fmt.Errorf("empty address range [%#x, %#x)", s.lo, s.hi)
+	}
+	if s.lo%Address(s.pageSize) != 0 || s.hi%Address(s.pageSize) != 0 {
+		return fmt.Errorf("address range [%#x, %#x) is not page-aligned", s.lo, s.hi)
+	}
+	sort.Slice(s.ranges, func(i, j int) bool {
+		return s.ranges[i].base < s.ranges[j].base
+	})
+	for i, r := range s.ranges {
+		if r.size == 0 || r.base%Address(s.pageSize) != 0 || r.size%s.pageSize != 0 {
+			return fmt.Errorf("reserved range [%#x, %#x) is empty or not page-aligned", r.base, r.end())
+		}
+		if r.base < s.lo || r.end() > s.hi || r.end() < r.base {
+			return fmt.Errorf("reserved range [%#x, %#x) is outside of the address range", r.base, r.end())
+		}
+		if i > 0 && s.ranges[i-1].end() > r.base {
+			return fmt.Errorf("reserved ranges overlap at %#x", r.base)
+		}
+	}
+	return nil
+}
+
+// vasHole is the JSON representation of a reserved range.
+type vasHole struct {
+	Base Address `json:"base"`
+	Size Bytes   `json:"size"`
+}
+
+func init() {
+	RegisterAddressSpace("vas", func(p Params) (AddressSpace, error) {
+		if err := p.Check("bits", "pageSize", "lo", "hi", "hint", "holes"); err != nil {
+			return nil, err
+		}
+		bits, err := p.Uint64("bits", 48)
+		if err != nil {
+			return nil, err
+		}
+		pageSize, err := p.Bytes("pageSize", 4096)
+		if err != nil {
+			return nil, err
+		}
+		lo, hi, hint, err := vasDefaults(int(bits))
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.Decode("lo", &lo); err != nil {
+			return nil, err
+		}
+		if _, err := p.Decode("hi", &hi); err != nil {
+			return nil, err
+		}
+		if _, err := p.Decode("hint", &hint); err != nil {
+			return nil, err
+		}
+		options := []VASOption{VASRange(lo, hi), VASHint(hint)}
+		var holes []vasHole
+		if _, err := p.Decode("holes", &holes); err != nil {
+			return nil, err
+		}
+		for _, h := range holes {
+			options = append(options, VASReserve(h.Base, h.Size))
+		}
+		return newVirtualAddressSpace(int(bits), pageSize, options...)
+	})
+}
+
+func (s *VirtualAddressSpace) RegisterStats(stats *simulation.Stats) {
+	s.stats.mapped = stats.RegisterOther(vasMappedStat)
+	s.stats.free = stats.RegisterOther(vasFreeStat)
+	s.stats.largest = stats.RegisterOther(vasLargestStat)
+	s.stats.frag = stats.RegisterOther(vasFragStat)
+	s.stats.failures = stats.RegisterOther(vasFailuresStat)
+	s.updateStats()
+}
+
+// gaps calls f for each free range of the address space in order,
+// until f returns false.
+func (s *VirtualAddressSpace) gaps(f func(lo, hi Address) bool) {
+	lo := s.lo
+	for _, r := range s.ranges {
+		if r.base > lo && !f(lo, r.base) {
+			return
+		}
+		lo = r.end()
+	}
+	if s.hi > lo {
+		f(lo, s.hi)
+	}
+}
+
+// updateStats sets the address space's statistics to their
+// current values.
+func (s *VirtualAddressSpace) updateStats() {
+	var free, largest Bytes
+	s.gaps(func(lo, hi Address) bool {
+		size := hi.Diff(lo)
+		free += size
+		if size > largest {
+			largest = size
+		}
+		return true
+	})
+	frag := uint64(0)
+	if free != 0 {
+		frag = uint64(1000 - largest*1000/free)
+	}
+	s.stats.mapped.Set(uint64(s.mapped))
+	s.stats.free.Set(uint64(free))
+	s.stats.largest.Set(uint64(largest))
+	s.stats.frag.Set(frag)
+}
+
+// insert adds r to the sorted list of ranges.
+func (s *VirtualAddressSpace) insert(r vasRange) {
+	i := sort.Search(len(s.ranges), func(i int) bool {
+		return s.ranges[i].base > r.base
+	})
+	s.ranges = append(s.ranges, vasRange{})
+	copy(s.ranges[i+1:], s.ranges[i:])
+	s.ranges[i] = r
+}
+
+func (s *VirtualAddressSpace) MapAligned(ctx Context, size, align Bytes) (Address, Bytes) {
+	size = size.AlignUp(s.pageSize)
+	if align < s.pageSize {
+		align = s.pageSize
+	}
+	var base Address
+	found := false
+	if s.hint >= s.lo && s.hint < s.hi {
+		// Bottom-up, starting at the hint.
+		s.gaps(func(lo, hi Address) bool {
+			if hi <= s.hint {
+				return true
+			}
+			if lo < s.hint {
+				lo = s.hint
+			}
+			start := lo.AlignUp(align)
+			if start >= lo && start < hi && hi.Diff(start) >= size {
+				base, found = start, true
+				return false
+			}
+			return true
+		})
+	}
+	if !found {
+		// Top-down, over the whole address space.
+		s.gaps(func(lo, hi Address) bool {
+			if hi.Diff(lo) >= size {
+				if start := (hi - Address(size)).AlignDown(align); start >= lo {
+					base, found = start, true
+				}
+			}
+			return true
+		})
+	}
+	if !found {
+		s.stats.failures.Add(1)
+		return 0, 0
+	}
+	s.insert(vasRange{base: base, size: size})
+	if base >= s.hint && s.hint >= s.lo && s.hint < s.hi {
+		s.hint = base.Add(size)
+	}
+	s.mapped += size
+	ctx.FreeBytes += uint64(size)
+	ctx.RSSBytes += uint64(size)
+	s.updateStats()
+	return base, size
+}
+
+func (s *VirtualAddressSpace) Unmap(ctx Context, addr Address, size, released Bytes) {
+	size = size.AlignUp(s.pageSize)
+	if released > size {
+		panic("attempted to unmap more released memory than mapped")
+	}
+	end := addr.Add(size)
+	i := sort.Search(len(s.ranges), func(i int) bool {
+		return s.ranges[i].end() > addr
+	})
+	if i == len(s.ranges) || s.ranges[i].hole || s.ranges[i].base > addr || s.ranges[i].end() < end {
+		panic("attempted to unmap memory that isn't mapped")
+	}
+	r := s.ranges[i]
+	var rest []vasRange
+	if r.base < addr {
+		rest = append(rest, vasRange{base: r.base, size: addr.Diff(r.base)})
+	}
+	if end < r.end() {
+		rest = append(rest, vasRange{base: end, size: r.end().Diff(end)})
+	}
+	s.ranges = append(s.ranges[:i], append(rest, s.ranges[i+1:]...)...)
+	s.mapped -= size
+	ctx.FreeBytes -= uint64(size)
+	ctx.ReleasedBytes -= uint64(released)
+	ctx.RSSBytes -= uint64(size - released)
+	s.updateStats()
+}
+
+// vasState is the saved state of a VirtualAddressSpace.
+type vasState struct {
+	Hint   Address
+	Ranges []vasRangeState
+	Mapped Bytes
+}
+
+// vasRangeState is the saved state of a vasRange.
+type vasRangeState struct {
+	Base Address
+	Size Bytes
+	Hole bool
+}
+
+// SaveState implements simulation.Checkpointer.
+func (s *VirtualAddressSpace) SaveState(enc *gob.Encoder) error {
+	st := vasState{Hint: s.hint, Mapped: s.mapped}
+	for _, r := range s.ranges {
+		st.Ranges = append(st.Ranges, vasRangeState{r.base, r.size, r.hole})
+	}
+	return enc.Encode(&st)
+}
+
+// LoadState implements simulation.Checkpointer.
+func (s *VirtualAddressSpace) LoadState(dec *gob.Decoder) error {
+	var st vasState
+	if err := dec.Decode(&st); err != nil {
+		return err
+	}
+	s.hint = st.Hint
+	s.mapped = st.Mapped
+	s.ranges = s.ranges[:0]
+	for _, r := range st.Ranges {
+		s.ranges = append(s.ranges, vasRange{r.Base, r.Size, r.Hole})
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package toolbox
+
+import (
+	"testing"
+
+	"github.com/mknyszek/goat/simulation"
+)
+
+func TestVirtualAddressSpaceMapAligned(t *testing.T) {
+	const page = 4096
+	tests := []struct {
+		name    string
+		options []VASOption
+		sizes   []Bytes
+		align   Bytes
+		bases   []Address
+	}{
+		{
+			name:    "Hint",
+			options: []VASOption{VASRange(0x10000, 0x100000), VASHint(0x20000)},
+			sizes:   []Bytes{page, 2 * page},
+			align:   page,
+			bases:   []Address{0x20000, 0x21000},
+		},
+		{
+			name:    "Aligned",
+			options: []VASOption{VASRange(0x10000, 0x100000), VASHint(0x21000)},
+			sizes:   []Bytes{0x10000},
+			align:   0x10000,
+			bases:   []Address{0x30000},
+		},
+		{
+			name:    "SkipHole",
+			options: []VASOption{VASRange(0x10000, 0x100000), VASHint(0x20000), VASReserve(0x20000, 0x8000)},
+			sizes:   []Bytes{page},
+			align:   page,
+			bases:   []Address{0x28000},
+		},
+		{
+			name:    "TopDown",
+			options: []VASOption{VASRange(0x10000, 0x100000), VASHint(0xf0000), VASReserve(0xf0000, 0x10000)},
+			sizes:   []Bytes{page, page},
+			align:   page,
+			bases:   []Address{0xef000, 0xee000},
+		},
+		{
+			name:    "Full",
+			options: []VASOption{VASRange(0x10000, 0x20000)},
+			sizes:   []Bytes{0x10000, page},
+			align:   page,
+			bases:   []Address{0x10000, 0},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := NewVirtualAddressSpace(48, page, test.options...)
+			stats := simulation.NewStats()
+			s.RegisterStats(stats)
+			ctx := Context{Stats: stats}
+			for i, size := range test.sizes {
+				base, mapped := s.MapAligned(ctx, size, test.align)
+				if base != test.bases[i] {
+					t.Errorf("mapping %d: expected base %#x, got %#x", i, test.bases[i], base)
+				}
+				if test.bases[i] == 0 && mapped != 0 {
+					t.Errorf("mapping %d: expected failure, got %d bytes", i, mapped)
+				}
+			}
+		})
+	}
+}
+
+func TestVirtualAddressSpaceUnmap(t *testing.T) {
+	const page = 4096
+	s := NewVirtualAddressSpace(48, page, VASRange(0x10000, 0x40000), VASHint(0x10000))
+	stats := simulation.NewStats()
+	s.RegisterStats(stats)
+	ctx := Context{Stats: stats}
+
+	base, size := s.MapAligned(ctx, 0x10000, page)
+	if base != 0x10000 || size != 0x10000 {
+		t.Fatalf("unexpected mapping [%#x, %#x)", base, base.Add(size))
+	}
+	// Model a page allocator releasing half the mapping.
+	stats.RSSBytes -= 0x8000
+	stats.ReleasedBytes += 0x8000
+
+	// Unmap the middle of the mapping, half of which was released.
+	s.Unmap(ctx, 0x14000, 0x8000, 0x4000)
+	if stats.FreeBytes != 0x8000 || stats.RSSBytes != 0x4000 || stats.ReleasedBytes != 0x4000 {
+		t.Errorf("expected free/rss/released %#x/%#x/%#x, got %#x/%#x/%#x",
+			0x8000, 0x4000, 0x4000, stats.FreeBytes, stats.RSSBytes, stats.ReleasedBytes)
+	}
+	if mapped := stats.LookupOther(vasMappedStat.Name).Value(); mapped != 0x8000 {
+		t.Errorf("expected %#x bytes mapped, got %#x", 0x8000, mapped)
+	}
+	if largest := stats.LookupOther(vasLargestStat.Name).Value(); largest != 0x20000 {
+		t.Errorf("expected largest free range of %#x bytes, got %#x", 0x20000, largest)
+	}
+	if frag := stats.LookupOther(vasFragStat.Name).Value(); frag != 200 {
+		t.Errorf("expected fragmentation of 200 permille, got %d", frag)
+	}
+
+	// The hole is reused once everything above the hint is taken.
+	if base, _ := s.MapAligned(ctx, 0x20000, page); base != 0x20000 {
+		t.Fatalf("expected mapping at %#x, got %#x", 0x20000, base)
+	}
+	if base, _ := s.MapAligned(ctx, 0x8000, page); base != 0x14000 {
+		t.Errorf("expected mapping in the hole at %#x, got %#x", 0x14000, base)
+	}
+}